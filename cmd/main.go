@@ -1,18 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/runeharvest/gserver/config"
 	"github.com/runeharvest/gserver/login"
+	"github.com/runeharvest/gserver/login/storage"
+	"github.com/runeharvest/gserver/login/storage/cache"
+	"github.com/runeharvest/gserver/login/storage/file"
 	"github.com/runeharvest/gserver/login/storage/memory"
+	storagesql "github.com/runeharvest/gserver/login/storage/sql"
 	netlisten "github.com/runeharvest/gserver/net"
+	netdialgrpc "github.com/runeharvest/gserver/net/dial/grpc"
 	netlistengrpc "github.com/runeharvest/gserver/net/listen/grpc"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
+// shutdownTimeout bounds how long in-flight RPCs may take to complete once
+// a signal asks the server to stop.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	err := run()
 	if err != nil {
@@ -22,44 +41,196 @@ func main() {
 }
 
 func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	err := config.MultiLoad("config", "login")
 	if err != nil {
 		return fmt.Errorf("multiload: %w", err)
 	}
 
-	memoryStorage, err := memory.NewMemoryStorage()
+	if !config.ValueBool("login", "is_tls_used") {
+		slog.Warn("TLS disabled by login.is_tls_used, passwords cross the network in cleartext")
+	}
+
+	storager, closer, err := storagerNew(ctx)
 	if err != nil {
-		return fmt.Errorf("new memory storage: %w", err)
+		return fmt.Errorf("new storager: %w", err)
+	}
+	if closer != nil {
+		defer func() {
+			err := closer.Close()
+			if err != nil {
+				slog.Warn("Storage close failed", "error", err)
+			}
+		}()
 	}
 
-	loginService, err := login.NewLoginService(memoryStorage)
+	loginService, err := login.NewLoginService(storager)
 	if err != nil {
 		return fmt.Errorf("new login service: %w", err)
 	}
+	err = loginService.SessionOrphanEnd(ctx)
+	if err != nil {
+		return fmt.Errorf("session orphan end: %w", err)
+	}
+	go loginService.SessionReaperRun(ctx)
+	go loginService.DeletedPurgeRun(ctx)
 
-	gs := grpc.NewServer()
-	grpcNetwork, err := netlistengrpc.NewGrpcNetwork(gs)
+	welcomeDial, err := netdialgrpc.NewGrpcWelcomeNetworkFromConfig()
 	if err != nil {
-		return fmt.Errorf("new grpc network: %w", err)
+		return fmt.Errorf("new grpc welcome network: %w", err)
 	}
+	defer welcomeDial.Close()
 
-	netListen, err := netlisten.NewNetListenService(grpcNetwork)
+	err = loginService.WelcomeRegister(welcomeDial)
+	if err != nil {
+		return fmt.Errorf("welcome register: %w", err)
+	}
+
+	clientNetwork, err := netlistengrpc.NewGrpcNetworkFromConfig(login.ListenAddr("client"), false)
+	if err != nil {
+		return fmt.Errorf("new client grpc network: %w", err)
+	}
+	clientListen, err := netlisten.NewNetListenService(clientNetwork)
+	if err != nil {
+		return fmt.Errorf("new client network service: %w", err)
+	}
+	err = clientListen.LoginRegister(loginService)
 	if err != nil {
-		return fmt.Errorf("new network service: %w", err)
+		return fmt.Errorf("login register: %w", err)
 	}
 
-	netListen.LoginRegister(loginService)
+	shardRegistryService, err := login.NewShardRegistryService(storager)
+	if err != nil {
+		return fmt.Errorf("new shard registry service: %w", err)
+	}
+	err = shardRegistryService.SessionRegister(loginService)
+	if err != nil {
+		return fmt.Errorf("session register: %w", err)
+	}
+	// Heartbeat streams last as long as their shard, so they are ended for
+	// the graceful stop not to wait on them.
+	context.AfterFunc(ctx, shardRegistryService.Shutdown)
+	// Shards authenticate with a client certificate when mutual TLS is set.
+	wsNetwork, err := netlistengrpc.NewGrpcNetworkFromConfig(login.ListenAddr("ws"), true)
+	if err != nil {
+		return fmt.Errorf("new ws grpc network: %w", err)
+	}
+	wsListen, err := netlisten.NewNetListenService(wsNetwork)
+	if err != nil {
+		return fmt.Errorf("new ws network service: %w", err)
+	}
+	err = wsListen.ShardRegistryRegister(shardRegistryService)
+	if err != nil {
+		return fmt.Errorf("shard registry register: %w", err)
+	}
 
-	lis, err := net.Listen("tcp", ":50051")
+	// The health service reports NOT_SERVING as soon as shutdown begins.
+	healthServer := health.NewServer()
+	context.AfterFunc(ctx, healthServer.Shutdown)
+	webNetwork, err := netlistengrpc.NewGrpcNetworkFromConfig(login.ListenAddr("web"), false)
+	if err != nil {
+		return fmt.Errorf("new web grpc network: %w", err)
+	}
+	err = webNetwork.HealthRegister(healthServer)
+	if err != nil {
+		return fmt.Errorf("health register: %w", err)
+	}
+	webListen, err := netlisten.NewNetListenService(webNetwork)
 	if err != nil {
-		return fmt.Errorf("net listen: %w", err)
+		return fmt.Errorf("new web network service: %w", err)
+	}
+
+	return serve(ctx, stop, []namedListener{
+		{"client", clientListen},
+		{"ws", wsListen},
+		{"web", webListen},
+	})
+}
+
+type namedListener struct {
+	name string
+	*netlisten.NetListenService
+}
+
+// serve runs listeners until ctx is done or one of them fails, then shuts
+// them all down. stop releases the signals of ctx.
+func serve(ctx context.Context, stop context.CancelFunc, listeners []namedListener) error {
+	// Serve outlives ctx: Shutdown drains it instead.
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			err := listener.Serve(context.Background())
+			if err != nil {
+				err = fmt.Errorf("serve %s: %w", listener.name, err)
+			}
+			served <- err
+		}()
+		fmt.Println("Login Server", listener.name, "listening on", listener.Addr())
+	}
+
+	var errs []error
+	pending := len(listeners)
+	select {
+	case err := <-served:
+		errs = append(errs, err)
+		pending--
+	case <-ctx.Done():
 	}
+	// A second signal kills the process.
+	stop()
 
-	fmt.Println("Login Server listening on port 50051:")
-	err = gs.Serve(lis)
+	fmt.Println("Login Server shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	shutdown := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			err := listener.Shutdown(shutdownCtx)
+			if err != nil {
+				err = fmt.Errorf("shutdown %s: %w", listener.name, err)
+			}
+			shutdown <- err
+		}()
+	}
+	for range listeners {
+		errs = append(errs, <-shutdown)
+	}
+	for ; pending > 0; pending-- {
+		errs = append(errs, <-served)
+	}
+	return errors.Join(errs...)
+}
+
+// storagerNew returns the Storager selected by login.storage_driver and the
+// Closer releasing it, nil for the memory storage.
+func storagerNew(ctx context.Context) (storage.Storager, io.Closer, error) {
+	driver := config.ValueStr("login", "storage_driver")
+	switch driver {
+	case "memory":
+		memoryStorage, err := memory.NewMemoryStorage()
+		return memoryStorage, nil, err
+	case "file":
+		fileStorage, err := file.NewFileStorage(config.ValueStr("login", "storage_data_dir"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileStorage, fileStorage, nil
+	case storagesql.DialectSqlite, storagesql.DialectMysql, storagesql.DialectPostgres:
+	default:
+		return nil, nil, fmt.Errorf("unknown storage_driver '%s'", driver)
+	}
+	sqlStorage, err := storagesql.NewSqlStorageFromConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	go sqlStorage.ReconnectRun(ctx)
+	// Every login reads the user and the shard list; spare the database.
+	cacheStorage, err := cache.NewCacheStorageFromConfig(sqlStorage)
 	if err != nil {
-		return fmt.Errorf("grpc serve: %w", err)
+		sqlStorage.Close()
+		return nil, nil, err
 	}
-	return nil
+	return cacheStorage, sqlStorage, nil
 }
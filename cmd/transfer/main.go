@@ -0,0 +1,234 @@
+// Command transfer imports users and shards into the login storage selected
+// by the login config, and exports them back out. The file formats are
+// documented in package github.com/runeharvest/gserver/login/storage/transfer.
+//
+// Usage:
+//
+//	transfer import [-format json|csv|sql] [-dry-run] FILE...
+//	transfer export [-format json|csv|sql] [-out PATH]
+//
+// The format defaults to the extension of each file. Importing prints a
+// report of what was, or with -dry-run would be, created and updated, with
+// the old and new ids of the users whose id was taken; importing the same
+// files again creates nothing. Exporting writes to
+// stdout without -out; CSV needs -out to name a directory, in which
+// users.csv and shards.csv are written.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/password"
+	"github.com/runeharvest/gserver/login/storage"
+	"github.com/runeharvest/gserver/login/storage/file"
+	storagesql "github.com/runeharvest/gserver/login/storage/sql"
+	"github.com/runeharvest/gserver/login/storage/transfer"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+	formatSQL  = "sql"
+)
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		fmt.Println("Failed:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: transfer import|export [flags]")
+	}
+
+	err := config.MultiLoad("config", "login")
+	if err != nil {
+		return fmt.Errorf("multiload: %w", err)
+	}
+
+	switch args[0] {
+	case "import":
+		return importRun(args[1:])
+	case "export":
+		return exportRun(args[1:])
+	}
+	return fmt.Errorf("unknown command '%s', expected import or export", args[0])
+}
+
+func importRun(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "file format: json, csv or sql (default: the file extension)")
+	isDryRun := flags.Bool("dry-run", false, "report what would be imported without writing anything")
+	isUnsupportedPasswordAllowed := flags.Bool("allow-unsupported-passwords", false, "import users whose password hash cannot be verified; they need a password reset")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: transfer import [-format json|csv|sql] [-dry-run] [-allow-unsupported-passwords] FILE...")
+	}
+
+	dump := &transfer.Dump{}
+	for _, path := range flags.Args() {
+		err = dumpRead(dump, path, *format)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+	}
+
+	passwords, err := password.NewPasswordServiceFromConfig()
+	if err != nil {
+		return fmt.Errorf("new password service: %w", err)
+	}
+
+	ctx := context.Background()
+	storager, closer, err := storagerOpen(ctx)
+	if err != nil {
+		return fmt.Errorf("open storager: %w", err)
+	}
+	defer closer.Close()
+
+	report, err := transfer.Import(ctx, storager, dump, transfer.Options{
+		DryRun:                       *isDryRun,
+		Passwords:                    passwords,
+		IsUnsupportedPasswordAllowed: *isUnsupportedPasswordAllowed,
+	})
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	fmt.Print(report)
+	return nil
+}
+
+func exportRun(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "", "file format: json, csv or sql (default: the -out extension, or json)")
+	out := flags.String("out", "", "file to write, or directory for csv (default: stdout)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	exportFormat := *format
+	if exportFormat == "" {
+		exportFormat = formatFromPath(*out)
+	}
+	if exportFormat == "" {
+		exportFormat = formatJSON
+	}
+
+	ctx := context.Background()
+	storager, closer, err := storagerOpen(ctx)
+	if err != nil {
+		return fmt.Errorf("open storager: %w", err)
+	}
+	defer closer.Close()
+
+	dump, err := transfer.Export(ctx, storager)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	switch exportFormat {
+	case formatJSON:
+		return fileWrite(*out, dump.WriteJSON)
+	case formatSQL:
+		return fileWrite(*out, dump.WriteSQL)
+	case formatCSV:
+		if *out == "" {
+			return fmt.Errorf("csv export needs -out to name a directory")
+		}
+		err = os.MkdirAll(*out, 0o755)
+		if err != nil {
+			return fmt.Errorf("mkdir %s: %w", *out, err)
+		}
+		err = fileWrite(filepath.Join(*out, "users.csv"), dump.WriteUsersCSV)
+		if err != nil {
+			return err
+		}
+		return fileWrite(filepath.Join(*out, "shards.csv"), dump.WriteShardsCSV)
+	}
+	return fmt.Errorf("unknown format '%s'", exportFormat)
+}
+
+// dumpRead appends the users and shards of the file at path to dump.
+func dumpRead(dump *transfer.Dump, path string, format string) error {
+	if format == "" {
+		format = formatFromPath(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch format {
+	case formatJSON:
+		return dump.ReadJSON(f)
+	case formatCSV:
+		return dump.ReadCSV(f)
+	case formatSQL:
+		return dump.ReadSQL(f)
+	}
+	return fmt.Errorf("unknown format '%s', set -format", format)
+}
+
+// fileWrite writes to the file at path with write, or to stdout if path is
+// empty.
+func fileWrite(path string, write func(w io.Writer) error) error {
+	if path == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+func formatFromPath(path string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+}
+
+// storagerOpen opens the Storager selected by login.storage_driver, without
+// the cache and reconnection the login server runs it with.
+func storagerOpen(ctx context.Context) (storage.Storager, io.Closer, error) {
+	driver := config.ValueStr("login", "storage_driver")
+	switch driver {
+	case "memory":
+		return nil, nil, fmt.Errorf("the memory storage does not outlive this command")
+	case "file":
+		fileStorage, err := file.NewFileStorage(config.ValueStr("login", "storage_data_dir"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileStorage, fileStorage, nil
+	case storagesql.DialectSqlite, storagesql.DialectMysql, storagesql.DialectPostgres:
+	default:
+		return nil, nil, fmt.Errorf("unknown storage_driver '%s'", driver)
+	}
+	sqlStorage, err := storagesql.NewSqlStorageFromConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sqlStorage, sqlStorage, nil
+}
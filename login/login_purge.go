@@ -0,0 +1,38 @@
+package login
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// deletedPurgeInterval is how often DeletedPurgeRun looks for tombstones.
+const deletedPurgeInterval = time.Hour
+
+// DeletedPurge removes the users and shards deleted longer than the
+// configured deleted_purge_after ago. Until then a deleted user keeps its
+// username, and LoginVerify tells it apart from an unknown user.
+func (e *LoginService) DeletedPurge(ctx context.Context) error {
+	purged, err := e.storager.Purge(ctx, time.Now().Add(-e.deletedPurgeAfter))
+	if purged > 0 {
+		slog.Info("Deleted users and shards purged", "count", purged)
+	}
+	return err
+}
+
+// DeletedPurgeRun calls DeletedPurge periodically until ctx is done.
+func (e *LoginService) DeletedPurgeRun(ctx context.Context) error {
+	ticker := time.NewTicker(deletedPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			err := e.DeletedPurge(ctx)
+			if err != nil {
+				slog.Warn("Deleted purge failed", "error", err)
+			}
+		}
+	}
+}
@@ -2,20 +2,50 @@ package login
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/password"
 	"github.com/runeharvest/gserver/login/storage"
+	"github.com/runeharvest/gserver/login/token"
+	"github.com/runeharvest/gserver/net/dial"
 	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
 	"github.com/runeharvest/gserver/stringfmt"
 )
 
+const (
+	// duplicateLoginPolicyKickOld disconnects the existing session when a
+	// user logs in again.
+	duplicateLoginPolicyKickOld = "kick_old"
+	// duplicateLoginPolicyRejectNew refuses a login while the user is online.
+	duplicateLoginPolicyRejectNew = "reject_new"
+)
+
 // LoginService is the use case handler for login-related operations.
 type LoginService struct {
 	loginv1.UnimplementedLoginServiceServer
-	storager storage.Storager
+	storager      storage.Storager
+	password      *password.PasswordService
+	token         *token.TokenService
+	welcomeDialer dial.WelcomeDialer
+
+	duplicateLoginPolicy      string
+	duplicateLoginKickTimeout time.Duration
+	chooseShardTimeout        time.Duration
+
+	sessionMux         sync.RWMutex
+	sessions           map[int32]*session
+	sessionIdleTimeout time.Duration
+
+	deletedPurgeAfter time.Duration
 }
 
 func NewLoginService(storage storage.Storager) (*LoginService, error) {
@@ -25,7 +55,72 @@ func NewLoginService(storage storage.Storager) (*LoginService, error) {
 		return nil, fmt.Errorf("validate config: %w", err)
 	}
 
-	e := &LoginService{storager: storage}
+	passwordService, err := password.NewPasswordServiceFromConfig()
+	if err != nil {
+		return nil, fmt.Errorf("new password service: %w", err)
+	}
+
+	tokenTTL, err := time.ParseDuration(config.ValueStr("login", "token_ttl"))
+	if err != nil {
+		return nil, fmt.Errorf("parse token_ttl: %w", err)
+	}
+	tokenIssuer := config.ValueStr("login", "token_issuer")
+	tokenKeyFile := config.ValueStr("login", "token_key_file")
+	var tokenService *token.TokenService
+	if tokenKeyFile == "" {
+		// Every restart invalidates the tokens issued with a generated key.
+		tokenService, err = token.NewTokenService(tokenIssuer, tokenTTL)
+	} else {
+		var privateKey ed25519.PrivateKey
+		privateKey, err = token.KeyFileLoad(tokenKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load token_key_file: %w", err)
+		}
+		tokenService, err = token.NewTokenServiceWithKey(tokenIssuer, tokenTTL, privateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("new token service: %w", err)
+	}
+
+	sessionIdleTimeout, err := time.ParseDuration(config.ValueStr("login", "session_idle_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("parse session_idle_timeout: %w", err)
+	}
+	if sessionIdleTimeout <= 0 {
+		return nil, fmt.Errorf("session_idle_timeout must be positive")
+	}
+
+	duplicateLoginPolicy := config.ValueStr("login", "duplicate_login_policy")
+	switch duplicateLoginPolicy {
+	case duplicateLoginPolicyKickOld, duplicateLoginPolicyRejectNew:
+	default:
+		return nil, fmt.Errorf("duplicate_login_policy '%s' must be '%s' or '%s'", duplicateLoginPolicy, duplicateLoginPolicyKickOld, duplicateLoginPolicyRejectNew)
+	}
+	duplicateLoginKickTimeout, err := time.ParseDuration(config.ValueStr("login", "duplicate_login_kick_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("parse duplicate_login_kick_timeout: %w", err)
+	}
+	chooseShardTimeout, err := time.ParseDuration(config.ValueStr("login", "choose_shard_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("parse choose_shard_timeout: %w", err)
+	}
+
+	deletedPurgeAfter, err := time.ParseDuration(config.ValueStr("login", "deleted_purge_after"))
+	if err != nil {
+		return nil, fmt.Errorf("parse deleted_purge_after: %w", err)
+	}
+
+	e := &LoginService{
+		storager:                  storage,
+		password:                  passwordService,
+		token:                     tokenService,
+		duplicateLoginPolicy:      duplicateLoginPolicy,
+		duplicateLoginKickTimeout: duplicateLoginKickTimeout,
+		chooseShardTimeout:        chooseShardTimeout,
+		sessions:                  make(map[int32]*session),
+		sessionIdleTimeout:        sessionIdleTimeout,
+		deletedPurgeAfter:         deletedPurgeAfter,
+	}
 
 	return e, nil
 }
@@ -53,6 +148,15 @@ func (e *LoginService) LoginVerify(ctx context.Context, req *loginv1.LoginVerify
 	}
 
 	user, err := e.storager.UserByLogin(ctx, req.Username)
+	if errors.Is(err, storage.ErrDeleted) {
+		// The same answer as a wrong password, so deleted accounts cannot be
+		// told apart from others.
+		resp.Error = "Invalid username or password"
+		if isLoginVerboseToClient {
+			resp.Error = "Account has been deleted"
+		}
+		return resp, nil
+	}
 	if err != nil {
 		resp.Error = "Failed to login for an unknown reason"
 		if isLoginVerboseToClient {
@@ -61,7 +165,8 @@ func (e *LoginService) LoginVerify(ctx context.Context, req *loginv1.LoginVerify
 		return resp, nil
 	}
 
-	if user == nil {
+	isUserCreated := user == nil
+	if isUserCreated {
 		isUnknownUserAllowed := config.ValueBool("login", "is_unknown_user_allowed")
 		if !isUnknownUserAllowed {
 			resp.Error = "Invalid username or password"
@@ -92,61 +197,153 @@ func (e *LoginService) LoginVerify(ctx context.Context, req *loginv1.LoginVerify
 			return resp, nil
 		}
 
-		newUser := &entityv1.User{
+		passwordHash, err := e.password.Hash(req.Password)
+		if err != nil {
+			resp.Error = "User creation failed for an unknown reason"
+			if isLoginVerboseToClient {
+				resp.Error = "Failed to hash password: " + err.Error()
+			}
+			return resp, nil
+		}
+
+		// The user is only stored below, together with going online.
+		user = &entityv1.User{
 			Username: req.Username,
-			Password: req.Password,
-			State:    entityv1.UserState_OFFLINE,
+			Password: passwordHash,
 		}
-		user, err = e.storager.UserCreate(ctx, newUser)
+	} else {
+		isRehashNeeded, err := e.password.Verify(req.Password, user.Password)
 		if err != nil {
-			resp.Error = "User creation failed for an unknown reason"
+			resp.Error = "Invalid username or password"
 			if isLoginVerboseToClient {
-				resp.Error = "Failed to create user: " + err.Error()
+				resp.Error = "Password is incorrect"
+				if !errors.Is(err, password.ErrMismatch) {
+					resp.Error = "Failed to verify password: " + err.Error()
+				}
 			}
 			return resp, nil
 		}
-		slog.Info("User created", "username", req.Username, "application", req.Application)
-	}
 
-	if user.Password != req.Password {
-		resp.Error = "Invalid username or password"
-		if isLoginVerboseToClient {
-			resp.Error = "Password is incorrect"
+		if user.State != entityv1.UserState_OFFLINE {
+			if e.duplicateLoginPolicy != duplicateLoginPolicyKickOld {
+				resp.Error = fmt.Sprintf("User '%s' is already connected", req.Username)
+				return resp, nil
+			}
+
+			err = e.sessionKick(ctx, user)
+			if err != nil {
+				resp.Error = fmt.Sprintf("User '%s' is already connected", req.Username)
+				if isLoginVerboseToClient {
+					resp.Error += ": failed to disconnect previous session: " + err.Error()
+				}
+				return resp, nil
+			}
+
+			user, err = e.storager.UserByUserID(ctx, user.UserId)
+			if err != nil || user == nil {
+				resp.Error = "Failed to login for an unknown reason"
+				if isLoginVerboseToClient {
+					resp.Error = fmt.Sprintf("Failed to reload user after disconnect: %v", err)
+				}
+				return resp, nil
+			}
 		}
-		return resp, nil
-	}
 
-	if user.State != entityv1.UserState_OFFLINE {
-		// TODO: unified service DC broadcast
-		//  CMessage msgout("DC");
-		// msgout.serial(uid);
-		// CUnifiedNetwork::getInstance()->send("WS", msgout);
+		if isRehashNeeded {
+			passwordHash, err := e.password.Hash(req.Password)
+			if err != nil {
+				slog.Warn("Password rehash failed", "username", req.Username, "error", err)
+			} else {
+				user.Password = passwordHash
+			}
+		}
+	}
 
-		// reason = toString("User '%s' is already connected", req.toUtf8().c_str());
-		// CMessage vplMsgout("VLP");
-		// vplMsgout.serial(reason);
-		// netbase.send(vplMsgout, from);
-		// return
-		resp.Error = fmt.Sprintf("User '%s' is already connected", req.Username)
-		return resp, nil
+	// Storing the user online, issuing its token and listing the shards is
+	// one unit of work, so a failed login leaves no trace in storage. Password
+	// hashing and kicking stay outside, as they are slow. Only the login that
+	// moves the revision it read goes online, so concurrent logins to the
+	// same account cannot both succeed.
+	claims := &token.Claims{
+		Username:    user.Username,
+		Privileges:  user.Privileges,
+		Application: req.Application,
 	}
+	expectedRevision := user.Revision
+	user.State = entityv1.UserState_ONLINE
+	var shards []*entityv1.Shard
+	err = e.storager.WithTx(ctx, func(tx storage.Storager) error {
+		var err error
+		if isUserCreated {
+			_, err = tx.UserCreate(ctx, user)
+			if errors.Is(err, storage.ErrUserExists) {
+				resp.Error = "Invalid username or password"
+				if isLoginVerboseToClient {
+					resp.Error = "User was created by a concurrent login"
+				}
+				return err
+			}
+			if err != nil {
+				resp.Error = "User creation failed for an unknown reason"
+				if isLoginVerboseToClient {
+					resp.Error = "Failed to create user: " + err.Error()
+				}
+				return err
+			}
+		} else {
+			err = tx.UserUpdateIf(ctx, user, expectedRevision)
+			if errors.Is(err, storage.ErrConflict) {
+				resp.Error = fmt.Sprintf("User '%s' is already connected", req.Username)
+				if isLoginVerboseToClient {
+					resp.Error += ": " + err.Error()
+				}
+				return err
+			}
+			if err != nil {
+				resp.Error = "Failed to update user cookie"
+				return err
+			}
+		}
 
-	// TODO: jwt token
+		claims.UserID = user.UserId
+		resp.Token, err = e.token.Issue(claims)
+		if err != nil {
+			resp.Error = "Failed to issue session token"
+			if isLoginVerboseToClient {
+				resp.Error = "Failed to issue session token: " + err.Error()
+			}
+			return err
+		}
 
-	user.State = entityv1.UserState_ONLINE
-	err = e.storager.UserUpdate(ctx, user)
+		shards, err = tx.ShardsByClientApplication(ctx, req.Application)
+		if err != nil {
+			resp.Error = "Failed to get shards"
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		resp.Error = "Failed to update user cookie"
+		if resp.Token != "" {
+			e.token.Revoke(claims)
+			resp.Token = ""
+		}
+		if resp.Error == "" {
+			resp.Error = "Failed to login for an unknown reason"
+			if isLoginVerboseToClient {
+				resp.Error = "Failed to login: " + err.Error()
+			}
+		}
 		return resp, nil
 	}
-
-	shards, err := e.storager.ShardsByClientApplication(ctx, req.Application)
-	if err != nil {
-		resp.Error = "Failed to get shards"
-		return resp, nil
+	if isUserCreated {
+		slog.Info("User created", "user_id", user.UserId, "username", req.Username, "application", req.Application)
 	}
+	e.sessionStart(claims)
 
 	for _, shard := range shards {
+		if !shard.IsOnline {
+			continue
+		}
 		resp.Shards = append(resp.Shards, &loginv1.LoginVerifyShardResponse{
 			Name:        shard.Name,
 			PlayerCount: shard.PlayerCount,
@@ -157,6 +354,28 @@ func (e *LoginService) LoginVerify(ctx context.Context, req *loginv1.LoginVerify
 	return resp, nil
 }
 
+// WelcomeRegister sets the dialer used to reach shard welcome services.
+func (e *LoginService) WelcomeRegister(welcomeDialer dial.WelcomeDialer) error {
+	e.welcomeDialer = welcomeDialer
+	return nil
+}
+
+// TokenService returns the service that signs session tokens, so other
+// services can verify them or be handed its public keys.
+func (e *LoginService) TokenService() *token.TokenService {
+	return e.token
+}
+
+// ListenAddr returns the address the listener named listener binds, from
+// the login.<listener>_bind_address and login.<listener>_port keys: "client"
+// for game clients, "ws" for shards and "web" for administration. An empty
+// bind address binds every interface and port 0 any free port.
+func ListenAddr(listener string) string {
+	host := config.ValueStr("login", listener+"_bind_address")
+	port := config.ValueInt("login", listener+"_port")
+	return net.JoinHostPort(host, strconv.FormatInt(port, 10))
+}
+
 func configValidate() error {
 
 	requiredKeys := []struct {
@@ -165,22 +384,49 @@ func configValidate() error {
 		typ     string // "string", "int", "bool"
 	}{
 		{"login", "displayed_variables", "[]string"},
+		{"login", "ws_bind_address", "string"},
 		{"login", "ws_port", "int"},
+		{"login", "web_bind_address", "string"},
 		{"login", "web_port", "int"},
+		{"login", "client_bind_address", "string"},
 		{"login", "client_port", "int"},
 		{"login", "is_external_shard_allowed", "bool"},
 		{"login", "is_unknown_user_allowed", "bool"},
 		{"login", "is_user_creation_allowed", "bool"},
 		{"login", "beep", "bool"},
+		{"login", "storage_driver", "string"},
+		{"login", "storage_data_dir", "string"},
 		{"login", "database_host", "string"},
 		{"login", "database_name", "string"},
 		{"login", "database_username", "string"},
 		{"login", "database_password", "string"},
 		{"login", "force_database_reconnection", "string"},
+		{"login", "storage_cache_user_ttl", "string"},
+		{"login", "storage_cache_shard_ttl", "string"},
 		{"login", "is_naming_service_used", "bool"},
 		{"login", "is_aes_used", "bool"},
+		{"login", "is_tls_used", "bool"},
+		{"login", "tls_cert_file", "string"},
+		{"login", "tls_key_file", "string"},
+		{"login", "tls_client_ca_file", "string"},
+		{"login", "tls_ca_file", "string"},
+		{"login", "tls_reload_interval", "string"},
 		{"login", "is_login_verbose_to_client", "bool"},
 		{"login", "shard_id", "int"},
+		{"login", "password_algorithm", "string"},
+		{"login", "password_argon2id_memory", "int"},
+		{"login", "password_argon2id_time", "int"},
+		{"login", "password_argon2id_threads", "int"},
+		{"login", "password_bcrypt_cost", "int"},
+		{"login", "token_issuer", "string"},
+		{"login", "token_ttl", "string"},
+		{"login", "token_key_file", "string"},
+		{"login", "shard_register_secret", "string"},
+		{"login", "session_idle_timeout", "string"},
+		{"login", "duplicate_login_policy", "string"},
+		{"login", "duplicate_login_kick_timeout", "string"},
+		{"login", "choose_shard_timeout", "string"},
+		{"login", "deleted_purge_after", "string"},
 	}
 
 	for _, k := range requiredKeys {
@@ -199,5 +445,12 @@ func configValidate() error {
 			return fmt.Errorf("%s.%s: %w", k.section, k.key, err)
 		}
 	}
+
+	for _, key := range []string{"ws_port", "web_port", "client_port"} {
+		port := config.ValueInt("login", key)
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("login.%s: %d is not a port", key, port)
+		}
+	}
 	return nil
 }
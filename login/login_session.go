@@ -0,0 +1,335 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/storage"
+	"github.com/runeharvest/gserver/login/token"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	welcomev1 "github.com/runeharvest/gserver/proto/rh/welcome/v1"
+)
+
+// privilegeAdmin is the user privilege required to force other users offline.
+const privilegeAdmin = "ADMIN"
+
+// sessionEndAttempts bounds how often sessionEnd retries a user update lost
+// to a concurrent one.
+const sessionEndAttempts = 5
+
+// session is an online user tracked by the login service.
+type session struct {
+	claims     *token.Claims
+	lastSeenAt time.Time
+	// shardID is the shard the user chose, 0 before choosing one.
+	shardID int32
+}
+
+// sessionStart records a new session for the user the claims were issued to.
+func (e *LoginService) sessionStart(claims *token.Claims) {
+	e.sessionMux.Lock()
+	defer e.sessionMux.Unlock()
+	e.sessions[claims.UserID] = &session{claims: claims, lastSeenAt: time.Now()}
+}
+
+// sessionTouch marks the session of userID as active.
+func (e *LoginService) sessionTouch(userID int32) {
+	e.sessionMux.Lock()
+	defer e.sessionMux.Unlock()
+	s, ok := e.sessions[userID]
+	if !ok {
+		return
+	}
+	s.lastSeenAt = time.Now()
+}
+
+// sessionShardSet records that the session with claims joined shardID, so
+// the heartbeats of that shard keep it alive.
+func (e *LoginService) sessionShardSet(claims *token.Claims, shardID int32) {
+	e.sessionMux.Lock()
+	defer e.sessionMux.Unlock()
+	s, ok := e.sessions[claims.UserID]
+	if !ok || s.claims.ID != claims.ID {
+		return
+	}
+	s.shardID = shardID
+	s.lastSeenAt = time.Now()
+}
+
+// sessionIsCurrent reports whether claims belong to the current session of
+// their user, rather than to one that ended or was replaced.
+func (e *LoginService) sessionIsCurrent(claims *token.Claims) bool {
+	e.sessionMux.RLock()
+	defer e.sessionMux.RUnlock()
+	s, ok := e.sessions[claims.UserID]
+	return ok && s.claims.ID == claims.ID
+}
+
+// SessionTouch marks the sessions of userIDs as active, for the users that
+// chose shardID. Shards call it through their heartbeats for the players
+// they host, so playing keeps the login session alive.
+func (e *LoginService) SessionTouch(shardID int32, userIDs []int32) {
+	now := time.Now()
+	e.sessionMux.Lock()
+	defer e.sessionMux.Unlock()
+	for _, userID := range userIDs {
+		s, ok := e.sessions[userID]
+		if !ok || s.shardID != shardID {
+			continue
+		}
+		s.lastSeenAt = now
+	}
+}
+
+// sessionEnd drops the session of userID, revokes its token and moves the
+// user back to OFFLINE, off any shard.
+func (e *LoginService) sessionEnd(ctx context.Context, userID int32, reason string) error {
+	e.sessionMux.Lock()
+	s, ok := e.sessions[userID]
+	delete(e.sessions, userID)
+	e.sessionMux.Unlock()
+
+	if ok {
+		e.token.Revoke(s.claims)
+	}
+	return e.userOffline(ctx, userID, reason)
+}
+
+// sessionIdleEnd ends the session with claims for reason if it is still the
+// current one of its user and was last seen before deadline. The reaper
+// finds idle sessions before ending them, and in between the user may have
+// come back or logged in again.
+func (e *LoginService) sessionIdleEnd(ctx context.Context, claims *token.Claims, deadline time.Time, reason string) error {
+	e.sessionMux.Lock()
+	s, ok := e.sessions[claims.UserID]
+	if !ok || s.claims.ID != claims.ID || !s.lastSeenAt.Before(deadline) {
+		e.sessionMux.Unlock()
+		return nil
+	}
+	delete(e.sessions, claims.UserID)
+	e.sessionMux.Unlock()
+
+	e.token.Revoke(s.claims)
+	return e.userOffline(ctx, claims.UserID, reason)
+}
+
+// userOffline moves userID back to OFFLINE, off any shard, unless a new
+// session owns the user by now.
+func (e *LoginService) userOffline(ctx context.Context, userID int32, reason string) error {
+	var err error
+	for range sessionEndAttempts {
+		var user *entityv1.User
+		user, err = e.storager.UserByUserID(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("user by user id: %w", err)
+		}
+		if user == nil {
+			return fmt.Errorf("user %d not found", userID)
+		}
+		if user.State == entityv1.UserState_OFFLINE {
+			return nil
+		}
+		// A login that started a new session since owns the user now.
+		e.sessionMux.RLock()
+		_, isNewSession := e.sessions[userID]
+		e.sessionMux.RUnlock()
+		if isNewSession {
+			return nil
+		}
+
+		expectedRevision := user.Revision
+		user.State = entityv1.UserState_OFFLINE
+		user.ShardId = 0
+		err = e.storager.UserUpdateIf(ctx, user, expectedRevision)
+		if errors.Is(err, storage.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("user update: %w", err)
+		}
+		slog.Info("Session ended", "user_id", userID, "username", user.Username, "reason", reason)
+		return nil
+	}
+	return fmt.Errorf("user update: %w", err)
+}
+
+// sessionKick disconnects the current session of user to make room for a new
+// login. If the user is on an online shard, its welcome service is told to
+// drop the player first and the session only ends once it acknowledges. An
+// offline shard holds no player to drop.
+func (e *LoginService) sessionKick(ctx context.Context, user *entityv1.User) error {
+	if user.ShardId != 0 {
+		shard, err := e.storager.ShardByShardID(ctx, user.ShardId)
+		if err != nil {
+			return fmt.Errorf("shard by shard id: %w", err)
+		}
+		if shard != nil && shard.IsOnline && shard.WsAddr != "" {
+			err = e.welcomeUserDisconnect(ctx, shard.WsAddr, user.UserId, "duplicate login")
+			if err != nil {
+				return fmt.Errorf("shard %d: %w", shard.ShardId, err)
+			}
+		}
+	}
+	return e.sessionEnd(ctx, user.UserId, "duplicate login")
+}
+
+// welcomeUserDisconnect asks the welcome service at wsAddr to disconnect
+// userID for reason and waits up to duplicate_login_kick_timeout for the ack.
+func (e *LoginService) welcomeUserDisconnect(ctx context.Context, wsAddr string, userID int32, reason string) error {
+	if e.welcomeDialer == nil {
+		return fmt.Errorf("welcome dialer not registered")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.duplicateLoginKickTimeout)
+	defer cancel()
+
+	welcomeClient, err := e.welcomeDialer.WelcomeDial(ctx, wsAddr)
+	if err != nil {
+		return fmt.Errorf("welcome dial: %w", err)
+	}
+	resp, err := welcomeClient.UserDisconnect(ctx, &welcomev1.UserDisconnectRequest{
+		UserId: userID,
+		Reason: reason,
+	})
+	if err != nil {
+		return fmt.Errorf("user disconnect: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("user disconnect: %s", resp.Error)
+	}
+	return nil
+}
+
+// Logout ends the session the given token belongs to.
+func (e *LoginService) Logout(ctx context.Context, req *loginv1.LogoutRequest) (*loginv1.LogoutResponse, error) {
+	resp := &loginv1.LogoutResponse{}
+
+	isLoginVerboseToClient := config.ValueBool("login", "is_login_verbose_to_client")
+
+	claims, err := e.token.Verify(req.Token)
+	if err != nil {
+		resp.Error = "Invalid session"
+		if isLoginVerboseToClient {
+			resp.Error = "Invalid session: " + err.Error()
+		}
+		return resp, nil
+	}
+
+	if !e.sessionIsCurrent(claims) {
+		// A stale token from an earlier session; the user is not logged in with it.
+		e.token.Revoke(claims)
+		return resp, nil
+	}
+
+	err = e.sessionEnd(ctx, claims.UserID, "logout")
+	if err != nil {
+		resp.Error = "Failed to logout for an unknown reason"
+		if isLoginVerboseToClient {
+			resp.Error = "Failed to end session: " + err.Error()
+		}
+		return resp, nil
+	}
+	return resp, nil
+}
+
+// Disconnect forces another user offline. The caller's token must carry the
+// admin privilege.
+func (e *LoginService) Disconnect(ctx context.Context, req *loginv1.DisconnectRequest) (*loginv1.DisconnectResponse, error) {
+	resp := &loginv1.DisconnectResponse{}
+
+	isLoginVerboseToClient := config.ValueBool("login", "is_login_verbose_to_client")
+
+	claims, err := e.token.Verify(req.Token)
+	if err != nil {
+		resp.Error = "Invalid session"
+		if isLoginVerboseToClient {
+			resp.Error = "Invalid session: " + err.Error()
+		}
+		return resp, nil
+	}
+	if !slices.Contains(claims.Privileges, privilegeAdmin) {
+		resp.Error = "Permission denied"
+		return resp, nil
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "disconnected by " + claims.Username
+	}
+	err = e.sessionEnd(ctx, req.UserId, reason)
+	if err != nil {
+		resp.Error = "Failed to disconnect user for an unknown reason"
+		if isLoginVerboseToClient {
+			resp.Error = "Failed to end session: " + err.Error()
+		}
+		return resp, nil
+	}
+	return resp, nil
+}
+
+// SessionReap ends every session that has been idle longer than the
+// configured session_idle_timeout.
+func (e *LoginService) SessionReap(ctx context.Context) error {
+	deadline := time.Now().Add(-e.sessionIdleTimeout)
+
+	var idleClaims []*token.Claims
+	e.sessionMux.RLock()
+	for _, s := range e.sessions {
+		if s.lastSeenAt.Before(deadline) {
+			idleClaims = append(idleClaims, s.claims)
+		}
+	}
+	e.sessionMux.RUnlock()
+
+	var errs []error
+	for _, claims := range idleClaims {
+		err := e.sessionIdleEnd(ctx, claims, deadline, "idle timeout")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", claims.UserID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SessionOrphanEnd moves the users a previous run left ONLINE back to
+// OFFLINE. Their sessions were only kept in memory, so nothing would reap
+// them and the reject_new duplicate login policy would lock them out. Call
+// it once at startup, before serving logins.
+func (e *LoginService) SessionOrphanEnd(ctx context.Context) error {
+	users, err := e.storager.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if err != nil {
+		return fmt.Errorf("users by state: %w", err)
+	}
+
+	var errs []error
+	for _, user := range users {
+		err = e.userOffline(ctx, user.UserId, "login service restart")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", user.UserId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SessionReaperRun calls SessionReap periodically until ctx is done.
+func (e *LoginService) SessionReaperRun(ctx context.Context) error {
+	ticker := time.NewTicker(e.sessionIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			err := e.SessionReap(ctx)
+			if err != nil {
+				slog.Warn("Session reap failed", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package login
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/storage/memory"
+	netdialloopback "github.com/runeharvest/gserver/net/dial/loopback"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	welcomev1 "github.com/runeharvest/gserver/proto/rh/welcome/v1"
+)
+
+func newTestLoginService(t *testing.T) (*LoginService, *memory.MemoryStorage) {
+	t.Helper()
+	err := config.SetConfig(defaultLoginConfig())
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	loginService, err := NewLoginService(memoryStorage)
+	if err != nil {
+		t.Fatal("new login service:", err)
+	}
+	return loginService, memoryStorage
+}
+
+func testLogin(t *testing.T, loginService *LoginService, username string, password string) *loginv1.LoginVerifyResponse {
+	t.Helper()
+	resp, err := loginService.LoginVerify(context.Background(), &loginv1.LoginVerifyRequest{
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		t.Fatal("login verify:", err)
+	}
+	return resp
+}
+
+func TestLogout(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+
+	resp2 := testLogin(t, loginService, "testuser", "testpassword")
+	if resp2.Error == "" {
+		t.Fatal("second login succeeded while online")
+	}
+
+	logoutResp, err := loginService.Logout(context.Background(), &loginv1.LogoutRequest{Token: resp.Token})
+	if err != nil {
+		t.Fatal("logout:", err)
+	}
+	if logoutResp.Error != "" {
+		t.Fatal("logout response error:", logoutResp.Error)
+	}
+
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if user.State != entityv1.UserState_OFFLINE {
+		t.Fatal("user state after logout:", user.State)
+	}
+
+	_, err = loginService.TokenService().Verify(resp.Token)
+	if err == nil {
+		t.Fatal("token still valid after logout")
+	}
+
+	resp = testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login after logout response error:", resp.Error)
+	}
+}
+
+func TestSessionReap(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+
+	err := loginService.SessionReap(context.Background())
+	if err != nil {
+		t.Fatal("session reap:", err)
+	}
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if user.State != entityv1.UserState_ONLINE {
+		t.Fatal("active session reaped")
+	}
+
+	loginService.sessionMux.Lock()
+	loginService.sessions[user.UserId].lastSeenAt = time.Now().Add(-time.Hour)
+	loginService.sessionMux.Unlock()
+
+	err = loginService.SessionReap(context.Background())
+	if err != nil {
+		t.Fatal("session reap:", err)
+	}
+	user, err = memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if user.State != entityv1.UserState_OFFLINE {
+		t.Fatal("idle session not reaped, user state:", user.State)
+	}
+}
+
+func TestSessionIdleEndRecheck(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+	claims, err := loginService.TokenService().Verify(resp.Token)
+	if err != nil {
+		t.Fatal("verify:", err)
+	}
+
+	// The reaper found the session idle, but the user came back before it
+	// ended the session.
+	deadline := time.Now()
+	err = loginService.sessionIdleEnd(context.Background(), claims, deadline.Add(-time.Hour), "idle timeout")
+	if err != nil {
+		t.Fatal("session idle end:", err)
+	}
+	if !loginService.sessionIsCurrent(claims) {
+		t.Fatal("session seen after the deadline ended")
+	}
+
+	// The user logged in again since.
+	staleClaims := *claims
+	staleClaims.ID = "stale"
+	err = loginService.sessionIdleEnd(context.Background(), &staleClaims, deadline.Add(time.Hour), "idle timeout")
+	if err != nil {
+		t.Fatal("session idle end:", err)
+	}
+	if !loginService.sessionIsCurrent(claims) {
+		t.Fatal("session ended for the claims of another session")
+	}
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if user.State != entityv1.UserState_ONLINE {
+		t.Fatal("user state:", user.State)
+	}
+
+	err = loginService.sessionIdleEnd(context.Background(), claims, deadline.Add(time.Hour), "idle timeout")
+	if err != nil {
+		t.Fatal("session idle end:", err)
+	}
+	if loginService.sessionIsCurrent(claims) {
+		t.Fatal("idle session not ended")
+	}
+}
+
+func TestSessionOrphanEnd(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+
+	// A restarted login service has no session for the user left online.
+	loginService, err := NewLoginService(memoryStorage)
+	if err != nil {
+		t.Fatal("new login service:", err)
+	}
+	resp = testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error == "" {
+		t.Fatal("login succeeded while online")
+	}
+
+	err = loginService.SessionOrphanEnd(context.Background())
+	if err != nil {
+		t.Fatal("session orphan end:", err)
+	}
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if user.State != entityv1.UserState_OFFLINE || user.ShardId != 0 {
+		t.Fatal("orphaned user not reset:", user.State, user.ShardId)
+	}
+	resp = testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+}
+
+func TestSessionTouch(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+	welcomeNetwork, err := netdialloopback.NewLoopbackWelcomeNetwork()
+	if err != nil {
+		t.Fatal("new loopback welcome network:", err)
+	}
+	err = welcomeNetwork.WelcomeRegister("shard:49999", &testWelcomeServer{})
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	err = loginService.WelcomeRegister(welcomeNetwork)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	_, err = memoryStorage.ShardCreate(context.Background(), &entityv1.Shard{
+		ShardId: 1, Name: "open", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true,
+	})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+	chosen, err := loginService.ChooseShard(context.Background(), &loginv1.ChooseShardRequest{Token: resp.Token, ShardId: 1})
+	if err != nil || chosen.Error != "" {
+		t.Fatal("choose shard:", chosen, err)
+	}
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+
+	// Heartbeats of the shard the user plays on keep the session alive,
+	// those of another shard do not.
+	idle := func() {
+		loginService.sessionMux.Lock()
+		loginService.sessions[user.UserId].lastSeenAt = time.Now().Add(-time.Hour)
+		loginService.sessionMux.Unlock()
+	}
+	idle()
+	loginService.SessionTouch(1, []int32{user.UserId})
+	err = loginService.SessionReap(context.Background())
+	if err != nil {
+		t.Fatal("session reap:", err)
+	}
+	user, err = memoryStorage.UserByUserID(context.Background(), user.UserId)
+	if err != nil {
+		t.Fatal("user by user id:", err)
+	}
+	if user.State != entityv1.UserState_ONLINE || user.ShardId != 1 {
+		t.Fatal("session touched by its shard reaped")
+	}
+
+	idle()
+	loginService.SessionTouch(2, []int32{user.UserId})
+	err = loginService.SessionReap(context.Background())
+	if err != nil {
+		t.Fatal("session reap:", err)
+	}
+	user, err = memoryStorage.UserByUserID(context.Background(), user.UserId)
+	if err != nil {
+		t.Fatal("user by user id:", err)
+	}
+	if user.State != entityv1.UserState_OFFLINE || user.ShardId != 0 {
+		t.Fatal("session touched by another shard not reaped, user:", user)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+
+	passwordHash, err := loginService.password.Hash("adminpassword")
+	if err != nil {
+		t.Fatal("hash:", err)
+	}
+	_, err = memoryStorage.UserCreate(context.Background(), &entityv1.User{
+		Username:   "admin",
+		Password:   passwordHash,
+		Privileges: []string{privilegeAdmin},
+	})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	userResp := testLogin(t, loginService, "testuser", "testpassword")
+	if userResp.Error != "" {
+		t.Fatal("login response error:", userResp.Error)
+	}
+	adminResp := testLogin(t, loginService, "admin", "adminpassword")
+	if adminResp.Error != "" {
+		t.Fatal("admin login response error:", adminResp.Error)
+	}
+
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+
+	resp, err := loginService.Disconnect(context.Background(), &loginv1.DisconnectRequest{Token: userResp.Token, UserId: user.UserId})
+	if err != nil {
+		t.Fatal("disconnect:", err)
+	}
+	if resp.Error == "" {
+		t.Fatal("disconnect without admin privilege succeeded")
+	}
+
+	resp, err = loginService.Disconnect(context.Background(), &loginv1.DisconnectRequest{Token: adminResp.Token, UserId: user.UserId})
+	if err != nil {
+		t.Fatal("disconnect:", err)
+	}
+	if resp.Error != "" {
+		t.Fatal("disconnect response error:", resp.Error)
+	}
+
+	user, err = memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if user.State != entityv1.UserState_OFFLINE {
+		t.Fatal("user state after disconnect:", user.State)
+	}
+}
+
+type testWelcomeServer struct {
+	welcomev1.UnimplementedWelcomeServiceServer
+	mutex        sync.Mutex
+	disconnected []int32
+	err          string
+}
+
+func (e *testWelcomeServer) UserDisconnect(ctx context.Context, req *welcomev1.UserDisconnectRequest) (*welcomev1.UserDisconnectResponse, error) {
+	if e.err != "" {
+		return &welcomev1.UserDisconnectResponse{Error: e.err}, nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.disconnected = append(e.disconnected, req.UserId)
+	return &welcomev1.UserDisconnectResponse{}, nil
+}
+
+func (e *testWelcomeServer) UserAdmit(ctx context.Context, req *welcomev1.UserAdmitRequest) (*welcomev1.UserAdmitResponse, error) {
+	if e.err != "" {
+		return &welcomev1.UserAdmitResponse{Error: e.err}, nil
+	}
+	return &welcomev1.UserAdmitResponse{FrontendAddr: "frontend:47851", Cookie: fmt.Sprintf("cookie-%d", req.UserId)}, nil
+}
+
+func TestDuplicateLoginKick(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+	loginService.duplicateLoginPolicy = duplicateLoginPolicyKickOld
+
+	welcomeServer := &testWelcomeServer{}
+	welcomeNetwork, err := netdialloopback.NewLoopbackWelcomeNetwork()
+	if err != nil {
+		t.Fatal("new loopback welcome network:", err)
+	}
+	err = welcomeNetwork.WelcomeRegister("shard1:49999", welcomeServer)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	err = loginService.WelcomeRegister(welcomeNetwork)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+
+	_, err = memoryStorage.ShardCreate(context.Background(), &entityv1.Shard{ShardId: 1, Name: "shard1", WsAddr: "shard1:49999", IsOnline: true})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+
+	oldResp := testLogin(t, loginService, "testuser", "testpassword")
+	if oldResp.Error != "" {
+		t.Fatal("login response error:", oldResp.Error)
+	}
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	user.ShardId = 1
+	err = memoryStorage.UserUpdate(context.Background(), user)
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+
+	welcomeServer.err = "shard busy"
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error == "" {
+		t.Fatal("login succeeded without welcome service ack")
+	}
+
+	welcomeServer.err = ""
+	resp = testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+	if len(welcomeServer.disconnected) != 1 || welcomeServer.disconnected[0] != user.UserId {
+		t.Fatal("welcome service not asked to disconnect user:", welcomeServer.disconnected)
+	}
+
+	_, err = loginService.TokenService().Verify(oldResp.Token)
+	if err == nil {
+		t.Fatal("old session token still valid after kick")
+	}
+}
+
+func TestDuplicateLoginKickShardOffline(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+	loginService.duplicateLoginPolicy = duplicateLoginPolicyKickOld
+
+	// The welcome service of a crashed shard does not answer.
+	welcomeServer := &testWelcomeServer{err: "unreachable"}
+	welcomeNetwork, err := netdialloopback.NewLoopbackWelcomeNetwork()
+	if err != nil {
+		t.Fatal("new loopback welcome network:", err)
+	}
+	err = welcomeNetwork.WelcomeRegister("shard1:49999", welcomeServer)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	err = loginService.WelcomeRegister(welcomeNetwork)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+
+	_, err = memoryStorage.ShardCreate(context.Background(), &entityv1.Shard{ShardId: 1, Name: "shard1", WsAddr: "shard1:49999"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+
+	oldResp := testLogin(t, loginService, "testuser", "testpassword")
+	if oldResp.Error != "" {
+		t.Fatal("login response error:", oldResp.Error)
+	}
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	user.ShardId = 1
+	err = memoryStorage.UserUpdate(context.Background(), user)
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+	if len(welcomeServer.disconnected) != 0 {
+		t.Fatal("welcome service of an offline shard asked to disconnect:", welcomeServer.disconnected)
+	}
+	_, err = loginService.TokenService().Verify(oldResp.Token)
+	if err == nil {
+		t.Fatal("old session token still valid after kick")
+	}
+}
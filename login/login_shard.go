@@ -0,0 +1,257 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	welcomev1 "github.com/runeharvest/gserver/proto/rh/welcome/v1"
+)
+
+// chooseShardAttempts bounds how often ChooseShard retries a reservation lost
+// to a concurrent update of the shard or the user.
+const chooseShardAttempts = 5
+
+// ChooseShard hands a logged in user off to a shard. The shard's welcome
+// service admits the user and returns a one-time cookie the client presents
+// to the shard frontend.
+func (e *LoginService) ChooseShard(ctx context.Context, req *loginv1.ChooseShardRequest) (*loginv1.ChooseShardResponse, error) {
+	resp := &loginv1.ChooseShardResponse{}
+
+	isLoginVerboseToClient := config.ValueBool("login", "is_login_verbose_to_client")
+
+	claims, err := e.token.Verify(req.Token)
+	if err != nil {
+		resp.Error = "Invalid session"
+		if isLoginVerboseToClient {
+			resp.Error = "Invalid session: " + err.Error()
+		}
+		return resp, nil
+	}
+	if !e.sessionIsCurrent(claims) {
+		// The session of the token ended, or a newer login replaced it.
+		resp.Error = "Invalid session"
+		if isLoginVerboseToClient {
+			resp.Error = "Invalid session: session ended"
+		}
+		return resp, nil
+	}
+	e.sessionTouch(claims.UserID)
+
+	user, err := e.storager.UserByUserID(ctx, claims.UserID)
+	if err != nil || user == nil {
+		resp.Error = "Failed to choose shard for an unknown reason"
+		if isLoginVerboseToClient {
+			resp.Error = fmt.Sprintf("Failed to get user %d: %v", claims.UserID, err)
+		}
+		return resp, nil
+	}
+	if user.State != entityv1.UserState_ONLINE {
+		resp.Error = "Invalid session"
+		if isLoginVerboseToClient {
+			resp.Error = "User is not logged in"
+		}
+		return resp, nil
+	}
+
+	shard, err := e.storager.ShardByShardID(ctx, req.ShardId)
+	if err != nil {
+		resp.Error = "Failed to choose shard for an unknown reason"
+		if isLoginVerboseToClient {
+			resp.Error = "Failed to get shard: " + err.Error()
+		}
+		return resp, nil
+	}
+	if shard == nil || !shard.IsOnline {
+		resp.Error = "Shard is not available"
+		return resp, nil
+	}
+
+	err = shardJoinAllowed(shard, user)
+	if err != nil {
+		resp.Error = "Shard is not available"
+		if isLoginVerboseToClient {
+			resp.Error = "Shard is not available: " + err.Error()
+		}
+		return resp, nil
+	}
+
+	admitResp, err := e.welcomeUserAdmit(ctx, shard.WsAddr, user)
+	if err != nil {
+		resp.Error = "Shard is not responding"
+		if isLoginVerboseToClient {
+			resp.Error = "Shard is not responding: " + err.Error()
+		}
+		return resp, nil
+	}
+	if admitResp.Error != "" {
+		resp.Error = "Shard refused the connection"
+		if isLoginVerboseToClient {
+			resp.Error = "Shard refused the connection: " + admitResp.Error
+		}
+		return resp, nil
+	}
+
+	// The checks above ran without holding anything; concurrent logins may
+	// have taken the last slot since, so they run again on the stored shard
+	// while reserving the slot, which only the first of them wins.
+	for range chooseShardAttempts {
+		resp.Error = ""
+		err = e.storager.WithTx(ctx, func(tx storage.Storager) error {
+			return e.shardJoin(ctx, tx, claims.UserID, req.ShardId, resp, isLoginVerboseToClient)
+		})
+		if !errors.Is(err, storage.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		if resp.Error == "" {
+			resp.Error = "Failed to choose shard for an unknown reason"
+			if isLoginVerboseToClient {
+				resp.Error = "Failed to reserve a shard slot: " + err.Error()
+			}
+		}
+		// The shard admitted a player who will not come.
+		err = e.welcomeUserDisconnect(ctx, shard.WsAddr, user.UserId, "shard join failed")
+		if err != nil {
+			slog.Warn("Shard admission revoke failed", "shard_id", shard.ShardId, "user_id", user.UserId, "error", err)
+		}
+		return resp, nil
+	}
+
+	e.sessionShardSet(claims, shard.ShardId)
+	slog.Info("Shard chosen", "user_id", user.UserId, "username", user.Username, "shard_id", shard.ShardId)
+	resp.FrontendAddr = admitResp.FrontendAddr
+	resp.Cookie = admitResp.Cookie
+	return resp, nil
+}
+
+// shardJoin reserves a slot on shardID for userID until the shard's next
+// heartbeat reports the real count, and moves the user to it, releasing the
+// slot of the shard the user was on. Choosing the same shard again changes
+// nothing. The updates only apply to the revisions read, so a concurrent
+// change of a shard or the user fails it with a *storage.ConflictError.
+func (e *LoginService) shardJoin(ctx context.Context, tx storage.Storager, userID int32, shardID int32, resp *loginv1.ChooseShardResponse, isLoginVerboseToClient bool) error {
+	user, err := tx.UserByUserID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("user by user id: %w", err)
+	}
+	if user == nil || user.State != entityv1.UserState_ONLINE {
+		resp.Error = "Invalid session"
+		if isLoginVerboseToClient {
+			resp.Error = "User is not logged in"
+		}
+		return fmt.Errorf("user %d is not online", userID)
+	}
+	shard, err := tx.ShardByShardID(ctx, shardID)
+	if err != nil {
+		return fmt.Errorf("shard by shard id: %w", err)
+	}
+	if shard == nil || !shard.IsOnline {
+		resp.Error = "Shard is not available"
+		return fmt.Errorf("shard %d is not available", shardID)
+	}
+	err = shardJoinAllowed(shard, user)
+	if err != nil {
+		resp.Error = "Shard is not available"
+		if isLoginVerboseToClient {
+			resp.Error = "Shard is not available: " + err.Error()
+		}
+		return err
+	}
+	if user.ShardId == shard.ShardId {
+		return nil
+	}
+	if user.ShardId != 0 {
+		err = shardLeave(ctx, tx, user.ShardId)
+		if err != nil {
+			return fmt.Errorf("shard %d leave: %w", user.ShardId, err)
+		}
+	}
+
+	expectedRevision := shard.Revision
+	shard.PlayerCount++
+	err = tx.ShardUpdateIf(ctx, shard, expectedRevision)
+	if err != nil {
+		return fmt.Errorf("shard update: %w", err)
+	}
+	expectedRevision = user.Revision
+	user.ShardId = shard.ShardId
+	err = tx.UserUpdateIf(ctx, user, expectedRevision)
+	if err != nil {
+		return fmt.Errorf("user update: %w", err)
+	}
+	return nil
+}
+
+// shardLeave releases the slot a user held on shardID.
+func shardLeave(ctx context.Context, tx storage.Storager, shardID int32) error {
+	shard, err := tx.ShardByShardID(ctx, shardID)
+	if err != nil {
+		return fmt.Errorf("shard by shard id: %w", err)
+	}
+	if shard == nil || shard.PlayerCount == 0 {
+		return nil
+	}
+	expectedRevision := shard.Revision
+	shard.PlayerCount--
+	err = tx.ShardUpdateIf(ctx, shard, expectedRevision)
+	if err != nil {
+		return fmt.Errorf("shard update: %w", err)
+	}
+	return nil
+}
+
+// shardJoinAllowed checks the shard state, the external shard policy and the
+// shard capacity for user.
+func shardJoinAllowed(shard *entityv1.Shard, user *entityv1.User) error {
+	switch shard.State {
+	case entityv1.ShardState_OPEN:
+	case entityv1.ShardState_RESTRICTED:
+		if len(user.Privileges) == 0 {
+			return fmt.Errorf("shard is restricted to privileged users")
+		}
+	default:
+		return fmt.Errorf("shard is closed")
+	}
+
+	if shard.IsExternal && !config.ValueBool("login", "is_external_shard_allowed") {
+		return fmt.Errorf("external shards are not allowed")
+	}
+
+	// A user choosing its shard again already counts in PlayerCount.
+	if shard.Capacity > 0 && shard.PlayerCount >= shard.Capacity && user.ShardId != shard.ShardId {
+		return fmt.Errorf("shard is full")
+	}
+	return nil
+}
+
+// welcomeUserAdmit asks the welcome service at wsAddr to admit user and hand
+// out a login cookie, waiting up to choose_shard_timeout.
+func (e *LoginService) welcomeUserAdmit(ctx context.Context, wsAddr string, user *entityv1.User) (*welcomev1.UserAdmitResponse, error) {
+	if e.welcomeDialer == nil {
+		return nil, fmt.Errorf("welcome dialer not registered")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.chooseShardTimeout)
+	defer cancel()
+
+	welcomeClient, err := e.welcomeDialer.WelcomeDial(ctx, wsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("welcome dial: %w", err)
+	}
+	resp, err := welcomeClient.UserAdmit(ctx, &welcomev1.UserAdmitRequest{
+		UserId:     user.UserId,
+		Username:   user.Username,
+		Privileges: user.Privileges,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("user admit: %w", err)
+	}
+	return resp, nil
+}
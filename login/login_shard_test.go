@@ -0,0 +1,290 @@
+package login
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/runeharvest/gserver/config"
+	netdialloopback "github.com/runeharvest/gserver/net/dial/loopback"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+)
+
+func TestChooseShard(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+
+	welcomeNetwork, err := netdialloopback.NewLoopbackWelcomeNetwork()
+	if err != nil {
+		t.Fatal("new loopback welcome network:", err)
+	}
+	err = welcomeNetwork.WelcomeRegister("shard:49999", &testWelcomeServer{})
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	err = loginService.WelcomeRegister(welcomeNetwork)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+
+	shards := []*entityv1.Shard{
+		{ShardId: 1, Name: "open", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true},
+		{ShardId: 2, Name: "closed", WsAddr: "shard:49999", State: entityv1.ShardState_CLOSED, IsOnline: true},
+		{ShardId: 3, Name: "restricted", WsAddr: "shard:49999", State: entityv1.ShardState_RESTRICTED, IsOnline: true},
+		{ShardId: 4, Name: "full", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true, Capacity: 10, PlayerCount: 10},
+		{ShardId: 5, Name: "external", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true, IsExternal: true},
+		{ShardId: 6, Name: "offline", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN},
+	}
+	for _, shard := range shards {
+		_, err = memoryStorage.ShardCreate(context.Background(), shard)
+		if err != nil {
+			t.Fatal("shard create:", err)
+		}
+	}
+	err = config.SetValue("login", "is_external_shard_allowed", false)
+	if err != nil {
+		t.Fatal("set value:", err)
+	}
+
+	loginResp := testLogin(t, loginService, "testuser", "testpassword")
+	if loginResp.Error != "" {
+		t.Fatal("login response error:", loginResp.Error)
+	}
+
+	for _, shardID := range []int32{2, 3, 4, 5, 6, 99} {
+		resp, err := loginService.ChooseShard(context.Background(), &loginv1.ChooseShardRequest{Token: loginResp.Token, ShardId: shardID})
+		if err != nil {
+			t.Fatal("choose shard:", err)
+		}
+		if resp.Error == "" {
+			t.Fatal("choose shard succeeded for shard", shardID)
+		}
+	}
+
+	resp, err := loginService.ChooseShard(context.Background(), &loginv1.ChooseShardRequest{Token: "garbage", ShardId: 1})
+	if err != nil {
+		t.Fatal("choose shard:", err)
+	}
+	if resp.Error == "" {
+		t.Fatal("choose shard succeeded with an invalid token")
+	}
+
+	resp, err = loginService.ChooseShard(context.Background(), &loginv1.ChooseShardRequest{Token: loginResp.Token, ShardId: 1})
+	if err != nil {
+		t.Fatal("choose shard:", err)
+	}
+	if resp.Error != "" {
+		t.Fatal("choose shard response error:", resp.Error)
+	}
+	if resp.FrontendAddr != "frontend:47851" || resp.Cookie == "" {
+		t.Fatal("choose shard response:", resp)
+	}
+
+	users, err := memoryStorage.UserByShardID(context.Background(), 1)
+	if err != nil {
+		t.Fatal("user by shard id:", err)
+	}
+	if len(users) != 1 || users[0].Username != "testuser" {
+		t.Fatal("users on shard:", users)
+	}
+
+	shard, err := memoryStorage.ShardByShardID(context.Background(), 1)
+	if err != nil {
+		t.Fatal("shard by shard id:", err)
+	}
+	if shard.PlayerCount != 1 {
+		t.Fatal("shard slot not reserved, player count:", shard.PlayerCount)
+	}
+}
+
+func TestChooseShardStaleSession(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+	loginService.duplicateLoginPolicy = duplicateLoginPolicyKickOld
+
+	welcomeNetwork, err := netdialloopback.NewLoopbackWelcomeNetwork()
+	if err != nil {
+		t.Fatal("new loopback welcome network:", err)
+	}
+	err = welcomeNetwork.WelcomeRegister("shard:49999", &testWelcomeServer{})
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	err = loginService.WelcomeRegister(welcomeNetwork)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	_, err = memoryStorage.ShardCreate(context.Background(), &entityv1.Shard{
+		ShardId: 1, Name: "open", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true,
+	})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+
+	first := testLogin(t, loginService, "testuser", "testpassword")
+	if first.Error != "" {
+		t.Fatal("login response error:", first.Error)
+	}
+	// The second login kicks the first session.
+	second := testLogin(t, loginService, "testuser", "testpassword")
+	if second.Error != "" {
+		t.Fatal("login response error:", second.Error)
+	}
+
+	resp, err := loginService.ChooseShard(context.Background(), &loginv1.ChooseShardRequest{Token: first.Token, ShardId: 1})
+	if err != nil {
+		t.Fatal("choose shard:", err)
+	}
+	if resp.Error == "" {
+		t.Fatal("choose shard succeeded with the token of a kicked session")
+	}
+	shard, err := memoryStorage.ShardByShardID(context.Background(), 1)
+	if err != nil {
+		t.Fatal("shard by shard id:", err)
+	}
+	if shard.PlayerCount != 0 {
+		t.Fatal("kicked session reserved a slot, player count:", shard.PlayerCount)
+	}
+}
+
+func TestChooseShardCapacity(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+
+	welcomeServer := &testWelcomeServer{}
+	welcomeNetwork, err := netdialloopback.NewLoopbackWelcomeNetwork()
+	if err != nil {
+		t.Fatal("new loopback welcome network:", err)
+	}
+	err = welcomeNetwork.WelcomeRegister("shard:49999", welcomeServer)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	err = loginService.WelcomeRegister(welcomeNetwork)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	_, err = memoryStorage.ShardCreate(context.Background(), &entityv1.Shard{
+		ShardId: 1, Name: "small", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true, Capacity: 2,
+	})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+
+	const userCount = 8
+	tokens := make([]string, userCount)
+	for i := range userCount {
+		resp := testLogin(t, loginService, fmt.Sprintf("testuser%d", i), "testpassword")
+		if resp.Error != "" {
+			t.Fatal("login response error:", resp.Error)
+		}
+		tokens[i] = resp.Token
+	}
+
+	var mutex sync.Mutex
+	chosenCount := 0
+	var wg sync.WaitGroup
+	for _, token := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := loginService.ChooseShard(context.Background(), &loginv1.ChooseShardRequest{Token: token, ShardId: 1})
+			if err != nil {
+				t.Error("choose shard:", err)
+				return
+			}
+			if resp.Error == "" {
+				mutex.Lock()
+				chosenCount++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	shard, err := memoryStorage.ShardByShardID(context.Background(), 1)
+	if err != nil {
+		t.Fatal("shard by shard id:", err)
+	}
+	if chosenCount != 2 || shard.PlayerCount != int32(chosenCount) {
+		t.Fatal("shard over capacity, chosen:", chosenCount, "player count:", shard.PlayerCount)
+	}
+	users, err := memoryStorage.UserByShardID(context.Background(), 1)
+	if err != nil {
+		t.Fatal("user by shard id:", err)
+	}
+	if len(users) != chosenCount {
+		t.Fatal("users on shard:", len(users), "chosen:", chosenCount)
+	}
+}
+
+func TestChooseShardAgain(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+
+	welcomeNetwork, err := netdialloopback.NewLoopbackWelcomeNetwork()
+	if err != nil {
+		t.Fatal("new loopback welcome network:", err)
+	}
+	err = welcomeNetwork.WelcomeRegister("shard:49999", &testWelcomeServer{})
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	err = loginService.WelcomeRegister(welcomeNetwork)
+	if err != nil {
+		t.Fatal("welcome register:", err)
+	}
+	for _, shard := range []*entityv1.Shard{
+		{ShardId: 1, Name: "first", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true, Capacity: 1},
+		{ShardId: 2, Name: "second", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true},
+	} {
+		_, err = memoryStorage.ShardCreate(context.Background(), shard)
+		if err != nil {
+			t.Fatal("shard create:", err)
+		}
+	}
+
+	loginResp := testLogin(t, loginService, "testuser", "testpassword")
+	if loginResp.Error != "" {
+		t.Fatal("login response error:", loginResp.Error)
+	}
+	chooseShard := func(shardID int32) {
+		t.Helper()
+		resp, err := loginService.ChooseShard(context.Background(), &loginv1.ChooseShardRequest{Token: loginResp.Token, ShardId: shardID})
+		if err != nil {
+			t.Fatal("choose shard:", err)
+		}
+		if resp.Error != "" {
+			t.Fatal("choose shard response error:", resp.Error)
+		}
+	}
+	playerCounts := func() (int32, int32) {
+		t.Helper()
+		var counts [2]int32
+		for i := range counts {
+			shard, err := memoryStorage.ShardByShardID(context.Background(), int32(i+1))
+			if err != nil {
+				t.Fatal("shard by shard id:", err)
+			}
+			counts[i] = shard.PlayerCount
+		}
+		return counts[0], counts[1]
+	}
+
+	// The user already holds the only slot of the shard chosen again.
+	chooseShard(1)
+	chooseShard(1)
+	if first, second := playerCounts(); first != 1 || second != 0 {
+		t.Fatal("player counts after choosing the same shard twice:", first, second)
+	}
+
+	chooseShard(2)
+	if first, second := playerCounts(); first != 0 || second != 1 {
+		t.Fatal("player counts after choosing another shard:", first, second)
+	}
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if user.ShardId != 2 {
+		t.Fatal("user shard:", user.ShardId)
+	}
+}
@@ -2,7 +2,6 @@ package login
 
 import (
 	"context"
-	"net"
 	"testing"
 
 	"github.com/runeharvest/gserver/config"
@@ -12,11 +11,12 @@ import (
 	netlistengrpc "github.com/runeharvest/gserver/net/listen/grpc"
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 func TestSingleDialLogin(t *testing.T) {
-	err := config.SetConfig(defaultLoginConfig())
+	loginConfig := defaultLoginConfig()
+	tlsConfigSet(t, loginConfig)
+	err := config.SetConfig(loginConfig)
 	if err != nil {
 		t.Fatal("set config:", err)
 	}
@@ -28,13 +28,11 @@ func TestSingleDialLogin(t *testing.T) {
 	if err != nil {
 		t.Fatal("new login service:", err)
 	}
-	err = config.SetConfig(defaultLoginConfig())
+	err = config.SetConfig(loginConfig)
 	if err != nil {
 		t.Fatal("set config:", err)
 	}
-	gs := grpc.NewServer()
-
-	grpcListen, err := netlistengrpc.NewGrpcNetwork(gs)
+	grpcListen, err := netlistengrpc.NewGrpcNetworkFromConfig(ListenAddr("client"), false)
 	if err != nil {
 		t.Fatal("new grpc listen network:", err)
 	}
@@ -45,14 +43,14 @@ func TestSingleDialLogin(t *testing.T) {
 	}
 	netListen.LoginRegister(loginService)
 
-	lis, err := net.Listen("tcp", ":50051")
+	go netListen.Serve(context.Background())
+	defer netListen.Shutdown(context.Background())
+
+	creds, err := netdialgrpc.CredentialsFromConfig()
 	if err != nil {
-		t.Fatal("net listen:", err)
+		t.Fatal("credentials from config:", err)
 	}
-
-	go gs.Serve(lis)
-
-	conn, err := grpc.NewClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(nil))
+	conn, err := grpc.NewClient(netListen.Addr().String(), grpc.WithTransportCredentials(creds), grpc.WithContextDialer(nil))
 	if err != nil {
 		t.Fatal("new grpc client:", err)
 	}
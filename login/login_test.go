@@ -2,13 +2,22 @@ package login
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/storage"
 	"github.com/runeharvest/gserver/login/storage/memory"
 	net "github.com/runeharvest/gserver/net"
 	netdialloopback "github.com/runeharvest/gserver/net/dial/loopback"
 	netlistenloopback "github.com/runeharvest/gserver/net/listen/loopback"
+	"github.com/runeharvest/gserver/net/nettest"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
 )
 
@@ -68,26 +77,387 @@ func TestDialLogin(t *testing.T) {
 
 }
 
+func TestLoginPasswordHashed(t *testing.T) {
+	err := config.SetConfig(defaultLoginConfig())
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	loginService, err := NewLoginService(memoryStorage)
+	if err != nil {
+		t.Fatal("new login service:", err)
+	}
+
+	resp, err := loginService.LoginVerify(context.Background(), &loginv1.LoginVerifyRequest{
+		Username: "testuser",
+		Password: "testpassword",
+	})
+	if err != nil {
+		t.Fatal("login verify:", err)
+	}
+	if resp.Error != "" {
+		t.Fatal("response error:", resp.Error)
+	}
+
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if user == nil {
+		t.Fatal("user not created")
+	}
+	if user.Password == "testpassword" {
+		t.Fatal("password stored in cleartext")
+	}
+
+	claims, err := loginService.TokenService().Verify(resp.Token)
+	if err != nil {
+		t.Fatal("verify token:", err)
+	}
+	if claims.Username != "testuser" {
+		t.Fatal("token username:", claims.Username)
+	}
+}
+
+func TestLoginVerifyDeleted(t *testing.T) {
+	err := config.SetConfig(defaultLoginConfig())
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	loginService, err := NewLoginService(memoryStorage)
+	if err != nil {
+		t.Fatal("new login service:", err)
+	}
+
+	ctx := context.Background()
+	user, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	err = memoryStorage.UserDelete(ctx, user.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+
+	err = config.SetValue("login", "is_login_verbose_to_client", false)
+	if err != nil {
+		t.Fatal("set value:", err)
+	}
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "Invalid username or password" {
+		t.Fatal("login to deleted account:", resp.Error)
+	}
+
+	// Once purged, the username is free for a new account.
+	loginService.deletedPurgeAfter = -time.Hour
+	err = loginService.DeletedPurge(ctx)
+	if err != nil {
+		t.Fatal("deleted purge:", err)
+	}
+	resp = testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login after purge:", resp.Error)
+	}
+}
+
+// shardsFailingStorager fails listing shards, the last step of a login.
+type shardsFailingStorager struct {
+	storage.Storager
+}
+
+func (e *shardsFailingStorager) ShardsByClientApplication(ctx context.Context, clientApp string) ([]*entityv1.Shard, error) {
+	return nil, errors.New("shards unavailable")
+}
+
+func (e *shardsFailingStorager) WithTx(ctx context.Context, fn func(tx storage.Storager) error) error {
+	return e.Storager.WithTx(ctx, func(tx storage.Storager) error {
+		return fn(&shardsFailingStorager{Storager: tx})
+	})
+}
+
+func TestLoginVerifyRolledBack(t *testing.T) {
+	err := config.SetConfig(defaultLoginConfig())
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	loginService, err := NewLoginService(&shardsFailingStorager{Storager: memoryStorage})
+	if err != nil {
+		t.Fatal("new login service:", err)
+	}
+
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error == "" || resp.Token != "" {
+		t.Fatal("expected login to fail, got", resp)
+	}
+
+	// The user created by the failed login is rolled back with it.
+	user, err := memoryStorage.UserByLogin(context.Background(), "testuser")
+	if err != nil || user != nil {
+		t.Fatal("user after failed login:", user, err)
+	}
+}
+
+// TestLoginVerifyConcurrent is meant for the race detector: LoginVerify
+// changes the users it reads while other goroutines read the same users.
+func TestLoginVerifyConcurrent(t *testing.T) {
+	cfg := defaultLoginConfig()
+	// Keep concurrent argon2id hashing cheap.
+	cfg["login"].(map[string]any)["password_argon2id_memory"] = 1024
+	err := config.SetConfig(cfg)
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	loginService, err := NewLoginService(memoryStorage)
+	if err != nil {
+		t.Fatal("new login service:", err)
+	}
+
+	const logins = 16
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*logins)
+
+	// Readers changing what they get back must not affect the store.
+	done := make(chan struct{})
+	readerDone := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-done:
+				readerDone <- nil
+				return
+			default:
+			}
+			users, err := memoryStorage.Users(ctx)
+			if err != nil {
+				readerDone <- err
+				return
+			}
+			for _, user := range users {
+				user.State = entityv1.UserState_OFFLINE
+				user.Password = ""
+			}
+		}
+	}()
+
+	for i := range logins {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resp, err := loginService.LoginVerify(ctx, &loginv1.LoginVerifyRequest{
+				Username: fmt.Sprintf("user%d", i),
+				Password: "testpassword",
+			})
+			if err == nil && resp.Error != "" {
+				err = fmt.Errorf("user%d: %s", i, resp.Error)
+			}
+			errs <- err
+		}()
+		// The same user from everywhere at once; some are rejected as
+		// already online, but none may race.
+		go func() {
+			defer wg.Done()
+			_, err := loginService.LoginVerify(ctx, &loginv1.LoginVerifyRequest{
+				Username: "shareduser",
+				Password: "testpassword",
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(done)
+	close(errs)
+	err = <-readerDone
+	if err != nil {
+		t.Fatal("users:", err)
+	}
+	for err := range errs {
+		if err != nil {
+			t.Fatal("concurrent login:", err)
+		}
+	}
+
+	users, err := memoryStorage.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if err != nil {
+		t.Fatal("users by state:", err)
+	}
+	if len(users) != logins+1 {
+		t.Fatal("expected every user online, got", len(users))
+	}
+	for _, user := range users {
+		if user.Password == "" {
+			t.Fatal("password lost for", user.Username)
+		}
+	}
+}
+
+// TestLoginVerifyConcurrentSameUser checks that of many simultaneous logins to
+// an existing offline account exactly one goes online.
+func TestLoginVerifyConcurrentSameUser(t *testing.T) {
+	cfg := defaultLoginConfig()
+	cfg["login"].(map[string]any)["password_argon2id_memory"] = 1024
+	err := config.SetConfig(cfg)
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	loginService, err := NewLoginService(memoryStorage)
+	if err != nil {
+		t.Fatal("new login service:", err)
+	}
+
+	ctx := context.Background()
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+	_, err = loginService.Logout(ctx, &loginv1.LogoutRequest{Token: resp.Token})
+	if err != nil {
+		t.Fatal("logout:", err)
+	}
+
+	const logins = 16
+	var wg sync.WaitGroup
+	var online atomic.Int32
+	start := make(chan struct{})
+	for range logins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			resp, err := loginService.LoginVerify(ctx, &loginv1.LoginVerifyRequest{
+				Username: "testuser",
+				Password: "testpassword",
+			})
+			if err == nil && resp.Error == "" {
+				online.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if online.Load() != 1 {
+		t.Fatal("expected exactly one login to succeed, got", online.Load())
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	loginConfig := defaultLoginConfig()
+	loginConfig["login"].(map[string]any)["client_bind_address"] = ""
+	loginConfig["login"].(map[string]any)["client_port"] = 7000
+	err := config.SetConfig(loginConfig)
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+	if addr := ListenAddr("client"); addr != ":7000" {
+		t.Fatal("client listen addr:", addr)
+	}
+	if addr := ListenAddr("ws"); addr != "127.0.0.1:0" {
+		t.Fatal("ws listen addr:", addr)
+	}
+
+	loginConfig["login"].(map[string]any)["web_port"] = 70000
+	err = config.SetConfig(loginConfig)
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	_, err = NewLoginService(memoryStorage)
+	if err == nil {
+		t.Fatal("new login service accepted web_port 70000")
+	}
+}
+
+// tlsConfigSet writes the certificates of a new CA to a temporary directory
+// and sets the login.tls_* keys of loginConfig to use them, verifying both
+// servers and clients with that CA.
+func tlsConfigSet(t *testing.T, loginConfig map[string]any) *nettest.CA {
+	t.Helper()
+	dir := t.TempDir()
+	ca := nettest.NewCA(t)
+	ca.CertWrite(t, filepath.Join(dir, "ca.pem"))
+	nettest.CertificateWrite(t, ca.Issue(t, "login"), filepath.Join(dir, "login.pem"), filepath.Join(dir, "login.key"))
+
+	section := loginConfig["login"].(map[string]any)
+	section["is_tls_used"] = true
+	section["tls_cert_file"] = filepath.Join(dir, "login.pem")
+	section["tls_key_file"] = filepath.Join(dir, "login.key")
+	section["tls_client_ca_file"] = filepath.Join(dir, "ca.pem")
+	section["tls_ca_file"] = filepath.Join(dir, "ca.pem")
+	return ca
+}
+
 func defaultLoginConfig() map[string]any {
 	return map[string]any{
 		"login": map[string]any{
-			"displayed_variables":         []string{},
-			"ws_port":                     8080,
-			"web_port":                    8081,
-			"client_port":                 8082,
-			"is_external_shard_allowed":   true,
-			"is_unknown_user_allowed":     true,
-			"is_user_creation_allowed":    true,
-			"beep":                        true,
-			"database_host":               "localhost",
-			"database_name":               "login",
-			"database_username":           "user",
-			"database_password":           "password",
-			"force_database_reconnection": "5s",
-			"is_naming_service_used":      false,
-			"is_aes_used":                 false,
-			"shard_id":                    1,
-			"is_login_verbose_to_client":  true,
+			"displayed_variables":          []string{},
+			"ws_bind_address":              "127.0.0.1",
+			"ws_port":                      0,
+			"web_bind_address":             "127.0.0.1",
+			"web_port":                     0,
+			"client_bind_address":          "127.0.0.1",
+			"client_port":                  0,
+			"is_external_shard_allowed":    true,
+			"is_unknown_user_allowed":      true,
+			"is_user_creation_allowed":     true,
+			"beep":                         true,
+			"storage_driver":               "memory",
+			"storage_data_dir":             "data",
+			"database_host":                "localhost",
+			"database_name":                "login",
+			"database_username":            "user",
+			"database_password":            "password",
+			"force_database_reconnection":  "5s",
+			"storage_cache_user_ttl":       "10s",
+			"storage_cache_shard_ttl":      "1m",
+			"is_naming_service_used":       false,
+			"is_aes_used":                  false,
+			"is_tls_used":                  false,
+			"tls_cert_file":                "",
+			"tls_key_file":                 "",
+			"tls_client_ca_file":           "",
+			"tls_ca_file":                  "",
+			"tls_reload_interval":          "1m",
+			"shard_id":                     1,
+			"is_login_verbose_to_client":   true,
+			"password_algorithm":           "argon2id",
+			"password_argon2id_memory":     64 * 1024,
+			"password_argon2id_time":       1,
+			"password_argon2id_threads":    2,
+			"password_bcrypt_cost":         10,
+			"token_issuer":                 "login",
+			"token_ttl":                    "1h",
+			"token_key_file":               "",
+			"shard_register_secret":        "",
+			"session_idle_timeout":         "30m",
+			"duplicate_login_policy":       "reject_new",
+			"duplicate_login_kick_timeout": "5s",
+			"choose_shard_timeout":         "5s",
+			"deleted_purge_after":          "720h",
 		},
 	}
 }
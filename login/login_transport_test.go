@@ -0,0 +1,271 @@
+package login
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/net/dial"
+	netdialgrpc "github.com/runeharvest/gserver/net/dial/grpc"
+	netdialloopback "github.com/runeharvest/gserver/net/dial/loopback"
+	netdialquic "github.com/runeharvest/gserver/net/dial/quic"
+	"github.com/runeharvest/gserver/net/listen"
+	netlistengrpc "github.com/runeharvest/gserver/net/listen/grpc"
+	netlistenloopback "github.com/runeharvest/gserver/net/listen/loopback"
+	netlistenquic "github.com/runeharvest/gserver/net/listen/quic"
+	"github.com/runeharvest/gserver/net/nettest"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// transport serves loginService on a listener and returns it with a dialer
+// connected to it.
+type transport func(t *testing.T, loginService loginv1.LoginServiceServer) (listen.Listener, dial.Dialer)
+
+// transportServe serves listener until the test ends.
+func transportServe(t *testing.T, listener listen.Listener) {
+	served := make(chan error, 1)
+	go func() { served <- listener.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		err := listener.Shutdown(context.Background())
+		if err != nil {
+			t.Error("shutdown:", err)
+		}
+		err = <-served
+		if err != nil {
+			t.Error("serve:", err)
+		}
+	})
+}
+
+func transportLoopback(t *testing.T, loginService loginv1.LoginServiceServer) (listen.Listener, dial.Dialer) {
+	listener, err := netlistenloopback.NewLoopbackNetwork()
+	if err != nil {
+		t.Fatal("new loopback listen network:", err)
+	}
+	err = listener.LoginRegister(loginService)
+	if err != nil {
+		t.Fatal("login register:", err)
+	}
+	transportServe(t, listener)
+	dialer, err := netdialloopback.NewLoopbackNetwork()
+	if err != nil {
+		t.Fatal("new loopback dial network:", err)
+	}
+	err = dialer.LoginRegister(loginService)
+	if err != nil {
+		t.Fatal("login register:", err)
+	}
+	return listener, dialer
+}
+
+func transportGrpc(t *testing.T, loginService loginv1.LoginServiceServer) (listen.Listener, dial.Dialer) {
+	listener, err := netlistengrpc.NewGrpcNetwork("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("new grpc listen network:", err)
+	}
+	err = listener.LoginRegister(loginService)
+	if err != nil {
+		t.Fatal("login register:", err)
+	}
+	transportServe(t, listener)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal("new grpc client:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	dialer, err := netdialgrpc.NewGrpcNetwork(conn)
+	if err != nil {
+		t.Fatal("new grpc dial network:", err)
+	}
+	return listener, dialer
+}
+
+func transportQuic(t *testing.T, loginService loginv1.LoginServiceServer) (listen.Listener, dial.Dialer) {
+	serverConfig, clientConfig := nettest.TLSConfigs(t)
+	listener, err := netlistenquic.NewQuicNetwork("127.0.0.1:0", serverConfig, nil)
+	if err != nil {
+		t.Fatal("new quic listen network:", err)
+	}
+	err = listener.LoginRegister(loginService)
+	if err != nil {
+		t.Fatal("login register:", err)
+	}
+	transportServe(t, listener)
+
+	dialer, err := netdialquic.NewQuicNetwork(listener.Addr().String(), clientConfig, nil)
+	if err != nil {
+		t.Fatal("new quic dial network:", err)
+	}
+	t.Cleanup(func() { dialer.Close() })
+	return listener, dialer
+}
+
+// transportScenario runs the same logins through listener and dialer, and
+// describes every answer in a way that does not depend on the transport.
+func transportScenario(listener listen.Listener, dialer dial.Dialer) []string {
+	ctx := context.Background()
+	var results []string
+	record := func(step string, resp interface{ GetError() string }, err error, details ...any) {
+		if err != nil {
+			results = append(results, fmt.Sprintf("%s: failed", step))
+			return
+		}
+		results = append(results, fmt.Sprintf("%s: error=%q %v", step, resp.GetError(), details))
+	}
+
+	login, err := dialer.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser", Password: "testpassword"})
+	var shardNames []string
+	for _, shard := range login.GetShards() {
+		shardNames = append(shardNames, shard.Name)
+	}
+	record("login", login, err, login.GetToken() != "", shardNames)
+
+	wrong, err := dialer.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser", Password: "wrongpassword"})
+	record("login wrong password", wrong, err, wrong.GetToken() != "")
+
+	inProcess, err := listener.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "otheruser", Password: "testpassword"})
+	record("login in-process", inProcess, err, inProcess.GetToken() != "")
+
+	chosen, err := dialer.ChooseShard(ctx, &loginv1.ChooseShardRequest{Token: login.GetToken(), ShardId: 1})
+	record("choose shard", chosen, err, chosen.GetFrontendAddr(), chosen.GetCookie())
+
+	invalid, err := dialer.ChooseShard(ctx, &loginv1.ChooseShardRequest{Token: "garbage", ShardId: 1})
+	record("choose shard invalid token", invalid, err)
+
+	disconnect, err := dialer.Disconnect(ctx, &loginv1.DisconnectRequest{Token: login.GetToken(), UserId: 2})
+	record("disconnect without privilege", disconnect, err)
+
+	logout, err := dialer.Logout(ctx, &loginv1.LogoutRequest{Token: login.GetToken()})
+	record("logout", logout, err)
+
+	relogin, err := dialer.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser", Password: "testpassword"})
+	record("login after logout", relogin, err, relogin.GetToken() != "")
+	return results
+}
+
+func TestTransports(t *testing.T) {
+	transports := []struct {
+		name      string
+		transport transport
+	}{
+		{"loopback", transportLoopback},
+		{"grpc", transportGrpc},
+		{"quic", transportQuic},
+	}
+
+	var expected []string
+	for _, tt := range transports {
+		loginService, memoryStorage := newTestLoginService(t)
+		welcomeNetwork, err := netdialloopback.NewLoopbackWelcomeNetwork()
+		if err != nil {
+			t.Fatal("new loopback welcome network:", err)
+		}
+		err = welcomeNetwork.WelcomeRegister("shard:49999", &testWelcomeServer{})
+		if err != nil {
+			t.Fatal("welcome register:", err)
+		}
+		err = loginService.WelcomeRegister(welcomeNetwork)
+		if err != nil {
+			t.Fatal("welcome register:", err)
+		}
+		_, err = memoryStorage.ShardCreate(context.Background(), &entityv1.Shard{
+			ShardId: 1, Name: "open", WsAddr: "shard:49999", State: entityv1.ShardState_OPEN, IsOnline: true,
+		})
+		if err != nil {
+			t.Fatal("shard create:", err)
+		}
+
+		listener, dialer := tt.transport(t, loginService)
+		results := transportScenario(listener, dialer)
+		if expected == nil {
+			if results[0] != `login: error="" [true [open]]` {
+				t.Fatal(tt.name, "login:", results[0])
+			}
+			expected = results
+			continue
+		}
+		if !slices.Equal(results, expected) {
+			t.Fatalf("%s results differ from %s:\n%q\nexpected\n%q", tt.name, transports[0].name, results, expected)
+		}
+	}
+}
+
+// blockingLoginService answers LoginVerify once release is closed.
+type blockingLoginService struct {
+	loginv1.UnimplementedLoginServiceServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingLoginService) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error) {
+	e.started <- struct{}{}
+	<-e.release
+	return &loginv1.LoginVerifyResponse{Token: "token-" + in.Username}, nil
+}
+
+func TestTransportsShutdown(t *testing.T) {
+	transports := []struct {
+		name      string
+		transport transport
+	}{
+		{"loopback", transportLoopback},
+		{"grpc", transportGrpc},
+		{"quic", transportQuic},
+	}
+
+	for _, tt := range transports {
+		t.Run(tt.name, func(t *testing.T) {
+			loginService := &blockingLoginService{started: make(chan struct{}, 1), release: make(chan struct{})}
+			listener, dialer := tt.transport(t, loginService)
+			// The loopback dialer calls the service directly; only the
+			// listener tracks the calls.
+			loginVerify := func(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error) {
+				return dialer.LoginVerify(ctx, in)
+			}
+			if tt.name == "loopback" {
+				loginVerify = listener.LoginVerify
+			}
+
+			inFlight := make(chan error, 1)
+			go func() {
+				resp, err := loginVerify(context.Background(), &loginv1.LoginVerifyRequest{Username: "testuser"})
+				if err == nil && resp.Token != "token-testuser" {
+					err = fmt.Errorf("token %q", resp.Token)
+				}
+				inFlight <- err
+			}()
+			<-loginService.started
+
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- listener.Shutdown(context.Background()) }()
+			select {
+			case err := <-shutdown:
+				t.Fatal("shutdown returned with a call in flight:", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			close(loginService.release)
+
+			err := <-inFlight
+			if err != nil {
+				t.Fatal("in-flight login verify:", err)
+			}
+			err = <-shutdown
+			if err != nil {
+				t.Fatal("shutdown:", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err = loginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser"})
+			if err == nil {
+				t.Fatal("login verify after shutdown succeeded")
+			}
+		})
+	}
+}
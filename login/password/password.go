@@ -0,0 +1,123 @@
+// Package password hashes and verifies user passwords.
+//
+// Hashes are stored as self-describing strings that record the algorithm and
+// its parameters, so a stored hash can always be verified even after the
+// configured algorithm or cost changes.
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/runeharvest/gserver/config"
+)
+
+// ErrMismatch is returned by Verify when the password does not match the hash.
+var ErrMismatch = errors.New("password mismatch")
+
+// ErrUnknownAlgorithm is returned when a hash was not produced by a known Hasher.
+var ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+
+// Hasher hashes passwords with a single algorithm and parameter set.
+type Hasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// Verify compares password against encoded in constant time.
+	// It returns ErrMismatch when the password is wrong.
+	Verify(password string, encoded string) error
+	// IsCurrent reports whether encoded was produced with this Hasher's
+	// algorithm and parameters.
+	IsCurrent(encoded string) bool
+	// IsOwner reports whether encoded was produced by this Hasher's algorithm.
+	IsOwner(encoded string) bool
+}
+
+// PasswordService hashes new passwords with the preferred Hasher and verifies
+// existing hashes with whichever Hasher produced them.
+type PasswordService struct {
+	preferred Hasher
+	hashers   []Hasher
+}
+
+// NewPasswordService returns a PasswordService hashing with preferred. Any
+// additional hashers are only used to verify existing hashes.
+func NewPasswordService(preferred Hasher, others ...Hasher) (*PasswordService, error) {
+	if preferred == nil {
+		return nil, fmt.Errorf("preferred hasher is nil")
+	}
+	e := &PasswordService{
+		preferred: preferred,
+		hashers:   append([]Hasher{preferred}, others...),
+	}
+	return e, nil
+}
+
+// NewPasswordServiceFromConfig builds a PasswordService from the login config.
+// The hasher named by login.password_algorithm is preferred, the other one is
+// kept so hashes made before an algorithm switch still verify.
+func NewPasswordServiceFromConfig() (*PasswordService, error) {
+	argon, err := NewArgon2idHasher(
+		uint32(config.ValueInt("login", "password_argon2id_memory")),
+		uint32(config.ValueInt("login", "password_argon2id_time")),
+		uint8(config.ValueInt("login", "password_argon2id_threads")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new argon2id hasher: %w", err)
+	}
+
+	bc, err := NewBcryptHasher(int(config.ValueInt("login", "password_bcrypt_cost")))
+	if err != nil {
+		return nil, fmt.Errorf("new bcrypt hasher: %w", err)
+	}
+
+	algorithm := config.ValueStr("login", "password_algorithm")
+	switch algorithm {
+	case "argon2id":
+		return NewPasswordService(argon, bc)
+	case "bcrypt":
+		return NewPasswordService(bc, argon)
+	}
+	return nil, fmt.Errorf("password algorithm '%s': %w", algorithm, ErrUnknownAlgorithm)
+}
+
+// Hash hashes password with the preferred Hasher.
+func (e *PasswordService) Hash(password string) (string, error) {
+	return e.preferred.Hash(password)
+}
+
+// Verify checks password against encoded. On success, isRehashNeeded reports
+// whether encoded should be replaced by a fresh Hash because the preferred
+// algorithm or its parameters changed since it was created.
+func (e *PasswordService) Verify(password string, encoded string) (isRehashNeeded bool, err error) {
+	for _, hasher := range e.hashers {
+		if !hasher.IsOwner(encoded) {
+			continue
+		}
+		err = hasher.Verify(password, encoded)
+		if err != nil {
+			return false, err
+		}
+		return !e.preferred.IsCurrent(encoded), nil
+	}
+	return false, ErrUnknownAlgorithm
+}
+
+// IsSupported reports whether encoded was produced by one of the hashers, so
+// that Verify can check passwords against it.
+func (e *PasswordService) IsSupported(encoded string) bool {
+	for _, hasher := range e.hashers {
+		if hasher.IsOwner(encoded) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashParts splits a $-delimited hash string, dropping the leading empty field.
+func hashParts(encoded string) []string {
+	if !strings.HasPrefix(encoded, "$") {
+		return nil
+	}
+	return strings.Split(encoded[1:], "$")
+}
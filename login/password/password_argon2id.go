@@ -0,0 +1,138 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+
+	// argon2idMemoryMax and argon2idTimeMax bound the cost a stored hash may
+	// ask of Verify, 1 GiB and 64 passes.
+	argon2idMemoryMax = 1 << 20
+	argon2idTimeMax   = 64
+)
+
+// Argon2idHasher hashes passwords with argon2id and encodes them in the PHC
+// string format: $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+type Argon2idHasher struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// NewArgon2idHasher returns an Argon2idHasher. memory is in KiB.
+func NewArgon2idHasher(memory uint32, time uint32, threads uint8) (*Argon2idHasher, error) {
+	e := &Argon2idHasher{memory: memory, time: time, threads: threads}
+	err := e.paramsCheck()
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// paramsCheck checks the parameters are ones argon2 accepts and within the
+// bounds of what Verify is willing to compute.
+func (e *Argon2idHasher) paramsCheck() error {
+	if e.threads < 1 {
+		return fmt.Errorf("threads must be at least 1")
+	}
+	if e.memory < 8*uint32(e.threads) {
+		return fmt.Errorf("memory must be at least 8 KiB per thread")
+	}
+	if e.memory > argon2idMemoryMax {
+		return fmt.Errorf("memory must be at most %d KiB", argon2idMemoryMax)
+	}
+	if e.time < 1 {
+		return fmt.Errorf("time must be at least 1")
+	}
+	if e.time > argon2idTimeMax {
+		return fmt.Errorf("time must be at most %d", argon2idTimeMax)
+	}
+	return nil
+}
+
+func (e *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("read salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, e.time, e.memory, e.threads, argon2idKeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, e.memory, e.time, e.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (e *Argon2idHasher) Verify(password string, encoded string) error {
+	params, salt, key, err := argon2idDecode(encoded)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	otherKey := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func (e *Argon2idHasher) IsCurrent(encoded string) bool {
+	params, _, key, err := argon2idDecode(encoded)
+	if err != nil {
+		return false
+	}
+	return *params == *e && len(key) == argon2idKeyLength
+}
+
+func (e *Argon2idHasher) IsOwner(encoded string) bool {
+	parts := hashParts(encoded)
+	return len(parts) > 0 && parts[0] == "argon2id"
+}
+
+func argon2idDecode(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := hashParts(encoded)
+	if len(parts) != 5 || parts[0] != "argon2id" {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[1], "v=%d", &version)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parse version: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	params := &Argon2idHasher{}
+	_, err = fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parse params: %w", err)
+	}
+	err = params.paramsCheck()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("params: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("decode salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("decode key: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, nil, nil, fmt.Errorf("empty key")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,62 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptHasher hashes passwords with bcrypt, using the standard
+// $2a$<cost>$<salt+hash> encoding.
+type BcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher returns a BcryptHasher with the given cost.
+func NewBcryptHasher(cost int) (*BcryptHasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("cost %d out of range [%d, %d]", cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	e := &BcryptHasher{cost: cost}
+	return e, nil
+}
+
+func (e *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), e.cost)
+	if err != nil {
+		return "", fmt.Errorf("generate: %w", err)
+	}
+	return string(hash), nil
+}
+
+func (e *BcryptHasher) Verify(password string, encoded string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatch
+	}
+	if err != nil {
+		return fmt.Errorf("compare: %w", err)
+	}
+	return nil
+}
+
+func (e *BcryptHasher) IsCurrent(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return false
+	}
+	return cost == e.cost
+}
+
+func (e *BcryptHasher) IsOwner(encoded string) bool {
+	parts := hashParts(encoded)
+	if len(parts) == 0 {
+		return false
+	}
+	switch parts[0] {
+	case "2a", "2b", "2y":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPasswordVerify(t *testing.T) {
+	argon, err := NewArgon2idHasher(8*1024, 1, 1)
+	if err != nil {
+		t.Fatal("new argon2id hasher:", err)
+	}
+	bc, err := NewBcryptHasher(4)
+	if err != nil {
+		t.Fatal("new bcrypt hasher:", err)
+	}
+
+	for _, hasher := range []Hasher{argon, bc} {
+		passwordService, err := NewPasswordService(hasher)
+		if err != nil {
+			t.Fatal("new password service:", err)
+		}
+
+		encoded, err := passwordService.Hash("testpassword")
+		if err != nil {
+			t.Fatal("hash:", err)
+		}
+		if strings.Contains(encoded, "testpassword") {
+			t.Fatal("hash contains the plaintext password:", encoded)
+		}
+
+		isRehashNeeded, err := passwordService.Verify("testpassword", encoded)
+		if err != nil {
+			t.Fatal("verify:", err)
+		}
+		if isRehashNeeded {
+			t.Fatal("rehash needed for a fresh hash:", encoded)
+		}
+
+		_, err = passwordService.Verify("wrongpassword", encoded)
+		if !errors.Is(err, ErrMismatch) {
+			t.Fatal("verify wrong password: expected ErrMismatch, got", err)
+		}
+	}
+}
+
+func TestArgon2idDecodeParams(t *testing.T) {
+	argon, err := NewArgon2idHasher(8*1024, 1, 1)
+	if err != nil {
+		t.Fatal("new argon2id hasher:", err)
+	}
+	const saltKey = "$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=8192,t=1,p=0" + saltKey,
+		"$argon2id$v=19$m=8192,t=0,p=1" + saltKey,
+		"$argon2id$v=19$m=8192,t=1000,p=1" + saltKey,
+		"$argon2id$v=19$m=15,t=1,p=2" + saltKey,
+		"$argon2id$v=19$m=4294967295,t=1,p=1" + saltKey,
+		"$argon2id$v=19$m=8192,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$",
+	} {
+		err = argon.Verify("testpassword", encoded)
+		if err == nil || errors.Is(err, ErrMismatch) {
+			t.Fatal("verify accepted params of", encoded, err)
+		}
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	oldArgon, err := NewArgon2idHasher(8*1024, 1, 1)
+	if err != nil {
+		t.Fatal("new argon2id hasher:", err)
+	}
+	newArgon, err := NewArgon2idHasher(8*1024, 2, 1)
+	if err != nil {
+		t.Fatal("new argon2id hasher:", err)
+	}
+	bc, err := NewBcryptHasher(4)
+	if err != nil {
+		t.Fatal("new bcrypt hasher:", err)
+	}
+
+	encoded, err := oldArgon.Hash("testpassword")
+	if err != nil {
+		t.Fatal("hash:", err)
+	}
+
+	tests := []struct {
+		name     string
+		service  func() (*PasswordService, error)
+		isRehash bool
+	}{
+		{"same params", func() (*PasswordService, error) { return NewPasswordService(oldArgon) }, false},
+		{"cost changed", func() (*PasswordService, error) { return NewPasswordService(newArgon) }, true},
+		{"algorithm changed", func() (*PasswordService, error) { return NewPasswordService(bc, oldArgon) }, true},
+	}
+	for _, tt := range tests {
+		passwordService, err := tt.service()
+		if err != nil {
+			t.Fatal(tt.name, "new password service:", err)
+		}
+		isRehashNeeded, err := passwordService.Verify("testpassword", encoded)
+		if err != nil {
+			t.Fatal(tt.name, "verify:", err)
+		}
+		if isRehashNeeded != tt.isRehash {
+			t.Fatalf("%s: rehash needed = %v, expected %v", tt.name, isRehashNeeded, tt.isRehash)
+		}
+	}
+
+	passwordService, err := NewPasswordService(bc)
+	if err != nil {
+		t.Fatal("new password service:", err)
+	}
+	_, err = passwordService.Verify("testpassword", encoded)
+	if !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatal("verify without argon2id hasher: expected ErrUnknownAlgorithm, got", err)
+	}
+}
@@ -0,0 +1,293 @@
+package login
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// SessionToucher keeps the login sessions of players alive.
+type SessionToucher interface {
+	SessionTouch(shardID int32, userIDs []int32)
+}
+
+// ShardRegistryService lets shard welcome services announce themselves and
+// keep their player count up to date.
+type ShardRegistryService struct {
+	loginv1.UnimplementedShardRegistryServiceServer
+	storager       storage.Storager
+	sessionToucher SessionToucher
+
+	heartbeatMux sync.Mutex
+	// heartbeats counts the open heartbeat streams of each shard.
+	heartbeats map[int32]int
+
+	shutdownOnce sync.Once
+	// shutdown is closed by Shutdown to end the heartbeat streams.
+	shutdown chan struct{}
+}
+
+func NewShardRegistryService(storager storage.Storager) (*ShardRegistryService, error) {
+	e := &ShardRegistryService{
+		storager:   storager,
+		heartbeats: map[int32]int{},
+		shutdown:   make(chan struct{}),
+	}
+	return e, nil
+}
+
+// Shutdown ends the open heartbeat streams and those opened later, which
+// would otherwise keep a graceful stop of the listener waiting for as long
+// as their shards run. The shards go offline and reconnect to the next
+// login service.
+func (e *ShardRegistryService) Shutdown() {
+	e.shutdownOnce.Do(func() { close(e.shutdown) })
+}
+
+// SessionRegister sets the service whose sessions the heartbeats keep alive.
+func (e *ShardRegistryService) SessionRegister(sessionToucher SessionToucher) error {
+	e.sessionToucher = sessionToucher
+	return nil
+}
+
+// ShardRegister creates or updates the shard and marks it online. Shards that
+// were not known before registering are flagged as external. Only
+// authenticated callers may register, see shardIsAuthenticated. Moving a
+// known shard to another address is refused while the shard still sends
+// heartbeats from its current address.
+func (e *ShardRegistryService) ShardRegister(ctx context.Context, req *loginv1.ShardRegisterRequest) (*loginv1.ShardRegisterResponse, error) {
+	resp := &loginv1.ShardRegisterResponse{}
+
+	if req.ShardId == 0 {
+		resp.Error = "Shard id is empty"
+		return resp, nil
+	}
+	if req.WsAddr == "" {
+		resp.Error = "Welcome service address is empty"
+		return resp, nil
+	}
+	if !shardIsAuthenticated(ctx, req.Secret) {
+		slog.Warn("Shard register refused", "shard_id", req.ShardId, "ws_addr", req.WsAddr)
+		resp.Error = "Shard is not authenticated"
+		return resp, nil
+	}
+
+	shard, err := e.storager.ShardByShardID(ctx, req.ShardId)
+	if err != nil {
+		resp.Error = "Failed to get shard: " + err.Error()
+		return resp, nil
+	}
+
+	if shard == nil {
+		shard = &entityv1.Shard{
+			ShardId:    req.ShardId,
+			Name:       req.Name,
+			WsAddr:     req.WsAddr,
+			ClientApp:  req.ClientApp,
+			Capacity:   req.Capacity,
+			State:      req.State,
+			IsOnline:   true,
+			IsExternal: true,
+		}
+		_, err = e.storager.ShardCreate(ctx, shard)
+		if err != nil {
+			resp.Error = "Failed to create shard: " + err.Error()
+			return resp, nil
+		}
+		slog.Info("Shard registered", "shard_id", req.ShardId, "name", req.Name, "ws_addr", req.WsAddr)
+		return resp, nil
+	}
+
+	if req.WsAddr != shard.WsAddr && e.heartbeatIsAlive(req.ShardId) {
+		slog.Warn("Shard address change refused", "shard_id", req.ShardId, "ws_addr", shard.WsAddr, "new_ws_addr", req.WsAddr)
+		resp.Error = "Shard is online at another address"
+		return resp, nil
+	}
+
+	shard.Name = req.Name
+	shard.WsAddr = req.WsAddr
+	shard.ClientApp = req.ClientApp
+	shard.Capacity = req.Capacity
+	shard.State = req.State
+	shard.PlayerCount = 0
+	shard.IsOnline = true
+	err = e.storager.ShardUpdate(ctx, shard)
+	if err != nil {
+		resp.Error = "Failed to update shard: " + err.Error()
+		return resp, nil
+	}
+	slog.Info("Shard re-registered", "shard_id", req.ShardId, "name", req.Name, "ws_addr", req.WsAddr)
+	return resp, nil
+}
+
+// shardIsAuthenticated reports whether the caller of the registry proved to
+// be a shard, either with a client certificate verified by the listener or
+// with secret matching the shard_register_secret of the login config.
+func shardIsAuthenticated(ctx context.Context, secret string) bool {
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+		if ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			return true
+		}
+	}
+	expected := config.ValueStr("login", "shard_register_secret")
+	return expected != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+}
+
+// heartbeatIsAlive reports whether a heartbeat stream of shardID is open.
+func (e *ShardRegistryService) heartbeatIsAlive(shardID int32) bool {
+	e.heartbeatMux.Lock()
+	defer e.heartbeatMux.Unlock()
+	return e.heartbeats[shardID] > 0
+}
+
+// heartbeatStart records an open heartbeat stream of shardID.
+func (e *ShardRegistryService) heartbeatStart(shardID int32) {
+	e.heartbeatMux.Lock()
+	defer e.heartbeatMux.Unlock()
+	e.heartbeats[shardID]++
+}
+
+// heartbeatEnd records the end of a heartbeat stream of shardID and returns
+// how many remain open.
+func (e *ShardRegistryService) heartbeatEnd(shardID int32) int {
+	e.heartbeatMux.Lock()
+	defer e.heartbeatMux.Unlock()
+	e.heartbeats[shardID]--
+	count := e.heartbeats[shardID]
+	if count == 0 {
+		delete(e.heartbeats, shardID)
+	}
+	return count
+}
+
+// ShardHeartbeat keeps a registered shard online for as long as the stream is
+// open, updating its player count and keeping the sessions of its players
+// alive with every message. The first message must authenticate like
+// ShardRegister. The shard is marked offline when its last stream ends for
+// any reason.
+func (e *ShardRegistryService) ShardHeartbeat(stream loginv1.ShardRegistryService_ShardHeartbeatServer) error {
+	var shardID int32
+	defer func() {
+		if shardID == 0 {
+			return
+		}
+		// Another stream of the shard, such as one opened on a reconnection
+		// before this one timed out, keeps it online.
+		if e.heartbeatEnd(shardID) > 0 {
+			return
+		}
+		// The stream context is already done, but the shard must still go offline.
+		err := e.shardOffline(context.WithoutCancel(stream.Context()), shardID)
+		if err != nil {
+			slog.Warn("Shard offline failed", "shard_id", shardID, "error", err)
+		}
+	}()
+
+	// Recv only returns once the shard sends, so it runs apart for Shutdown
+	// to end the stream in between.
+	type heartbeatRecv struct {
+		req *loginv1.ShardHeartbeatRequest
+		err error
+	}
+	recvs := make(chan heartbeatRecv)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			select {
+			case recvs <- heartbeatRecv{req: req, err: err}:
+			case <-stream.Context().Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var recv heartbeatRecv
+		select {
+		case recv = <-recvs:
+		case <-stream.Context().Done():
+			return fmt.Errorf("recv: %w", stream.Context().Err())
+		case <-e.shutdown:
+			return status.Error(codes.Unavailable, "login service shutting down")
+		}
+		req, err := recv.req, recv.err
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&loginv1.ShardHeartbeatResponse{})
+		}
+		if err != nil {
+			return fmt.Errorf("recv: %w", err)
+		}
+
+		if shardID == 0 && !shardIsAuthenticated(stream.Context(), req.Secret) {
+			slog.Warn("Shard heartbeat refused", "shard_id", req.ShardId)
+			return stream.SendAndClose(&loginv1.ShardHeartbeatResponse{
+				Error: "Shard is not authenticated",
+			})
+		}
+		if shardID != 0 && req.ShardId != shardID {
+			return stream.SendAndClose(&loginv1.ShardHeartbeatResponse{
+				Error: fmt.Sprintf("Heartbeat for shard %d on the stream of shard %d", req.ShardId, shardID),
+			})
+		}
+
+		shard, err := e.storager.ShardByShardID(stream.Context(), req.ShardId)
+		if err != nil {
+			return fmt.Errorf("shard by shard id: %w", err)
+		}
+		if shard == nil {
+			return stream.SendAndClose(&loginv1.ShardHeartbeatResponse{
+				Error: fmt.Sprintf("Shard %d is not registered", req.ShardId),
+			})
+		}
+		if shardID == 0 {
+			e.heartbeatStart(req.ShardId)
+		}
+		shardID = req.ShardId
+
+		shard.PlayerCount = req.PlayerCount
+		shard.IsOnline = true
+		err = e.storager.ShardUpdate(stream.Context(), shard)
+		if err != nil {
+			return fmt.Errorf("shard update: %w", err)
+		}
+		if e.sessionToucher != nil {
+			e.sessionToucher.SessionTouch(shardID, req.UserIds)
+		}
+	}
+}
+
+func (e *ShardRegistryService) shardOffline(ctx context.Context, shardID int32) error {
+	shard, err := e.storager.ShardByShardID(ctx, shardID)
+	if err != nil {
+		return fmt.Errorf("shard by shard id: %w", err)
+	}
+	if shard == nil {
+		return nil
+	}
+	shard.IsOnline = false
+	shard.PlayerCount = 0
+	err = e.storager.ShardUpdate(ctx, shard)
+	if err != nil {
+		return fmt.Errorf("shard update: %w", err)
+	}
+	slog.Info("Shard offline", "shard_id", shardID, "name", shard.Name)
+	return nil
+}
@@ -0,0 +1,391 @@
+package login
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/storage/memory"
+	netlisten "github.com/runeharvest/gserver/net"
+	netlistengrpc "github.com/runeharvest/gserver/net/listen/grpc"
+	"github.com/runeharvest/gserver/net/nettest"
+	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestShardRegistryHeartbeat(t *testing.T) {
+	loginService, memoryStorage := newTestLoginService(t)
+	err := config.SetValue("login", "shard_register_secret", "s3cret")
+	if err != nil {
+		t.Fatal("set value:", err)
+	}
+
+	shardRegistryService, err := NewShardRegistryService(memoryStorage)
+	if err != nil {
+		t.Fatal("new shard registry service:", err)
+	}
+
+	grpcListen, err := netlistengrpc.NewGrpcNetwork("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("new grpc listen network:", err)
+	}
+	netListen, err := netlisten.NewNetListenService(grpcListen)
+	if err != nil {
+		t.Fatal("new net listen service:", err)
+	}
+	err = netListen.ShardRegistryRegister(shardRegistryService)
+	if err != nil {
+		t.Fatal("shard registry register:", err)
+	}
+
+	go netListen.Serve(context.Background())
+	defer netListen.Shutdown(context.Background())
+
+	conn, err := grpc.NewClient(netListen.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal("new grpc client:", err)
+	}
+	defer conn.Close()
+	registryClient := loginv1.NewShardRegistryServiceClient(conn)
+
+	registerResp, err := registryClient.ShardRegister(context.Background(), &loginv1.ShardRegisterRequest{
+		ShardId:  101,
+		Name:     "Atys",
+		WsAddr:   "atys:49999",
+		Capacity: 1000,
+		Secret:   "s3cret",
+	})
+	if err != nil {
+		t.Fatal("shard register:", err)
+	}
+	if registerResp.Error != "" {
+		t.Fatal("shard register response error:", registerResp.Error)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := registryClient.ShardHeartbeat(ctx)
+	if err != nil {
+		t.Fatal("shard heartbeat:", err)
+	}
+	err = stream.Send(&loginv1.ShardHeartbeatRequest{ShardId: 101, PlayerCount: 42, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal("heartbeat send:", err)
+	}
+
+	waitFor(t, func() bool {
+		shard, err := memoryStorage.ShardByShardID(context.Background(), 101)
+		return err == nil && shard != nil && shard.PlayerCount == 42
+	})
+
+	resp := testLogin(t, loginService, "testuser", "testpassword")
+	if resp.Error != "" {
+		t.Fatal("login response error:", resp.Error)
+	}
+	if len(resp.Shards) != 1 || resp.Shards[0].ShardId != 101 || resp.Shards[0].PlayerCount != 42 {
+		t.Fatal("login shards:", resp.Shards)
+	}
+
+	cancel()
+
+	waitFor(t, func() bool {
+		shard, err := memoryStorage.ShardByShardID(context.Background(), 101)
+		return err == nil && shard != nil && !shard.IsOnline
+	})
+}
+
+func TestShardRegisterAddressChange(t *testing.T) {
+	_, memoryStorage := newTestLoginService(t)
+	err := config.SetValue("login", "shard_register_secret", "s3cret")
+	if err != nil {
+		t.Fatal("set value:", err)
+	}
+
+	shardRegistryService, err := NewShardRegistryService(memoryStorage)
+	if err != nil {
+		t.Fatal("new shard registry service:", err)
+	}
+	grpcListen, err := netlistengrpc.NewGrpcNetwork("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("new grpc listen network:", err)
+	}
+	netListen, err := netlisten.NewNetListenService(grpcListen)
+	if err != nil {
+		t.Fatal("new net listen service:", err)
+	}
+	err = netListen.ShardRegistryRegister(shardRegistryService)
+	if err != nil {
+		t.Fatal("shard registry register:", err)
+	}
+	go netListen.Serve(context.Background())
+	defer netListen.Shutdown(context.Background())
+
+	conn, err := grpc.NewClient(netListen.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal("new grpc client:", err)
+	}
+	defer conn.Close()
+	registryClient := loginv1.NewShardRegistryServiceClient(conn)
+
+	shardRegister := func(wsAddr string, secret string) string {
+		resp, err := registryClient.ShardRegister(context.Background(), &loginv1.ShardRegisterRequest{
+			ShardId: 101,
+			Name:    "Atys",
+			WsAddr:  wsAddr,
+			Secret:  secret,
+		})
+		if err != nil {
+			t.Fatal("shard register:", err)
+		}
+		return resp.Error
+	}
+
+	if shardRegister("atys:49999", "") == "" {
+		t.Fatal("unauthenticated shard register succeeded")
+	}
+	if errMsg := shardRegister("atys:49999", "s3cret"); errMsg != "" {
+		t.Fatal("shard register response error:", errMsg)
+	}
+
+	heartbeatStart := func(ctx context.Context, secret string) loginv1.ShardRegistryService_ShardHeartbeatClient {
+		stream, err := registryClient.ShardHeartbeat(ctx)
+		if err != nil {
+			t.Fatal("shard heartbeat:", err)
+		}
+		err = stream.Send(&loginv1.ShardHeartbeatRequest{ShardId: 101, Secret: secret})
+		if err != nil {
+			t.Fatal("heartbeat send:", err)
+		}
+		return stream
+	}
+
+	resp, err := heartbeatStart(context.Background(), "").CloseAndRecv()
+	if err != nil {
+		t.Fatal("heartbeat close:", err)
+	}
+	if resp.Error == "" {
+		t.Fatal("unauthenticated heartbeat succeeded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	heartbeatStart(ctx, "s3cret")
+	waitFor(t, func() bool { return shardRegistryService.heartbeatIsAlive(101) })
+
+	// The current address may register again, as after a restart.
+	if errMsg := shardRegister("atys:49999", "s3cret"); errMsg != "" {
+		t.Fatal("shard register at the same address:", errMsg)
+	}
+	if shardRegister("evil:49999", "") == "" {
+		t.Fatal("unauthenticated address change succeeded")
+	}
+	if shardRegister("evil:49999", "wrong") == "" {
+		t.Fatal("address change with a wrong secret succeeded")
+	}
+	if shardRegister("atys2:49999", "s3cret") == "" {
+		t.Fatal("address change succeeded while the heartbeat is alive")
+	}
+
+	// A second stream, as after a reconnect, keeps the shard online when
+	// the first one ends.
+	ctxSecond, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	heartbeatStart(ctxSecond, "s3cret")
+	waitFor(t, func() bool {
+		shardRegistryService.heartbeatMux.Lock()
+		defer shardRegistryService.heartbeatMux.Unlock()
+		return shardRegistryService.heartbeats[101] == 2
+	})
+	cancel()
+	waitFor(t, func() bool {
+		shardRegistryService.heartbeatMux.Lock()
+		defer shardRegistryService.heartbeatMux.Unlock()
+		return shardRegistryService.heartbeats[101] == 1
+	})
+	shard, err := memoryStorage.ShardByShardID(context.Background(), 101)
+	if err != nil {
+		t.Fatal("shard by shard id:", err)
+	}
+	if !shard.IsOnline {
+		t.Fatal("shard offline while a heartbeat stream is open")
+	}
+
+	cancelSecond()
+	waitFor(t, func() bool {
+		shard, err := memoryStorage.ShardByShardID(context.Background(), 101)
+		return err == nil && shard != nil && !shard.IsOnline
+	})
+
+	if errMsg := shardRegister("atys2:49999", "s3cret"); errMsg != "" {
+		t.Fatal("authenticated address change:", errMsg)
+	}
+	shard, err = memoryStorage.ShardByShardID(context.Background(), 101)
+	if err != nil {
+		t.Fatal("shard by shard id:", err)
+	}
+	if shard.WsAddr != "atys2:49999" {
+		t.Fatal("shard address not changed:", shard.WsAddr)
+	}
+}
+
+func TestShardRegistryShutdown(t *testing.T) {
+	_, memoryStorage := newTestLoginService(t)
+	err := config.SetValue("login", "shard_register_secret", "s3cret")
+	if err != nil {
+		t.Fatal("set value:", err)
+	}
+
+	shardRegistryService, err := NewShardRegistryService(memoryStorage)
+	if err != nil {
+		t.Fatal("new shard registry service:", err)
+	}
+	grpcListen, err := netlistengrpc.NewGrpcNetwork("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("new grpc listen network:", err)
+	}
+	netListen, err := netlisten.NewNetListenService(grpcListen)
+	if err != nil {
+		t.Fatal("new net listen service:", err)
+	}
+	err = netListen.ShardRegistryRegister(shardRegistryService)
+	if err != nil {
+		t.Fatal("shard registry register:", err)
+	}
+	go netListen.Serve(context.Background())
+
+	conn, err := grpc.NewClient(netListen.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal("new grpc client:", err)
+	}
+	defer conn.Close()
+	registryClient := loginv1.NewShardRegistryServiceClient(conn)
+
+	registerResp, err := registryClient.ShardRegister(context.Background(), &loginv1.ShardRegisterRequest{
+		ShardId: 101,
+		Name:    "Atys",
+		WsAddr:  "atys:49999",
+		Secret:  "s3cret",
+	})
+	if err != nil {
+		t.Fatal("shard register:", err)
+	}
+	if registerResp.Error != "" {
+		t.Fatal("shard register response error:", registerResp.Error)
+	}
+	stream, err := registryClient.ShardHeartbeat(context.Background())
+	if err != nil {
+		t.Fatal("shard heartbeat:", err)
+	}
+	err = stream.Send(&loginv1.ShardHeartbeatRequest{ShardId: 101, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal("heartbeat send:", err)
+	}
+	waitFor(t, func() bool { return shardRegistryService.heartbeatIsAlive(101) })
+
+	// The heartbeat stream must not hold up the graceful stop.
+	shardRegistryService.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = netListen.Shutdown(ctx)
+	if err != nil {
+		t.Fatal("shutdown:", err)
+	}
+	_, err = stream.CloseAndRecv()
+	if status.Code(err) != codes.Unavailable {
+		t.Fatal("heartbeat after shutdown:", err)
+	}
+	shard, err := memoryStorage.ShardByShardID(context.Background(), 101)
+	if err != nil {
+		t.Fatal("shard by shard id:", err)
+	}
+	if shard.IsOnline {
+		t.Fatal("shard online after shutdown")
+	}
+}
+
+func TestShardRegistryMutualTLS(t *testing.T) {
+	loginConfig := defaultLoginConfig()
+	ca := tlsConfigSet(t, loginConfig)
+	err := config.SetConfig(loginConfig)
+	if err != nil {
+		t.Fatal("set config:", err)
+	}
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	shardRegistryService, err := NewShardRegistryService(memoryStorage)
+	if err != nil {
+		t.Fatal("new shard registry service:", err)
+	}
+
+	grpcListen, err := netlistengrpc.NewGrpcNetworkFromConfig(ListenAddr("ws"), true)
+	if err != nil {
+		t.Fatal("new grpc listen network:", err)
+	}
+	netListen, err := netlisten.NewNetListenService(grpcListen)
+	if err != nil {
+		t.Fatal("new net listen service:", err)
+	}
+	err = netListen.ShardRegistryRegister(shardRegistryService)
+	if err != nil {
+		t.Fatal("shard registry register:", err)
+	}
+	go netListen.Serve(context.Background())
+	defer netListen.Shutdown(context.Background())
+
+	shardRegister := func(creds credentials.TransportCredentials) error {
+		conn, err := grpc.NewClient(netListen.Addr().String(), grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatal("new grpc client:", err)
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = loginv1.NewShardRegistryServiceClient(conn).ShardRegister(ctx, &loginv1.ShardRegisterRequest{
+			ShardId: 101,
+			Name:    "Atys",
+			WsAddr:  "atys:49999",
+		})
+		return err
+	}
+
+	err = shardRegister(insecure.NewCredentials())
+	if err == nil {
+		t.Fatal("shard register without tls succeeded")
+	}
+	err = shardRegister(credentials.NewTLS(&tls.Config{RootCAs: ca.Pool}))
+	if err == nil {
+		t.Fatal("shard register without a client certificate succeeded")
+	}
+	stranger := nettest.NewCA(t)
+	err = shardRegister(credentials.NewTLS(&tls.Config{RootCAs: ca.Pool, Certificates: []tls.Certificate{stranger.Issue(t, "shard")}}))
+	if err == nil {
+		t.Fatal("shard register with a certificate of another ca succeeded")
+	}
+	err = shardRegister(credentials.NewTLS(&tls.Config{RootCAs: ca.Pool, Certificates: []tls.Certificate{ca.Issue(t, "shard")}}))
+	if err != nil {
+		t.Fatal("shard register with a client certificate:", err)
+	}
+	shard, err := memoryStorage.ShardByShardID(context.Background(), 101)
+	if err != nil || shard == nil {
+		t.Fatal("shard by shard id:", shard, err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
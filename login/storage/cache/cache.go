@@ -0,0 +1,298 @@
+// Package cache implements storage.Storager as a read cache in front of
+// another Storager, for the lookups every login makes.
+//
+// UserByLogin, ShardByShardID and ShardsByClientApplication are answered from
+// memory until their TTL expires. Writes made through the cache drop what
+// they may have changed, or store it for shard updates, so a single login
+// service always reads its own writes. Writes made by other processes sharing the same database are only
+// seen once the TTL expires; keep the user TTL short when running several
+// login services.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// userEntriesMax bounds the cached users. Expired entries are swept once it
+// is reached, and the whole cache is dropped if that is not enough.
+const userEntriesMax = 1 << 16
+
+// Counters counts the lookups of one cached method.
+type Counters struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// Stats holds the counters of every cached method.
+type Stats struct {
+	UserByLogin               Counters
+	ShardByShardID            Counters
+	ShardsByClientApplication Counters
+}
+
+type counters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func (c *counters) load() Counters {
+	return Counters{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+type entry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// CacheStorage caches the lookups of the Storager it wraps. Entities are
+// cloned on the way in and out, like the stores do.
+type CacheStorage struct {
+	next     storage.Storager
+	userTTL  time.Duration
+	shardTTL time.Duration
+
+	mux sync.Mutex
+	// generation is bumped by every write, so a lookup that raced with a
+	// write does not cache what it read before the write.
+	generation          uint64
+	usersByLogin        map[string]entry[*entityv1.User]
+	usernamesByUserID   map[int32]string
+	shardsByShardID     map[int32]entry[*entityv1.Shard]
+	shardsByClientApp   map[string]entry[[]*entityv1.Shard]
+	userByLoginStats    counters
+	shardByShardIDStats counters
+	shardsByClientStats counters
+}
+
+// NewCacheStorage wraps next. A TTL of 0 disables caching users or shards.
+func NewCacheStorage(next storage.Storager, userTTL time.Duration, shardTTL time.Duration) (*CacheStorage, error) {
+	if userTTL < 0 || shardTTL < 0 {
+		return nil, fmt.Errorf("negative ttl")
+	}
+	e := &CacheStorage{
+		next:              next,
+		userTTL:           userTTL,
+		shardTTL:          shardTTL,
+		usersByLogin:      make(map[string]entry[*entityv1.User]),
+		usernamesByUserID: make(map[int32]string),
+		shardsByShardID:   make(map[int32]entry[*entityv1.Shard]),
+		shardsByClientApp: make(map[string]entry[[]*entityv1.Shard]),
+	}
+	return e, nil
+}
+
+// NewCacheStorageFromConfig wraps next with the TTLs of the login
+// storage_cache_user_ttl and storage_cache_shard_ttl config keys.
+func NewCacheStorageFromConfig(next storage.Storager) (*CacheStorage, error) {
+	userTTL, err := time.ParseDuration(config.ValueStr("login", "storage_cache_user_ttl"))
+	if err != nil {
+		return nil, fmt.Errorf("parse storage_cache_user_ttl: %w", err)
+	}
+	shardTTL, err := time.ParseDuration(config.ValueStr("login", "storage_cache_shard_ttl"))
+	if err != nil {
+		return nil, fmt.Errorf("parse storage_cache_shard_ttl: %w", err)
+	}
+	return NewCacheStorage(next, userTTL, shardTTL)
+}
+
+// Stats returns the hit and miss counters of the cached methods.
+func (e *CacheStorage) Stats() Stats {
+	return Stats{
+		UserByLogin:               e.userByLoginStats.load(),
+		ShardByShardID:            e.shardByShardIDStats.load(),
+		ShardsByClientApplication: e.shardsByClientStats.load(),
+	}
+}
+
+func (e *CacheStorage) UserByLogin(ctx context.Context, login string) (*entityv1.User, error) {
+	if e.userTTL == 0 {
+		return e.next.UserByLogin(ctx, login)
+	}
+
+	e.mux.Lock()
+	cached, ok := e.usersByLogin[login]
+	generation := e.generation
+	e.mux.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		e.userByLoginStats.hits.Add(1)
+		return userClone(cached.value), nil
+	}
+	e.userByLoginStats.misses.Add(1)
+
+	user, err := e.next.UserByLogin(ctx, login)
+	// Unknown and deleted users are not cached, so creating or purging them
+	// elsewhere needs no invalidation.
+	if err != nil || user == nil {
+		return user, err
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.generation == generation {
+		if len(e.usersByLogin) >= userEntriesMax {
+			e.usersSweepLocked()
+		}
+		e.usersByLogin[login] = entry[*entityv1.User]{value: userClone(user), expiresAt: time.Now().Add(e.userTTL)}
+		e.usernamesByUserID[user.UserId] = login
+	}
+	return user, nil
+}
+
+func (e *CacheStorage) ShardByShardID(ctx context.Context, shardID int32) (*entityv1.Shard, error) {
+	if e.shardTTL == 0 {
+		return e.next.ShardByShardID(ctx, shardID)
+	}
+
+	e.mux.Lock()
+	cached, ok := e.shardsByShardID[shardID]
+	generation := e.generation
+	e.mux.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		e.shardByShardIDStats.hits.Add(1)
+		return shardClone(cached.value), nil
+	}
+	e.shardByShardIDStats.misses.Add(1)
+
+	shard, err := e.next.ShardByShardID(ctx, shardID)
+	if err != nil || shard == nil {
+		return shard, err
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.generation == generation {
+		e.shardsByShardID[shardID] = entry[*entityv1.Shard]{value: shardClone(shard), expiresAt: time.Now().Add(e.shardTTL)}
+	}
+	return shard, nil
+}
+
+func (e *CacheStorage) ShardsByClientApplication(ctx context.Context, clientApp string) ([]*entityv1.Shard, error) {
+	if e.shardTTL == 0 {
+		return e.next.ShardsByClientApplication(ctx, clientApp)
+	}
+
+	e.mux.Lock()
+	cached, ok := e.shardsByClientApp[clientApp]
+	generation := e.generation
+	e.mux.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		e.shardsByClientStats.hits.Add(1)
+		return shardsClone(cached.value), nil
+	}
+	e.shardsByClientStats.misses.Add(1)
+
+	shards, err := e.next.ShardsByClientApplication(ctx, clientApp)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.generation == generation {
+		e.shardsByClientApp[clientApp] = entry[[]*entityv1.Shard]{value: shardsClone(shards), expiresAt: time.Now().Add(e.shardTTL)}
+	}
+	return shards, nil
+}
+
+// userInvalidate drops the cached user with userID and any user cached under
+// username, which may be its new name.
+func (e *CacheStorage) userInvalidate(userID int32, username string) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.generation++
+	if login, ok := e.usernamesByUserID[userID]; ok {
+		delete(e.usersByLogin, login)
+		delete(e.usernamesByUserID, userID)
+	}
+	if cached, ok := e.usersByLogin[username]; ok {
+		delete(e.usersByLogin, username)
+		delete(e.usernamesByUserID, cached.value.UserId)
+	}
+}
+
+// shardInvalidate drops the cached shard with shardID and every cached shard
+// list, as the shard may have left or joined any of them.
+func (e *CacheStorage) shardInvalidate(shardID int32) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.generation++
+	delete(e.shardsByShardID, shardID)
+	clear(e.shardsByClientApp)
+}
+
+// shardUpdated stores shard, as just written, in the cached entry and lists
+// that hold it. Shards heartbeat often, and dropping every list each time
+// would leave little cached. Only the lists the shard left or joined by
+// changing its client application are dropped.
+func (e *CacheStorage) shardUpdated(shard *entityv1.Shard) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.generation++
+	if cached, ok := e.shardsByShardID[shard.ShardId]; ok {
+		cached.value = shardClone(shard)
+		e.shardsByShardID[shard.ShardId] = cached
+	}
+	isListed := false
+	for clientApp, cached := range e.shardsByClientApp {
+		i := slices.IndexFunc(cached.value, func(listed *entityv1.Shard) bool {
+			return listed.ShardId == shard.ShardId
+		})
+		if i < 0 {
+			continue
+		}
+		if clientApp != shard.ClientApp {
+			delete(e.shardsByClientApp, clientApp)
+			continue
+		}
+		// Lookups clone the cached list after unlocking, so it is replaced
+		// rather than changed.
+		cached.value = slices.Clone(cached.value)
+		cached.value[i] = shardClone(shard)
+		e.shardsByClientApp[clientApp] = cached
+		isListed = true
+	}
+	if !isListed {
+		delete(e.shardsByClientApp, shard.ClientApp)
+	}
+}
+
+// usersSweepLocked drops the expired users, or every user if none expired.
+func (e *CacheStorage) usersSweepLocked() {
+	now := time.Now()
+	for login, cached := range e.usersByLogin {
+		if now.After(cached.expiresAt) {
+			delete(e.usersByLogin, login)
+			delete(e.usernamesByUserID, cached.value.UserId)
+		}
+	}
+	if len(e.usersByLogin) >= userEntriesMax {
+		clear(e.usersByLogin)
+		clear(e.usernamesByUserID)
+	}
+}
+
+func userClone(user *entityv1.User) *entityv1.User {
+	return proto.Clone(user).(*entityv1.User)
+}
+
+func shardClone(shard *entityv1.Shard) *entityv1.Shard {
+	return proto.Clone(shard).(*entityv1.Shard)
+}
+
+func shardsClone(shards []*entityv1.Shard) []*entityv1.Shard {
+	var clones []*entityv1.Shard
+	for _, shard := range shards {
+		clones = append(clones, shardClone(shard))
+	}
+	return clones
+}
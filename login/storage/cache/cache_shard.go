@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+func (e *CacheStorage) Shards(ctx context.Context) ([]*entityv1.Shard, error) {
+	return e.next.Shards(ctx)
+}
+
+func (e *CacheStorage) ShardList(ctx context.Context, filter storage.ShardListFilter, page storage.Page) ([]*entityv1.Shard, string, error) {
+	return e.next.ShardList(ctx, filter, page)
+}
+
+func (e *CacheStorage) ShardByWSAddr(ctx context.Context, wsAddr string) (*entityv1.Shard, error) {
+	return e.next.ShardByWSAddr(ctx, wsAddr)
+}
+
+func (e *CacheStorage) ShardCreate(ctx context.Context, shard *entityv1.Shard) (*entityv1.Shard, error) {
+	created, err := e.next.ShardCreate(ctx, shard)
+	e.shardInvalidate(shard.ShardId)
+	return created, err
+}
+
+func (e *CacheStorage) ShardUpdate(ctx context.Context, shard *entityv1.Shard) error {
+	err := e.next.ShardUpdate(ctx, shard)
+	if err != nil {
+		e.shardInvalidate(shard.ShardId)
+		return err
+	}
+	e.shardUpdated(shard)
+	return nil
+}
+
+func (e *CacheStorage) ShardUpdateIf(ctx context.Context, shard *entityv1.Shard, expectedRevision int64) error {
+	err := e.next.ShardUpdateIf(ctx, shard, expectedRevision)
+	if err != nil {
+		e.shardInvalidate(shard.ShardId)
+		return err
+	}
+	e.shardUpdated(shard)
+	return nil
+}
+
+func (e *CacheStorage) ShardDelete(ctx context.Context, shardID int32) error {
+	err := e.next.ShardDelete(ctx, shardID)
+	e.shardInvalidate(shardID)
+	return err
+}
@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	"github.com/runeharvest/gserver/login/storage/memory"
+	"github.com/runeharvest/gserver/login/storage/storagetest"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+func newTestCacheStorage(t *testing.T, userTTL time.Duration, shardTTL time.Duration) (*CacheStorage, *memory.MemoryStorage) {
+	t.Helper()
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	cacheStorage, err := NewCacheStorage(memoryStorage, userTTL, shardTTL)
+	if err != nil {
+		t.Fatal("new cache storage:", err)
+	}
+	return cacheStorage, memoryStorage
+}
+
+func TestCacheUserByLogin(t *testing.T) {
+	ctx := context.Background()
+	cacheStorage, memoryStorage := newTestCacheStorage(t, time.Hour, time.Hour)
+
+	user, err := cacheStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	for range 3 {
+		got, err := cacheStorage.UserByLogin(ctx, "testuser")
+		if err != nil || got == nil || got.UserId != user.UserId {
+			t.Fatal("user by login:", got, err)
+		}
+		// Callers own what they get back.
+		got.Username = "changed"
+	}
+	stats := cacheStorage.Stats().UserByLogin
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatal("user by login stats:", stats)
+	}
+
+	// Writes through the cache are read back at once.
+	user.State = entityv1.UserState_ONLINE
+	err = cacheStorage.UserUpdateIf(ctx, user, 1)
+	if err != nil {
+		t.Fatal("user update if:", err)
+	}
+	got, err := cacheStorage.UserByLogin(ctx, "testuser")
+	if err != nil || got.State != entityv1.UserState_ONLINE || got.Revision != 2 {
+		t.Fatal("user by login after update:", got, err)
+	}
+
+	// Renaming drops the old name too.
+	user.Username = "renamed"
+	err = cacheStorage.UserUpdate(ctx, user)
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+	got, err = cacheStorage.UserByLogin(ctx, "testuser")
+	if err != nil || got != nil {
+		t.Fatal("user by old login after rename:", got, err)
+	}
+	got, err = cacheStorage.UserByLogin(ctx, "renamed")
+	if err != nil || got == nil {
+		t.Fatal("user by new login after rename:", got, err)
+	}
+
+	// Writes that bypass the cache are not seen until the TTL expires.
+	err = memoryStorage.UserDelete(ctx, user.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	got, err = cacheStorage.UserByLogin(ctx, "renamed")
+	if err != nil || got == nil {
+		t.Fatal("user by login after delete behind the cache:", got, err)
+	}
+}
+
+func TestCacheUserTTL(t *testing.T) {
+	ctx := context.Background()
+	cacheStorage, memoryStorage := newTestCacheStorage(t, 10*time.Millisecond, 0)
+
+	user, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	_, err = cacheStorage.UserByLogin(ctx, "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	err = memoryStorage.UserDelete(ctx, user.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = cacheStorage.UserByLogin(ctx, "testuser")
+	if !errors.Is(err, storage.ErrDeleted) {
+		t.Fatal("user by login after ttl: expected ErrDeleted, got", err)
+	}
+	stats := cacheStorage.Stats().UserByLogin
+	if stats.Hits != 0 || stats.Misses != 2 {
+		t.Fatal("user by login stats:", stats)
+	}
+}
+
+func TestCacheShards(t *testing.T) {
+	ctx := context.Background()
+	cacheStorage, _ := newTestCacheStorage(t, time.Hour, time.Hour)
+
+	shard, err := cacheStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, ClientApp: "ryzom"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	for range 2 {
+		shards, err := cacheStorage.ShardsByClientApplication(ctx, "ryzom")
+		if err != nil || len(shards) != 1 {
+			t.Fatal("shards by client application:", shards, err)
+		}
+		got, err := cacheStorage.ShardByShardID(ctx, 101)
+		if err != nil || got == nil {
+			t.Fatal("shard by shard id:", got, err)
+		}
+	}
+	stats := cacheStorage.Stats()
+	if stats.ShardsByClientApplication.Hits != 1 || stats.ShardByShardID.Hits != 1 {
+		t.Fatal("shard stats:", stats)
+	}
+
+	// Moving the shard to another client application inside a unit of work
+	// drops every list once it commits.
+	err = cacheStorage.WithTx(ctx, func(tx storage.Storager) error {
+		shard.ClientApp = "other"
+		return tx.ShardUpdate(ctx, shard)
+	})
+	if err != nil {
+		t.Fatal("with tx:", err)
+	}
+	shards, err := cacheStorage.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil || len(shards) != 0 {
+		t.Fatal("shards by old client application:", shards, err)
+	}
+	got, err := cacheStorage.ShardByShardID(ctx, 101)
+	if err != nil || got.ClientApp != "other" {
+		t.Fatal("shard by shard id after update:", got, err)
+	}
+}
+
+func TestCacheShardUpdateInPlace(t *testing.T) {
+	ctx := context.Background()
+	cacheStorage, _ := newTestCacheStorage(t, time.Hour, time.Hour)
+
+	shard, err := cacheStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, ClientApp: "ryzom", IsOnline: true})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	_, err = cacheStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 102, ClientApp: "other"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	for _, clientApp := range []string{"ryzom", "other"} {
+		_, err = cacheStorage.ShardsByClientApplication(ctx, clientApp)
+		if err != nil {
+			t.Fatal("shards by client application:", err)
+		}
+	}
+
+	// Heartbeats update the cached lists instead of dropping them.
+	for playerCount := range int32(3) {
+		shard.PlayerCount = playerCount
+		err = cacheStorage.ShardUpdate(ctx, shard)
+		if err != nil {
+			t.Fatal("shard update:", err)
+		}
+		shards, err := cacheStorage.ShardsByClientApplication(ctx, "ryzom")
+		if err != nil || len(shards) != 1 || shards[0].PlayerCount != playerCount || shards[0].Revision != shard.Revision {
+			t.Fatal("shards by client application after update:", shards, err)
+		}
+	}
+	stats := cacheStorage.Stats()
+	if stats.ShardsByClientApplication.Hits != 3 || stats.ShardsByClientApplication.Misses != 2 {
+		t.Fatal("shard list stats:", stats)
+	}
+
+	// Moving the shard drops the lists it left and joined only.
+	shard.ClientApp = "other"
+	err = cacheStorage.ShardUpdateIf(ctx, shard, shard.Revision)
+	if err != nil {
+		t.Fatal("shard update if:", err)
+	}
+	shards, err := cacheStorage.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil || len(shards) != 0 {
+		t.Fatal("shards by old client application:", shards, err)
+	}
+	shards, err = cacheStorage.ShardsByClientApplication(ctx, "other")
+	if err != nil || len(shards) != 2 {
+		t.Fatal("shards by new client application:", shards, err)
+	}
+	stats = cacheStorage.Stats()
+	if stats.ShardsByClientApplication.Misses != 4 {
+		t.Fatal("shard list stats after move:", stats)
+	}
+}
+
+func TestCacheShardUpdateConcurrent(t *testing.T) {
+	ctx := context.Background()
+	cacheStorage, _ := newTestCacheStorage(t, time.Hour, time.Hour)
+
+	shard, err := cacheStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, ClientApp: "ryzom"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for playerCount := range int32(200) {
+			shard.PlayerCount = playerCount
+			err := cacheStorage.ShardUpdate(ctx, shard)
+			if err != nil {
+				t.Error("shard update:", err)
+				return
+			}
+		}
+	}()
+	for range 200 {
+		shards, err := cacheStorage.ShardsByClientApplication(ctx, "ryzom")
+		if err != nil || len(shards) != 1 {
+			t.Fatal("shards by client application:", shards, err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestCacheStorager(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		cacheStorage, _ := newTestCacheStorage(t, time.Hour, time.Hour)
+		return cacheStorage
+	})
+}
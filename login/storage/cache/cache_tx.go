@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+// cacheTx is the Storager handed to WithTx functions. Its reads bypass the
+// cache, so fn sees its own writes; its writes are remembered and applied to
+// or dropped from the cache once the unit of work is over.
+type cacheTx struct {
+	storage.Storager
+	e        *CacheStorage
+	userIDs  map[int32]string
+	shardIDs []int32
+	// shardsUpdated holds the shards updated successfully, in order.
+	shardsUpdated []*entityv1.Shard
+}
+
+// WithTx drops what fn wrote from the cache after next's WithTx returns,
+// whether it committed or not. Shard updates that committed are stored in
+// the cache instead, see shardUpdated.
+func (e *CacheStorage) WithTx(ctx context.Context, fn func(tx storage.Storager) error) (err error) {
+	t := &cacheTx{e: e, userIDs: make(map[int32]string)}
+	defer func() {
+		for userID, username := range t.userIDs {
+			e.userInvalidate(userID, username)
+		}
+		for _, shard := range t.shardsUpdated {
+			if err != nil {
+				e.shardInvalidate(shard.ShardId)
+				continue
+			}
+			e.shardUpdated(shard)
+		}
+		// After the updates, which a later create or delete supersedes.
+		for _, shardID := range t.shardIDs {
+			e.shardInvalidate(shardID)
+		}
+	}()
+	return e.next.WithTx(ctx, func(tx storage.Storager) error {
+		t.Storager = tx
+		return fn(t)
+	})
+}
+
+func (t *cacheTx) WithTx(ctx context.Context, fn func(tx storage.Storager) error) error {
+	return fn(t)
+}
+
+func (t *cacheTx) UserUpdate(ctx context.Context, user *entityv1.User) error {
+	t.userIDs[user.UserId] = user.Username
+	return t.Storager.UserUpdate(ctx, user)
+}
+
+func (t *cacheTx) UserUpdateIf(ctx context.Context, user *entityv1.User, expectedRevision int64) error {
+	t.userIDs[user.UserId] = user.Username
+	return t.Storager.UserUpdateIf(ctx, user, expectedRevision)
+}
+
+func (t *cacheTx) UserDelete(ctx context.Context, userID int32) error {
+	t.userIDs[userID] = ""
+	return t.Storager.UserDelete(ctx, userID)
+}
+
+func (t *cacheTx) ShardCreate(ctx context.Context, shard *entityv1.Shard) (*entityv1.Shard, error) {
+	t.shardIDs = append(t.shardIDs, shard.ShardId)
+	return t.Storager.ShardCreate(ctx, shard)
+}
+
+func (t *cacheTx) ShardUpdate(ctx context.Context, shard *entityv1.Shard) error {
+	err := t.Storager.ShardUpdate(ctx, shard)
+	t.shardUpdatedPush(shard, err)
+	return err
+}
+
+func (t *cacheTx) ShardUpdateIf(ctx context.Context, shard *entityv1.Shard, expectedRevision int64) error {
+	err := t.Storager.ShardUpdateIf(ctx, shard, expectedRevision)
+	t.shardUpdatedPush(shard, err)
+	return err
+}
+
+// shardUpdatedPush remembers the outcome of a shard update.
+func (t *cacheTx) shardUpdatedPush(shard *entityv1.Shard, err error) {
+	if err != nil {
+		t.shardIDs = append(t.shardIDs, shard.ShardId)
+		return
+	}
+	t.shardsUpdated = append(t.shardsUpdated, shardClone(shard))
+}
+
+func (t *cacheTx) ShardDelete(ctx context.Context, shardID int32) error {
+	t.shardIDs = append(t.shardIDs, shardID)
+	return t.Storager.ShardDelete(ctx, shardID)
+}
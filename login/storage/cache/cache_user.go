@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+func (e *CacheStorage) Users(ctx context.Context) ([]*entityv1.User, error) {
+	return e.next.Users(ctx)
+}
+
+func (e *CacheStorage) UserList(ctx context.Context, filter storage.UserListFilter, page storage.Page) ([]*entityv1.User, string, error) {
+	return e.next.UserList(ctx, filter, page)
+}
+
+func (e *CacheStorage) UserByUserID(ctx context.Context, userID int32) (*entityv1.User, error) {
+	return e.next.UserByUserID(ctx, userID)
+}
+
+func (e *CacheStorage) UsersByState(ctx context.Context, state entityv1.UserState) ([]*entityv1.User, error) {
+	return e.next.UsersByState(ctx, state)
+}
+
+func (e *CacheStorage) UserByShardID(ctx context.Context, shardID int32) ([]*entityv1.User, error) {
+	return e.next.UserByShardID(ctx, shardID)
+}
+
+func (e *CacheStorage) UserCreate(ctx context.Context, user *entityv1.User) (*entityv1.User, error) {
+	return e.next.UserCreate(ctx, user)
+}
+
+// UserUpdate drops the cached user even if the update fails, as a conflict
+// means the cached copy is stale.
+func (e *CacheStorage) UserUpdate(ctx context.Context, user *entityv1.User) error {
+	err := e.next.UserUpdate(ctx, user)
+	e.userInvalidate(user.UserId, user.Username)
+	return err
+}
+
+func (e *CacheStorage) UserUpdateIf(ctx context.Context, user *entityv1.User, expectedRevision int64) error {
+	err := e.next.UserUpdateIf(ctx, user, expectedRevision)
+	e.userInvalidate(user.UserId, user.Username)
+	return err
+}
+
+func (e *CacheStorage) UserDelete(ctx context.Context, userID int32) error {
+	err := e.next.UserDelete(ctx, userID)
+	e.userInvalidate(userID, "")
+	return err
+}
+
+// Purge only removes deleted users and shards, which are never cached.
+func (e *CacheStorage) Purge(ctx context.Context, before time.Time) (int, error) {
+	return e.next.Purge(ctx, before)
+}
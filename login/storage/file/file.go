@@ -0,0 +1,551 @@
+// Package file implements storage.Storager as an append-only log file, for
+// single node deployments that need persistence without a database server.
+//
+// Every create, update or delete appends one record holding the whole user or
+// shard and is synced to disk before it is applied in memory. On open the log
+// is replayed; a torn tail left by a crash is truncated away, while damage
+// before it fails the open and leaves the log for an operator to look at. Once
+// the log holds many more records than live entities it is compacted by
+// writing a fresh log next to it and renaming it into place.
+//
+// Only one process may use a data directory at a time; NewFileStorage takes
+// an exclusive lock on it.
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	logName     = "login.log"
+	logTempName = "login.log.tmp"
+	lockName    = "LOCK"
+	logMagic    = "RHLOG001"
+
+	recordUser  byte = 1
+	recordShard byte = 2
+	// recordBatch holds the records of one WithTx, applied all or nothing.
+	recordBatch byte = 3
+	// recordUserPurge and recordShardPurge drop a deleted user or shard. A
+	// deletion itself is a recordUser or recordShard with DeletedAt set.
+	recordUserPurge  byte = 4
+	recordShardPurge byte = 5
+	// recordUserIDHigh holds a user with only UserId set: the highest id
+	// ever allocated. Compaction drops purged users, and their ids must not
+	// be handed out again.
+	recordUserIDHigh byte = 6
+
+	// recordHeaderSize is the length and CRC-32C of the record body.
+	recordHeaderSize = 8
+	// recordMaxSize guards replay against allocating for a garbage length.
+	recordMaxSize = 16 << 20
+
+	// The log is compacted once it holds compactMinRecords records and
+	// compactRatio times more records than live users and shards.
+	compactMinRecords = 1024
+	compactRatio      = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileStorage keeps every user and shard in memory and persists them to the
+// log. Entities are copied on the way in and out, so callers may change what
+// they get back without affecting the store.
+type FileStorage struct {
+	mux        sync.RWMutex
+	dir        string
+	lock       *os.File
+	log        *os.File
+	records    int
+	shards     map[int32]*entityv1.Shard
+	users      map[int32]*entityv1.User
+	lastUserID int32
+
+	// While isInTx, records are collected in batch instead of appended and
+	// undo reverts the in-memory writes in reverse order.
+	isInTx bool
+	batch  bytes.Buffer
+	undo   []func()
+}
+
+// NewFileStorage opens or creates the log in dir and replays it.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+
+	e := &FileStorage{
+		dir:    dir,
+		shards: make(map[int32]*entityv1.Shard),
+		users:  make(map[int32]*entityv1.User),
+	}
+
+	e.lock, err = dirLock(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// A temp log is a compaction that did not finish; the old log is intact.
+	err = os.Remove(filepath.Join(dir, logTempName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		e.lock.Close()
+		return nil, fmt.Errorf("remove temp log: %w", err)
+	}
+
+	e.log, err = os.OpenFile(filepath.Join(dir, logName), os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		e.lock.Close()
+		return nil, fmt.Errorf("open log: %w", err)
+	}
+	err = e.replay()
+	if err != nil {
+		e.log.Close()
+		e.lock.Close()
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	return e, nil
+}
+
+// Close closes the log and releases the data directory. The storage must not
+// be used afterwards.
+func (e *FileStorage) Close() error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	err := e.log.Close()
+	// Closing the lock file releases the lock.
+	return errors.Join(err, e.lock.Close())
+}
+
+// Compact rewrites the log with a single record per live user and shard.
+func (e *FileStorage) Compact(ctx context.Context) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.compact()
+}
+
+// Snapshot writes a compacted log of the current state to w. The output has
+// the same format as the log file, so a snapshot saved as login.log in an
+// empty directory restores it.
+func (e *FileStorage) Snapshot(ctx context.Context, w io.Writer) error {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	_, err := e.writeAll(bw)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// replay reads the log from the start, applying every record. A damaged
+// record followed by nothing but zeros is the torn tail of an interrupted
+// append and is truncated; any other damage, and records replay cannot
+// apply, fail it without changing the log.
+func (e *FileStorage) replay() error {
+	info, err := e.log.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	if info.Size() == 0 {
+		_, err = e.log.Write([]byte(logMagic))
+		if err != nil {
+			return fmt.Errorf("write magic: %w", err)
+		}
+		return e.log.Sync()
+	}
+
+	r := bufio.NewReader(e.log)
+	magic := make([]byte, len(logMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != logMagic {
+		return fmt.Errorf("%s is not a login log", e.log.Name())
+	}
+
+	offset := int64(len(logMagic))
+	for {
+		kind, payload, err := recordRead(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			isTorn, zeroErr := readerIsZero(r)
+			if zeroErr != nil {
+				return fmt.Errorf("read: %w", zeroErr)
+			}
+			if !isTorn {
+				return fmt.Errorf("record at offset %d: %w", offset, err)
+			}
+			slog.Warn("Truncating torn tail of login log", "path", e.log.Name(), "offset", offset, "error", err)
+			err = e.log.Truncate(offset)
+			if err != nil {
+				return fmt.Errorf("truncate: %w", err)
+			}
+			err = e.log.Sync()
+			if err != nil {
+				return fmt.Errorf("sync: %w", err)
+			}
+			break
+		}
+		err = e.apply(kind, payload)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		offset += recordHeaderSize + 1 + int64(len(payload))
+		e.records++
+	}
+
+	_, err = e.log.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	return nil
+}
+
+// readerIsZero reports whether r holds nothing but zero bytes up to EOF, as
+// a file extended by a crash before its data reached the disk does.
+func readerIsZero(r io.Reader) (bool, error) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// apply applies the record, or nothing of it if it cannot be decoded.
+func (e *FileStorage) apply(kind byte, payload []byte) error {
+	change, err := e.recordDecode(kind, payload)
+	if err != nil {
+		return err
+	}
+	change()
+	return nil
+}
+
+// recordDecode decodes the record into the change it makes to the store.
+// Decoding a batch decodes every record of it, so that a damaged batch
+// changes nothing.
+func (e *FileStorage) recordDecode(kind byte, payload []byte) (func(), error) {
+	switch kind {
+	case recordBatch:
+		var changes []func()
+		r := bytes.NewReader(payload)
+		for {
+			kind, payload, err := recordRead(r)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("batch: %w", err)
+			}
+			if kind == recordBatch {
+				return nil, fmt.Errorf("batch: nested batch")
+			}
+			change, err := e.recordDecode(kind, payload)
+			if err != nil {
+				return nil, fmt.Errorf("batch: %w", err)
+			}
+			changes = append(changes, change)
+		}
+		return func() {
+			for _, change := range changes {
+				change()
+			}
+		}, nil
+	case recordUser:
+		user := &entityv1.User{}
+		err := proto.Unmarshal(payload, user)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal user: %w", err)
+		}
+		return func() {
+			e.users[user.UserId] = user
+			e.lastUserID = max(e.lastUserID, user.UserId)
+		}, nil
+	case recordShard:
+		shard := &entityv1.Shard{}
+		err := proto.Unmarshal(payload, shard)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal shard: %w", err)
+		}
+		return func() { e.shards[shard.ShardId] = shard }, nil
+	case recordUserPurge:
+		user := &entityv1.User{}
+		err := proto.Unmarshal(payload, user)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal user: %w", err)
+		}
+		return func() { delete(e.users, user.UserId) }, nil
+	case recordShardPurge:
+		shard := &entityv1.Shard{}
+		err := proto.Unmarshal(payload, shard)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal shard: %w", err)
+		}
+		return func() { delete(e.shards, shard.ShardId) }, nil
+	case recordUserIDHigh:
+		user := &entityv1.User{}
+		err := proto.Unmarshal(payload, user)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal user id high: %w", err)
+		}
+		return func() { e.lastUserID = max(e.lastUserID, user.UserId) }, nil
+	}
+	return nil, fmt.Errorf("unknown record kind %d", kind)
+}
+
+func (e *FileStorage) Purge(ctx context.Context, before time.Time) (int, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.purgeLocked(before)
+}
+
+func (e *FileStorage) purgeLocked(before time.Time) (int, error) {
+	purged := 0
+	for userID, user := range e.users {
+		if user.DeletedAt == 0 || user.DeletedAt >= before.UnixMilli() {
+			continue
+		}
+		err := e.record(recordUserPurge, &entityv1.User{UserId: userID})
+		if err != nil {
+			return purged, err
+		}
+		delete(e.users, userID)
+		e.undoPush(func() { e.users[userID] = user })
+		purged++
+	}
+	for shardID, shard := range e.shards {
+		if shard.DeletedAt == 0 || shard.DeletedAt >= before.UnixMilli() {
+			continue
+		}
+		err := e.record(recordShardPurge, &entityv1.Shard{ShardId: shardID})
+		if err != nil {
+			return purged, err
+		}
+		delete(e.shards, shardID)
+		e.undoPush(func() { e.shards[shardID] = shard })
+		purged++
+	}
+	e.compactIfNeeded()
+	return purged, nil
+}
+
+// record logs msg: appended to the log, or to the batch while in WithTx. The
+// caller holds the write lock and applies the change in memory only if record
+// succeeds.
+func (e *FileStorage) record(kind byte, msg proto.Message) error {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if e.isInTx {
+		return recordWrite(&e.batch, kind, payload)
+	}
+	return e.append(kind, payload)
+}
+
+// undoPush records how to revert an in-memory write, if WithTx is running.
+func (e *FileStorage) undoPush(undo func()) {
+	if e.isInTx {
+		e.undo = append(e.undo, undo)
+	}
+}
+
+// append durably writes one record to the log.
+func (e *FileStorage) append(kind byte, payload []byte) error {
+	offset, err := e.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+
+	err = recordWrite(e.log, kind, payload)
+	if err == nil {
+		err = e.log.Sync()
+	}
+	if err != nil {
+		// Drop the partial record so the next append does not land after it.
+		truncateErr := e.log.Truncate(offset)
+		if truncateErr == nil {
+			_, truncateErr = e.log.Seek(offset, io.SeekStart)
+		}
+		return errors.Join(fmt.Errorf("append: %w", err), truncateErr)
+	}
+	e.records++
+	return nil
+}
+
+// compactIfNeeded compacts once superseded records dominate the log. The
+// record that triggered it is already durable, so failures are only logged.
+func (e *FileStorage) compactIfNeeded() {
+	if e.isInTx {
+		// The maps hold writes that are not committed yet.
+		return
+	}
+	live := len(e.users) + len(e.shards)
+	if e.records < compactMinRecords || e.records < compactRatio*live {
+		return
+	}
+	err := e.compact()
+	if err != nil {
+		slog.Warn("Login log compaction failed", "path", e.log.Name(), "error", err)
+	}
+}
+
+func (e *FileStorage) compact() error {
+	tempPath := filepath.Join(e.dir, logTempName)
+	temp, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("create temp log: %w", err)
+	}
+	defer os.Remove(tempPath)
+
+	bw := bufio.NewWriter(temp)
+	records, err := e.writeAll(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if err != nil {
+		temp.Close()
+		return fmt.Errorf("write temp log: %w", err)
+	}
+
+	err = os.Rename(tempPath, filepath.Join(e.dir, logName))
+	if err != nil {
+		temp.Close()
+		return fmt.Errorf("rename: %w", err)
+	}
+	err = dirSync(e.dir)
+	if err != nil {
+		slog.Warn("Login log directory sync failed", "dir", e.dir, "error", err)
+	}
+
+	e.log.Close()
+	e.log = temp
+	e.records = records
+	return nil
+}
+
+// writeAll writes the magic, the user id high-water mark and one record per
+// user and shard to w.
+func (e *FileStorage) writeAll(w io.Writer) (int, error) {
+	_, err := io.WriteString(w, logMagic)
+	if err != nil {
+		return 0, fmt.Errorf("write magic: %w", err)
+	}
+
+	payload, err := proto.Marshal(&entityv1.User{UserId: e.lastUserID})
+	if err != nil {
+		return 0, fmt.Errorf("marshal user id high: %w", err)
+	}
+	err = recordWrite(w, recordUserIDHigh, payload)
+	if err != nil {
+		return 0, err
+	}
+	records := 1
+	for _, user := range e.users {
+		payload, err := proto.Marshal(user)
+		if err != nil {
+			return 0, fmt.Errorf("marshal user %d: %w", user.UserId, err)
+		}
+		err = recordWrite(w, recordUser, payload)
+		if err != nil {
+			return 0, err
+		}
+		records++
+	}
+	for _, shard := range e.shards {
+		payload, err := proto.Marshal(shard)
+		if err != nil {
+			return 0, fmt.Errorf("marshal shard %d: %w", shard.ShardId, err)
+		}
+		err = recordWrite(w, recordShard, payload)
+		if err != nil {
+			return 0, err
+		}
+		records++
+	}
+	return records, nil
+}
+
+// recordWrite writes a record as its body length, the CRC-32C of the body,
+// and the body: the record kind followed by the marshaled entity.
+func recordWrite(w io.Writer, kind byte, payload []byte) error {
+	record := make([]byte, recordHeaderSize+1+len(payload))
+	record[recordHeaderSize] = kind
+	copy(record[recordHeaderSize+1:], payload)
+	body := record[recordHeaderSize:]
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(body, crcTable))
+
+	_, err := w.Write(record)
+	if err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
+	return nil
+}
+
+// recordRead reads the next record. It returns io.EOF only at a clean record
+// boundary; a partial or damaged record is an error.
+func recordRead(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if errors.Is(err, io.EOF) && n == 0 {
+		return 0, nil, io.EOF
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("read record header: %w", io.ErrUnexpectedEOF)
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size == 0 || size > recordMaxSize {
+		return 0, nil, fmt.Errorf("invalid record size %d", size)
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("read record body: %w", io.ErrUnexpectedEOF)
+	}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, nil, fmt.Errorf("record checksum mismatch")
+	}
+	return body[0], body[1:], nil
+}
+
+// dirSync makes a rename in dir durable.
+func dirSync(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dirLock only creates the lock file; only unix systems lock it.
+func dirLock(dir string) (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open lock: %w", err)
+	}
+	return lock, nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package file
+
+import "testing"
+
+func TestFileDirLock(t *testing.T) {
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	_, err := NewFileStorage(dir)
+	if err == nil {
+		t.Fatal("second file storage on a locked directory succeeded")
+	}
+
+	fileStorage.Close()
+	newTestFileStorage(t, dir)
+}
@@ -0,0 +1,192 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func (e *FileStorage) Shards(ctx context.Context) ([]*entityv1.Shard, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.shardsLocked(), nil
+}
+
+func (e *FileStorage) ShardList(ctx context.Context, filter storage.ShardListFilter, page storage.Page) ([]*entityv1.Shard, string, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.shardListLocked(filter, page)
+}
+
+func (e *FileStorage) ShardByShardID(ctx context.Context, shardID int32) (*entityv1.Shard, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.shardByShardIDLocked(shardID), nil
+}
+
+func (e *FileStorage) ShardByWSAddr(ctx context.Context, wsAddr string) (*entityv1.Shard, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.shardByWSAddrLocked(wsAddr), nil
+}
+
+func (e *FileStorage) ShardCreate(ctx context.Context, shard *entityv1.Shard) (*entityv1.Shard, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.shardCreateLocked(shard)
+}
+
+func (e *FileStorage) ShardUpdate(ctx context.Context, shard *entityv1.Shard) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.shardUpdateLocked(shard, nil)
+}
+
+func (e *FileStorage) ShardUpdateIf(ctx context.Context, shard *entityv1.Shard, expectedRevision int64) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.shardUpdateLocked(shard, &expectedRevision)
+}
+
+func (e *FileStorage) ShardsByClientApplication(ctx context.Context, clientApp string) ([]*entityv1.Shard, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.shardsByClientApplicationLocked(clientApp), nil
+}
+
+func (e *FileStorage) ShardDelete(ctx context.Context, shardID int32) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.shardDeleteLocked(shardID)
+}
+
+func (e *FileStorage) shardsLocked() []*entityv1.Shard {
+	var shards []*entityv1.Shard
+	for _, shardID := range slices.Sorted(maps.Keys(e.shards)) {
+		shard := e.shards[shardID]
+		if shard.DeletedAt != 0 {
+			continue
+		}
+		shards = append(shards, proto.Clone(shard).(*entityv1.Shard))
+	}
+	return shards
+}
+
+func (e *FileStorage) shardListLocked(filter storage.ShardListFilter, page storage.Page) ([]*entityv1.Shard, string, error) {
+	after, err := storage.CursorDecode(page.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	var shards []*entityv1.Shard
+	for _, shardID := range slices.Sorted(maps.Keys(e.shards)) {
+		shard := e.shards[shardID]
+		if shardID <= after || shard.DeletedAt != 0 || !filter.Match(shard) {
+			continue
+		}
+		if len(shards) == page.Size() {
+			return shards, storage.CursorEncode(shards[len(shards)-1].ShardId), nil
+		}
+		shards = append(shards, proto.Clone(shard).(*entityv1.Shard))
+	}
+	return shards, "", nil
+}
+
+func (e *FileStorage) shardByShardIDLocked(shardID int32) *entityv1.Shard {
+	if shard, ok := e.shards[shardID]; ok && shard.DeletedAt == 0 {
+		return proto.Clone(shard).(*entityv1.Shard)
+	}
+	return nil
+}
+
+func (e *FileStorage) shardByWSAddrLocked(wsAddr string) *entityv1.Shard {
+	for _, shard := range e.shards {
+		if shard.WsAddr == wsAddr && shard.DeletedAt == 0 {
+			return proto.Clone(shard).(*entityv1.Shard)
+		}
+	}
+	return nil
+}
+
+func (e *FileStorage) shardCreateLocked(shard *entityv1.Shard) (*entityv1.Shard, error) {
+	// A new shard may reuse the id of a deleted one.
+	if previous, ok := e.shards[shard.ShardId]; ok && previous.DeletedAt == 0 {
+		return nil, fmt.Errorf("shard %d: %w", shard.ShardId, storage.ErrShardExists)
+	}
+	stored := proto.Clone(shard).(*entityv1.Shard)
+	stored.Revision = 1
+	err := e.record(recordShard, stored)
+	if err != nil {
+		return nil, err
+	}
+	previous, ok := e.shards[stored.ShardId]
+	e.shards[stored.ShardId] = stored
+	e.undoPush(func() {
+		if ok {
+			e.shards[previous.ShardId] = previous
+			return
+		}
+		delete(e.shards, stored.ShardId)
+	})
+	e.compactIfNeeded()
+	shard.Revision = stored.Revision
+	return shard, nil
+}
+
+// shardUpdateLocked stores shard, if expectedRevision is set only while the
+// stored revision matches it.
+func (e *FileStorage) shardUpdateLocked(shard *entityv1.Shard, expectedRevision *int64) error {
+	previous, ok := e.shards[shard.ShardId]
+	if !ok || previous.DeletedAt != 0 {
+		return fmt.Errorf("shard %d: %w", shard.ShardId, storage.ErrNotFound)
+	}
+	if expectedRevision != nil && previous.Revision != *expectedRevision {
+		return &storage.ConflictError{Entity: "shard", ID: shard.ShardId, ExpectedRevision: *expectedRevision, ActualRevision: previous.Revision}
+	}
+
+	stored := proto.Clone(shard).(*entityv1.Shard)
+	stored.Revision = previous.Revision + 1
+	err := e.record(recordShard, stored)
+	if err != nil {
+		return err
+	}
+	e.shards[stored.ShardId] = stored
+	e.undoPush(func() { e.shards[previous.ShardId] = previous })
+	e.compactIfNeeded()
+	shard.Revision = stored.Revision
+	return nil
+}
+
+func (e *FileStorage) shardsByClientApplicationLocked(clientApp string) []*entityv1.Shard {
+	var shards []*entityv1.Shard
+	for _, shard := range e.shards {
+		if shard.ClientApp == clientApp && shard.DeletedAt == 0 {
+			shards = append(shards, proto.Clone(shard).(*entityv1.Shard))
+		}
+	}
+	return shards
+}
+
+func (e *FileStorage) shardDeleteLocked(shardID int32) error {
+	previous, ok := e.shards[shardID]
+	if !ok || previous.DeletedAt != 0 {
+		return fmt.Errorf("shard %d: %w", shardID, storage.ErrNotFound)
+	}
+
+	deleted := proto.Clone(previous).(*entityv1.Shard)
+	deleted.Revision++
+	deleted.DeletedAt = time.Now().UnixMilli()
+	err := e.record(recordShard, deleted)
+	if err != nil {
+		return err
+	}
+	e.shards[shardID] = deleted
+	e.undoPush(func() { e.shards[shardID] = previous })
+	e.compactIfNeeded()
+	return nil
+}
@@ -0,0 +1,467 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	"github.com/runeharvest/gserver/login/storage/storagetest"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+func newTestFileStorage(t *testing.T, dir string) *FileStorage {
+	t.Helper()
+	fileStorage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal("new file storage:", err)
+	}
+	t.Cleanup(func() { fileStorage.Close() })
+	return fileStorage
+}
+
+func TestFileUserPersisted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	user, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	_, err = fileStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if !errors.Is(err, storage.ErrUserExists) {
+		t.Fatal("duplicate user create: expected ErrUserExists, got", err)
+	}
+
+	user.State = entityv1.UserState_ONLINE
+	err = fileStorage.UserUpdate(ctx, user)
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+	err = fileStorage.UserUpdate(ctx, &entityv1.User{UserId: 9999})
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("update missing user: expected ErrNotFound, got", err)
+	}
+	_, err = fileStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Atys", ClientApp: "ryzom"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	fileStorage.Close()
+
+	reopened := newTestFileStorage(t, dir)
+	got, err := reopened.UserByLogin(ctx, "testuser")
+	if err != nil || got == nil || got.UserId != user.UserId || got.State != entityv1.UserState_ONLINE || got.Revision != 2 {
+		t.Fatal("user by login after reopen:", got, err)
+	}
+	err = reopened.UserUpdateIf(ctx, got, 1)
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatal("stale user update if: expected ErrConflict, got", err)
+	}
+	shards, err := reopened.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil || len(shards) != 1 {
+		t.Fatal("shards by client application after reopen:", shards, err)
+	}
+
+	// Ids keep increasing after a restart.
+	other, err := reopened.UserCreate(ctx, &entityv1.User{Username: "otheruser"})
+	if err != nil || other.UserId <= user.UserId {
+		t.Fatal("user create after reopen:", other, err)
+	}
+}
+
+func TestFileUserIDNotReused(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	first, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "first"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	last, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "last"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	err = fileStorage.UserDelete(ctx, last.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	_, err = fileStorage.Purge(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal("purge:", err)
+	}
+	// Compaction drops every trace of the purged user.
+	err = fileStorage.Compact(ctx)
+	if err != nil {
+		t.Fatal("compact:", err)
+	}
+	fileStorage.Close()
+
+	reopened := newTestFileStorage(t, dir)
+	user, err := reopened.UserCreate(ctx, &entityv1.User{Username: "new"})
+	if err != nil {
+		t.Fatal("user create after reopen:", err)
+	}
+	if user.UserId <= last.UserId {
+		t.Fatal("purged user id reused:", user.UserId, "first:", first.UserId, "last:", last.UserId)
+	}
+}
+
+func TestFileTornTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	_, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	fileStorage.Close()
+
+	// Simulate a crash in the middle of appending the next record.
+	path := filepath.Join(dir, logName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal("open log:", err)
+	}
+	_, err = f.Write([]byte{0, 0, 0, 42, 1, 2})
+	if err != nil {
+		t.Fatal("write torn record:", err)
+	}
+	f.Close()
+
+	reopened := newTestFileStorage(t, dir)
+	got, err := reopened.UserByLogin(ctx, "testuser")
+	if err != nil || got == nil {
+		t.Fatal("user by login after torn tail:", got, err)
+	}
+	_, err = reopened.UserCreate(ctx, &entityv1.User{Username: "otheruser"})
+	if err != nil {
+		t.Fatal("user create after torn tail:", err)
+	}
+	reopened.Close()
+
+	again := newTestFileStorage(t, dir)
+	users, err := again.Users(ctx)
+	if err != nil || len(users) != 2 {
+		t.Fatal("users after torn tail and reopen:", users, err)
+	}
+}
+
+func TestFileZeroTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	_, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	fileStorage.Close()
+
+	// Simulate a crash after the file grew but before the record reached the disk.
+	path := filepath.Join(dir, logName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal("open log:", err)
+	}
+	_, err = f.Write(make([]byte, 64))
+	if err != nil {
+		t.Fatal("write zero tail:", err)
+	}
+	f.Close()
+
+	reopened := newTestFileStorage(t, dir)
+	got, err := reopened.UserByLogin(ctx, "testuser")
+	if err != nil || got == nil {
+		t.Fatal("user by login after zero tail:", got, err)
+	}
+}
+
+func TestFileCorruptRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	for _, username := range []string{"testuser", "otheruser"} {
+		_, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: username})
+		if err != nil {
+			t.Fatal("user create:", err)
+		}
+	}
+	fileStorage.Close()
+
+	// Flip a byte of the first record, which another record follows.
+	path := filepath.Join(dir, logName)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("read log:", err)
+	}
+	content[len(logMagic)+recordHeaderSize+2] ^= 0xff
+	err = os.WriteFile(path, content, 0o640)
+	if err != nil {
+		t.Fatal("write log:", err)
+	}
+
+	_, err = NewFileStorage(dir)
+	if err == nil {
+		t.Fatal("new file storage with a corrupt record succeeded")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("read log:", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("log changed by a failed replay")
+	}
+}
+
+func TestFileUnknownRecordKind(t *testing.T) {
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+	fileStorage.Close()
+
+	// A record from a newer version is valid, just not understood.
+	path := filepath.Join(dir, logName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal("open log:", err)
+	}
+	err = recordWrite(f, 99, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal("record write:", err)
+	}
+	f.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("stat log:", err)
+	}
+
+	_, err = NewFileStorage(dir)
+	if err == nil {
+		t.Fatal("new file storage with an unknown record kind succeeded")
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("stat log:", err)
+	}
+	if after.Size() != info.Size() {
+		t.Fatal("log truncated by a failed replay:", info.Size(), after.Size())
+	}
+}
+
+func TestFileBatchAllOrNothing(t *testing.T) {
+	fileStorage := newTestFileStorage(t, t.TempDir())
+
+	var batch bytes.Buffer
+	err := recordWrite(&batch, recordUser, []byte{})
+	if err != nil {
+		t.Fatal("record write:", err)
+	}
+	err = recordWrite(&batch, recordShard, []byte{0xff})
+	if err != nil {
+		t.Fatal("record write:", err)
+	}
+
+	fileStorage.mux.Lock()
+	defer fileStorage.mux.Unlock()
+	err = fileStorage.apply(recordBatch, batch.Bytes())
+	if err == nil {
+		t.Fatal("apply of a batch with an undecodable record succeeded")
+	}
+	if len(fileStorage.users) != 0 {
+		t.Fatal("batch partly applied:", fileStorage.users)
+	}
+}
+
+func TestFileCompact(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	shard, err := fileStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Atys"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	// Heartbeats rewrite the same shard over and over.
+	for i := range 3 * compactMinRecords {
+		shard.PlayerCount = int32(i)
+		err = fileStorage.ShardUpdate(ctx, shard)
+		if err != nil {
+			t.Fatal("shard update:", err)
+		}
+	}
+	if fileStorage.records >= compactMinRecords {
+		t.Fatal("log not compacted, records:", fileStorage.records)
+	}
+	fileStorage.Close()
+
+	reopened := newTestFileStorage(t, dir)
+	got, err := reopened.ShardByShardID(ctx, 101)
+	if err != nil || got == nil || got.PlayerCount != 3*compactMinRecords-1 {
+		t.Fatal("shard by shard id after compaction:", got, err)
+	}
+}
+
+func TestFileSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fileStorage := newTestFileStorage(t, t.TempDir())
+
+	user, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Privileges: []string{"GM"}})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	var snapshot bytes.Buffer
+	err = fileStorage.Snapshot(ctx, &snapshot)
+	if err != nil {
+		t.Fatal("snapshot:", err)
+	}
+
+	restoreDir := t.TempDir()
+	err = os.WriteFile(filepath.Join(restoreDir, logName), snapshot.Bytes(), 0o640)
+	if err != nil {
+		t.Fatal("write snapshot:", err)
+	}
+	restored := newTestFileStorage(t, restoreDir)
+	got, err := restored.UserByUserID(ctx, user.UserId)
+	if err != nil || got == nil || got.Username != "testuser" || len(got.Privileges) != 1 {
+		t.Fatal("user by user id from snapshot:", got, err)
+	}
+}
+
+func TestFileWithTx(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	user, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	errFail := errors.New("fail")
+	err = fileStorage.WithTx(ctx, func(tx storage.Storager) error {
+		_, err := tx.UserCreate(ctx, &entityv1.User{Username: "otheruser"})
+		if err != nil {
+			return err
+		}
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatal("rolled back with tx: expected errFail, got", err)
+	}
+	got, err := fileStorage.UserByLogin(ctx, "otheruser")
+	if err != nil || got != nil {
+		t.Fatal("user created in rolled back tx:", got, err)
+	}
+
+	err = fileStorage.WithTx(ctx, func(tx storage.Storager) error {
+		user.State = entityv1.UserState_ONLINE
+		err := tx.UserUpdateIf(ctx, user, 1)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Atys"})
+		return err
+	})
+	if err != nil {
+		t.Fatal("committed with tx:", err)
+	}
+	fileStorage.Close()
+
+	// Only the committed unit of work reaches the log.
+	reopened := newTestFileStorage(t, dir)
+	users, err := reopened.Users(ctx)
+	if err != nil || len(users) != 1 || users[0].State != entityv1.UserState_ONLINE {
+		t.Fatal("users after reopen:", users, err)
+	}
+	shard, err := reopened.ShardByShardID(ctx, 101)
+	if err != nil || shard == nil {
+		t.Fatal("shard by shard id after reopen:", shard, err)
+	}
+}
+
+func TestFileShardList(t *testing.T) {
+	ctx := context.Background()
+	fileStorage := newTestFileStorage(t, t.TempDir())
+
+	for _, shardID := range []int32{103, 101, 102} {
+		_, err := fileStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: shardID, ClientApp: "ryzom"})
+		if err != nil {
+			t.Fatal("shard create:", err)
+		}
+	}
+
+	shards, next, err := fileStorage.ShardList(ctx, storage.ShardListFilter{}, storage.Page{Limit: 2})
+	if err != nil || len(shards) != 2 || shards[0].ShardId != 101 || shards[1].ShardId != 102 || next == "" {
+		t.Fatal("shard list first page:", shards, next, err)
+	}
+	shards, next, err = fileStorage.ShardList(ctx, storage.ShardListFilter{}, storage.Page{Cursor: next, Limit: 2})
+	if err != nil || len(shards) != 1 || shards[0].ShardId != 103 || next != "" {
+		t.Fatal("shard list last page:", shards, next, err)
+	}
+	shards, _, err = fileStorage.ShardList(ctx, storage.ShardListFilter{ClientApp: "other"}, storage.Page{})
+	if err != nil || len(shards) != 0 {
+		t.Fatal("shard list other client application:", shards, err)
+	}
+}
+
+func TestFileDelete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fileStorage := newTestFileStorage(t, dir)
+
+	deleted, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "deleted"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	purged, err := fileStorage.UserCreate(ctx, &entityv1.User{Username: "purged"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	err = fileStorage.UserDelete(ctx, deleted.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	err = fileStorage.UserDelete(ctx, purged.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	// Only tombstones older than before are purged.
+	for _, user := range fileStorage.users {
+		if user.UserId == deleted.UserId {
+			user.DeletedAt = time.Now().Add(time.Hour).UnixMilli()
+		}
+	}
+	n, err := fileStorage.Purge(ctx, time.Now().Add(time.Minute))
+	if err != nil || n != 1 {
+		t.Fatal("purge:", n, err)
+	}
+	fileStorage.Close()
+
+	reopened := newTestFileStorage(t, dir)
+	_, err = reopened.UserByLogin(ctx, "deleted")
+	if !errors.Is(err, storage.ErrDeleted) {
+		t.Fatal("deleted user by login after reopen: expected ErrDeleted, got", err)
+	}
+	got, err := reopened.UserByLogin(ctx, "purged")
+	if err != nil || got != nil {
+		t.Fatal("purged user by login after reopen:", got, err)
+	}
+	users, err := reopened.Users(ctx)
+	if err != nil || len(users) != 0 {
+		t.Fatal("users after reopen:", users, err)
+	}
+}
+
+func TestFileStorager(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		return newTestFileStorage(t, t.TempDir())
+	})
+}
@@ -0,0 +1,136 @@
+package file
+
+import (
+	"context"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+// fileTx is the Storager handed to WithTx functions. It runs every call under
+// the write lock WithTx already holds.
+type fileTx struct {
+	e *FileStorage
+}
+
+// WithTx runs fn while holding the write lock and logs all of its writes as a
+// single batch record, so after a crash either all or none of them are
+// replayed. If fn returns an error or panics, or the batch cannot be
+// written, its writes are undone.
+func (e *FileStorage) WithTx(ctx context.Context, fn func(tx storage.Storager) error) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	e.isInTx = true
+	isCommitted := false
+	defer func() {
+		if !isCommitted {
+			for i := len(e.undo) - 1; i >= 0; i-- {
+				e.undo[i]()
+			}
+		}
+		e.isInTx = false
+		e.undo = nil
+		e.batch.Reset()
+	}()
+
+	err := fn(&fileTx{e: e})
+	if err != nil {
+		return err
+	}
+	if e.batch.Len() > 0 {
+		err = e.append(recordBatch, e.batch.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	isCommitted = true
+	e.isInTx = false
+	e.compactIfNeeded()
+	return nil
+}
+
+func (t *fileTx) WithTx(ctx context.Context, fn func(tx storage.Storager) error) error {
+	return fn(t)
+}
+
+func (t *fileTx) Shards(ctx context.Context) ([]*entityv1.Shard, error) {
+	return t.e.shardsLocked(), nil
+}
+
+func (t *fileTx) ShardList(ctx context.Context, filter storage.ShardListFilter, page storage.Page) ([]*entityv1.Shard, string, error) {
+	return t.e.shardListLocked(filter, page)
+}
+
+func (t *fileTx) ShardByShardID(ctx context.Context, shardID int32) (*entityv1.Shard, error) {
+	return t.e.shardByShardIDLocked(shardID), nil
+}
+
+func (t *fileTx) ShardByWSAddr(ctx context.Context, wsAddr string) (*entityv1.Shard, error) {
+	return t.e.shardByWSAddrLocked(wsAddr), nil
+}
+
+func (t *fileTx) ShardCreate(ctx context.Context, shard *entityv1.Shard) (*entityv1.Shard, error) {
+	return t.e.shardCreateLocked(shard)
+}
+
+func (t *fileTx) ShardUpdate(ctx context.Context, shard *entityv1.Shard) error {
+	return t.e.shardUpdateLocked(shard, nil)
+}
+
+func (t *fileTx) ShardUpdateIf(ctx context.Context, shard *entityv1.Shard, expectedRevision int64) error {
+	return t.e.shardUpdateLocked(shard, &expectedRevision)
+}
+
+func (t *fileTx) ShardsByClientApplication(ctx context.Context, clientApp string) ([]*entityv1.Shard, error) {
+	return t.e.shardsByClientApplicationLocked(clientApp), nil
+}
+
+func (t *fileTx) ShardDelete(ctx context.Context, shardID int32) error {
+	return t.e.shardDeleteLocked(shardID)
+}
+
+func (t *fileTx) Users(ctx context.Context) ([]*entityv1.User, error) {
+	return t.e.usersLocked(), nil
+}
+
+func (t *fileTx) UserList(ctx context.Context, filter storage.UserListFilter, page storage.Page) ([]*entityv1.User, string, error) {
+	return t.e.userListLocked(filter, page)
+}
+
+func (t *fileTx) UserByLogin(ctx context.Context, login string) (*entityv1.User, error) {
+	return t.e.userByLoginLocked(login)
+}
+
+func (t *fileTx) UserByUserID(ctx context.Context, userID int32) (*entityv1.User, error) {
+	return t.e.userByUserIDLocked(userID), nil
+}
+
+func (t *fileTx) UsersByState(ctx context.Context, state entityv1.UserState) ([]*entityv1.User, error) {
+	return t.e.usersByStateLocked(state), nil
+}
+
+func (t *fileTx) UserByShardID(ctx context.Context, shardID int32) ([]*entityv1.User, error) {
+	return t.e.userByShardIDLocked(shardID), nil
+}
+
+func (t *fileTx) UserCreate(ctx context.Context, user *entityv1.User) (*entityv1.User, error) {
+	return t.e.userCreateLocked(user)
+}
+
+func (t *fileTx) UserUpdate(ctx context.Context, user *entityv1.User) error {
+	return t.e.userUpdateLocked(user, nil)
+}
+
+func (t *fileTx) UserUpdateIf(ctx context.Context, user *entityv1.User, expectedRevision int64) error {
+	return t.e.userUpdateLocked(user, &expectedRevision)
+}
+
+func (t *fileTx) UserDelete(ctx context.Context, userID int32) error {
+	return t.e.userDeleteLocked(userID)
+}
+
+func (t *fileTx) Purge(ctx context.Context, before time.Time) (int, error) {
+	return t.e.purgeLocked(before)
+}
@@ -0,0 +1,238 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func (e *FileStorage) Users(ctx context.Context) ([]*entityv1.User, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.usersLocked(), nil
+}
+
+func (e *FileStorage) UserList(ctx context.Context, filter storage.UserListFilter, page storage.Page) ([]*entityv1.User, string, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.userListLocked(filter, page)
+}
+
+func (e *FileStorage) UserByLogin(ctx context.Context, login string) (*entityv1.User, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.userByLoginLocked(login)
+}
+
+func (e *FileStorage) UserByUserID(ctx context.Context, userID int32) (*entityv1.User, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.userByUserIDLocked(userID), nil
+}
+
+func (e *FileStorage) UsersByState(ctx context.Context, state entityv1.UserState) ([]*entityv1.User, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.usersByStateLocked(state), nil
+}
+
+func (e *FileStorage) UserByShardID(ctx context.Context, shardID int32) ([]*entityv1.User, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.userByShardIDLocked(shardID), nil
+}
+
+func (e *FileStorage) UserCreate(ctx context.Context, user *entityv1.User) (*entityv1.User, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.userCreateLocked(user)
+}
+
+func (e *FileStorage) UserUpdate(ctx context.Context, user *entityv1.User) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.userUpdateLocked(user, nil)
+}
+
+func (e *FileStorage) UserUpdateIf(ctx context.Context, user *entityv1.User, expectedRevision int64) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.userUpdateLocked(user, &expectedRevision)
+}
+
+func (e *FileStorage) UserDelete(ctx context.Context, userID int32) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.userDeleteLocked(userID)
+}
+
+func (e *FileStorage) usersLocked() []*entityv1.User {
+	var users []*entityv1.User
+	for _, userID := range slices.Sorted(maps.Keys(e.users)) {
+		user := e.users[userID]
+		if user.DeletedAt != 0 {
+			continue
+		}
+		users = append(users, proto.Clone(user).(*entityv1.User))
+	}
+	return users
+}
+
+// userListLocked sorts the user ids for every page, which is fine for the
+// small deployments the log file is meant for.
+func (e *FileStorage) userListLocked(filter storage.UserListFilter, page storage.Page) ([]*entityv1.User, string, error) {
+	after, err := storage.CursorDecode(page.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	var users []*entityv1.User
+	for _, userID := range slices.Sorted(maps.Keys(e.users)) {
+		user := e.users[userID]
+		if userID <= after || user.DeletedAt != 0 || !filter.Match(user) {
+			continue
+		}
+		if len(users) == page.Size() {
+			return users, storage.CursorEncode(users[len(users)-1].UserId), nil
+		}
+		users = append(users, proto.Clone(user).(*entityv1.User))
+	}
+	return users, "", nil
+}
+
+func (e *FileStorage) userByLoginLocked(login string) (*entityv1.User, error) {
+	for _, user := range e.users {
+		if user.Username != login {
+			continue
+		}
+		if user.DeletedAt != 0 {
+			return nil, fmt.Errorf("user %d: %w", user.UserId, storage.ErrDeleted)
+		}
+		return proto.Clone(user).(*entityv1.User), nil
+	}
+	return nil, nil
+}
+
+func (e *FileStorage) userByUserIDLocked(userID int32) *entityv1.User {
+	if user, ok := e.users[userID]; ok && user.DeletedAt == 0 {
+		return proto.Clone(user).(*entityv1.User)
+	}
+	return nil
+}
+
+func (e *FileStorage) usersByStateLocked(state entityv1.UserState) []*entityv1.User {
+	var users []*entityv1.User
+	for _, user := range e.users {
+		if user.State == state && user.DeletedAt == 0 {
+			users = append(users, proto.Clone(user).(*entityv1.User))
+		}
+	}
+	return users
+}
+
+func (e *FileStorage) userByShardIDLocked(shardID int32) []*entityv1.User {
+	var users []*entityv1.User
+	for _, user := range e.users {
+		if user.ShardId == shardID && user.DeletedAt == 0 {
+			users = append(users, proto.Clone(user).(*entityv1.User))
+		}
+	}
+	return users
+}
+
+// usernameTakenLocked reports whether any user, deleted ones included, has
+// username.
+func (e *FileStorage) usernameTakenLocked(username string) bool {
+	for _, existing := range e.users {
+		if existing.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *FileStorage) userCreateLocked(user *entityv1.User) (*entityv1.User, error) {
+	if e.usernameTakenLocked(user.Username) {
+		return nil, fmt.Errorf("username '%s': %w", user.Username, storage.ErrUserExists)
+	}
+	if _, ok := e.users[user.UserId]; ok && user.UserId != 0 {
+		return nil, fmt.Errorf("user %d: %w", user.UserId, storage.ErrUserExists)
+	}
+
+	stored := proto.Clone(user).(*entityv1.User)
+	if stored.UserId == 0 {
+		stored.UserId = e.lastUserID + 1
+	}
+	stored.Revision = 1
+	if stored.CreatedAt == 0 {
+		stored.CreatedAt = time.Now().UnixMilli()
+	}
+	err := e.record(recordUser, stored)
+	if err != nil {
+		return nil, err
+	}
+	lastUserID := e.lastUserID
+	e.lastUserID = max(e.lastUserID, stored.UserId)
+	e.users[stored.UserId] = stored
+	e.undoPush(func() {
+		delete(e.users, stored.UserId)
+		e.lastUserID = lastUserID
+	})
+	e.compactIfNeeded()
+
+	user.UserId = stored.UserId
+	user.Revision = stored.Revision
+	user.CreatedAt = stored.CreatedAt
+	return user, nil
+}
+
+// userUpdateLocked stores user, if expectedRevision is set only while the
+// stored revision matches it.
+func (e *FileStorage) userUpdateLocked(user *entityv1.User, expectedRevision *int64) error {
+	previous, ok := e.users[user.UserId]
+	if !ok || previous.DeletedAt != 0 {
+		return fmt.Errorf("user %d: %w", user.UserId, storage.ErrNotFound)
+	}
+	if expectedRevision != nil && previous.Revision != *expectedRevision {
+		return &storage.ConflictError{Entity: "user", ID: user.UserId, ExpectedRevision: *expectedRevision, ActualRevision: previous.Revision}
+	}
+	if user.Username != previous.Username && e.usernameTakenLocked(user.Username) {
+		return fmt.Errorf("username '%s': %w", user.Username, storage.ErrUserExists)
+	}
+
+	stored := proto.Clone(user).(*entityv1.User)
+	stored.Revision = previous.Revision + 1
+	err := e.record(recordUser, stored)
+	if err != nil {
+		return err
+	}
+	e.users[stored.UserId] = stored
+	e.undoPush(func() { e.users[previous.UserId] = previous })
+	e.compactIfNeeded()
+	user.Revision = stored.Revision
+	return nil
+}
+
+func (e *FileStorage) userDeleteLocked(userID int32) error {
+	previous, ok := e.users[userID]
+	if !ok || previous.DeletedAt != 0 {
+		return fmt.Errorf("user %d: %w", userID, storage.ErrNotFound)
+	}
+
+	deleted := proto.Clone(previous).(*entityv1.User)
+	deleted.Revision++
+	deleted.DeletedAt = time.Now().UnixMilli()
+	err := e.record(recordUser, deleted)
+	if err != nil {
+		return err
+	}
+	e.users[userID] = deleted
+	e.undoPush(func() { e.users[userID] = previous })
+	e.compactIfNeeded()
+	return nil
+}
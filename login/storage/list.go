@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+const (
+	// PageLimitDefault is the page size of a Page without Limit.
+	PageLimitDefault = 100
+	// PageLimitMax caps Page.Limit.
+	PageLimitMax = 1000
+)
+
+// ErrInvalidCursor is returned by the list methods for a cursor they did not
+// hand out.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page selects a page of a list. The first page has no Cursor; the next
+// cursor returned with each page continues the list after it.
+type Page struct {
+	Cursor string
+	Limit  int
+}
+
+// Size returns the number of entities the page holds at most.
+func (p Page) Size() int {
+	if p.Limit <= 0 {
+		return PageLimitDefault
+	}
+	return min(p.Limit, PageLimitMax)
+}
+
+// UserListFilter selects users for UserList. Zero fields select every user.
+type UserListFilter struct {
+	State          *entityv1.UserState
+	ShardID        *int32
+	UsernamePrefix string
+	CreatedAfter   time.Time
+}
+
+// Match reports whether filter selects user.
+func (f UserListFilter) Match(user *entityv1.User) bool {
+	if f.State != nil && user.State != *f.State {
+		return false
+	}
+	if f.ShardID != nil && user.ShardId != *f.ShardID {
+		return false
+	}
+	if !strings.HasPrefix(user.Username, f.UsernamePrefix) {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && user.CreatedAt <= f.CreatedAfter.UnixMilli() {
+		return false
+	}
+	return true
+}
+
+// ShardListFilter selects shards for ShardList. Zero fields select every
+// shard.
+type ShardListFilter struct {
+	ClientApp string
+}
+
+// Match reports whether filter selects shard.
+func (f ShardListFilter) Match(shard *entityv1.Shard) bool {
+	return f.ClientApp == "" || shard.ClientApp == f.ClientApp
+}
+
+// CursorEncode returns the cursor continuing a list after the entity with id.
+func CursorEncode(id int32) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(int64(id), 10)))
+}
+
+// CursorDecode returns the id of the last entity before cursor, or
+// math.MinInt32 for the first page.
+func CursorDecode(cursor string) (int32, error) {
+	if cursor == "" {
+		return math.MinInt32, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("cursor '%s': %w", cursor, ErrInvalidCursor)
+	}
+	id, err := strconv.ParseInt(string(b), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("cursor '%s': %w", cursor, ErrInvalidCursor)
+	}
+	return int32(id), nil
+}
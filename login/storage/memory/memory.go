@@ -1,21 +1,238 @@
 package memory
 
 import (
+	"context"
+	"slices"
 	"sync"
+	"time"
 
+	"github.com/runeharvest/gserver/login/storage"
 	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
 )
 
+// MemoryStorage keeps users and shards in maps, with secondary indexes for
+// every lookup the Storager offers. Entities are cloned on the way in and out,
+// so nothing outside the lock ever shares a stored pointer.
 type MemoryStorage struct {
-	mux    sync.RWMutex
-	shards map[int32]*entityv1.Shard
-	users  map[int32]*entityv1.User
+	mux        sync.RWMutex
+	shards     map[int32]*entityv1.Shard
+	users      map[int32]*entityv1.User
+	lastUserID int32
+
+	// userIDs and shardIDs hold the stored ids in order, for ordered lists.
+	userIDs  []int32
+	shardIDs []int32
+
+	// Deleted users and shards are moved out of the maps above, so no lookup
+	// sees them, into tombstones kept until purged.
+	deletedUsers     map[int32]*entityv1.User
+	deletedUsernames map[string]int32
+	deletedShards    map[int32]*entityv1.Shard
+
+	// userKeys and shardKeys remember the indexed fields as they were when
+	// last stored, to find the index entries to drop on update.
+	userKeys          map[int32]userKey
+	usersByUsername   map[string]int32
+	usersByState      map[entityv1.UserState]idSet
+	usersByShardID    map[int32]idSet
+	shardKeys         map[int32]shardKey
+	shardsByWSAddr    map[string]int32
+	shardsByClientApp map[string]idSet
+
+	// undo reverts the writes of the running WithTx in reverse order. It is
+	// only collected while isInTx.
+	isInTx bool
+	undo   []func()
+
+	// userFeed and shardFeed send committed writes to watches. Events of the
+	// running WithTx wait in pending until it commits.
+	userFeed  *storage.Feed[storage.UserEvent]
+	shardFeed *storage.Feed[storage.ShardEvent]
+	pending   []func()
+}
+
+type userKey struct {
+	username string
+	state    entityv1.UserState
+	shardID  int32
 }
 
+type shardKey struct {
+	wsAddr    string
+	clientApp string
+}
+
+type idSet map[int32]struct{}
+
 func NewMemoryStorage() (*MemoryStorage, error) {
 	e := &MemoryStorage{
-		shards: make(map[int32]*entityv1.Shard),
-		users:  make(map[int32]*entityv1.User),
+		shards:            make(map[int32]*entityv1.Shard),
+		users:             make(map[int32]*entityv1.User),
+		userKeys:          make(map[int32]userKey),
+		usersByUsername:   make(map[string]int32),
+		usersByState:      make(map[entityv1.UserState]idSet),
+		usersByShardID:    make(map[int32]idSet),
+		shardKeys:         make(map[int32]shardKey),
+		shardsByWSAddr:    make(map[string]int32),
+		shardsByClientApp: make(map[string]idSet),
+		deletedUsers:      make(map[int32]*entityv1.User),
+		deletedUsernames:  make(map[string]int32),
+		deletedShards:     make(map[int32]*entityv1.Shard),
+		userFeed:          storage.NewFeed(watchBufferSize, userEventClone),
+		shardFeed:         storage.NewFeed(watchBufferSize, shardEventClone),
 	}
 	return e, nil
 }
+
+func (e *MemoryStorage) Purge(ctx context.Context, before time.Time) (int, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.purgeLocked(before), nil
+}
+
+func (e *MemoryStorage) purgeLocked(before time.Time) int {
+	purged := 0
+	for userID, user := range e.deletedUsers {
+		if user.DeletedAt >= before.UnixMilli() {
+			continue
+		}
+		delete(e.deletedUsers, userID)
+		delete(e.deletedUsernames, user.Username)
+		e.undoPush(func() {
+			e.deletedUsers[userID] = user
+			e.deletedUsernames[user.Username] = userID
+		})
+		purged++
+	}
+	for shardID, shard := range e.deletedShards {
+		if shard.DeletedAt >= before.UnixMilli() {
+			continue
+		}
+		delete(e.deletedShards, shardID)
+		e.undoPush(func() { e.deletedShards[shardID] = shard })
+		purged++
+	}
+	return purged
+}
+
+// userIndex stores user and moves its index entries to its current fields.
+func (e *MemoryStorage) userIndex(user *entityv1.User) {
+	e.userUnindex(user.UserId)
+
+	if _, ok := e.users[user.UserId]; !ok {
+		e.userIDs = idsInsert(e.userIDs, user.UserId)
+	}
+	e.users[user.UserId] = user
+	e.userKeys[user.UserId] = userKey{username: user.Username, state: user.State, shardID: user.ShardId}
+	e.usersByUsername[user.Username] = user.UserId
+	idSetAdd(e.usersByState, user.State, user.UserId)
+	idSetAdd(e.usersByShardID, user.ShardId, user.UserId)
+}
+
+// userRemove drops the user and its index entries.
+func (e *MemoryStorage) userRemove(userID int32) {
+	e.userUnindex(userID)
+	if _, ok := e.users[userID]; ok {
+		e.userIDs = idsRemove(e.userIDs, userID)
+	}
+	delete(e.users, userID)
+}
+
+func (e *MemoryStorage) userUnindex(userID int32) {
+	old, ok := e.userKeys[userID]
+	if !ok {
+		return
+	}
+	if e.usersByUsername[old.username] == userID {
+		delete(e.usersByUsername, old.username)
+	}
+	idSetRemove(e.usersByState, old.state, userID)
+	idSetRemove(e.usersByShardID, old.shardID, userID)
+	delete(e.userKeys, userID)
+}
+
+// shardIndex stores shard and moves its index entries to its current fields.
+func (e *MemoryStorage) shardIndex(shard *entityv1.Shard) {
+	e.shardUnindex(shard.ShardId)
+
+	if _, ok := e.shards[shard.ShardId]; !ok {
+		e.shardIDs = idsInsert(e.shardIDs, shard.ShardId)
+	}
+	e.shards[shard.ShardId] = shard
+	e.shardKeys[shard.ShardId] = shardKey{wsAddr: shard.WsAddr, clientApp: shard.ClientApp}
+	e.shardsByWSAddr[shard.WsAddr] = shard.ShardId
+	idSetAdd(e.shardsByClientApp, shard.ClientApp, shard.ShardId)
+}
+
+// shardRemove drops the shard and its index entries.
+func (e *MemoryStorage) shardRemove(shardID int32) {
+	e.shardUnindex(shardID)
+	if _, ok := e.shards[shardID]; ok {
+		e.shardIDs = idsRemove(e.shardIDs, shardID)
+	}
+	delete(e.shards, shardID)
+}
+
+func (e *MemoryStorage) shardUnindex(shardID int32) {
+	old, ok := e.shardKeys[shardID]
+	if !ok {
+		return
+	}
+	if e.shardsByWSAddr[old.wsAddr] == shardID {
+		delete(e.shardsByWSAddr, old.wsAddr)
+	}
+	idSetRemove(e.shardsByClientApp, old.clientApp, shardID)
+	delete(e.shardKeys, shardID)
+}
+
+// undoPush records how to revert a write, if a WithTx is running.
+func (e *MemoryStorage) undoPush(undo func()) {
+	if e.isInTx {
+		e.undo = append(e.undo, undo)
+	}
+}
+
+func idSetAdd[K comparable](index map[K]idSet, key K, id int32) {
+	ids, ok := index[key]
+	if !ok {
+		ids = make(idSet)
+		index[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func idSetRemove[K comparable](index map[K]idSet, key K, id int32) {
+	ids := index[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(index, key)
+	}
+}
+
+// idsInsert adds id to the sorted ids. New users get the highest id, so this
+// is an append for them.
+func idsInsert(ids []int32, id int32) []int32 {
+	i, _ := slices.BinarySearch(ids, id)
+	return slices.Insert(ids, i, id)
+}
+
+func idsRemove(ids []int32, id int32) []int32 {
+	i, ok := slices.BinarySearch(ids, id)
+	if !ok {
+		return ids
+	}
+	return slices.Delete(ids, i, i+1)
+}
+
+// idsAfter returns the sorted ids greater than the id cursor ends at.
+func idsAfter(ids []int32, cursor string) ([]int32, error) {
+	after, err := storage.CursorDecode(cursor)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := slices.BinarySearch(ids, after)
+	if ok {
+		i++
+	}
+	return ids[i:], nil
+}
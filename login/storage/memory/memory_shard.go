@@ -2,62 +2,177 @@ package memory
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/runeharvest/gserver/login/storage"
 	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func (e *MemoryStorage) Shards(ctx context.Context) ([]*entityv1.Shard, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	var shards []*entityv1.Shard
-	for _, shard := range e.shards {
-		shards = append(shards, shard)
-	}
-	return shards, nil
+	return e.shardsLocked(), nil
+}
+
+func (e *MemoryStorage) ShardList(ctx context.Context, filter storage.ShardListFilter, page storage.Page) ([]*entityv1.Shard, string, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.shardListLocked(filter, page)
 }
 
 func (e *MemoryStorage) ShardByShardID(ctx context.Context, shardID int32) (*entityv1.Shard, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	if shard, ok := e.shards[shardID]; ok {
-		return shard, nil
-	}
-	return nil, nil
+	return e.shardByShardIDLocked(shardID), nil
 }
 
 func (e *MemoryStorage) ShardByWSAddr(ctx context.Context, wsAddr string) (*entityv1.Shard, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	for _, shard := range e.shards {
-		if shard.WsAddr == wsAddr {
-			return shard, nil
-		}
-	}
-	return nil, nil
+	return e.shardByWSAddrLocked(wsAddr), nil
 }
 
 func (e *MemoryStorage) ShardCreate(ctx context.Context, shard *entityv1.Shard) (*entityv1.Shard, error) {
 	e.mux.Lock()
 	defer e.mux.Unlock()
-	e.shards[shard.ShardId] = shard
-	return shard, nil
+	return e.shardCreateLocked(shard)
 }
 
 func (e *MemoryStorage) ShardUpdate(ctx context.Context, shard *entityv1.Shard) error {
 	e.mux.Lock()
 	defer e.mux.Unlock()
-	e.shards[shard.ShardId] = shard
-	return nil
+	return e.shardUpdateLocked(shard, nil)
+}
+
+func (e *MemoryStorage) ShardUpdateIf(ctx context.Context, shard *entityv1.Shard, expectedRevision int64) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.shardUpdateLocked(shard, &expectedRevision)
 }
 
 func (e *MemoryStorage) ShardsByClientApplication(ctx context.Context, clientApp string) ([]*entityv1.Shard, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
+	return e.shardsByClientApplicationLocked(clientApp), nil
+}
+
+func (e *MemoryStorage) ShardDelete(ctx context.Context, shardID int32) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.shardDeleteLocked(shardID)
+}
+
+func (e *MemoryStorage) shardsLocked() []*entityv1.Shard {
 	var shards []*entityv1.Shard
-	for _, shard := range e.shards {
-		if shard.ClientApp == clientApp {
-			shards = append(shards, shard)
+	for _, shardID := range e.shardIDs {
+		shards = append(shards, shardClone(e.shards[shardID]))
+	}
+	return shards
+}
+
+func (e *MemoryStorage) shardListLocked(filter storage.ShardListFilter, page storage.Page) ([]*entityv1.Shard, string, error) {
+	shardIDs, err := idsAfter(e.shardIDs, page.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	var shards []*entityv1.Shard
+	for _, shardID := range shardIDs {
+		shard := e.shards[shardID]
+		if !filter.Match(shard) {
+			continue
+		}
+		if len(shards) == page.Size() {
+			return shards, storage.CursorEncode(shards[len(shards)-1].ShardId), nil
+		}
+		shards = append(shards, shardClone(shard))
+	}
+	return shards, "", nil
+}
+
+func (e *MemoryStorage) shardByShardIDLocked(shardID int32) *entityv1.Shard {
+	if shard, ok := e.shards[shardID]; ok {
+		return shardClone(shard)
+	}
+	return nil
+}
+
+func (e *MemoryStorage) shardByWSAddrLocked(wsAddr string) *entityv1.Shard {
+	if shardID, ok := e.shardsByWSAddr[wsAddr]; ok {
+		return shardClone(e.shards[shardID])
+	}
+	return nil
+}
+
+func (e *MemoryStorage) shardCreateLocked(shard *entityv1.Shard) (*entityv1.Shard, error) {
+	if _, ok := e.shards[shard.ShardId]; ok {
+		return nil, fmt.Errorf("shard %d: %w", shard.ShardId, storage.ErrShardExists)
+	}
+	// A new shard may reuse the id of a deleted one.
+	tombstone, isDeleted := e.deletedShards[shard.ShardId]
+	delete(e.deletedShards, shard.ShardId)
+	shard.Revision = 1
+	stored := shardClone(shard)
+	e.shardIndex(stored)
+	e.shardPublish(storage.EventCreate, stored, nil)
+
+	shardID := shard.ShardId
+	e.undoPush(func() {
+		if isDeleted {
+			e.deletedShards[shardID] = tombstone
 		}
+		e.shardRemove(shardID)
+	})
+	return shard, nil
+}
+
+// shardUpdateLocked stores shard, if expectedRevision is set only while the
+// stored revision matches it.
+func (e *MemoryStorage) shardUpdateLocked(shard *entityv1.Shard, expectedRevision *int64) error {
+	stored, ok := e.shards[shard.ShardId]
+	if !ok {
+		return fmt.Errorf("shard %d: %w", shard.ShardId, storage.ErrNotFound)
+	}
+	if expectedRevision != nil && stored.Revision != *expectedRevision {
+		return &storage.ConflictError{Entity: "shard", ID: shard.ShardId, ExpectedRevision: *expectedRevision, ActualRevision: stored.Revision}
+	}
+	shard.Revision = stored.Revision + 1
+	updated := shardClone(shard)
+	e.shardIndex(updated)
+	e.shardPublish(storage.EventUpdate, updated, stored)
+
+	e.undoPush(func() { e.shardIndex(stored) })
+	return nil
+}
+
+func (e *MemoryStorage) shardsByClientApplicationLocked(clientApp string) []*entityv1.Shard {
+	var shards []*entityv1.Shard
+	for shardID := range e.shardsByClientApp[clientApp] {
+		shards = append(shards, shardClone(e.shards[shardID]))
 	}
-	return shards, nil
+	return shards
+}
+
+func (e *MemoryStorage) shardDeleteLocked(shardID int32) error {
+	stored, ok := e.shards[shardID]
+	if !ok {
+		return fmt.Errorf("shard %d: %w", shardID, storage.ErrNotFound)
+	}
+	deleted := shardClone(stored)
+	deleted.Revision++
+	deleted.DeletedAt = time.Now().UnixMilli()
+	e.shardRemove(shardID)
+	e.deletedShards[shardID] = deleted
+	e.shardPublish(storage.EventDelete, deleted, stored)
+
+	e.undoPush(func() {
+		delete(e.deletedShards, shardID)
+		e.shardIndex(stored)
+	})
+	return nil
+}
+
+func shardClone(shard *entityv1.Shard) *entityv1.Shard {
+	return proto.Clone(shard).(*entityv1.Shard)
 }
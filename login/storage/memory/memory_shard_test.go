@@ -0,0 +1,92 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+func TestShardIndexUpdated(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+
+	_, err = memoryStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, WsAddr: "atys:49999", ClientApp: "ryzom"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	err = memoryStorage.ShardUpdate(ctx, &entityv1.Shard{ShardId: 101, WsAddr: "atys:50000", ClientApp: "other"})
+	if err != nil {
+		t.Fatal("shard update:", err)
+	}
+
+	shard, err := memoryStorage.ShardByWSAddr(ctx, "atys:49999")
+	if err != nil || shard != nil {
+		t.Fatal("shard by old ws addr:", shard, err)
+	}
+	shard, err = memoryStorage.ShardByWSAddr(ctx, "atys:50000")
+	if err != nil || shard == nil || shard.ShardId != 101 {
+		t.Fatal("shard by new ws addr:", shard, err)
+	}
+	shards, err := memoryStorage.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil || len(shards) != 0 {
+		t.Fatal("shards by old client application:", shards, err)
+	}
+	shards, err = memoryStorage.ShardsByClientApplication(ctx, "other")
+	if err != nil || len(shards) != 1 {
+		t.Fatal("shards by new client application:", shards, err)
+	}
+}
+
+func TestShardDelete(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	_, err = memoryStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, WsAddr: "atys:49999", ClientApp: "ryzom"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+
+	// A rolled back delete leaves the shard in place.
+	err = memoryStorage.WithTx(ctx, func(tx storage.Storager) error {
+		err := tx.ShardDelete(ctx, 101)
+		if err != nil {
+			return err
+		}
+		return errors.New("fail")
+	})
+	if err == nil {
+		t.Fatal("rolled back with tx: expected error")
+	}
+	shard, err := memoryStorage.ShardByWSAddr(ctx, "atys:49999")
+	if err != nil || shard == nil {
+		t.Fatal("shard by ws addr after rolled back delete:", shard, err)
+	}
+
+	err = memoryStorage.ShardDelete(ctx, 101)
+	if err != nil {
+		t.Fatal("shard delete:", err)
+	}
+	shards, err := memoryStorage.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil || len(shards) != 0 {
+		t.Fatal("shards by client application after delete:", shards, err)
+	}
+
+	// The id of a retired shard can be reused.
+	shard, err = memoryStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Atys"})
+	if err != nil || shard.Revision != 1 {
+		t.Fatal("shard create over deleted shard:", shard, err)
+	}
+	purged, err := memoryStorage.Purge(ctx, time.Now().Add(time.Hour))
+	if err != nil || purged != 0 {
+		t.Fatal("purge after reuse:", purged, err)
+	}
+}
@@ -0,0 +1,18 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/runeharvest/gserver/login/storage"
+	"github.com/runeharvest/gserver/login/storage/storagetest"
+)
+
+func TestStorager(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		memoryStorage, err := NewMemoryStorage()
+		if err != nil {
+			t.Fatal("new memory storage:", err)
+		}
+		return memoryStorage
+	})
+}
@@ -0,0 +1,133 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+// memoryTx is the Storager handed to WithTx functions. It runs every call
+// under the write lock WithTx already holds.
+type memoryTx struct {
+	e *MemoryStorage
+}
+
+// WithTx runs fn while holding the write lock, so other callers see either
+// none or all of its writes. If fn returns an error or panics, its writes are
+// undone and never reach watches.
+func (e *MemoryStorage) WithTx(ctx context.Context, fn func(tx storage.Storager) error) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	e.isInTx = true
+	isCommitted := false
+	defer func() {
+		if !isCommitted {
+			for i := len(e.undo) - 1; i >= 0; i-- {
+				e.undo[i]()
+			}
+		}
+		e.isInTx = false
+		e.undo = nil
+		pending := e.pending
+		e.pending = nil
+		if isCommitted {
+			for _, publish := range pending {
+				publish()
+			}
+		}
+	}()
+
+	err := fn(&memoryTx{e: e})
+	if err != nil {
+		return err
+	}
+	isCommitted = true
+	return nil
+}
+
+func (t *memoryTx) WithTx(ctx context.Context, fn func(tx storage.Storager) error) error {
+	return fn(t)
+}
+
+func (t *memoryTx) Shards(ctx context.Context) ([]*entityv1.Shard, error) {
+	return t.e.shardsLocked(), nil
+}
+
+func (t *memoryTx) ShardList(ctx context.Context, filter storage.ShardListFilter, page storage.Page) ([]*entityv1.Shard, string, error) {
+	return t.e.shardListLocked(filter, page)
+}
+
+func (t *memoryTx) ShardByShardID(ctx context.Context, shardID int32) (*entityv1.Shard, error) {
+	return t.e.shardByShardIDLocked(shardID), nil
+}
+
+func (t *memoryTx) ShardByWSAddr(ctx context.Context, wsAddr string) (*entityv1.Shard, error) {
+	return t.e.shardByWSAddrLocked(wsAddr), nil
+}
+
+func (t *memoryTx) ShardCreate(ctx context.Context, shard *entityv1.Shard) (*entityv1.Shard, error) {
+	return t.e.shardCreateLocked(shard)
+}
+
+func (t *memoryTx) ShardUpdate(ctx context.Context, shard *entityv1.Shard) error {
+	return t.e.shardUpdateLocked(shard, nil)
+}
+
+func (t *memoryTx) ShardUpdateIf(ctx context.Context, shard *entityv1.Shard, expectedRevision int64) error {
+	return t.e.shardUpdateLocked(shard, &expectedRevision)
+}
+
+func (t *memoryTx) ShardsByClientApplication(ctx context.Context, clientApp string) ([]*entityv1.Shard, error) {
+	return t.e.shardsByClientApplicationLocked(clientApp), nil
+}
+
+func (t *memoryTx) ShardDelete(ctx context.Context, shardID int32) error {
+	return t.e.shardDeleteLocked(shardID)
+}
+
+func (t *memoryTx) Users(ctx context.Context) ([]*entityv1.User, error) {
+	return t.e.usersLocked(), nil
+}
+
+func (t *memoryTx) UserList(ctx context.Context, filter storage.UserListFilter, page storage.Page) ([]*entityv1.User, string, error) {
+	return t.e.userListLocked(filter, page)
+}
+
+func (t *memoryTx) UserByLogin(ctx context.Context, login string) (*entityv1.User, error) {
+	return t.e.userByLoginLocked(login)
+}
+
+func (t *memoryTx) UserByUserID(ctx context.Context, userID int32) (*entityv1.User, error) {
+	return t.e.userByUserIDLocked(userID), nil
+}
+
+func (t *memoryTx) UsersByState(ctx context.Context, state entityv1.UserState) ([]*entityv1.User, error) {
+	return t.e.usersByStateLocked(state), nil
+}
+
+func (t *memoryTx) UserByShardID(ctx context.Context, shardID int32) ([]*entityv1.User, error) {
+	return t.e.userByShardIDLocked(shardID), nil
+}
+
+func (t *memoryTx) UserCreate(ctx context.Context, user *entityv1.User) (*entityv1.User, error) {
+	return t.e.userCreateLocked(user)
+}
+
+func (t *memoryTx) UserUpdate(ctx context.Context, user *entityv1.User) error {
+	return t.e.userUpdateLocked(user, nil)
+}
+
+func (t *memoryTx) UserUpdateIf(ctx context.Context, user *entityv1.User, expectedRevision int64) error {
+	return t.e.userUpdateLocked(user, &expectedRevision)
+}
+
+func (t *memoryTx) UserDelete(ctx context.Context, userID int32) error {
+	return t.e.userDeleteLocked(userID)
+}
+
+func (t *memoryTx) Purge(ctx context.Context, before time.Time) (int, error) {
+	return t.e.purgeLocked(before), nil
+}
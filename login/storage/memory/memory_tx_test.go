@@ -0,0 +1,69 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+func TestWithTx(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	user, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	errFail := errors.New("fail")
+	err = memoryStorage.WithTx(ctx, func(tx storage.Storager) error {
+		_, err := tx.UserCreate(ctx, &entityv1.User{Username: "otheruser"})
+		if err != nil {
+			return err
+		}
+		online := &entityv1.User{UserId: user.UserId, Username: "testuser", State: entityv1.UserState_ONLINE}
+		err = tx.UserUpdate(ctx, online)
+		if err != nil {
+			return err
+		}
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatal("rolled back with tx: expected errFail, got", err)
+	}
+
+	got, err := memoryStorage.UserByLogin(ctx, "otheruser")
+	if err != nil || got != nil {
+		t.Fatal("user created in rolled back tx:", got, err)
+	}
+	users, err := memoryStorage.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if err != nil || len(users) != 0 {
+		t.Fatal("users updated in rolled back tx:", users, err)
+	}
+	got, err = memoryStorage.UserByUserID(ctx, user.UserId)
+	if err != nil || got == nil || got.Revision != 1 {
+		t.Fatal("user after rolled back tx:", got, err)
+	}
+
+	var other *entityv1.User
+	err = memoryStorage.WithTx(ctx, func(tx storage.Storager) error {
+		other, err = tx.UserCreate(ctx, &entityv1.User{Username: "otheruser"})
+		return err
+	})
+	if err != nil {
+		t.Fatal("committed with tx:", err)
+	}
+	// The id of the rolled back user is handed out again.
+	if other.UserId != user.UserId+1 {
+		t.Fatal("user id after rolled back tx:", other.UserId)
+	}
+	got, err = memoryStorage.UserByLogin(ctx, "otheruser")
+	if err != nil || got == nil {
+		t.Fatal("user created in committed tx:", got, err)
+	}
+}
@@ -2,74 +2,229 @@ package memory
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/runeharvest/gserver/login/storage"
 	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func (e *MemoryStorage) Users(ctx context.Context) ([]*entityv1.User, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	var users []*entityv1.User
-	for _, user := range e.users {
-		users = append(users, user)
-	}
-	return users, nil
+	return e.usersLocked(), nil
+}
+
+func (e *MemoryStorage) UserList(ctx context.Context, filter storage.UserListFilter, page storage.Page) ([]*entityv1.User, string, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.userListLocked(filter, page)
 }
 
 func (e *MemoryStorage) UserByLogin(ctx context.Context, login string) (*entityv1.User, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	for _, user := range e.users {
-		if user.Username == login {
-			return user, nil
-		}
-	}
-	return nil, nil
+	return e.userByLoginLocked(login)
 }
 
 func (e *MemoryStorage) UserByUserID(ctx context.Context, userID int32) (*entityv1.User, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	if user, ok := e.users[userID]; ok {
-		return user, nil
-	}
-	return nil, nil
+	return e.userByUserIDLocked(userID), nil
 }
 
 func (e *MemoryStorage) UsersByState(ctx context.Context, state entityv1.UserState) ([]*entityv1.User, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	var users []*entityv1.User
-	for _, user := range e.users {
-		if user.State == state {
-			users = append(users, user)
-		}
-	}
-	return users, nil
+	return e.usersByStateLocked(state), nil
 }
 
 func (e *MemoryStorage) UserByShardID(ctx context.Context, shardID int32) ([]*entityv1.User, error) {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
-	var users []*entityv1.User
-	for _, user := range e.users {
-		if user.ShardId == shardID {
-			users = append(users, user)
-		}
-	}
-	return users, nil
+	return e.userByShardIDLocked(shardID), nil
 }
 
 func (e *MemoryStorage) UserCreate(ctx context.Context, user *entityv1.User) (*entityv1.User, error) {
 	e.mux.Lock()
 	defer e.mux.Unlock()
-	e.users[user.UserId] = user
-	return user, nil
+	return e.userCreateLocked(user)
 }
 
+// UserUpdate also returns ErrUserExists if the user is renamed to the
+// username of another user.
 func (e *MemoryStorage) UserUpdate(ctx context.Context, user *entityv1.User) error {
 	e.mux.Lock()
 	defer e.mux.Unlock()
-	e.users[user.UserId] = user
+	return e.userUpdateLocked(user, nil)
+}
+
+func (e *MemoryStorage) UserUpdateIf(ctx context.Context, user *entityv1.User, expectedRevision int64) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.userUpdateLocked(user, &expectedRevision)
+}
+
+func (e *MemoryStorage) UserDelete(ctx context.Context, userID int32) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.userDeleteLocked(userID)
+}
+
+func (e *MemoryStorage) usersLocked() []*entityv1.User {
+	var users []*entityv1.User
+	for _, userID := range e.userIDs {
+		users = append(users, userClone(e.users[userID]))
+	}
+	return users
+}
+
+// userListLocked scans the users in order from the cursor, so a page with a
+// selective filter costs as much as the users it skips.
+func (e *MemoryStorage) userListLocked(filter storage.UserListFilter, page storage.Page) ([]*entityv1.User, string, error) {
+	userIDs, err := idsAfter(e.userIDs, page.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	var users []*entityv1.User
+	for _, userID := range userIDs {
+		user := e.users[userID]
+		if !filter.Match(user) {
+			continue
+		}
+		if len(users) == page.Size() {
+			return users, storage.CursorEncode(users[len(users)-1].UserId), nil
+		}
+		users = append(users, userClone(user))
+	}
+	return users, "", nil
+}
+
+func (e *MemoryStorage) userByLoginLocked(login string) (*entityv1.User, error) {
+	if userID, ok := e.usersByUsername[login]; ok {
+		return userClone(e.users[userID]), nil
+	}
+	if userID, ok := e.deletedUsernames[login]; ok {
+		return nil, fmt.Errorf("user %d: %w", userID, storage.ErrDeleted)
+	}
+	return nil, nil
+}
+
+func (e *MemoryStorage) userByUserIDLocked(userID int32) *entityv1.User {
+	if user, ok := e.users[userID]; ok {
+		return userClone(user)
+	}
 	return nil
 }
+
+func (e *MemoryStorage) usersByStateLocked(state entityv1.UserState) []*entityv1.User {
+	var users []*entityv1.User
+	for userID := range e.usersByState[state] {
+		users = append(users, userClone(e.users[userID]))
+	}
+	return users
+}
+
+func (e *MemoryStorage) userByShardIDLocked(shardID int32) []*entityv1.User {
+	var users []*entityv1.User
+	for userID := range e.usersByShardID[shardID] {
+		users = append(users, userClone(e.users[userID]))
+	}
+	return users
+}
+
+func (e *MemoryStorage) userCreateLocked(user *entityv1.User) (*entityv1.User, error) {
+	if e.usernameTaken(user.Username, 0) {
+		return nil, fmt.Errorf("username '%s': %w", user.Username, storage.ErrUserExists)
+	}
+	if user.UserId != 0 && e.userIDTaken(user.UserId) {
+		return nil, fmt.Errorf("user %d: %w", user.UserId, storage.ErrUserExists)
+	}
+	lastUserID := e.lastUserID
+	if user.UserId == 0 {
+		user.UserId = e.lastUserID + 1
+	}
+	e.lastUserID = max(e.lastUserID, user.UserId)
+	user.Revision = 1
+	if user.CreatedAt == 0 {
+		user.CreatedAt = time.Now().UnixMilli()
+	}
+	stored := userClone(user)
+	e.userIndex(stored)
+	e.userPublish(storage.EventCreate, stored, nil)
+
+	userID := user.UserId
+	e.undoPush(func() {
+		e.userRemove(userID)
+		e.lastUserID = lastUserID
+	})
+	return user, nil
+}
+
+// userUpdateLocked stores user, if expectedRevision is set only while the
+// stored revision matches it.
+func (e *MemoryStorage) userUpdateLocked(user *entityv1.User, expectedRevision *int64) error {
+	stored, ok := e.users[user.UserId]
+	if !ok {
+		return fmt.Errorf("user %d: %w", user.UserId, storage.ErrNotFound)
+	}
+	if expectedRevision != nil && stored.Revision != *expectedRevision {
+		return &storage.ConflictError{Entity: "user", ID: user.UserId, ExpectedRevision: *expectedRevision, ActualRevision: stored.Revision}
+	}
+	if e.usernameTaken(user.Username, user.UserId) {
+		return fmt.Errorf("username '%s': %w", user.Username, storage.ErrUserExists)
+	}
+	user.Revision = stored.Revision + 1
+	updated := userClone(user)
+	e.userIndex(updated)
+	e.userPublish(storage.EventUpdate, updated, stored)
+
+	e.undoPush(func() { e.userIndex(stored) })
+	return nil
+}
+
+func (e *MemoryStorage) userDeleteLocked(userID int32) error {
+	stored, ok := e.users[userID]
+	if !ok {
+		return fmt.Errorf("user %d: %w", userID, storage.ErrNotFound)
+	}
+	deleted := userClone(stored)
+	deleted.Revision++
+	deleted.DeletedAt = time.Now().UnixMilli()
+	e.userRemove(userID)
+	e.deletedUsers[userID] = deleted
+	e.deletedUsernames[deleted.Username] = userID
+	e.userPublish(storage.EventDelete, deleted, stored)
+
+	e.undoPush(func() {
+		delete(e.deletedUsers, userID)
+		delete(e.deletedUsernames, deleted.Username)
+		e.userIndex(stored)
+	})
+	return nil
+}
+
+// usernameTaken reports whether a user other than userID, deleted or not,
+// holds username.
+func (e *MemoryStorage) usernameTaken(username string, userID int32) bool {
+	if id, ok := e.usersByUsername[username]; ok && id != userID {
+		return true
+	}
+	_, ok := e.deletedUsernames[username]
+	return ok
+}
+
+// userIDTaken reports whether a user, deleted or not, has userID.
+func (e *MemoryStorage) userIDTaken(userID int32) bool {
+	_, ok := e.users[userID]
+	if ok {
+		return true
+	}
+	_, ok = e.deletedUsers[userID]
+	return ok
+}
+
+func userClone(user *entityv1.User) *entityv1.User {
+	return proto.Clone(user).(*entityv1.User)
+}
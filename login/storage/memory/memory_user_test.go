@@ -0,0 +1,400 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+func TestUserCreateAllocatesID(t *testing.T) {
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+
+	seen := make(map[int32]bool)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		user, err := memoryStorage.UserCreate(context.Background(), &entityv1.User{Username: username})
+		if err != nil {
+			t.Fatal("user create:", err)
+		}
+		if user.UserId == 0 {
+			t.Fatal("user id not allocated for", username)
+		}
+		if seen[user.UserId] {
+			t.Fatal("user id allocated twice:", user.UserId)
+		}
+		seen[user.UserId] = true
+	}
+
+	users, err := memoryStorage.Users(context.Background())
+	if err != nil {
+		t.Fatal("users:", err)
+	}
+	if len(users) != 3 {
+		t.Fatal("expected 3 users, got", len(users))
+	}
+}
+
+func TestUserCreateConcurrentSameName(t *testing.T) {
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+
+	const attempts = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := memoryStorage.UserCreate(context.Background(), &entityv1.User{Username: "testuser"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		if !errors.Is(err, storage.ErrUserExists) {
+			t.Fatal("user create: expected ErrUserExists, got", err)
+		}
+	}
+	if created != 1 {
+		t.Fatal("expected exactly one user created, got", created)
+	}
+}
+
+func TestUserIndexUpdated(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+
+	user, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: "alice"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	_, err = memoryStorage.UserCreate(ctx, &entityv1.User{Username: "bob"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	err = memoryStorage.UserUpdate(ctx, &entityv1.User{UserId: user.UserId, Username: "alicia", State: entityv1.UserState_ONLINE, ShardId: 101})
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+
+	got, err := memoryStorage.UserByLogin(ctx, "alice")
+	if err != nil || got != nil {
+		t.Fatal("user by old login:", got, err)
+	}
+	got, err = memoryStorage.UserByLogin(ctx, "alicia")
+	if err != nil || got == nil || got.UserId != user.UserId {
+		t.Fatal("user by new login:", got, err)
+	}
+	users, err := memoryStorage.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if err != nil || len(users) != 1 || users[0].UserId != user.UserId {
+		t.Fatal("users by state online:", users, err)
+	}
+	users, err = memoryStorage.UsersByState(ctx, entityv1.UserState_OFFLINE)
+	if err != nil || len(users) != 1 || users[0].Username != "bob" {
+		t.Fatal("users by state offline:", users, err)
+	}
+	users, err = memoryStorage.UserByShardID(ctx, 101)
+	if err != nil || len(users) != 1 {
+		t.Fatal("user by shard id:", users, err)
+	}
+
+	err = memoryStorage.UserUpdate(ctx, &entityv1.User{UserId: user.UserId, Username: "bob"})
+	if !errors.Is(err, storage.ErrUserExists) {
+		t.Fatal("rename to taken username: expected ErrUserExists, got", err)
+	}
+}
+
+// benchUsers is the population the lookup benchmarks run against.
+const benchUsers = 1_000_000
+
+var (
+	benchStorageOnce sync.Once
+	benchStorage     *MemoryStorage
+)
+
+// benchMemoryStorage returns a storage with benchUsers users, one percent of
+// them online, spread over 1000 shards. It is built once and shared by the
+// benchmarks, which must not change it.
+func benchMemoryStorage(b *testing.B) *MemoryStorage {
+	b.Helper()
+	benchStorageOnce.Do(func() {
+		memoryStorage, err := NewMemoryStorage()
+		if err != nil {
+			b.Fatal("new memory storage:", err)
+		}
+		for i := range benchUsers {
+			user := &entityv1.User{
+				Username: fmt.Sprintf("user%d", i),
+				ShardId:  int32(i%1000) + 1,
+			}
+			if i%100 == 0 {
+				user.State = entityv1.UserState_ONLINE
+			}
+			_, err := memoryStorage.UserCreate(context.Background(), user)
+			if err != nil {
+				b.Fatal("user create:", err)
+			}
+		}
+		benchStorage = memoryStorage
+	})
+	if benchStorage == nil {
+		b.Fatal("bench storage not built")
+	}
+	return benchStorage
+}
+
+func BenchmarkUserByLogin(b *testing.B) {
+	memoryStorage := benchMemoryStorage(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := range b.N {
+		user, err := memoryStorage.UserByLogin(ctx, fmt.Sprintf("user%d", i*7919%benchUsers))
+		if err != nil || user == nil {
+			b.Fatal("user by login:", user, err)
+		}
+	}
+}
+
+func BenchmarkUsersByState(b *testing.B) {
+	memoryStorage := benchMemoryStorage(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for range b.N {
+		users, err := memoryStorage.UsersByState(ctx, entityv1.UserState_ONLINE)
+		if err != nil || len(users) != benchUsers/100 {
+			b.Fatal("users by state:", len(users), err)
+		}
+	}
+}
+
+func BenchmarkUserByShardID(b *testing.B) {
+	memoryStorage := benchMemoryStorage(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := range b.N {
+		users, err := memoryStorage.UserByShardID(ctx, int32(i%1000)+1)
+		if err != nil || len(users) != benchUsers/1000 {
+			b.Fatal("user by shard id:", len(users), err)
+		}
+	}
+}
+
+func BenchmarkUserCreate(b *testing.B) {
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		b.Fatal("new memory storage:", err)
+	}
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := range b.N {
+		_, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: fmt.Sprintf("user%d", i)})
+		if err != nil {
+			b.Fatal("user create:", err)
+		}
+	}
+}
+
+func TestUserCloned(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+
+	user := &entityv1.User{Username: "alice", Privileges: []string{"GM"}}
+	_, err = memoryStorage.UserCreate(ctx, user)
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	user.State = entityv1.UserState_ONLINE
+	user.Privileges[0] = "ADMIN"
+
+	got, err := memoryStorage.UserByUserID(ctx, user.UserId)
+	if err != nil {
+		t.Fatal("user by user id:", err)
+	}
+	if got.State != entityv1.UserState_OFFLINE || got.Privileges[0] != "GM" {
+		t.Fatal("stored user changed through the created pointer:", got)
+	}
+
+	got.Username = "mallory"
+	again, err := memoryStorage.UserByLogin(ctx, "alice")
+	if err != nil || again == nil || again.Username != "alice" {
+		t.Fatal("stored user changed through a returned pointer:", again, err)
+	}
+}
+
+func TestUserUpdateIf(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+
+	user, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: "alice"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	if user.Revision != 1 {
+		t.Fatal("revision after create:", user.Revision)
+	}
+
+	first, _ := memoryStorage.UserByUserID(ctx, user.UserId)
+	second, _ := memoryStorage.UserByUserID(ctx, user.UserId)
+
+	first.State = entityv1.UserState_ONLINE
+	err = memoryStorage.UserUpdateIf(ctx, first, first.Revision)
+	if err != nil {
+		t.Fatal("first user update if:", err)
+	}
+	if first.Revision != 2 {
+		t.Fatal("revision after update:", first.Revision)
+	}
+
+	second.State = entityv1.UserState_ONLINE
+	err = memoryStorage.UserUpdateIf(ctx, second, second.Revision)
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatal("second user update if: expected ErrConflict, got", err)
+	}
+	var conflictErr *storage.ConflictError
+	if !errors.As(err, &conflictErr) || conflictErr.ExpectedRevision != 1 || conflictErr.ActualRevision != 2 {
+		t.Fatal("conflict error:", err)
+	}
+
+	err = memoryStorage.UserUpdateIf(ctx, &entityv1.User{UserId: 9999}, 1)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("update if missing user: expected ErrNotFound, got", err)
+	}
+}
+
+func TestUserList(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	for i := range 25 {
+		user := &entityv1.User{Username: fmt.Sprintf("user%02d", i)}
+		if i%2 == 0 {
+			user.Username = fmt.Sprintf("other%02d", i)
+			user.State = entityv1.UserState_ONLINE
+		}
+		_, err := memoryStorage.UserCreate(ctx, user)
+		if err != nil {
+			t.Fatal("user create:", err)
+		}
+	}
+
+	var userIDs []int32
+	page := storage.Page{Limit: 10}
+	for pages := 1; ; pages++ {
+		users, next, err := memoryStorage.UserList(ctx, storage.UserListFilter{}, page)
+		if err != nil {
+			t.Fatal("user list:", err)
+		}
+		for _, user := range users {
+			userIDs = append(userIDs, user.UserId)
+		}
+		if next == "" {
+			if pages != 3 {
+				t.Fatal("user list pages:", pages)
+			}
+			break
+		}
+		page.Cursor = next
+	}
+	for i, userID := range userIDs {
+		if userID != int32(i+1) {
+			t.Fatal("user list order:", userIDs)
+		}
+	}
+
+	online := entityv1.UserState_ONLINE
+	users, next, err := memoryStorage.UserList(ctx, storage.UserListFilter{State: &online, UsernamePrefix: "other1"}, storage.Page{})
+	if err != nil || next != "" || len(users) != 5 {
+		t.Fatal("user list filtered:", users, next, err)
+	}
+	users, _, err = memoryStorage.UserList(ctx, storage.UserListFilter{CreatedAfter: time.Now().Add(time.Hour)}, storage.Page{})
+	if err != nil || len(users) != 0 {
+		t.Fatal("user list created after now:", users, err)
+	}
+	_, _, err = memoryStorage.UserList(ctx, storage.UserListFilter{}, storage.Page{Cursor: "!"})
+	if !errors.Is(err, storage.ErrInvalidCursor) {
+		t.Fatal("user list bad cursor: expected ErrInvalidCursor, got", err)
+	}
+}
+
+func TestUserDelete(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	user, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", State: entityv1.UserState_ONLINE})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	err = memoryStorage.UserDelete(ctx, user.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	_, err = memoryStorage.UserByLogin(ctx, "testuser")
+	if !errors.Is(err, storage.ErrDeleted) {
+		t.Fatal("user by login after delete: expected ErrDeleted, got", err)
+	}
+	got, err := memoryStorage.UserByUserID(ctx, user.UserId)
+	if err != nil || got != nil {
+		t.Fatal("user by user id after delete:", got, err)
+	}
+	users, err := memoryStorage.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if err != nil || len(users) != 0 {
+		t.Fatal("users by state after delete:", users, err)
+	}
+	_, err = memoryStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if !errors.Is(err, storage.ErrUserExists) {
+		t.Fatal("user create with deleted username: expected ErrUserExists, got", err)
+	}
+	err = memoryStorage.UserUpdate(ctx, user)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("user update after delete: expected ErrNotFound, got", err)
+	}
+	err = memoryStorage.UserDelete(ctx, user.UserId)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("user delete twice: expected ErrNotFound, got", err)
+	}
+
+	purged, err := memoryStorage.Purge(ctx, time.Now().Add(-time.Hour))
+	if err != nil || purged != 0 {
+		t.Fatal("purge before delete:", purged, err)
+	}
+	purged, err = memoryStorage.Purge(ctx, time.Now().Add(time.Hour))
+	if err != nil || purged != 1 {
+		t.Fatal("purge after delete:", purged, err)
+	}
+	_, err = memoryStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create after purge:", err)
+	}
+}
@@ -0,0 +1,62 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+// watchBufferSize is how many events a watch may fall behind before it is
+// ended with storage.ErrSlowConsumer.
+const watchBufferSize = 256
+
+func (e *MemoryStorage) WatchUsers(ctx context.Context, filter storage.UserFilter) (*storage.Watch[storage.UserEvent], error) {
+	if filter == nil {
+		return e.userFeed.Watch(ctx, nil), nil
+	}
+	return e.userFeed.Watch(ctx, func(event storage.UserEvent) bool {
+		return filter(event.User) || (event.Previous != nil && filter(event.Previous))
+	}), nil
+}
+
+func (e *MemoryStorage) WatchShards(ctx context.Context) (*storage.Watch[storage.ShardEvent], error) {
+	return e.shardFeed.Watch(ctx, nil), nil
+}
+
+// userPublish sends a user write to the watches, once committed. user and
+// previous are stored pointers, which are replaced but never changed.
+func (e *MemoryStorage) userPublish(typ storage.EventType, user *entityv1.User, previous *entityv1.User) {
+	event := storage.UserEvent{Type: typ, User: user, Previous: previous}
+	if e.isInTx {
+		e.pending = append(e.pending, func() { e.userFeed.Publish(event) })
+		return
+	}
+	e.userFeed.Publish(event)
+}
+
+// shardPublish is userPublish for shards.
+func (e *MemoryStorage) shardPublish(typ storage.EventType, shard *entityv1.Shard, previous *entityv1.Shard) {
+	event := storage.ShardEvent{Type: typ, Shard: shard, Previous: previous}
+	if e.isInTx {
+		e.pending = append(e.pending, func() { e.shardFeed.Publish(event) })
+		return
+	}
+	e.shardFeed.Publish(event)
+}
+
+func userEventClone(event storage.UserEvent) storage.UserEvent {
+	event.User = userClone(event.User)
+	if event.Previous != nil {
+		event.Previous = userClone(event.Previous)
+	}
+	return event
+}
+
+func shardEventClone(event storage.ShardEvent) storage.ShardEvent {
+	event.Shard = shardClone(event.Shard)
+	if event.Previous != nil {
+		event.Previous = shardClone(event.Previous)
+	}
+	return event
+}
@@ -0,0 +1,161 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+func userEventNext(t *testing.T, watch *storage.Watch[storage.UserEvent]) storage.UserEvent {
+	t.Helper()
+	select {
+	case event, ok := <-watch.Events():
+		if !ok {
+			t.Fatal("watch ended:", watch.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return storage.UserEvent{}
+}
+
+func TestWatchUsers(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	var watcher storage.Watcher = memoryStorage
+	watch, err := watcher.WatchUsers(ctx, func(user *entityv1.User) bool {
+		return user.State == entityv1.UserState_ONLINE
+	})
+	if err != nil {
+		t.Fatal("watch users:", err)
+	}
+
+	user, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	user.State = entityv1.UserState_ONLINE
+	err = memoryStorage.UserUpdate(ctx, user)
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+
+	// Writes of a rolled back unit of work are never sent.
+	err = memoryStorage.WithTx(ctx, func(tx storage.Storager) error {
+		user.ShardId = 101
+		err := tx.UserUpdate(ctx, user)
+		if err != nil {
+			return err
+		}
+		return errors.New("fail")
+	})
+	if err == nil {
+		t.Fatal("rolled back with tx: expected error")
+	}
+
+	user.ShardId = 0
+	user.State = entityv1.UserState_OFFLINE
+	err = memoryStorage.UserUpdate(ctx, user)
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+
+	// The offline user created first is filtered out; going online and
+	// leaving the filter again are sent.
+	event := userEventNext(t, watch)
+	if event.Type != storage.EventUpdate || event.User.State != entityv1.UserState_ONLINE || event.Previous.State != entityv1.UserState_OFFLINE {
+		t.Fatal("online event:", event)
+	}
+	event = userEventNext(t, watch)
+	if event.Type != storage.EventUpdate || event.User.State != entityv1.UserState_OFFLINE || event.User.Revision != 3 {
+		t.Fatal("offline event:", event)
+	}
+
+	// Events are copies.
+	event.User.Username = "changed"
+	got, err := memoryStorage.UserByUserID(ctx, user.UserId)
+	if err != nil || got.Username != "testuser" {
+		t.Fatal("user by user id after changing event:", got, err)
+	}
+}
+
+func TestWatchShards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	watch, err := memoryStorage.WatchShards(ctx)
+	if err != nil {
+		t.Fatal("watch shards:", err)
+	}
+
+	shard, err := memoryStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Atys"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	shard.PlayerCount = 1
+	err = memoryStorage.ShardUpdate(ctx, shard)
+	if err != nil {
+		t.Fatal("shard update:", err)
+	}
+
+	event := <-watch.Events()
+	if event.Type != storage.EventCreate || event.Shard.ShardId != 101 || event.Previous != nil {
+		t.Fatal("create event:", event)
+	}
+	event = <-watch.Events()
+	if event.Type != storage.EventUpdate || event.Shard.PlayerCount != 1 || event.Previous.PlayerCount != 0 {
+		t.Fatal("update event:", event)
+	}
+
+	cancel()
+	_, ok := <-watch.Events()
+	if ok || !errors.Is(watch.Err(), context.Canceled) {
+		t.Fatal("watch after cancel:", ok, watch.Err())
+	}
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	slow, err := memoryStorage.WatchShards(ctx)
+	if err != nil {
+		t.Fatal("watch shards:", err)
+	}
+
+	shard, err := memoryStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	for i := range watchBufferSize {
+		shard.PlayerCount = int32(i)
+		err = memoryStorage.ShardUpdate(ctx, shard)
+		if err != nil {
+			t.Fatal("shard update:", err)
+		}
+	}
+
+	// The buffered events are still delivered before the watch ends.
+	events := 0
+	for range slow.Events() {
+		events++
+	}
+	if events != watchBufferSize || !errors.Is(slow.Err(), storage.ErrSlowConsumer) {
+		t.Fatal("slow watch:", events, slow.Err())
+	}
+	if memoryStorage.shardFeed.Len() != 0 {
+		t.Fatal("slow watch still running")
+	}
+}
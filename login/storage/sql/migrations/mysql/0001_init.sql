@@ -0,0 +1,24 @@
+CREATE TABLE users (
+	user_id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	username VARCHAR(64) COLLATE utf8mb4_bin NOT NULL UNIQUE,
+	password VARCHAR(255) NOT NULL,
+	state INT NOT NULL DEFAULT 0,
+	shard_id INT NOT NULL DEFAULT 0,
+	privileges VARCHAR(255) NOT NULL DEFAULT '',
+	INDEX users_state (state),
+	INDEX users_shard_id (shard_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE shards (
+	shard_id INT NOT NULL PRIMARY KEY,
+	name VARCHAR(64) NOT NULL DEFAULT '',
+	player_count INT NOT NULL DEFAULT 0,
+	ws_addr VARCHAR(255) NOT NULL DEFAULT '',
+	client_app VARCHAR(64) NOT NULL DEFAULT '',
+	is_online BOOLEAN NOT NULL DEFAULT FALSE,
+	capacity INT NOT NULL DEFAULT 0,
+	state INT NOT NULL DEFAULT 0,
+	is_external BOOLEAN NOT NULL DEFAULT FALSE,
+	INDEX shards_ws_addr (ws_addr),
+	INDEX shards_client_app (client_app)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
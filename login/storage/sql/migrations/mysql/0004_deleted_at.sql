@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN deleted_at BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE shards ADD COLUMN deleted_at BIGINT NOT NULL DEFAULT 0;
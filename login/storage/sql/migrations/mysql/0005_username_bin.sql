@@ -0,0 +1 @@
+ALTER TABLE users MODIFY username VARCHAR(64) COLLATE utf8mb4_bin NOT NULL;
@@ -0,0 +1,28 @@
+CREATE TABLE users (
+	user_id SERIAL PRIMARY KEY,
+	username VARCHAR(64) NOT NULL UNIQUE,
+	password VARCHAR(255) NOT NULL,
+	state INTEGER NOT NULL DEFAULT 0,
+	shard_id INTEGER NOT NULL DEFAULT 0,
+	privileges VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX users_state ON users (state);
+
+CREATE INDEX users_shard_id ON users (shard_id);
+
+CREATE TABLE shards (
+	shard_id INTEGER PRIMARY KEY,
+	name VARCHAR(64) NOT NULL DEFAULT '',
+	player_count INTEGER NOT NULL DEFAULT 0,
+	ws_addr VARCHAR(255) NOT NULL DEFAULT '',
+	client_app VARCHAR(64) NOT NULL DEFAULT '',
+	is_online BOOLEAN NOT NULL DEFAULT FALSE,
+	capacity INTEGER NOT NULL DEFAULT 0,
+	state INTEGER NOT NULL DEFAULT 0,
+	is_external BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX shards_ws_addr ON shards (ws_addr);
+
+CREATE INDEX shards_client_app ON shards (client_app);
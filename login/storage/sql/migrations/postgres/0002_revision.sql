@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN revision BIGINT NOT NULL DEFAULT 1;
+
+ALTER TABLE shards ADD COLUMN revision BIGINT NOT NULL DEFAULT 1;
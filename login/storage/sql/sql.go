@@ -0,0 +1,307 @@
+// Package sql implements storage.Storager on top of database/sql.
+//
+// The schema is created and upgraded by embedded migrations, one set per
+// supported dialect: sqlite, mysql and postgres. The matching driver must be
+// registered by the caller with a blank import.
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/runeharvest/gserver/config"
+	"github.com/runeharvest/gserver/login/storage"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+const (
+	DialectSqlite   = "sqlite"
+	DialectMysql    = "mysql"
+	DialectPostgres = "postgres"
+)
+
+type SqlStorage struct {
+	dbMux   sync.RWMutex
+	db      *sql.DB
+	dialect string
+
+	reconnectMux      sync.Mutex
+	reopen            func(ctx context.Context) (*sql.DB, error)
+	forceReconnection time.Duration
+	connState         atomic.Int32
+
+	// tx is set on the storage handed to WithTx functions, which runs every
+	// statement in the transaction instead of on db.
+	tx *sql.Tx
+}
+
+// NewSqlStorage wraps db and migrates its schema to the latest version. The
+// storage cannot reopen a caller-owned db, so broken connections are only
+// retried through db's own pool.
+func NewSqlStorage(ctx context.Context, db *sql.DB, dialect string) (*SqlStorage, error) {
+	switch dialect {
+	case DialectSqlite, DialectMysql, DialectPostgres:
+	default:
+		return nil, fmt.Errorf("unsupported dialect '%s'", dialect)
+	}
+
+	e := &SqlStorage{db: db, dialect: dialect}
+	err := e.migrate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return e, nil
+}
+
+// NewSqlStorageOpen opens driverName with dsn, migrates its schema and keeps
+// both to reopen the database when the connection breaks or every
+// forceReconnection interval while ReconnectRun is running.
+func NewSqlStorageOpen(ctx context.Context, driverName string, dsn string, dialect string, forceReconnection time.Duration) (*SqlStorage, error) {
+	reopen := func(ctx context.Context) (*sql.DB, error) {
+		db, err := sql.Open(driverName, dsn)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", dialect, err)
+		}
+		if dialect == DialectSqlite {
+			// SQLite allows a single writer; serialise access instead of failing with SQLITE_BUSY.
+			db.SetMaxOpenConns(1)
+		}
+		err = db.PingContext(ctx)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("ping %s: %w", dialect, err)
+		}
+		return db, nil
+	}
+
+	db, err := reopen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e, err := NewSqlStorage(ctx, db, dialect)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	e.reopen = reopen
+	e.forceReconnection = forceReconnection
+	return e, nil
+}
+
+// NewSqlStorageFromConfig opens the database described by the login
+// storage_driver and database_* config keys. force_database_reconnection is
+// the forced reconnection interval, "0s" disables it.
+func NewSqlStorageFromConfig(ctx context.Context) (*SqlStorage, error) {
+	dialect := config.ValueStr("login", "storage_driver")
+	host := config.ValueStr("login", "database_host")
+	name := config.ValueStr("login", "database_name")
+	username := config.ValueStr("login", "database_username")
+	password := config.ValueStr("login", "database_password")
+
+	var driverName, dsn string
+	switch dialect {
+	case DialectSqlite:
+		driverName = "sqlite"
+		dsn = "file:" + name + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	case DialectMysql:
+		driverName = "mysql"
+		dsn = fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&clientFoundRows=true", username, password, host, name)
+	case DialectPostgres:
+		driverName = "postgres"
+		dsn = (&url.URL{Scheme: "postgres", User: url.UserPassword(username, password), Host: host, Path: name}).String()
+	default:
+		return nil, fmt.Errorf("unsupported storage driver '%s'", dialect)
+	}
+
+	forceReconnection, err := time.ParseDuration(config.ValueStr("login", "force_database_reconnection"))
+	if err != nil {
+		return nil, fmt.Errorf("parse force_database_reconnection: %w", err)
+	}
+
+	return NewSqlStorageOpen(ctx, driverName, dsn, dialect, forceReconnection)
+}
+
+// Close closes the underlying database.
+func (e *SqlStorage) Close() error {
+	return e.dbGet().Close()
+}
+
+// rebind rewrites ? placeholders for dialects that use numbered ones.
+func (e *SqlStorage) rebind(query string) string {
+	if e.dialect != DialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// migrate applies every embedded migration newer than the recorded schema version.
+func (e *SqlStorage) migrate(ctx context.Context) error {
+	_, err := e.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)")
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current sql.NullInt64
+	err = e.db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("schema version: %w", err)
+	}
+
+	dir := path.Join("migrations", e.dialect)
+	entries, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", dir, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		name := entry.Name()
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return fmt.Errorf("migration %s: missing version prefix", name)
+		}
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return fmt.Errorf("migration %s: parse version: %w", name, err)
+		}
+		if version <= current.Int64 {
+			continue
+		}
+
+		content, err := migrations.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		err = e.migrationApply(ctx, version, string(content))
+		if err != nil {
+			return fmt.Errorf("apply %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (e *SqlStorage) migrationApply(ctx context.Context, version int64, content string) error {
+	tx, err := e.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, statement := range strings.Split(content, ";") {
+		statement = strings.TrimSpace(statement)
+		if statement == "" {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return fmt.Errorf("exec: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, e.rebind("INSERT INTO schema_migrations (version) VALUES (?)"), version)
+	if err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+	return tx.Commit()
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// Purge deletes the tombstones in one statement per table.
+func (e *SqlStorage) Purge(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	for _, table := range []string{"users", "shards"} {
+		var result sql.Result
+		err := e.write(ctx, func(q querier) error {
+			var err error
+			result, err = q.ExecContext(ctx, e.rebind("DELETE FROM "+table+" WHERE deleted_at > 0 AND deleted_at < ?"), before.UnixMilli())
+			return err
+		})
+		if err != nil {
+			return purged, fmt.Errorf("delete %s: %w", table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return purged, fmt.Errorf("rows affected: %w", err)
+		}
+		purged += int(n)
+	}
+	return purged, nil
+}
+
+// revisionUpdate sets the columns in setClause from args on the row of table
+// with idColumn id, and bumps its revision. With expectedRevision set it only
+// updates that revision; without, it retries until no concurrent update gets
+// in between. It returns the new revision.
+func (e *SqlStorage) revisionUpdate(ctx context.Context, entity string, table string, idColumn string, id int32, expectedRevision *int64, setClause string, args []any) (int64, error) {
+	for {
+		var revision int64
+		err := e.readRetry(ctx, func(q querier) error {
+			return q.QueryRowContext(ctx, e.rebind("SELECT revision FROM "+table+" WHERE "+idColumn+" = ? AND deleted_at = 0"), id).Scan(&revision)
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%s %d: %w", entity, id, storage.ErrNotFound)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("revision: %w", err)
+		}
+		if expectedRevision != nil && revision != *expectedRevision {
+			return 0, &storage.ConflictError{Entity: entity, ID: id, ExpectedRevision: *expectedRevision, ActualRevision: revision}
+		}
+
+		query := "UPDATE " + table + " SET " + setClause + ", revision = ? WHERE " + idColumn + " = ? AND revision = ?"
+		updateArgs := append(append([]any{}, args...), revision+1, id, revision)
+		var result sql.Result
+		err = e.write(ctx, func(q querier) error {
+			var err error
+			result, err = q.ExecContext(ctx, e.rebind(query), updateArgs...)
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("update: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("rows affected: %w", err)
+		}
+		if n > 0 {
+			return revision + 1, nil
+		}
+		// Updated by someone else between the read and the update; the next
+		// round reports the conflict or retries.
+	}
+}
@@ -0,0 +1,225 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	reconnectBackoffMin = 100 * time.Millisecond
+	reconnectBackoffMax = 5 * time.Second
+	// readRetryAttempts bounds how often an idempotent read is retried on a
+	// broken connection before the error is returned to the caller.
+	readRetryAttempts = 8
+)
+
+// ConnState is the health of the database connection.
+type ConnState int32
+
+const (
+	ConnStateConnected ConnState = iota
+	ConnStateReconnecting
+	ConnStateDisconnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateConnected:
+		return "connected"
+	case ConnStateReconnecting:
+		return "reconnecting"
+	case ConnStateDisconnected:
+		return "disconnected"
+	}
+	return fmt.Sprintf("ConnState(%d)", int32(s))
+}
+
+// ConnState returns the last known state of the database connection.
+func (e *SqlStorage) ConnState() ConnState {
+	return ConnState(e.connState.Load())
+}
+
+// Ping checks the database connection and updates ConnState, for health checks.
+func (e *SqlStorage) Ping(ctx context.Context) error {
+	err := e.dbGet().PingContext(ctx)
+	if err != nil {
+		e.connState.Store(int32(ConnStateDisconnected))
+		return fmt.Errorf("ping: %w", err)
+	}
+	e.connState.Store(int32(ConnStateConnected))
+	return nil
+}
+
+func (e *SqlStorage) dbGet() *sql.DB {
+	e.dbMux.RLock()
+	defer e.dbMux.RUnlock()
+	return e.db
+}
+
+// reconnect replaces failed with a freshly opened database. If another caller
+// already replaced it, nothing is done. Storages built around a caller-owned
+// *sql.DB cannot reopen it and only ping.
+func (e *SqlStorage) reconnect(ctx context.Context, failed *sql.DB) error {
+	e.reconnectMux.Lock()
+	defer e.reconnectMux.Unlock()
+
+	if e.dbGet() != failed {
+		return nil
+	}
+	if e.reopen == nil {
+		return e.Ping(ctx)
+	}
+
+	e.connState.Store(int32(ConnStateReconnecting))
+	db, err := e.reopen(ctx)
+	if err != nil {
+		e.connState.Store(int32(ConnStateDisconnected))
+		return fmt.Errorf("reopen: %w", err)
+	}
+
+	e.dbMux.Lock()
+	e.db = db
+	e.dbMux.Unlock()
+	e.connState.Store(int32(ConnStateConnected))
+
+	// Close waits for queries already running on the old pool.
+	go failed.Close()
+	return nil
+}
+
+// readRetry runs an idempotent read. While it fails with a broken connection
+// the database is reconnected with exponential backoff and the read retried.
+func (e *SqlStorage) readRetry(ctx context.Context, read func(q querier) error) error {
+	if e.tx != nil {
+		// A broken connection has lost the transaction; retrying cannot help.
+		return read(e.tx)
+	}
+	backoff := reconnectBackoffMin
+	for attempt := 1; ; attempt++ {
+		db := e.dbGet()
+		err := read(db)
+		if !isConnError(err) {
+			e.connState.Store(int32(ConnStateConnected))
+			return err
+		}
+		if attempt >= readRetryAttempts {
+			e.connState.Store(int32(ConnStateDisconnected))
+			return err
+		}
+		slog.Warn("Database read failed, reconnecting", "attempt", attempt, "backoff", backoff, "error", err)
+
+		e.connState.Store(int32(ConnStateReconnecting))
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, reconnectBackoffMax)
+
+		err = e.reconnect(ctx, db)
+		if err != nil {
+			slog.Warn("Database reconnect failed", "error", err)
+		}
+	}
+}
+
+// write runs a statement that is not safe to repeat. A broken connection is
+// reconnected for later calls, but the write itself is not retried.
+func (e *SqlStorage) write(ctx context.Context, write func(q querier) error) error {
+	if e.tx != nil {
+		return write(e.tx)
+	}
+	db := e.dbGet()
+	err := write(db)
+	if !isConnError(err) {
+		e.connState.Store(int32(ConnStateConnected))
+		return err
+	}
+	reconnectErr := e.reconnect(ctx, db)
+	if reconnectErr != nil {
+		slog.Warn("Database reconnect failed", "error", reconnectErr)
+	}
+	return err
+}
+
+// ReconnectRun forces a reconnection every force_database_reconnection
+// interval until ctx is done, as the NeL login service did. A non-positive
+// interval disables forced reconnection.
+func (e *SqlStorage) ReconnectRun(ctx context.Context) error {
+	if e.forceReconnection <= 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(e.forceReconnection)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			err := e.reconnect(ctx, e.dbGet())
+			if err != nil {
+				slog.Warn("Forced database reconnect failed", "error", err)
+			}
+		}
+	}
+}
+
+// isConnError reports whether err means the connection to the database broke,
+// as opposed to a failure of the statement itself.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// The caller gave up; context.DeadlineExceeded is a net.Error too, but
+	// retrying or reconnecting cannot help.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isUniqueViolation reports whether err is the driver refusing a row that
+// breaks a unique constraint. Inside a transaction this is the only safe way
+// to tell: postgres aborts the transaction on the error, so nothing can be
+// looked up to find the conflicting row.
+func isUniqueViolation(err error) bool {
+	// github.com/go-sql-driver/mysql: ER_DUP_ENTRY.
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062
+	}
+	// github.com/lib/pq and pgx: unique_violation.
+	var sqlStateErr interface{ SQLState() string }
+	if errors.As(err, &sqlStateErr) {
+		return sqlStateErr.SQLState() == "23505"
+	}
+	// modernc.org/sqlite: SQLITE_CONSTRAINT_UNIQUE and
+	// SQLITE_CONSTRAINT_PRIMARYKEY.
+	var codeErr interface{ Code() int }
+	if errors.As(err, &codeErr) {
+		return codeErr.Code() == 2067 || codeErr.Code() == 1555
+	}
+	return false
+}
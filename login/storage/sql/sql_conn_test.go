@@ -0,0 +1,171 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	"modernc.org/sqlite"
+)
+
+// flakyDown makes every flaky driver connection fail like a lost network link.
+var flakyDown atomic.Bool
+
+func init() {
+	sql.Register("flakysqlite", flakyDriver{&sqlite.Driver{}})
+}
+
+type flakyDriver struct {
+	driver.Driver
+}
+
+func (d flakyDriver) Open(name string) (driver.Conn, error) {
+	if flakyDown.Load() {
+		return nil, flakyErr()
+	}
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return flakyConn{conn}, nil
+}
+
+type flakyConn struct {
+	driver.Conn
+}
+
+func (c flakyConn) Prepare(query string) (driver.Stmt, error) {
+	if flakyDown.Load() {
+		return nil, flakyErr()
+	}
+	return c.Conn.Prepare(query)
+}
+
+func flakyErr() error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: &net.DNSError{Err: "connection lost", IsTemporary: true}}
+}
+
+func TestSqlReconnect(t *testing.T) {
+	ctx := context.Background()
+	t.Cleanup(func() { flakyDown.Store(false) })
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "login.db") + "?_pragma=busy_timeout(5000)"
+	sqlStorage, err := NewSqlStorageOpen(ctx, "flakysqlite", dsn, DialectSqlite, 0)
+	if err != nil {
+		t.Fatal("new sql storage:", err)
+	}
+	defer sqlStorage.Close()
+
+	_, err = sqlStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	// Writes are not retried, the caller sees the broken connection.
+	flakyDown.Store(true)
+	_, err = sqlStorage.UserCreate(ctx, &entityv1.User{Username: "otheruser", Password: "hash"})
+	if err == nil {
+		t.Fatal("user create while down: expected error")
+	}
+	if sqlStorage.ConnState() == ConnStateConnected {
+		t.Fatal("conn state while down:", sqlStorage.ConnState())
+	}
+
+	// Reads are retried until the database is back.
+	time.AfterFunc(300*time.Millisecond, func() { flakyDown.Store(false) })
+	user, err := sqlStorage.UserByLogin(ctx, "testuser")
+	if err != nil || user == nil {
+		t.Fatal("user by login after reconnect:", user, err)
+	}
+	if sqlStorage.ConnState() != ConnStateConnected {
+		t.Fatal("conn state after reconnect:", sqlStorage.ConnState())
+	}
+
+	// A read that keeps failing gives up once ctx is done.
+	flakyDown.Store(true)
+	ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = sqlStorage.UserByLogin(ctx, "testuser")
+	if err == nil {
+		t.Fatal("user by login while down: expected error")
+	}
+}
+
+func TestSqlReconnectRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "login.db") + "?_pragma=busy_timeout(5000)"
+	sqlStorage, err := NewSqlStorageOpen(ctx, "flakysqlite", dsn, DialectSqlite, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal("new sql storage:", err)
+	}
+	defer sqlStorage.Close()
+
+	before := sqlStorage.dbGet()
+	go sqlStorage.ReconnectRun(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sqlStorage.dbGet() == before {
+		if time.Now().After(deadline) {
+			t.Fatal("database was not reopened by force_database_reconnection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = sqlStorage.UserByLogin(ctx, "testuser")
+	if err != nil {
+		t.Fatal("user by login after forced reconnect:", err)
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	tests := []struct {
+		err               error
+		isUniqueViolation bool
+	}{
+		{&mysql.MySQLError{Number: 1062}, true},
+		{&mysql.MySQLError{Number: 1452}, false},
+		{&pq.Error{Code: "23505"}, true},
+		{&pq.Error{Code: "23503"}, false},
+		{fmt.Errorf("insert: %w", &pq.Error{Code: "23505"}), true},
+		{flakyErr(), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if isUniqueViolation(tt.err) != tt.isUniqueViolation {
+			t.Fatal("is unique violation:", tt.err)
+		}
+	}
+}
+
+func TestIsConnError(t *testing.T) {
+	tests := []struct {
+		err         error
+		isConnError bool
+	}{
+		{flakyErr(), true},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("query: %w", io.ErrUnexpectedEOF), true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), false},
+		{&pq.Error{Code: "23505"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if isConnError(tt.err) != tt.isConnError {
+			t.Fatal("is conn error:", tt.err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+const shardColumns = "shard_id, name, player_count, ws_addr, client_app, is_online, capacity, state, is_external, revision, deleted_at"
+
+func scanShard(row rowScanner) (*entityv1.Shard, error) {
+	shard := &entityv1.Shard{}
+	var state int32
+	err := row.Scan(&shard.ShardId, &shard.Name, &shard.PlayerCount, &shard.WsAddr, &shard.ClientApp,
+		&shard.IsOnline, &shard.Capacity, &state, &shard.IsExternal, &shard.Revision, &shard.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
+	shard.State = entityv1.ShardState(state)
+	return shard, nil
+}
+
+func (e *SqlStorage) shardsQuery(ctx context.Context, query string, args ...any) ([]*entityv1.Shard, error) {
+	var shards []*entityv1.Shard
+	err := e.readRetry(ctx, func(q querier) error {
+		shards = nil
+		rows, err := q.QueryContext(ctx, e.rebind(query), args...)
+		if err != nil {
+			return fmt.Errorf("query: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			shard, err := scanShard(rows)
+			if err != nil {
+				return fmt.Errorf("scan: %w", err)
+			}
+			shards = append(shards, shard)
+		}
+		err = rows.Err()
+		if err != nil {
+			return fmt.Errorf("rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+func (e *SqlStorage) shardQuery(ctx context.Context, query string, args ...any) (*entityv1.Shard, error) {
+	var shard *entityv1.Shard
+	err := e.readRetry(ctx, func(q querier) error {
+		var err error
+		shard, err = scanShard(q.QueryRowContext(ctx, e.rebind(query), args...))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	return shard, nil
+}
+
+func (e *SqlStorage) Shards(ctx context.Context) ([]*entityv1.Shard, error) {
+	return e.shardsQuery(ctx, "SELECT "+shardColumns+" FROM shards WHERE deleted_at = 0 ORDER BY shard_id")
+}
+
+func (e *SqlStorage) ShardList(ctx context.Context, filter storage.ShardListFilter, page storage.Page) ([]*entityv1.Shard, string, error) {
+	after, err := storage.CursorDecode(page.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	query := "SELECT " + shardColumns + " FROM shards WHERE shard_id > ? AND deleted_at = 0"
+	args := []any{after}
+	if filter.ClientApp != "" {
+		query += " AND client_app = ?"
+		args = append(args, filter.ClientApp)
+	}
+	query += " ORDER BY shard_id LIMIT ?"
+	args = append(args, page.Size()+1)
+
+	shards, err := e.shardsQuery(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(shards) <= page.Size() {
+		return shards, "", nil
+	}
+	shards = shards[:page.Size()]
+	return shards, storage.CursorEncode(shards[len(shards)-1].ShardId), nil
+}
+
+func (e *SqlStorage) ShardByShardID(ctx context.Context, shardID int32) (*entityv1.Shard, error) {
+	return e.shardQuery(ctx, "SELECT "+shardColumns+" FROM shards WHERE shard_id = ? AND deleted_at = 0", shardID)
+}
+
+func (e *SqlStorage) ShardByWSAddr(ctx context.Context, wsAddr string) (*entityv1.Shard, error) {
+	return e.shardQuery(ctx, "SELECT "+shardColumns+" FROM shards WHERE ws_addr = ? AND deleted_at = 0", wsAddr)
+}
+
+func (e *SqlStorage) ShardCreate(ctx context.Context, shard *entityv1.Shard) (*entityv1.Shard, error) {
+	const query = "INSERT INTO shards (" + shardColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1, 0)"
+	err := e.write(ctx, func(q querier) error {
+		// A new shard may reuse the id of a deleted one.
+		_, err := q.ExecContext(ctx, e.rebind("DELETE FROM shards WHERE shard_id = ? AND deleted_at > 0"), shard.ShardId)
+		if err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, e.rebind(query),
+			shard.ShardId, shard.Name, shard.PlayerCount, shard.WsAddr, shard.ClientApp,
+			shard.IsOnline, shard.Capacity, int32(shard.State), shard.IsExternal,
+		)
+		return err
+	})
+	if isUniqueViolation(err) {
+		return nil, fmt.Errorf("shard %d: %w", shard.ShardId, storage.ErrShardExists)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("insert: %w", err)
+	}
+	shard.Revision = 1
+	return shard, nil
+}
+
+func (e *SqlStorage) ShardUpdate(ctx context.Context, shard *entityv1.Shard) error {
+	return e.shardUpdate(ctx, shard, nil)
+}
+
+func (e *SqlStorage) ShardUpdateIf(ctx context.Context, shard *entityv1.Shard, expectedRevision int64) error {
+	return e.shardUpdate(ctx, shard, &expectedRevision)
+}
+
+func (e *SqlStorage) shardUpdate(ctx context.Context, shard *entityv1.Shard, expectedRevision *int64) error {
+	revision, err := e.revisionUpdate(ctx, "shard", "shards", "shard_id", shard.ShardId, expectedRevision,
+		"name = ?, player_count = ?, ws_addr = ?, client_app = ?, is_online = ?, capacity = ?, state = ?, is_external = ?",
+		[]any{shard.Name, shard.PlayerCount, shard.WsAddr, shard.ClientApp, shard.IsOnline, shard.Capacity, int32(shard.State), shard.IsExternal},
+	)
+	if err != nil {
+		return err
+	}
+	shard.Revision = revision
+	return nil
+}
+
+func (e *SqlStorage) ShardsByClientApplication(ctx context.Context, clientApp string) ([]*entityv1.Shard, error) {
+	return e.shardsQuery(ctx, "SELECT "+shardColumns+" FROM shards WHERE client_app = ? AND deleted_at = 0", clientApp)
+}
+
+func (e *SqlStorage) ShardDelete(ctx context.Context, shardID int32) error {
+	_, err := e.revisionUpdate(ctx, "shard", "shards", "shard_id", shardID, nil, "deleted_at = ?", []any{time.Now().UnixMilli()})
+	return err
+}
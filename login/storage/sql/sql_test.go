@@ -0,0 +1,373 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	"github.com/runeharvest/gserver/login/storage/storagetest"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	_ "modernc.org/sqlite"
+)
+
+func newTestSqlStorage(t *testing.T, path string) *SqlStorage {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	sqlStorage, err := NewSqlStorage(context.Background(), db, DialectSqlite)
+	if err != nil {
+		t.Fatal("new sql storage:", err)
+	}
+	return sqlStorage
+}
+
+func TestSqlUser(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "login.db")
+	sqlStorage := newTestSqlStorage(t, path)
+
+	user, err := sqlStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash", Privileges: []string{"GM", "DEV"}})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	if user.UserId == 0 {
+		t.Fatal("user id not allocated")
+	}
+
+	_, err = sqlStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash"})
+	if !errors.Is(err, storage.ErrUserExists) {
+		t.Fatal("duplicate user create: expected ErrUserExists, got", err)
+	}
+
+	user.State = entityv1.UserState_ONLINE
+	user.ShardId = 101
+	err = sqlStorage.UserUpdate(ctx, user)
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+
+	err = sqlStorage.UserUpdate(ctx, &entityv1.User{UserId: 9999, Username: "ghost"})
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("update missing user: expected ErrNotFound, got", err)
+	}
+
+	// A second storage on the same file sees the data, as after a restart.
+	reopened := newTestSqlStorage(t, path)
+
+	got, err := reopened.UserByLogin(ctx, "testuser")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	if got == nil || got.UserId != user.UserId || got.State != entityv1.UserState_ONLINE || got.ShardId != 101 {
+		t.Fatal("user by login:", got)
+	}
+	if len(got.Privileges) != 2 || got.Privileges[0] != "GM" || got.Privileges[1] != "DEV" {
+		t.Fatal("privileges:", got.Privileges)
+	}
+
+	got, err = reopened.UserByLogin(ctx, "nobody")
+	if err != nil || got != nil {
+		t.Fatal("user by unknown login:", got, err)
+	}
+
+	users, err := reopened.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if err != nil || len(users) != 1 {
+		t.Fatal("users by state:", users, err)
+	}
+	users, err = reopened.UserByShardID(ctx, 101)
+	if err != nil || len(users) != 1 {
+		t.Fatal("user by shard id:", users, err)
+	}
+}
+
+func TestSqlUserCreateConcurrentSameName(t *testing.T) {
+	sqlStorage := newTestSqlStorage(t, filepath.Join(t.TempDir(), "login.db"))
+
+	const attempts = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sqlStorage.UserCreate(context.Background(), &entityv1.User{Username: "testuser", Password: "hash"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		if !errors.Is(err, storage.ErrUserExists) {
+			t.Fatal("user create: expected ErrUserExists, got", err)
+		}
+	}
+	if created != 1 {
+		t.Fatal("expected exactly one user created, got", created)
+	}
+}
+
+func TestSqlShard(t *testing.T) {
+	ctx := context.Background()
+	sqlStorage := newTestSqlStorage(t, filepath.Join(t.TempDir(), "login.db"))
+
+	_, err := sqlStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Atys", WsAddr: "atys:49999", ClientApp: "ryzom", State: entityv1.ShardState_OPEN})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	_, err = sqlStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 102, Name: "Test", WsAddr: "test:49999", ClientApp: "other"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+
+	shard, err := sqlStorage.ShardByWSAddr(ctx, "atys:49999")
+	if err != nil || shard == nil || shard.ShardId != 101 || shard.State != entityv1.ShardState_OPEN {
+		t.Fatal("shard by ws addr:", shard, err)
+	}
+
+	shard.PlayerCount = 42
+	shard.IsOnline = true
+	err = sqlStorage.ShardUpdate(ctx, shard)
+	if err != nil {
+		t.Fatal("shard update:", err)
+	}
+
+	shards, err := sqlStorage.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil {
+		t.Fatal("shards by client application:", err)
+	}
+	if len(shards) != 1 || shards[0].PlayerCount != 42 || !shards[0].IsOnline {
+		t.Fatal("shards by client application:", shards)
+	}
+
+	shards, err = sqlStorage.Shards(ctx)
+	if err != nil || len(shards) != 2 {
+		t.Fatal("shards:", shards, err)
+	}
+
+	shard, err = sqlStorage.ShardByShardID(ctx, 999)
+	if err != nil || shard != nil {
+		t.Fatal("shard by unknown shard id:", shard, err)
+	}
+}
+
+func TestSqlUpdateIf(t *testing.T) {
+	ctx := context.Background()
+	sqlStorage := newTestSqlStorage(t, filepath.Join(t.TempDir(), "login.db"))
+
+	user, err := sqlStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash"})
+	if err != nil || user.Revision != 1 {
+		t.Fatal("user create:", user, err)
+	}
+
+	user.State = entityv1.UserState_ONLINE
+	err = sqlStorage.UserUpdateIf(ctx, user, 1)
+	if err != nil || user.Revision != 2 {
+		t.Fatal("user update if:", user.Revision, err)
+	}
+	err = sqlStorage.UserUpdateIf(ctx, user, 1)
+	var conflictErr *storage.ConflictError
+	if !errors.As(err, &conflictErr) || conflictErr.ActualRevision != 2 {
+		t.Fatal("stale user update if: expected ConflictError, got", err)
+	}
+	err = sqlStorage.UserUpdate(ctx, user)
+	if err != nil || user.Revision != 3 {
+		t.Fatal("user update:", user.Revision, err)
+	}
+	got, err := sqlStorage.UserByUserID(ctx, user.UserId)
+	if err != nil || got.Revision != 3 || got.State != entityv1.UserState_ONLINE {
+		t.Fatal("user by user id:", got, err)
+	}
+	err = sqlStorage.UserUpdateIf(ctx, &entityv1.User{UserId: 9999}, 1)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("update if missing user: expected ErrNotFound, got", err)
+	}
+
+	shard, err := sqlStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Atys"})
+	if err != nil || shard.Revision != 1 {
+		t.Fatal("shard create:", shard, err)
+	}
+	shard.PlayerCount = 1
+	err = sqlStorage.ShardUpdateIf(ctx, shard, 1)
+	if err != nil || shard.Revision != 2 {
+		t.Fatal("shard update if:", shard.Revision, err)
+	}
+	err = sqlStorage.ShardUpdateIf(ctx, shard, 1)
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatal("stale shard update if: expected ErrConflict, got", err)
+	}
+}
+
+func TestSqlWithTx(t *testing.T) {
+	ctx := context.Background()
+	sqlStorage := newTestSqlStorage(t, filepath.Join(t.TempDir(), "login.db"))
+
+	user, err := sqlStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	errFail := errors.New("fail")
+	err = sqlStorage.WithTx(ctx, func(tx storage.Storager) error {
+		_, err := tx.UserCreate(ctx, &entityv1.User{Username: "otheruser", Password: "hash"})
+		if err != nil {
+			return err
+		}
+		online := &entityv1.User{UserId: user.UserId, Username: "testuser", Password: "hash", State: entityv1.UserState_ONLINE}
+		err = tx.UserUpdateIf(ctx, online, 1)
+		if err != nil {
+			return err
+		}
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatal("rolled back with tx: expected errFail, got", err)
+	}
+	got, err := sqlStorage.UserByLogin(ctx, "otheruser")
+	if err != nil || got != nil {
+		t.Fatal("user created in rolled back tx:", got, err)
+	}
+	got, err = sqlStorage.UserByUserID(ctx, user.UserId)
+	if err != nil || got == nil || got.Revision != 1 || got.State != entityv1.UserState_OFFLINE {
+		t.Fatal("user after rolled back tx:", got, err)
+	}
+
+	err = sqlStorage.WithTx(ctx, func(tx storage.Storager) error {
+		_, err := tx.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Atys", ClientApp: "ryzom"})
+		if err != nil {
+			return err
+		}
+		// Nested units of work join the outer one.
+		return tx.WithTx(ctx, func(tx storage.Storager) error {
+			_, err := tx.UserCreate(ctx, &entityv1.User{Username: "otheruser", Password: "hash"})
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal("committed with tx:", err)
+	}
+	got, err = sqlStorage.UserByLogin(ctx, "otheruser")
+	if err != nil || got == nil {
+		t.Fatal("user created in committed tx:", got, err)
+	}
+	shards, err := sqlStorage.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil || len(shards) != 1 {
+		t.Fatal("shards created in committed tx:", shards, err)
+	}
+}
+
+func TestSqlUserList(t *testing.T) {
+	ctx := context.Background()
+	sqlStorage := newTestSqlStorage(t, filepath.Join(t.TempDir(), "login.db"))
+
+	for _, username := range []string{"Alice", "alina", "bob", "alfred"} {
+		_, err := sqlStorage.UserCreate(ctx, &entityv1.User{Username: username, Password: "hash"})
+		if err != nil {
+			t.Fatal("user create:", err)
+		}
+	}
+
+	users, next, err := sqlStorage.UserList(ctx, storage.UserListFilter{UsernamePrefix: "al"}, storage.Page{Limit: 1})
+	if err != nil || len(users) != 1 || users[0].Username != "alina" || next == "" {
+		t.Fatal("user list first page:", users, next, err)
+	}
+	users, next, err = sqlStorage.UserList(ctx, storage.UserListFilter{UsernamePrefix: "al"}, storage.Page{Cursor: next, Limit: 1})
+	if err != nil || len(users) != 1 || users[0].Username != "alfred" || next != "" {
+		t.Fatal("user list last page:", users, next, err)
+	}
+
+	created := users[0].CreatedAt
+	if created == 0 {
+		t.Fatal("user created at not set")
+	}
+	users, _, err = sqlStorage.UserList(ctx, storage.UserListFilter{CreatedAfter: time.UnixMilli(created)}, storage.Page{})
+	if err != nil || len(users) != 0 {
+		t.Fatal("user list created after last user:", users, err)
+	}
+
+	_, err = sqlStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 102, ClientApp: "ryzom"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	_, err = sqlStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, ClientApp: "ryzom"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	shards, next, err := sqlStorage.ShardList(ctx, storage.ShardListFilter{ClientApp: "ryzom"}, storage.Page{})
+	if err != nil || len(shards) != 2 || shards[0].ShardId != 101 || next != "" {
+		t.Fatal("shard list:", shards, next, err)
+	}
+}
+
+func TestSqlDelete(t *testing.T) {
+	ctx := context.Background()
+	sqlStorage := newTestSqlStorage(t, filepath.Join(t.TempDir(), "login.db"))
+
+	user, err := sqlStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	err = sqlStorage.UserDelete(ctx, user.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	_, err = sqlStorage.UserByLogin(ctx, "testuser")
+	if !errors.Is(err, storage.ErrDeleted) {
+		t.Fatal("user by login after delete: expected ErrDeleted, got", err)
+	}
+	got, err := sqlStorage.UserByUserID(ctx, user.UserId)
+	if err != nil || got != nil {
+		t.Fatal("user by user id after delete:", got, err)
+	}
+	_, err = sqlStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash"})
+	if !errors.Is(err, storage.ErrUserExists) {
+		t.Fatal("user create with deleted username: expected ErrUserExists, got", err)
+	}
+	err = sqlStorage.UserUpdate(ctx, user)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("user update after delete: expected ErrNotFound, got", err)
+	}
+
+	_, err = sqlStorage.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, WsAddr: "atys:49999"})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	err = sqlStorage.ShardDelete(ctx, 101)
+	if err != nil {
+		t.Fatal("shard delete:", err)
+	}
+	shard, err := sqlStorage.ShardByWSAddr(ctx, "atys:49999")
+	if err != nil || shard != nil {
+		t.Fatal("shard by ws addr after delete:", shard, err)
+	}
+
+	purged, err := sqlStorage.Purge(ctx, time.Now().Add(time.Hour))
+	if err != nil || purged != 2 {
+		t.Fatal("purge:", purged, err)
+	}
+	_, err = sqlStorage.UserCreate(ctx, &entityv1.User{Username: "testuser", Password: "hash"})
+	if err != nil {
+		t.Fatal("user create after purge:", err)
+	}
+}
+
+func TestSqlStorager(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		return newTestSqlStorage(t, filepath.Join(t.TempDir(), "login.db"))
+	})
+}
@@ -0,0 +1,49 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/runeharvest/gserver/login/storage"
+)
+
+// WithTx runs fn in a database transaction, committed if fn returns nil and
+// rolled back otherwise. Statements in the transaction are not retried on a
+// broken connection; the error is returned and the caller retries the whole
+// unit of work.
+func (e *SqlStorage) WithTx(ctx context.Context, fn func(tx storage.Storager) error) error {
+	if e.tx != nil {
+		return fn(e)
+	}
+
+	db := e.dbGet()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		if isConnError(err) {
+			reconnectErr := e.reconnect(ctx, db)
+			if reconnectErr != nil {
+				slog.Warn("Database reconnect failed", "error", reconnectErr)
+			}
+		}
+		return fmt.Errorf("begin: %w", err)
+	}
+
+	isCommitted := false
+	defer func() {
+		if !isCommitted {
+			tx.Rollback()
+		}
+	}()
+
+	err = fn(&SqlStorage{dialect: e.dialect, tx: tx})
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	isCommitted = true
+	return nil
+}
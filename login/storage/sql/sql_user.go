@@ -0,0 +1,219 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+const userColumns = "user_id, username, password, state, shard_id, privileges, revision, created_at, deleted_at"
+
+func scanUser(row rowScanner) (*entityv1.User, error) {
+	user := &entityv1.User{}
+	var state int32
+	var privileges string
+	err := row.Scan(&user.UserId, &user.Username, &user.Password, &state, &user.ShardId, &privileges, &user.Revision, &user.CreatedAt, &user.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
+	user.State = entityv1.UserState(state)
+	if privileges != "" {
+		user.Privileges = strings.Split(privileges, ",")
+	}
+	return user, nil
+}
+
+func (e *SqlStorage) usersQuery(ctx context.Context, query string, args ...any) ([]*entityv1.User, error) {
+	var users []*entityv1.User
+	err := e.readRetry(ctx, func(q querier) error {
+		users = nil
+		rows, err := q.QueryContext(ctx, e.rebind(query), args...)
+		if err != nil {
+			return fmt.Errorf("query: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return fmt.Errorf("scan: %w", err)
+			}
+			users = append(users, user)
+		}
+		err = rows.Err()
+		if err != nil {
+			return fmt.Errorf("rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (e *SqlStorage) userQuery(ctx context.Context, query string, args ...any) (*entityv1.User, error) {
+	var user *entityv1.User
+	err := e.readRetry(ctx, func(q querier) error {
+		var err error
+		user, err = scanUser(q.QueryRowContext(ctx, e.rebind(query), args...))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	return user, nil
+}
+
+func (e *SqlStorage) Users(ctx context.Context) ([]*entityv1.User, error) {
+	return e.usersQuery(ctx, "SELECT "+userColumns+" FROM users WHERE deleted_at = 0 ORDER BY user_id")
+}
+
+func (e *SqlStorage) UserList(ctx context.Context, filter storage.UserListFilter, page storage.Page) ([]*entityv1.User, string, error) {
+	after, err := storage.CursorDecode(page.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	query := "SELECT " + userColumns + " FROM users WHERE user_id > ? AND deleted_at = 0"
+	args := []any{after}
+	if filter.State != nil {
+		query += " AND state = ?"
+		args = append(args, int32(*filter.State))
+	}
+	if filter.ShardID != nil {
+		query += " AND shard_id = ?"
+		args = append(args, *filter.ShardID)
+	}
+	if filter.UsernamePrefix != "" {
+		// Unlike LIKE, substr compares case sensitively in every dialect and
+		// needs no escaping.
+		query += " AND substr(username, 1, ?) = ?"
+		args = append(args, utf8.RuneCountInString(filter.UsernamePrefix), filter.UsernamePrefix)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		query += " AND created_at > ?"
+		args = append(args, filter.CreatedAfter.UnixMilli())
+	}
+	// One more row than the page holds tells whether there is a next page.
+	query += " ORDER BY user_id LIMIT ?"
+	args = append(args, page.Size()+1)
+
+	users, err := e.usersQuery(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(users) <= page.Size() {
+		return users, "", nil
+	}
+	users = users[:page.Size()]
+	return users, storage.CursorEncode(users[len(users)-1].UserId), nil
+}
+
+func (e *SqlStorage) UserByLogin(ctx context.Context, login string) (*entityv1.User, error) {
+	// Deleted users keep their username, so the lookup finds them too.
+	user, err := e.userQuery(ctx, "SELECT "+userColumns+" FROM users WHERE username = ?", login)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil && user.DeletedAt != 0 {
+		return nil, fmt.Errorf("user %d: %w", user.UserId, storage.ErrDeleted)
+	}
+	return user, nil
+}
+
+func (e *SqlStorage) UserByUserID(ctx context.Context, userID int32) (*entityv1.User, error) {
+	return e.userQuery(ctx, "SELECT "+userColumns+" FROM users WHERE user_id = ? AND deleted_at = 0", userID)
+}
+
+func (e *SqlStorage) UsersByState(ctx context.Context, state entityv1.UserState) ([]*entityv1.User, error) {
+	return e.usersQuery(ctx, "SELECT "+userColumns+" FROM users WHERE state = ? AND deleted_at = 0", int32(state))
+}
+
+func (e *SqlStorage) UserByShardID(ctx context.Context, shardID int32) ([]*entityv1.User, error) {
+	return e.usersQuery(ctx, "SELECT "+userColumns+" FROM users WHERE shard_id = ? AND deleted_at = 0", shardID)
+}
+
+func (e *SqlStorage) UserCreate(ctx context.Context, user *entityv1.User) (*entityv1.User, error) {
+	const query = "INSERT INTO users (username, password, state, shard_id, privileges, revision, created_at) VALUES (?, ?, ?, ?, ?, 1, ?)"
+	const queryWithID = "INSERT INTO users (user_id, username, password, state, shard_id, privileges, revision, created_at) VALUES (?, ?, ?, ?, ?, ?, 1, ?)"
+	createdAt := user.CreatedAt
+	if createdAt == 0 {
+		createdAt = time.Now().UnixMilli()
+	}
+	args := []any{user.Username, user.Password, int32(user.State), user.ShardId, strings.Join(user.Privileges, ","), createdAt}
+
+	var userID int64
+	err := e.write(ctx, func(q querier) error {
+		if user.UserId != 0 {
+			userID = int64(user.UserId)
+			_, err := q.ExecContext(ctx, e.rebind(queryWithID), append([]any{user.UserId}, args...)...)
+			if err != nil || e.dialect != DialectPostgres {
+				return err
+			}
+			// Unlike sqlite and mysql, postgres does not move the sequence
+			// past ids inserted explicitly.
+			_, err = q.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('users', 'user_id'), (SELECT MAX(user_id) FROM users))")
+			return err
+		}
+		if e.dialect == DialectPostgres {
+			return q.QueryRowContext(ctx, e.rebind(query+" RETURNING user_id"), args...).Scan(&userID)
+		}
+		result, err := q.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		userID, err = result.LastInsertId()
+		return err
+	})
+	if isUniqueViolation(err) {
+		// The unique constraint on username is what makes concurrent creates
+		// safe, deleted users included. A given UserId breaks the primary key.
+		return nil, fmt.Errorf("user %d '%s': %w", user.UserId, user.Username, storage.ErrUserExists)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("insert: %w", err)
+	}
+
+	user.UserId = int32(userID)
+	user.Revision = 1
+	user.CreatedAt = createdAt
+	return user, nil
+}
+
+func (e *SqlStorage) UserUpdate(ctx context.Context, user *entityv1.User) error {
+	return e.userUpdate(ctx, user, nil)
+}
+
+func (e *SqlStorage) UserUpdateIf(ctx context.Context, user *entityv1.User, expectedRevision int64) error {
+	return e.userUpdate(ctx, user, &expectedRevision)
+}
+
+func (e *SqlStorage) userUpdate(ctx context.Context, user *entityv1.User, expectedRevision *int64) error {
+	revision, err := e.revisionUpdate(ctx, "user", "users", "user_id", user.UserId, expectedRevision,
+		"username = ?, password = ?, state = ?, shard_id = ?, privileges = ?",
+		[]any{user.Username, user.Password, int32(user.State), user.ShardId, strings.Join(user.Privileges, ",")},
+	)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("username '%s': %w", user.Username, storage.ErrUserExists)
+	}
+	if err != nil {
+		return err
+	}
+	user.Revision = revision
+	return nil
+}
+
+func (e *SqlStorage) UserDelete(ctx context.Context, userID int32) error {
+	_, err := e.revisionUpdate(ctx, "user", "users", "user_id", userID, nil, "deleted_at = ?", []any{time.Now().UnixMilli()})
+	return err
+}
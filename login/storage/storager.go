@@ -2,23 +2,111 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
 )
 
+var (
+	// ErrUserExists is returned by UserCreate when the username is already taken.
+	ErrUserExists = errors.New("user already exists")
+	// ErrShardExists is returned by ShardCreate when a shard with the same
+	// ShardId exists.
+	ErrShardExists = errors.New("shard already exists")
+	// ErrNotFound is returned by updates of a user or shard that does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict matches every *ConflictError.
+	ErrConflict = errors.New("revision conflict")
+	// ErrDeleted is returned by UserByLogin when the user was deleted.
+	ErrDeleted = errors.New("deleted")
+)
+
+// ConflictError is returned by UserUpdateIf and ShardUpdateIf when the stored
+// revision is not the expected one, because someone else updated it first.
+type ConflictError struct {
+	Entity           string // "user" or "shard"
+	ID               int32
+	ExpectedRevision int64
+	ActualRevision   int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %d: expected revision %d, stored revision %d", e.Entity, e.ID, e.ExpectedRevision, e.ActualRevision)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Storager persists users and shards. Entities returned are owned by the
+// caller and entities passed in are not retained, so callers may change
+// either freely; changes are only stored by the update methods.
+//
+// Every stored user and shard carries a Revision, 1 when created and bumped
+// by each update. Creates and updates set the new Revision on the entity
+// passed in.
+//
+// Deleted users and shards are kept as tombstones with DeletedAt set until
+// Purge removes them. Every method but Purge skips them as if they did not
+// exist, except that a deleted user still holds its username: UserByLogin
+// returns ErrDeleted for it and UserCreate ErrUserExists.
 type Storager interface {
+	// Shards returns every shard, ordered by ShardId.
 	Shards(ctx context.Context) ([]*entityv1.Shard, error)
+	// ShardList returns a page of the shards filter selects, ordered by
+	// ShardId, and the cursor of the next page, "" after the last one.
+	ShardList(ctx context.Context, filter ShardListFilter, page Page) ([]*entityv1.Shard, string, error)
 	ShardByShardID(ctx context.Context, shardID int32) (*entityv1.Shard, error)
 	ShardByWSAddr(ctx context.Context, wsAddr string) (*entityv1.Shard, error)
+	// ShardCreate stores a new shard under its ShardId, which may be the id of
+	// a deleted shard. It returns ErrShardExists if a live shard has it.
 	ShardCreate(ctx context.Context, shard *entityv1.Shard) (*entityv1.Shard, error)
+	// ShardUpdate replaces the stored shard with the same ShardId. It returns
+	// ErrNotFound if there is none.
 	ShardUpdate(ctx context.Context, shard *entityv1.Shard) error
+	// ShardUpdateIf is ShardUpdate that only succeeds while the stored
+	// revision is expectedRevision. It returns a *ConflictError otherwise.
+	ShardUpdateIf(ctx context.Context, shard *entityv1.Shard, expectedRevision int64) error
 	ShardsByClientApplication(ctx context.Context, clientApp string) ([]*entityv1.Shard, error)
+	// ShardDelete sets DeletedAt on the shard, bumping its revision. It
+	// returns ErrNotFound if there is no such shard.
+	ShardDelete(ctx context.Context, shardID int32) error
 
+	// Users returns every user, ordered by UserId. Prefer UserList, which
+	// does not load the whole table.
 	Users(ctx context.Context) ([]*entityv1.User, error)
+	// UserList returns a page of the users filter selects, ordered by
+	// UserId, and the cursor of the next page, "" after the last one.
+	UserList(ctx context.Context, filter UserListFilter, page Page) ([]*entityv1.User, string, error)
 	UserByLogin(ctx context.Context, login string) (*entityv1.User, error)
 	UserByUserID(ctx context.Context, userID int32) (*entityv1.User, error)
 	UsersByState(ctx context.Context, state entityv1.UserState) ([]*entityv1.User, error)
 	UserByShardID(ctx context.Context, shardID int32) ([]*entityv1.User, error)
+	// UserCreate allocates a new UserId and stores user under it, with
+	// CreatedAt set to now unless already set. A UserId already set is kept,
+	// for imports; later allocations continue above it. It returns
+	// ErrUserExists if a user, deleted ones included, has the same Username or
+	// the given UserId.
 	UserCreate(ctx context.Context, user *entityv1.User) (*entityv1.User, error)
+	// UserUpdate replaces the stored user with the same UserId. It returns
+	// ErrNotFound if there is none.
 	UserUpdate(ctx context.Context, user *entityv1.User) error
+	// UserUpdateIf is UserUpdate that only succeeds while the stored revision
+	// is expectedRevision. It returns a *ConflictError otherwise.
+	UserUpdateIf(ctx context.Context, user *entityv1.User, expectedRevision int64) error
+	// UserDelete sets DeletedAt on the user, bumping its revision. It returns
+	// ErrNotFound if there is no such user.
+	UserDelete(ctx context.Context, userID int32) error
+
+	// Purge removes the users and shards deleted before before and returns
+	// how many it removed.
+	Purge(ctx context.Context, before time.Time) (int, error)
+
+	// WithTx runs fn as one unit of work: the writes fn makes through tx are
+	// committed together if it returns nil and rolled back otherwise. Inside
+	// fn only tx may be used, and tx must not be kept after fn returns.
+	// WithTx on tx runs fn in the same unit of work.
+	WithTx(ctx context.Context, fn func(tx Storager) error) error
 }
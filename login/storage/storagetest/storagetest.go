@@ -0,0 +1,871 @@
+// Package storagetest checks that a storage.Storager behaves like every other
+// backend. A backend test calls Run with a factory returning an empty store:
+//
+//	func TestStorager(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storager {
+//			memoryStorage, err := memory.NewMemoryStorage()
+//			if err != nil {
+//				t.Fatal("new memory storage:", err)
+//			}
+//			return memoryStorage
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+// Factory returns a new, empty Storager. It is called once per subtest and
+// should release what it opened with t.Cleanup.
+type Factory func(t *testing.T) storage.Storager
+
+// Run runs every conformance test against the Storagers factory returns.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storager)
+	}{
+		{"UserCreate", testUserCreate},
+		{"UserNotFound", testUserNotFound},
+		{"UserUpdate", testUserUpdate},
+		{"UserUpdateIf", testUserUpdateIf},
+		{"UserQueries", testUserQueries},
+		{"UserList", testUserList},
+		{"UserOwnership", testUserOwnership},
+		{"UserDelete", testUserDelete},
+		{"ShardCreate", testShardCreate},
+		{"ShardNotFound", testShardNotFound},
+		{"ShardUpdate", testShardUpdate},
+		{"ShardQueries", testShardQueries},
+		{"ShardList", testShardList},
+		{"ShardDelete", testShardDelete},
+		{"Purge", testPurge},
+		{"WithTx", testWithTx},
+		{"WithTxUserCreateDuplicate", testWithTxUserCreateDuplicate},
+		{"ConcurrentUserCreate", testConcurrentUserCreate},
+		{"ConcurrentUserUpdateIf", testConcurrentUserUpdateIf},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, factory(t))
+		})
+	}
+}
+
+func userCreate(t *testing.T, s storage.Storager, user *entityv1.User) *entityv1.User {
+	t.Helper()
+	created, err := s.UserCreate(context.Background(), user)
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	return created
+}
+
+func shardCreate(t *testing.T, s storage.Storager, shard *entityv1.Shard) *entityv1.Shard {
+	t.Helper()
+	created, err := s.ShardCreate(context.Background(), shard)
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	return created
+}
+
+func userIDs(users []*entityv1.User) []int32 {
+	var ids []int32
+	for _, user := range users {
+		ids = append(ids, user.UserId)
+	}
+	return ids
+}
+
+func shardIDs(shards []*entityv1.Shard) []int32 {
+	var ids []int32
+	for _, shard := range shards {
+		ids = append(ids, shard.ShardId)
+	}
+	return ids
+}
+
+// sorted returns ids sorted, for results whose order is unspecified.
+func sorted(ids []int32) []int32 {
+	return slices.Sorted(slices.Values(ids))
+}
+
+func testUserCreate(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Second)
+
+	first := userCreate(t, s, &entityv1.User{Username: "first", Password: "hash", Privileges: []string{"GM", "DEV"}})
+	if first.UserId == 0 || first.Revision != 1 || first.CreatedAt < before.UnixMilli() {
+		t.Fatal("created user:", first)
+	}
+	second := userCreate(t, s, &entityv1.User{Username: "second"})
+	if second.UserId <= first.UserId {
+		t.Fatal("user ids not increasing:", first.UserId, second.UserId)
+	}
+
+	got, err := s.UserByUserID(ctx, first.UserId)
+	if err != nil || got == nil {
+		t.Fatal("user by user id:", got, err)
+	}
+	if got.Username != "first" || got.Password != "hash" || !slices.Equal(got.Privileges, []string{"GM", "DEV"}) || got.Revision != 1 || got.CreatedAt != first.CreatedAt {
+		t.Fatal("stored user:", got)
+	}
+
+	_, err = s.UserCreate(ctx, &entityv1.User{Username: "first"})
+	if !errors.Is(err, storage.ErrUserExists) {
+		t.Fatal("duplicate user create: expected ErrUserExists, got", err)
+	}
+
+	// A given UserId is kept, for imports, and allocation continues above it.
+	kept := userCreate(t, s, &entityv1.User{Username: "kept", UserId: second.UserId + 100})
+	if kept.UserId != second.UserId+100 || kept.Revision != 1 {
+		t.Fatal("created user with id:", kept)
+	}
+	got, err = s.UserByUserID(ctx, kept.UserId)
+	if err != nil || got == nil || got.Username != "kept" {
+		t.Fatal("user by kept user id:", got, err)
+	}
+	next := userCreate(t, s, &entityv1.User{Username: "next"})
+	if next.UserId <= kept.UserId {
+		t.Fatal("user id allocated below a kept one:", next.UserId, kept.UserId)
+	}
+	_, err = s.UserCreate(ctx, &entityv1.User{Username: "taken", UserId: first.UserId})
+	if !errors.Is(err, storage.ErrUserExists) {
+		t.Fatal("user create with a taken id: expected ErrUserExists, got", err)
+	}
+
+	// A given CreatedAt is kept, for imports.
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	imported := userCreate(t, s, &entityv1.User{Username: "imported", CreatedAt: createdAt})
+	got, err = s.UserByUserID(ctx, imported.UserId)
+	if err != nil || got.CreatedAt != createdAt {
+		t.Fatal("imported user created at:", got, err)
+	}
+}
+
+func testUserNotFound(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+
+	user, err := s.UserByLogin(ctx, "nobody")
+	if user != nil || err != nil {
+		t.Fatal("user by unknown login: expected (nil, nil), got", user, err)
+	}
+	user, err = s.UserByUserID(ctx, 9999)
+	if user != nil || err != nil {
+		t.Fatal("user by unknown user id: expected (nil, nil), got", user, err)
+	}
+	users, err := s.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if len(users) != 0 || err != nil {
+		t.Fatal("users by state of empty store:", users, err)
+	}
+	users, err = s.UserByShardID(ctx, 101)
+	if len(users) != 0 || err != nil {
+		t.Fatal("users by shard id of empty store:", users, err)
+	}
+	users, err = s.Users(ctx)
+	if len(users) != 0 || err != nil {
+		t.Fatal("users of empty store:", users, err)
+	}
+
+	err = s.UserUpdate(ctx, &entityv1.User{UserId: 9999, Username: "nobody"})
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("update unknown user: expected ErrNotFound, got", err)
+	}
+	err = s.UserUpdateIf(ctx, &entityv1.User{UserId: 9999, Username: "nobody"}, 1)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("update if unknown user: expected ErrNotFound, got", err)
+	}
+	err = s.UserDelete(ctx, 9999)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("delete unknown user: expected ErrNotFound, got", err)
+	}
+}
+
+func testUserUpdate(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	user := userCreate(t, s, &entityv1.User{Username: "testuser", Password: "hash"})
+
+	user.State = entityv1.UserState_ONLINE
+	user.ShardId = 101
+	user.Password = "rehash"
+	user.Privileges = []string{"GM"}
+	err := s.UserUpdate(ctx, user)
+	if err != nil || user.Revision != 2 {
+		t.Fatal("user update:", user.Revision, err)
+	}
+
+	got, err := s.UserByLogin(ctx, "testuser")
+	if err != nil || got == nil {
+		t.Fatal("user by login:", got, err)
+	}
+	if got.State != entityv1.UserState_ONLINE || got.ShardId != 101 || got.Password != "rehash" || !slices.Equal(got.Privileges, []string{"GM"}) || got.Revision != 2 {
+		t.Fatal("updated user:", got)
+	}
+
+	// Renaming moves the user to its new login.
+	user.Username = "renamed"
+	err = s.UserUpdate(ctx, user)
+	if err != nil {
+		t.Fatal("user rename:", err)
+	}
+	got, err = s.UserByLogin(ctx, "testuser")
+	if err != nil || got != nil {
+		t.Fatal("user by old login:", got, err)
+	}
+	got, err = s.UserByLogin(ctx, "renamed")
+	if err != nil || got == nil || got.UserId != user.UserId {
+		t.Fatal("user by new login:", got, err)
+	}
+
+	// Logins stay unique, deleted users included.
+	other := userCreate(t, s, &entityv1.User{Username: "other"})
+	deleted := userCreate(t, s, &entityv1.User{Username: "deleted"})
+	err = s.UserDelete(ctx, deleted.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	for _, username := range []string{"renamed", "deleted"} {
+		other.Username = username
+		err = s.UserUpdate(ctx, other)
+		if !errors.Is(err, storage.ErrUserExists) {
+			t.Fatal("rename to a taken login: expected ErrUserExists, got", err)
+		}
+	}
+	got, err = s.UserByLogin(ctx, "renamed")
+	if err != nil || got == nil || got.UserId != user.UserId {
+		t.Fatal("user by new login after a refused rename:", got, err)
+	}
+}
+
+func testUserUpdateIf(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	user := userCreate(t, s, &entityv1.User{Username: "testuser"})
+
+	stale := &entityv1.User{UserId: user.UserId, Username: "testuser", State: entityv1.UserState_ONLINE}
+	err := s.UserUpdateIf(ctx, user, 1)
+	if err != nil || user.Revision != 2 {
+		t.Fatal("user update if:", user.Revision, err)
+	}
+
+	err = s.UserUpdateIf(ctx, stale, 1)
+	var conflictErr *storage.ConflictError
+	if !errors.As(err, &conflictErr) || !errors.Is(err, storage.ErrConflict) {
+		t.Fatal("stale user update if: expected ConflictError, got", err)
+	}
+	if conflictErr.Entity != "user" || conflictErr.ID != user.UserId || conflictErr.ExpectedRevision != 1 || conflictErr.ActualRevision != 2 {
+		t.Fatal("conflict error:", conflictErr)
+	}
+
+	got, err := s.UserByUserID(ctx, user.UserId)
+	if err != nil || got.State != entityv1.UserState_OFFLINE || got.Revision != 2 {
+		t.Fatal("user after conflict:", got, err)
+	}
+}
+
+func testUserQueries(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	online := userCreate(t, s, &entityv1.User{Username: "online", State: entityv1.UserState_ONLINE, ShardId: 101})
+	other := userCreate(t, s, &entityv1.User{Username: "other", State: entityv1.UserState_ONLINE, ShardId: 102})
+	offline := userCreate(t, s, &entityv1.User{Username: "offline"})
+
+	users, err := s.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if err != nil || !slices.Equal(sorted(userIDs(users)), []int32{online.UserId, other.UserId}) {
+		t.Fatal("users by state online:", users, err)
+	}
+	users, err = s.UsersByState(ctx, entityv1.UserState_OFFLINE)
+	if err != nil || !slices.Equal(userIDs(users), []int32{offline.UserId}) {
+		t.Fatal("users by state offline:", users, err)
+	}
+	users, err = s.UserByShardID(ctx, 101)
+	if err != nil || !slices.Equal(userIDs(users), []int32{online.UserId}) {
+		t.Fatal("users by shard id:", users, err)
+	}
+
+	// Queries follow updates.
+	online.State = entityv1.UserState_OFFLINE
+	online.ShardId = 0
+	err = s.UserUpdate(ctx, online)
+	if err != nil {
+		t.Fatal("user update:", err)
+	}
+	users, err = s.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if err != nil || !slices.Equal(userIDs(users), []int32{other.UserId}) {
+		t.Fatal("users by state online after update:", users, err)
+	}
+	users, err = s.UserByShardID(ctx, 101)
+	if err != nil || len(users) != 0 {
+		t.Fatal("users by shard id after update:", users, err)
+	}
+
+	users, err = s.Users(ctx)
+	if err != nil || !slices.Equal(userIDs(users), []int32{online.UserId, other.UserId, offline.UserId}) {
+		t.Fatal("users not ordered by user id:", users, err)
+	}
+}
+
+func testUserList(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	var all []int32
+	for i := range 7 {
+		user := &entityv1.User{Username: fmt.Sprintf("user%d", i)}
+		if i%2 == 1 {
+			user.Username = fmt.Sprintf("odd%d", i)
+			user.State = entityv1.UserState_ONLINE
+			user.ShardId = 101
+		}
+		all = append(all, userCreate(t, s, user).UserId)
+	}
+
+	var listed []int32
+	page := storage.Page{Limit: 3}
+	for pages := 1; ; pages++ {
+		users, next, err := s.UserList(ctx, storage.UserListFilter{}, page)
+		if err != nil || len(users) > 3 {
+			t.Fatal("user list page:", users, err)
+		}
+		listed = append(listed, userIDs(users)...)
+		if next == "" {
+			if pages != 3 {
+				t.Fatal("user list pages:", pages)
+			}
+			break
+		}
+		page.Cursor = next
+	}
+	if !slices.Equal(listed, all) {
+		t.Fatal("user list:", listed, "expected", all)
+	}
+
+	// A full last page has no next cursor.
+	users, next, err := s.UserList(ctx, storage.UserListFilter{}, storage.Page{Limit: 7})
+	if err != nil || len(users) != 7 || next != "" {
+		t.Fatal("user list exact page:", len(users), next, err)
+	}
+
+	state := entityv1.UserState_ONLINE
+	shardID := int32(101)
+	users, _, err = s.UserList(ctx, storage.UserListFilter{State: &state, ShardID: &shardID, UsernamePrefix: "odd"}, storage.Page{})
+	if err != nil || !slices.Equal(userIDs(users), []int32{all[1], all[3], all[5]}) {
+		t.Fatal("user list filtered:", users, err)
+	}
+	users, _, err = s.UserList(ctx, storage.UserListFilter{UsernamePrefix: "ODD"}, storage.Page{})
+	if err != nil || len(users) != 0 {
+		t.Fatal("user list prefix is case sensitive:", users, err)
+	}
+	users, _, err = s.UserList(ctx, storage.UserListFilter{CreatedAfter: time.Now().Add(time.Hour)}, storage.Page{})
+	if err != nil || len(users) != 0 {
+		t.Fatal("user list created after future:", users, err)
+	}
+	users, _, err = s.UserList(ctx, storage.UserListFilter{CreatedAfter: time.Now().Add(-time.Hour)}, storage.Page{})
+	if err != nil || len(users) != 7 {
+		t.Fatal("user list created after past:", users, err)
+	}
+
+	_, _, err = s.UserList(ctx, storage.UserListFilter{}, storage.Page{Cursor: "not a cursor"})
+	if !errors.Is(err, storage.ErrInvalidCursor) {
+		t.Fatal("user list bad cursor: expected ErrInvalidCursor, got", err)
+	}
+}
+
+func testUserOwnership(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	user := &entityv1.User{Username: "testuser", Privileges: []string{"GM"}}
+	userCreate(t, s, user)
+
+	// Neither the entity passed in nor the ones returned are shared with the
+	// store.
+	user.Username = "changed"
+	user.Privileges[0] = "changed"
+	got, err := s.UserByLogin(ctx, "testuser")
+	if err != nil || got == nil || got.Privileges[0] != "GM" {
+		t.Fatal("user after changing the created entity:", got, err)
+	}
+	got.State = entityv1.UserState_ONLINE
+	got.Privileges[0] = "changed"
+	again, err := s.UserByLogin(ctx, "testuser")
+	if err != nil || again.State != entityv1.UserState_OFFLINE || again.Privileges[0] != "GM" {
+		t.Fatal("user after changing a returned entity:", again, err)
+	}
+	users, err := s.Users(ctx)
+	if err != nil || len(users) != 1 {
+		t.Fatal("users:", users, err)
+	}
+	users[0].Username = "changed"
+	again, err = s.UserByUserID(ctx, users[0].UserId)
+	if err != nil || again.Username != "testuser" {
+		t.Fatal("user after changing a listed entity:", again, err)
+	}
+}
+
+func testUserDelete(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	user := userCreate(t, s, &entityv1.User{Username: "testuser", State: entityv1.UserState_ONLINE, ShardId: 101})
+	kept := userCreate(t, s, &entityv1.User{Username: "kept"})
+
+	err := s.UserDelete(ctx, user.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+
+	_, err = s.UserByLogin(ctx, "testuser")
+	if !errors.Is(err, storage.ErrDeleted) {
+		t.Fatal("user by login after delete: expected ErrDeleted, got", err)
+	}
+	got, err := s.UserByUserID(ctx, user.UserId)
+	if got != nil || err != nil {
+		t.Fatal("user by user id after delete:", got, err)
+	}
+	users, err := s.UsersByState(ctx, entityv1.UserState_ONLINE)
+	if len(users) != 0 || err != nil {
+		t.Fatal("users by state after delete:", users, err)
+	}
+	users, err = s.UserByShardID(ctx, 101)
+	if len(users) != 0 || err != nil {
+		t.Fatal("users by shard id after delete:", users, err)
+	}
+	users, err = s.Users(ctx)
+	if err != nil || !slices.Equal(userIDs(users), []int32{kept.UserId}) {
+		t.Fatal("users after delete:", users, err)
+	}
+	users, _, err = s.UserList(ctx, storage.UserListFilter{}, storage.Page{})
+	if err != nil || !slices.Equal(userIDs(users), []int32{kept.UserId}) {
+		t.Fatal("user list after delete:", users, err)
+	}
+
+	_, err = s.UserCreate(ctx, &entityv1.User{Username: "testuser"})
+	if !errors.Is(err, storage.ErrUserExists) {
+		t.Fatal("user create with deleted username: expected ErrUserExists, got", err)
+	}
+	err = s.UserUpdate(ctx, user)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("user update after delete: expected ErrNotFound, got", err)
+	}
+	err = s.UserDelete(ctx, user.UserId)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("user delete twice: expected ErrNotFound, got", err)
+	}
+}
+
+func testShardCreate(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	shard := shardCreate(t, s, &entityv1.Shard{
+		ShardId:     101,
+		Name:        "Atys",
+		PlayerCount: 3,
+		WsAddr:      "atys:49999",
+		ClientApp:   "ryzom",
+		IsOnline:    true,
+		Capacity:    1000,
+		State:       entityv1.ShardState_RESTRICTED,
+		IsExternal:  true,
+	})
+	if shard.Revision != 1 {
+		t.Fatal("created shard revision:", shard.Revision)
+	}
+
+	got, err := s.ShardByShardID(ctx, 101)
+	if err != nil || got == nil {
+		t.Fatal("shard by shard id:", got, err)
+	}
+	if got.Name != "Atys" || got.PlayerCount != 3 || got.WsAddr != "atys:49999" || got.ClientApp != "ryzom" || !got.IsOnline ||
+		got.Capacity != 1000 || got.State != entityv1.ShardState_RESTRICTED || !got.IsExternal || got.Revision != 1 {
+		t.Fatal("stored shard:", got)
+	}
+
+	// Neither the entity passed in nor the ones returned are shared with the
+	// store.
+	shard.Name = "changed"
+	got.PlayerCount = 42
+	got, err = s.ShardByWSAddr(ctx, "atys:49999")
+	if err != nil || got == nil || got.Name != "Atys" || got.PlayerCount != 3 {
+		t.Fatal("shard after changing entities:", got, err)
+	}
+
+	// A second create of the same id neither replaces the shard nor resets
+	// its revision.
+	err = s.ShardUpdate(ctx, got)
+	if err != nil {
+		t.Fatal("shard update:", err)
+	}
+	_, err = s.ShardCreate(ctx, &entityv1.Shard{ShardId: 101, Name: "Arispotle"})
+	if !errors.Is(err, storage.ErrShardExists) {
+		t.Fatal("duplicate shard create: expected ErrShardExists, got", err)
+	}
+	got, err = s.ShardByShardID(ctx, 101)
+	if err != nil || got == nil || got.Name != "Atys" || got.Revision != 2 {
+		t.Fatal("shard after duplicate create:", got, err)
+	}
+}
+
+func testShardNotFound(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+
+	shard, err := s.ShardByShardID(ctx, 999)
+	if shard != nil || err != nil {
+		t.Fatal("shard by unknown shard id: expected (nil, nil), got", shard, err)
+	}
+	shard, err = s.ShardByWSAddr(ctx, "nowhere:1")
+	if shard != nil || err != nil {
+		t.Fatal("shard by unknown ws addr: expected (nil, nil), got", shard, err)
+	}
+	shards, err := s.ShardsByClientApplication(ctx, "ryzom")
+	if len(shards) != 0 || err != nil {
+		t.Fatal("shards by client application of empty store:", shards, err)
+	}
+	shards, err = s.Shards(ctx)
+	if len(shards) != 0 || err != nil {
+		t.Fatal("shards of empty store:", shards, err)
+	}
+
+	err = s.ShardUpdate(ctx, &entityv1.Shard{ShardId: 999})
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("update unknown shard: expected ErrNotFound, got", err)
+	}
+	err = s.ShardUpdateIf(ctx, &entityv1.Shard{ShardId: 999}, 1)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("update if unknown shard: expected ErrNotFound, got", err)
+	}
+	err = s.ShardDelete(ctx, 999)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("delete unknown shard: expected ErrNotFound, got", err)
+	}
+}
+
+func testShardUpdate(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	shard := shardCreate(t, s, &entityv1.Shard{ShardId: 101, WsAddr: "atys:49999", ClientApp: "ryzom"})
+
+	shard.PlayerCount = 10
+	shard.WsAddr = "atys:50000"
+	err := s.ShardUpdate(ctx, shard)
+	if err != nil || shard.Revision != 2 {
+		t.Fatal("shard update:", shard.Revision, err)
+	}
+	got, err := s.ShardByWSAddr(ctx, "atys:49999")
+	if err != nil || got != nil {
+		t.Fatal("shard by old ws addr:", got, err)
+	}
+	got, err = s.ShardByWSAddr(ctx, "atys:50000")
+	if err != nil || got == nil || got.PlayerCount != 10 || got.Revision != 2 {
+		t.Fatal("shard by new ws addr:", got, err)
+	}
+
+	shard.PlayerCount = 11
+	err = s.ShardUpdateIf(ctx, shard, 2)
+	if err != nil || shard.Revision != 3 {
+		t.Fatal("shard update if:", shard.Revision, err)
+	}
+	err = s.ShardUpdateIf(ctx, shard, 2)
+	var conflictErr *storage.ConflictError
+	if !errors.As(err, &conflictErr) || conflictErr.Entity != "shard" || conflictErr.ActualRevision != 3 {
+		t.Fatal("stale shard update if: expected ConflictError, got", err)
+	}
+}
+
+func testShardQueries(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	shardCreate(t, s, &entityv1.Shard{ShardId: 103, WsAddr: "c:1", ClientApp: "ryzom"})
+	shardCreate(t, s, &entityv1.Shard{ShardId: 101, WsAddr: "a:1", ClientApp: "ryzom"})
+	other := shardCreate(t, s, &entityv1.Shard{ShardId: 102, WsAddr: "b:1", ClientApp: "other"})
+
+	shards, err := s.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil || !slices.Equal(sorted(shardIDs(shards)), []int32{101, 103}) {
+		t.Fatal("shards by client application:", shards, err)
+	}
+	shards, err = s.ShardsByClientApplication(ctx, "unknown")
+	if err != nil || len(shards) != 0 {
+		t.Fatal("shards by unknown client application:", shards, err)
+	}
+
+	other.ClientApp = "ryzom"
+	err = s.ShardUpdate(ctx, other)
+	if err != nil {
+		t.Fatal("shard update:", err)
+	}
+	shards, err = s.ShardsByClientApplication(ctx, "other")
+	if err != nil || len(shards) != 0 {
+		t.Fatal("shards by old client application:", shards, err)
+	}
+
+	shards, err = s.Shards(ctx)
+	if err != nil || !slices.Equal(shardIDs(shards), []int32{101, 102, 103}) {
+		t.Fatal("shards not ordered by shard id:", shards, err)
+	}
+}
+
+func testShardList(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	for _, shardID := range []int32{105, 101, 104, 102, 103} {
+		clientApp := "ryzom"
+		if shardID%2 == 0 {
+			clientApp = "other"
+		}
+		shardCreate(t, s, &entityv1.Shard{ShardId: shardID, WsAddr: fmt.Sprintf("shard:%d", shardID), ClientApp: clientApp})
+	}
+
+	shards, next, err := s.ShardList(ctx, storage.ShardListFilter{}, storage.Page{Limit: 2})
+	if err != nil || !slices.Equal(shardIDs(shards), []int32{101, 102}) || next == "" {
+		t.Fatal("shard list first page:", shards, next, err)
+	}
+	shards, next, err = s.ShardList(ctx, storage.ShardListFilter{}, storage.Page{Cursor: next, Limit: 2})
+	if err != nil || !slices.Equal(shardIDs(shards), []int32{103, 104}) || next == "" {
+		t.Fatal("shard list second page:", shards, next, err)
+	}
+	shards, next, err = s.ShardList(ctx, storage.ShardListFilter{}, storage.Page{Cursor: next, Limit: 2})
+	if err != nil || !slices.Equal(shardIDs(shards), []int32{105}) || next != "" {
+		t.Fatal("shard list last page:", shards, next, err)
+	}
+
+	shards, _, err = s.ShardList(ctx, storage.ShardListFilter{ClientApp: "ryzom"}, storage.Page{})
+	if err != nil || !slices.Equal(shardIDs(shards), []int32{101, 103, 105}) {
+		t.Fatal("shard list filtered:", shards, err)
+	}
+}
+
+func testShardDelete(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	shardCreate(t, s, &entityv1.Shard{ShardId: 101, WsAddr: "atys:49999", ClientApp: "ryzom"})
+	shardCreate(t, s, &entityv1.Shard{ShardId: 102, WsAddr: "leto:49999", ClientApp: "ryzom"})
+
+	err := s.ShardDelete(ctx, 101)
+	if err != nil {
+		t.Fatal("shard delete:", err)
+	}
+	shard, err := s.ShardByShardID(ctx, 101)
+	if shard != nil || err != nil {
+		t.Fatal("shard by shard id after delete:", shard, err)
+	}
+	shard, err = s.ShardByWSAddr(ctx, "atys:49999")
+	if shard != nil || err != nil {
+		t.Fatal("shard by ws addr after delete:", shard, err)
+	}
+	shards, err := s.ShardsByClientApplication(ctx, "ryzom")
+	if err != nil || !slices.Equal(shardIDs(shards), []int32{102}) {
+		t.Fatal("shards by client application after delete:", shards, err)
+	}
+	shards, _, err = s.ShardList(ctx, storage.ShardListFilter{}, storage.Page{})
+	if err != nil || !slices.Equal(shardIDs(shards), []int32{102}) {
+		t.Fatal("shard list after delete:", shards, err)
+	}
+	err = s.ShardUpdate(ctx, &entityv1.Shard{ShardId: 101})
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal("shard update after delete: expected ErrNotFound, got", err)
+	}
+
+	// The id of a retired shard can be reused.
+	shardCreate(t, s, &entityv1.Shard{ShardId: 101, Name: "New Atys"})
+	got, err := s.ShardByShardID(ctx, 101)
+	if err != nil || got == nil || got.Name != "New Atys" || got.Revision != 1 {
+		t.Fatal("shard by shard id after reuse:", got, err)
+	}
+}
+
+func testPurge(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	user := userCreate(t, s, &entityv1.User{Username: "testuser"})
+	userCreate(t, s, &entityv1.User{Username: "kept"})
+	shardCreate(t, s, &entityv1.Shard{ShardId: 101})
+
+	purged, err := s.Purge(ctx, time.Now().Add(time.Hour))
+	if err != nil || purged != 0 {
+		t.Fatal("purge without deletes:", purged, err)
+	}
+
+	err = s.UserDelete(ctx, user.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	err = s.ShardDelete(ctx, 101)
+	if err != nil {
+		t.Fatal("shard delete:", err)
+	}
+	purged, err = s.Purge(ctx, time.Now().Add(-time.Hour))
+	if err != nil || purged != 0 {
+		t.Fatal("purge of recent deletes:", purged, err)
+	}
+	purged, err = s.Purge(ctx, time.Now().Add(time.Hour))
+	if err != nil || purged != 2 {
+		t.Fatal("purge:", purged, err)
+	}
+
+	// The username is free again once purged.
+	got, err := s.UserByLogin(ctx, "testuser")
+	if got != nil || err != nil {
+		t.Fatal("user by login after purge:", got, err)
+	}
+	userCreate(t, s, &entityv1.User{Username: "testuser"})
+	users, err := s.Users(ctx)
+	if err != nil || len(users) != 2 {
+		t.Fatal("users after purge:", users, err)
+	}
+}
+
+func testWithTx(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	user := userCreate(t, s, &entityv1.User{Username: "testuser"})
+
+	errFail := errors.New("fail")
+	err := s.WithTx(ctx, func(tx storage.Storager) error {
+		userCreate(t, tx, &entityv1.User{Username: "rolledback"})
+		shardCreate(t, tx, &entityv1.Shard{ShardId: 101})
+		online := &entityv1.User{UserId: user.UserId, Username: "testuser", State: entityv1.UserState_ONLINE}
+		err := tx.UserUpdateIf(ctx, online, 1)
+		if err != nil {
+			return err
+		}
+		// Writes are visible inside the unit of work.
+		got, err := tx.UserByLogin(ctx, "rolledback")
+		if err != nil || got == nil {
+			t.Error("user by login inside tx:", got, err)
+		}
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatal("rolled back with tx: expected errFail, got", err)
+	}
+	got, err := s.UserByLogin(ctx, "rolledback")
+	if got != nil || err != nil {
+		t.Fatal("user created in rolled back tx:", got, err)
+	}
+	shard, err := s.ShardByShardID(ctx, 101)
+	if shard != nil || err != nil {
+		t.Fatal("shard created in rolled back tx:", shard, err)
+	}
+	got, err = s.UserByUserID(ctx, user.UserId)
+	if err != nil || got.State != entityv1.UserState_OFFLINE || got.Revision != 1 {
+		t.Fatal("user updated in rolled back tx:", got, err)
+	}
+
+	err = s.WithTx(ctx, func(tx storage.Storager) error {
+		shardCreate(t, tx, &entityv1.Shard{ShardId: 101})
+		// Nested units of work join the outer one.
+		return tx.WithTx(ctx, func(tx storage.Storager) error {
+			_, err := tx.UserCreate(ctx, &entityv1.User{Username: "committed"})
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal("committed with tx:", err)
+	}
+	got, err = s.UserByLogin(ctx, "committed")
+	if err != nil || got == nil {
+		t.Fatal("user created in committed tx:", got, err)
+	}
+	shard, err = s.ShardByShardID(ctx, 101)
+	if err != nil || shard == nil {
+		t.Fatal("shard created in committed tx:", shard, err)
+	}
+}
+
+func testWithTxUserCreateDuplicate(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	user := userCreate(t, s, &entityv1.User{Username: "testuser"})
+	deleted := userCreate(t, s, &entityv1.User{Username: "deleted"})
+	err := s.UserDelete(ctx, deleted.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+
+	for _, username := range []string{"testuser", "deleted"} {
+		err = s.WithTx(ctx, func(tx storage.Storager) error {
+			_, err := tx.UserCreate(ctx, &entityv1.User{Username: username})
+			return err
+		})
+		if !errors.Is(err, storage.ErrUserExists) {
+			t.Fatal("duplicate user create in tx: expected ErrUserExists, got", err)
+		}
+	}
+	got, err := s.UserByUserID(ctx, user.UserId)
+	if err != nil || got == nil || got.Revision != 1 {
+		t.Fatal("user after duplicate create in tx:", got, err)
+	}
+}
+
+func testConcurrentUserCreate(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	const creators = 8
+
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	var ids sync.Map
+	errs := make(chan error, 2*creators)
+	for i := range creators {
+		wg.Add(2)
+		// Every creator races for the same username and creates its own.
+		go func() {
+			defer wg.Done()
+			_, err := s.UserCreate(ctx, &entityv1.User{Username: "contended"})
+			if err == nil {
+				created.Add(1)
+			} else if !errors.Is(err, storage.ErrUserExists) {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			user, err := s.UserCreate(ctx, &entityv1.User{Username: fmt.Sprintf("user%d", i)})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, ok := ids.LoadOrStore(user.UserId, true); ok {
+				errs <- fmt.Errorf("user id %d allocated twice", user.UserId)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal("concurrent user create:", err)
+	}
+	if created.Load() != 1 {
+		t.Fatal("expected exactly one create of the same username to succeed, got", created.Load())
+	}
+}
+
+func testConcurrentUserUpdateIf(t *testing.T, s storage.Storager) {
+	ctx := context.Background()
+	user := userCreate(t, s, &entityv1.User{Username: "testuser"})
+	const updaters = 8
+
+	var wg sync.WaitGroup
+	var updated atomic.Int32
+	errs := make(chan error, updaters)
+	for i := range updaters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			update := &entityv1.User{UserId: user.UserId, Username: "testuser", ShardId: int32(i + 1)}
+			err := s.UserUpdateIf(ctx, update, 1)
+			if err == nil {
+				updated.Add(1)
+			} else if !errors.Is(err, storage.ErrConflict) {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal("concurrent user update if:", err)
+	}
+	if updated.Load() != 1 {
+		t.Fatal("expected exactly one update of the same revision to succeed, got", updated.Load())
+	}
+	got, err := s.UserByUserID(ctx, user.UserId)
+	if err != nil || got.Revision != 2 {
+		t.Fatal("user after concurrent updates:", got, err)
+	}
+}
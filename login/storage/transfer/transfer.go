@@ -0,0 +1,402 @@
+// Package transfer moves users and shards between a storage.Storager and
+// files, to migrate an existing login database onto gserver and back out.
+//
+// Three formats are read and written:
+//
+// JSON holds both tables in one document:
+//
+//	{
+//	  "users": [
+//	    {"user_id": 1, "username": "alice", "password": "$argon2id$...",
+//	     "state": "offline", "shard_id": 0, "privileges": ["GM"],
+//	     "created_at": "2024-05-01T12:00:00Z"}
+//	  ],
+//	  "shards": [
+//	    {"shard_id": 101, "name": "Atys", "ws_addr": "shard.example.net:48851",
+//	     "client_app": "ryzom", "state": "open", "is_online": false,
+//	     "player_count": 0, "capacity": 0, "is_external": false}
+//	  ]
+//	}
+//
+// User states are "offline" and "online", shard states "closed", "open" and
+// "restricted". Omitted fields are zero; created_at is RFC 3339.
+//
+// CSV holds one table per file, with a header row naming its columns in any
+// order. A file whose header has a username column holds users, with the
+// columns user_id, username, password, state, shard_id, privileges and
+// created_at; privileges are comma-separated. Any other file holds shards,
+// with the columns of the JSON shards. Unknown columns are ignored and
+// missing ones are zero.
+//
+// SQL is a mysqldump of the user and shard tables of a legacy NeL/Ryzom nel
+// database, with or without --complete-insert, as long as the CREATE TABLE
+// statements are kept for dumps without column names. Every other table is
+// skipped. The legacy columns map to:
+//
+//	user.UId                user_id
+//	user.Login              username
+//	user.Password           password
+//	user.ShardId            shard_id, -1 becoming 0
+//	user.State              state, 'Online' or 'Offline'
+//	user.Privilege          privileges, ":DEV:GM:" becoming ["DEV", "GM"]
+//	shard.ShardId           shard_id
+//	shard.Name              name
+//	shard.WsAddr            ws_addr
+//	shard.ClientApplication client_app
+//	shard.State             state, ds_open becoming open, ds_close closed, and
+//	                        ds_restricted and ds_dev restricted
+//	shard.Online            is_online
+//	shard.NbPlayers         player_count
+//
+// Written SQL is INSERT statements with column names for those same tables.
+// created_at, capacity and is_external have no legacy column and are left
+// out.
+//
+// Import matches users by username and shards by ShardId, so importing the
+// same file twice creates nothing the second time. Users already present are
+// left untouched, as players may have changed them since; shards already
+// present are updated. Users are imported offline and shards offline and
+// empty, as nothing of a running session survives the move. Users keep
+// their shard_id, the shard their characters live on.
+//
+// A password hash that Options.Passwords cannot verify, such as the crypt
+// hashes of the legacy database, fails the import unless
+// Options.IsUnsupportedPasswordAllowed is set; a dry run counts them.
+//
+// Created users keep their user_id, which shards and other databases refer
+// to players by. A user whose id is held by another user gets a new one;
+// Report.UserIDsRemapped maps the old ids to the new and the report lists
+// them. An id held by a deleted user that was not purged yet fails the
+// import; purge before importing.
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/runeharvest/gserver/login/password"
+	"github.com/runeharvest/gserver/login/storage"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Dump holds the users and shards read from or written to a file.
+type Dump struct {
+	Users  []*entityv1.User
+	Shards []*entityv1.Shard
+}
+
+// Options tunes Import.
+type Options struct {
+	// DryRun reports what Import would do without writing anything.
+	DryRun bool
+	// Passwords, when set, checks that it can verify the imported password
+	// hashes.
+	Passwords *password.PasswordService
+	// IsUnsupportedPasswordAllowed imports the users whose password hash
+	// Passwords cannot verify instead of failing. They cannot log in until
+	// their password is reset.
+	IsUnsupportedPasswordAllowed bool
+}
+
+// Report counts what Import did, or would do on a dry run.
+type Report struct {
+	DryRun bool
+
+	UsersCreated int
+	// UsersExisting counts the users whose username is already taken.
+	UsersExisting int
+	// UsersDeleted counts the users whose username belongs to a deleted user.
+	UsersDeleted int
+	// UsersDuplicate counts the users whose username came earlier in the dump.
+	UsersDuplicate int
+	// PasswordsUnsupported counts the created users whose password hash
+	// Options.Passwords cannot verify.
+	PasswordsUnsupported int
+	// UserIDsRemapped maps the UserId in the dump of every created user whose
+	// id was taken to the UserId it was created with, 0 on a dry run.
+	UserIDsRemapped map[int32]int32
+
+	ShardsCreated   int
+	ShardsUpdated   int
+	ShardsUnchanged int
+	// ShardsDuplicate counts the shards whose ShardId came earlier in the dump.
+	ShardsDuplicate int
+}
+
+// String returns the report as printed by the transfer command.
+func (r *Report) String() string {
+	var b strings.Builder
+	if r.DryRun {
+		b.WriteString("Dry run, nothing was written.\n")
+	}
+	fmt.Fprintf(&b, "Users:  %d created, %d existing, %d deleted, %d duplicate\n",
+		r.UsersCreated, r.UsersExisting, r.UsersDeleted, r.UsersDuplicate)
+	fmt.Fprintf(&b, "Shards: %d created, %d updated, %d unchanged, %d duplicate\n",
+		r.ShardsCreated, r.ShardsUpdated, r.ShardsUnchanged, r.ShardsDuplicate)
+	if r.PasswordsUnsupported > 0 {
+		fmt.Fprintf(&b, "Warning: %d users have a password hash that cannot be verified and need a password reset\n", r.PasswordsUnsupported)
+	}
+	if len(r.UserIDsRemapped) > 0 {
+		fmt.Fprintf(&b, "Warning: %d users had their id taken and got a new one, old -> new:\n", len(r.UserIDsRemapped))
+		for _, userID := range slices.Sorted(maps.Keys(r.UserIDsRemapped)) {
+			fmt.Fprintf(&b, "  %d -> %d\n", userID, r.UserIDsRemapped[userID])
+		}
+	}
+	return b.String()
+}
+
+// Validate checks that every user has a username and every shard a ShardId.
+func (d *Dump) Validate() error {
+	for i, user := range d.Users {
+		if user.Username == "" {
+			return fmt.Errorf("user %d: empty username", i+1)
+		}
+	}
+	for i, shard := range d.Shards {
+		if shard.ShardId == 0 {
+			return fmt.Errorf("shard %d: zero shard id", i+1)
+		}
+	}
+	return nil
+}
+
+// Import stores the users and shards of dump in storager within a single
+// unit of work, so a failed import leaves storager as it was.
+func Import(ctx context.Context, storager storage.Storager, dump *Dump, options Options) (*Report, error) {
+	err := dump.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+
+	var report *Report
+	err = storager.WithTx(ctx, func(tx storage.Storager) error {
+		report = &Report{DryRun: options.DryRun}
+		err := shardsImport(ctx, tx, dump.Shards, options, report)
+		if err != nil {
+			return fmt.Errorf("shards: %w", err)
+		}
+		err = usersImport(ctx, tx, dump.Users, options, report)
+		if err != nil {
+			return fmt.Errorf("users: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func shardsImport(ctx context.Context, tx storage.Storager, shards []*entityv1.Shard, options Options, report *Report) error {
+	isSeen := make(map[int32]bool)
+	for _, shard := range shards {
+		if isSeen[shard.ShardId] {
+			report.ShardsDuplicate++
+			continue
+		}
+		isSeen[shard.ShardId] = true
+
+		existing, err := tx.ShardByShardID(ctx, shard.ShardId)
+		if err != nil {
+			return fmt.Errorf("shard by shard id %d: %w", shard.ShardId, err)
+		}
+		if existing == nil {
+			report.ShardsCreated++
+			if options.DryRun {
+				continue
+			}
+			_, err = tx.ShardCreate(ctx, &entityv1.Shard{
+				ShardId:    shard.ShardId,
+				Name:       shard.Name,
+				WsAddr:     shard.WsAddr,
+				ClientApp:  shard.ClientApp,
+				State:      shard.State,
+				Capacity:   shard.Capacity,
+				IsExternal: shard.IsExternal,
+			})
+			if err != nil {
+				return fmt.Errorf("shard create %d: %w", shard.ShardId, err)
+			}
+			continue
+		}
+
+		updated := proto.Clone(existing).(*entityv1.Shard)
+		updated.Name = shard.Name
+		updated.WsAddr = shard.WsAddr
+		updated.ClientApp = shard.ClientApp
+		updated.State = shard.State
+		updated.Capacity = shard.Capacity
+		updated.IsExternal = shard.IsExternal
+		if proto.Equal(updated, existing) {
+			report.ShardsUnchanged++
+			continue
+		}
+		report.ShardsUpdated++
+		if options.DryRun {
+			continue
+		}
+		err = tx.ShardUpdateIf(ctx, updated, existing.Revision)
+		if err != nil {
+			return fmt.Errorf("shard update %d: %w", shard.ShardId, err)
+		}
+	}
+	return nil
+}
+
+// usersImport creates the users that keep their id first, so the ids
+// allocated to the others cannot take one of theirs.
+func usersImport(ctx context.Context, tx storage.Storager, users []*entityv1.User, options Options, report *Report) error {
+	isSeen := make(map[string]bool)
+	isIDSeen := make(map[int32]bool)
+	var pending []*entityv1.User
+	for _, user := range users {
+		if isSeen[user.Username] {
+			report.UsersDuplicate++
+			continue
+		}
+		isSeen[user.Username] = true
+
+		existing, err := tx.UserByLogin(ctx, user.Username)
+		if errors.Is(err, storage.ErrDeleted) {
+			report.UsersDeleted++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("user by login '%s': %w", user.Username, err)
+		}
+		if existing != nil {
+			report.UsersExisting++
+			continue
+		}
+
+		report.UsersCreated++
+		if options.Passwords != nil && !options.Passwords.IsSupported(user.Password) {
+			if !options.DryRun && !options.IsUnsupportedPasswordAllowed {
+				return fmt.Errorf("user '%s': password hash cannot be verified, reset it or allow unsupported passwords", user.Username)
+			}
+			report.PasswordsUnsupported++
+		}
+		if user.UserId == 0 {
+			pending = append(pending, user)
+			continue
+		}
+		holder, err := tx.UserByUserID(ctx, user.UserId)
+		if err != nil {
+			return fmt.Errorf("user by user id %d: %w", user.UserId, err)
+		}
+		// On a dry run, earlier users of the dump are not in tx.
+		if holder != nil || isIDSeen[user.UserId] {
+			if report.UserIDsRemapped == nil {
+				report.UserIDsRemapped = make(map[int32]int32)
+			}
+			report.UserIDsRemapped[user.UserId] = 0
+			pending = append(pending, user)
+			continue
+		}
+		isIDSeen[user.UserId] = true
+		if options.DryRun {
+			continue
+		}
+		_, err = userCreate(ctx, tx, user, user.UserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.DryRun {
+		return nil
+	}
+	for _, user := range pending {
+		created, err := userCreate(ctx, tx, user, 0)
+		if err != nil {
+			return err
+		}
+		if _, ok := report.UserIDsRemapped[user.UserId]; ok {
+			report.UserIDsRemapped[user.UserId] = created.UserId
+		}
+	}
+	return nil
+}
+
+// userCreate creates the user of the dump under userID, or under a new id if
+// userID is 0.
+func userCreate(ctx context.Context, tx storage.Storager, user *entityv1.User, userID int32) (*entityv1.User, error) {
+	created, err := tx.UserCreate(ctx, &entityv1.User{
+		UserId:     userID,
+		Username:   user.Username,
+		Password:   user.Password,
+		ShardId:    user.ShardId,
+		Privileges: user.Privileges,
+		CreatedAt:  user.CreatedAt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("user create '%s': %w", user.Username, err)
+	}
+	return created, nil
+}
+
+// Export reads every user and shard of storager, a page at a time.
+func Export(ctx context.Context, storager storage.Storager) (*Dump, error) {
+	dump := &Dump{}
+	page := storage.Page{Limit: storage.PageLimitMax}
+	for {
+		users, next, err := storager.UserList(ctx, storage.UserListFilter{}, page)
+		if err != nil {
+			return nil, fmt.Errorf("user list: %w", err)
+		}
+		dump.Users = append(dump.Users, users...)
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+
+	page = storage.Page{Limit: storage.PageLimitMax}
+	for {
+		shards, next, err := storager.ShardList(ctx, storage.ShardListFilter{}, page)
+		if err != nil {
+			return nil, fmt.Errorf("shard list: %w", err)
+		}
+		dump.Shards = append(dump.Shards, shards...)
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+	return dump, nil
+}
+
+func userStateString(state entityv1.UserState) string {
+	return strings.ToLower(state.String())
+}
+
+func userStateParse(s string) (entityv1.UserState, error) {
+	if s == "" {
+		return entityv1.UserState_OFFLINE, nil
+	}
+	state, ok := entityv1.UserState_value[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown user state '%s'", s)
+	}
+	return entityv1.UserState(state), nil
+}
+
+func shardStateString(state entityv1.ShardState) string {
+	return strings.ToLower(state.String())
+}
+
+func shardStateParse(s string) (entityv1.ShardState, error) {
+	if s == "" {
+		return entityv1.ShardState_CLOSED, nil
+	}
+	state, ok := entityv1.ShardState_value[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown shard state '%s'", s)
+	}
+	return entityv1.ShardState(state), nil
+}
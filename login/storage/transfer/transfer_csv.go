@@ -0,0 +1,225 @@
+package transfer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+var (
+	csvUserColumns  = []string{"user_id", "username", "password", "state", "shard_id", "privileges", "created_at"}
+	csvShardColumns = []string{"shard_id", "name", "ws_addr", "client_app", "state", "is_online", "player_count", "capacity", "is_external"}
+)
+
+// csvRow reads the cells of a record by column name.
+type csvRow struct {
+	columns map[string]int
+	record  []string
+}
+
+func (r csvRow) str(column string) string {
+	i, ok := r.columns[column]
+	if !ok || i >= len(r.record) {
+		return ""
+	}
+	return strings.TrimSpace(r.record[i])
+}
+
+func (r csvRow) int32(column string) (int32, error) {
+	s := r.str(column)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", column, err)
+	}
+	return int32(n), nil
+}
+
+func (r csvRow) bool(column string) (bool, error) {
+	s := r.str(column)
+	if s == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("parse %s: %w", column, err)
+	}
+	return b, nil
+}
+
+// ReadCSV appends the users or shards of the CSV table in r, telling them
+// apart by the header row.
+func (d *Dump) ReadCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("missing header row")
+	}
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	_, isUsers := columns["username"]
+	_, isShards := columns["shard_id"]
+	if !isUsers && !isShards {
+		return fmt.Errorf("header has neither a username nor a shard_id column")
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		row := csvRow{columns: columns, record: record}
+		if isUsers {
+			err = d.csvUserRead(row)
+		} else {
+			err = d.csvShardRead(row)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+func (d *Dump) csvUserRead(row csvRow) error {
+	userID, err := row.int32("user_id")
+	if err != nil {
+		return err
+	}
+	state, err := userStateParse(row.str("state"))
+	if err != nil {
+		return err
+	}
+	shardID, err := row.int32("shard_id")
+	if err != nil {
+		return err
+	}
+	createdAt, err := createdAtParse(row.str("created_at"))
+	if err != nil {
+		return err
+	}
+	var privileges []string
+	for _, privilege := range strings.Split(row.str("privileges"), ",") {
+		privilege = strings.TrimSpace(privilege)
+		if privilege != "" {
+			privileges = append(privileges, privilege)
+		}
+	}
+	d.Users = append(d.Users, &entityv1.User{
+		UserId:     userID,
+		Username:   row.str("username"),
+		Password:   row.str("password"),
+		State:      state,
+		ShardId:    shardID,
+		Privileges: privileges,
+		CreatedAt:  createdAt,
+	})
+	return nil
+}
+
+func (d *Dump) csvShardRead(row csvRow) error {
+	shardID, err := row.int32("shard_id")
+	if err != nil {
+		return err
+	}
+	state, err := shardStateParse(row.str("state"))
+	if err != nil {
+		return err
+	}
+	isOnline, err := row.bool("is_online")
+	if err != nil {
+		return err
+	}
+	playerCount, err := row.int32("player_count")
+	if err != nil {
+		return err
+	}
+	capacity, err := row.int32("capacity")
+	if err != nil {
+		return err
+	}
+	isExternal, err := row.bool("is_external")
+	if err != nil {
+		return err
+	}
+	d.Shards = append(d.Shards, &entityv1.Shard{
+		ShardId:     shardID,
+		Name:        row.str("name"),
+		WsAddr:      row.str("ws_addr"),
+		ClientApp:   row.str("client_app"),
+		State:       state,
+		IsOnline:    isOnline,
+		PlayerCount: playerCount,
+		Capacity:    capacity,
+		IsExternal:  isExternal,
+	})
+	return nil
+}
+
+// WriteUsersCSV writes the users as a CSV table.
+func (d *Dump) WriteUsersCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(csvUserColumns)
+	if err != nil {
+		return err
+	}
+	for _, user := range d.Users {
+		err = writer.Write([]string{
+			strconv.FormatInt(int64(user.UserId), 10),
+			user.Username,
+			user.Password,
+			userStateString(user.State),
+			strconv.FormatInt(int64(user.ShardId), 10),
+			strings.Join(user.Privileges, ","),
+			createdAtString(user.CreatedAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteShardsCSV writes the shards as a CSV table.
+func (d *Dump) WriteShardsCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(csvShardColumns)
+	if err != nil {
+		return err
+	}
+	for _, shard := range d.Shards {
+		err = writer.Write([]string{
+			strconv.FormatInt(int64(shard.ShardId), 10),
+			shard.Name,
+			shard.WsAddr,
+			shard.ClientApp,
+			shardStateString(shard.State),
+			strconv.FormatBool(shard.IsOnline),
+			strconv.FormatInt(int64(shard.PlayerCount), 10),
+			strconv.FormatInt(int64(shard.Capacity), 10),
+			strconv.FormatBool(shard.IsExternal),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
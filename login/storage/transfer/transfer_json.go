@@ -0,0 +1,139 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+type jsonDump struct {
+	Users  []jsonUser  `json:"users"`
+	Shards []jsonShard `json:"shards"`
+}
+
+type jsonUser struct {
+	UserID     int32    `json:"user_id,omitempty"`
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	State      string   `json:"state,omitempty"`
+	ShardID    int32    `json:"shard_id,omitempty"`
+	Privileges []string `json:"privileges,omitempty"`
+	CreatedAt  string   `json:"created_at,omitempty"`
+}
+
+type jsonShard struct {
+	ShardID     int32  `json:"shard_id"`
+	Name        string `json:"name"`
+	WsAddr      string `json:"ws_addr"`
+	ClientApp   string `json:"client_app"`
+	State       string `json:"state"`
+	IsOnline    bool   `json:"is_online,omitempty"`
+	PlayerCount int32  `json:"player_count,omitempty"`
+	Capacity    int32  `json:"capacity,omitempty"`
+	IsExternal  bool   `json:"is_external,omitempty"`
+}
+
+// ReadJSON appends the users and shards of the JSON document in r.
+func (d *Dump) ReadJSON(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var doc jsonDump
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	for i, u := range doc.Users {
+		state, err := userStateParse(u.State)
+		if err != nil {
+			return fmt.Errorf("user %d: %w", i+1, err)
+		}
+		createdAt, err := createdAtParse(u.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("user %d: %w", i+1, err)
+		}
+		d.Users = append(d.Users, &entityv1.User{
+			UserId:     u.UserID,
+			Username:   u.Username,
+			Password:   u.Password,
+			State:      state,
+			ShardId:    u.ShardID,
+			Privileges: u.Privileges,
+			CreatedAt:  createdAt,
+		})
+	}
+	for i, s := range doc.Shards {
+		state, err := shardStateParse(s.State)
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i+1, err)
+		}
+		d.Shards = append(d.Shards, &entityv1.Shard{
+			ShardId:     s.ShardID,
+			Name:        s.Name,
+			WsAddr:      s.WsAddr,
+			ClientApp:   s.ClientApp,
+			State:       state,
+			IsOnline:    s.IsOnline,
+			PlayerCount: s.PlayerCount,
+			Capacity:    s.Capacity,
+			IsExternal:  s.IsExternal,
+		})
+	}
+	return nil
+}
+
+// WriteJSON writes the users and shards as an indented JSON document.
+func (d *Dump) WriteJSON(w io.Writer) error {
+	doc := jsonDump{Users: []jsonUser{}, Shards: []jsonShard{}}
+	for _, user := range d.Users {
+		doc.Users = append(doc.Users, jsonUser{
+			UserID:     user.UserId,
+			Username:   user.Username,
+			Password:   user.Password,
+			State:      userStateString(user.State),
+			ShardID:    user.ShardId,
+			Privileges: user.Privileges,
+			CreatedAt:  createdAtString(user.CreatedAt),
+		})
+	}
+	for _, shard := range d.Shards {
+		doc.Shards = append(doc.Shards, jsonShard{
+			ShardID:     shard.ShardId,
+			Name:        shard.Name,
+			WsAddr:      shard.WsAddr,
+			ClientApp:   shard.ClientApp,
+			State:       shardStateString(shard.State),
+			IsOnline:    shard.IsOnline,
+			PlayerCount: shard.PlayerCount,
+			Capacity:    shard.Capacity,
+			IsExternal:  shard.IsExternal,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// createdAtString formats a CreatedAt in unix milliseconds as RFC 3339, or ""
+// if it is unset.
+func createdAtString(createdAt int64) string {
+	if createdAt == 0 {
+		return ""
+	}
+	return time.UnixMilli(createdAt).UTC().Format(time.RFC3339Nano)
+}
+
+func createdAtParse(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("parse created_at: %w", err)
+	}
+	return t.UnixMilli(), nil
+}
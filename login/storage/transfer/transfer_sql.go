@@ -0,0 +1,496 @@
+package transfer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+const (
+	sqlTableUser  = "user"
+	sqlTableShard = "shard"
+)
+
+// sqlDefinitionKeywords start the table definitions of a CREATE TABLE that
+// are not columns.
+var sqlDefinitionKeywords = map[string]bool{
+	"PRIMARY": true, "KEY": true, "INDEX": true, "UNIQUE": true, "FULLTEXT": true,
+	"SPATIAL": true, "CONSTRAINT": true, "FOREIGN": true, "CHECK": true,
+}
+
+var sqlEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+type sqlTokenKind int
+
+const (
+	sqlWord sqlTokenKind = iota
+	sqlIdent
+	sqlString
+	sqlPunct
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+}
+
+func (t sqlToken) isWord(word string) bool {
+	return t.kind == sqlWord && strings.EqualFold(t.text, word)
+}
+
+func (t sqlToken) isPunct(punct string) bool {
+	return t.kind == sqlPunct && t.text == punct
+}
+
+// isName reports whether t can name a table or a column.
+func (t sqlToken) isName() bool {
+	return t.kind == sqlIdent || t.kind == sqlWord
+}
+
+// ReadSQL appends the users and shards of the nel mysqldump in r.
+func (d *Dump) ReadSQL(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	// columns holds the column names of each table, in the order of its
+	// CREATE TABLE, for inserts that do not name them.
+	columns := make(map[string][]string)
+	for n := 1; ; n++ {
+		statement, err := sqlStatementRead(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("statement %d: %w", n, err)
+		}
+		tokens, err := sqlTokenize(statement)
+		if err != nil {
+			return fmt.Errorf("statement %d: %w", n, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		switch {
+		case tokens[0].isWord("CREATE"):
+			table, tableColumns := sqlCreateTableParse(tokens)
+			if table != "" {
+				columns[table] = tableColumns
+			}
+		case tokens[0].isWord("INSERT") || tokens[0].isWord("REPLACE"):
+			err = d.sqlInsertRead(tokens, columns)
+			if err != nil {
+				return fmt.Errorf("statement %d: %w", n, err)
+			}
+		}
+	}
+}
+
+// sqlStatementRead returns the next statement of r without its ';' and with
+// its comments blanked out, or io.EOF after the last one.
+func sqlStatementRead(r *bufio.Reader) (string, error) {
+	var b strings.Builder
+	var quote rune
+	for {
+		c, _, err := r.ReadRune()
+		if errors.Is(err, io.EOF) {
+			if quote != 0 {
+				return "", fmt.Errorf("unterminated %c quote", quote)
+			}
+			statement := strings.TrimSpace(b.String())
+			if statement == "" {
+				return "", io.EOF
+			}
+			return statement, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if quote != 0 {
+			b.WriteRune(c)
+			if c == '\\' && quote != '`' {
+				escaped, _, err := r.ReadRune()
+				if err != nil {
+					return "", fmt.Errorf("unterminated %c quote", quote)
+				}
+				b.WriteRune(escaped)
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+			b.WriteRune(c)
+		case ';':
+			statement := strings.TrimSpace(b.String())
+			if statement != "" {
+				return statement, nil
+			}
+			b.Reset()
+		case '#':
+			_, err = r.ReadString('\n')
+			b.WriteRune(' ')
+		case '-':
+			next, _ := r.Peek(1)
+			if len(next) == 1 && next[0] == '-' {
+				_, err = r.ReadString('\n')
+				b.WriteRune(' ')
+			} else {
+				b.WriteRune(c)
+			}
+		case '/':
+			next, _ := r.Peek(1)
+			if len(next) == 1 && next[0] == '*' {
+				err = sqlCommentSkip(r)
+				b.WriteRune(' ')
+			} else {
+				b.WriteRune(c)
+			}
+		default:
+			b.WriteRune(c)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+	}
+}
+
+// sqlCommentSkip skips a /* */ comment, r being on its '*'. mysqldump wraps
+// its session settings in such comments; none of them matter here.
+func sqlCommentSkip(r *bufio.Reader) error {
+	_, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	var previous byte
+	for {
+		c, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("unterminated comment")
+		}
+		if err != nil {
+			return err
+		}
+		if previous == '*' && c == '/' {
+			return nil
+		}
+		previous = c
+	}
+}
+
+// sqlTokenize splits a statement into words, quoted identifiers, unescaped
+// strings and the punctuation ( ) and ,.
+func sqlTokenize(statement string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	for i := 0; i < len(statement); {
+		c := statement[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, sqlToken{kind: sqlPunct, text: string(c)})
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			text, n, err := sqlUnquote(statement[i:])
+			if err != nil {
+				return nil, err
+			}
+			kind := sqlString
+			if c == '`' {
+				kind = sqlIdent
+			}
+			tokens = append(tokens, sqlToken{kind: kind, text: text})
+			i += n
+		default:
+			end := i
+			for end < len(statement) && !strings.ContainsRune(" \t\n\r(),'\"`", rune(statement[end])) {
+				end++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlWord, text: statement[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// sqlUnquote unquotes the string or identifier s starts with, and returns
+// how many bytes of s it took.
+func sqlUnquote(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote && i+1 < len(s) && s[i+1] == quote:
+			b.WriteByte(quote)
+			i++
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && quote != '`' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case '0':
+				b.WriteByte(0)
+			case 'b':
+				b.WriteByte('\b')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'Z':
+				b.WriteByte('\x1a')
+			case '%', '_':
+				// Kept escaped, as MySQL does outside of LIKE patterns.
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c quote", quote)
+}
+
+// sqlCreateTableParse returns the lowercased name and column names of a
+// CREATE TABLE statement, or no name for any other CREATE.
+func sqlCreateTableParse(tokens []sqlToken) (string, []string) {
+	open := -1
+	isTable := false
+	for i, token := range tokens {
+		if token.isWord("TABLE") {
+			isTable = true
+		}
+		if token.isPunct("(") {
+			open = i
+			break
+		}
+	}
+	if !isTable || open < 1 || !tokens[open-1].isName() {
+		return "", nil
+	}
+	table := strings.ToLower(tokens[open-1].text)
+
+	var columns []string
+	depth := 0
+	isDefinitionStart := true
+	for _, token := range tokens[open:] {
+		switch {
+		case token.isPunct("("):
+			depth++
+			continue
+		case token.isPunct(")"):
+			depth--
+			continue
+		case token.isPunct(",") && depth == 1:
+			isDefinitionStart = true
+			continue
+		}
+		if depth == 1 && isDefinitionStart {
+			isDefinitionStart = false
+			if token.kind == sqlIdent || (token.kind == sqlWord && !sqlDefinitionKeywords[strings.ToUpper(token.text)]) {
+				columns = append(columns, strings.ToLower(token.text))
+			}
+		}
+	}
+	return table, columns
+}
+
+// sqlInsertRead appends the rows of an INSERT into the user or shard table.
+func (d *Dump) sqlInsertRead(tokens []sqlToken, columns map[string][]string) error {
+	i := 0
+	for i < len(tokens) && !tokens[i].isWord("INTO") {
+		i++
+	}
+	i++
+	if i >= len(tokens) || !tokens[i].isName() {
+		return fmt.Errorf("insert without a table")
+	}
+	table := strings.ToLower(tokens[i].text)
+	if table != sqlTableUser && table != sqlTableShard {
+		return nil
+	}
+	i++
+
+	rowColumns := columns[table]
+	if i < len(tokens) && tokens[i].isPunct("(") {
+		rowColumns = nil
+		for i++; i < len(tokens) && !tokens[i].isPunct(")"); i++ {
+			if tokens[i].isName() {
+				rowColumns = append(rowColumns, strings.ToLower(tokens[i].text))
+			}
+		}
+		i++
+	}
+	if len(rowColumns) == 0 {
+		return fmt.Errorf("insert into %s: no column names and no CREATE TABLE before it", table)
+	}
+	if i >= len(tokens) || !(tokens[i].isWord("VALUES") || tokens[i].isWord("VALUE")) {
+		return fmt.Errorf("insert into %s: expected VALUES", table)
+	}
+	i++
+
+	for i < len(tokens) {
+		if !tokens[i].isPunct("(") {
+			// Trailing clauses such as ON DUPLICATE KEY UPDATE.
+			break
+		}
+		row := make(map[string]string)
+		column := 0
+		for i++; i < len(tokens) && !tokens[i].isPunct(")"); i++ {
+			if tokens[i].isPunct(",") {
+				column++
+				continue
+			}
+			if column >= len(rowColumns) {
+				return fmt.Errorf("insert into %s: more values than columns", table)
+			}
+			if !tokens[i].isWord("NULL") {
+				row[rowColumns[column]] = tokens[i].text
+			}
+		}
+		i++
+
+		var err error
+		if table == sqlTableUser {
+			err = d.sqlUserRead(row)
+		} else {
+			err = d.sqlShardRead(row)
+		}
+		if err != nil {
+			return fmt.Errorf("insert into %s: %w", table, err)
+		}
+
+		if i < len(tokens) && tokens[i].isPunct(",") {
+			i++
+		}
+	}
+	return nil
+}
+
+func sqlInt32(row map[string]string, column string) (int32, error) {
+	s := row[column]
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", column, err)
+	}
+	return int32(n), nil
+}
+
+func (d *Dump) sqlUserRead(row map[string]string) error {
+	userID, err := sqlInt32(row, "uid")
+	if err != nil {
+		return err
+	}
+	shardID, err := sqlInt32(row, "shardid")
+	if err != nil {
+		return err
+	}
+	state := entityv1.UserState_OFFLINE
+	if strings.EqualFold(row["state"], "Online") {
+		state = entityv1.UserState_ONLINE
+	}
+	var privileges []string
+	for _, privilege := range strings.Split(row["privilege"], ":") {
+		if privilege != "" {
+			privileges = append(privileges, privilege)
+		}
+	}
+	d.Users = append(d.Users, &entityv1.User{
+		UserId:     userID,
+		Username:   row["login"],
+		Password:   row["password"],
+		State:      state,
+		ShardId:    max(shardID, 0),
+		Privileges: privileges,
+	})
+	return nil
+}
+
+func (d *Dump) sqlShardRead(row map[string]string) error {
+	shardID, err := sqlInt32(row, "shardid")
+	if err != nil {
+		return err
+	}
+	playerCount, err := sqlInt32(row, "nbplayers")
+	if err != nil {
+		return err
+	}
+	var state entityv1.ShardState
+	switch row["state"] {
+	case "ds_open":
+		state = entityv1.ShardState_OPEN
+	case "ds_restricted", "ds_dev", "":
+		// nel creates shards as ds_dev, open to developers only.
+		state = entityv1.ShardState_RESTRICTED
+	case "ds_close":
+		state = entityv1.ShardState_CLOSED
+	default:
+		return fmt.Errorf("unknown shard state '%s'", row["state"])
+	}
+	d.Shards = append(d.Shards, &entityv1.Shard{
+		ShardId:     shardID,
+		Name:        row["name"],
+		WsAddr:      row["wsaddr"],
+		ClientApp:   row["clientapplication"],
+		State:       state,
+		IsOnline:    row["online"] != "" && row["online"] != "0",
+		PlayerCount: playerCount,
+	})
+	return nil
+}
+
+// WriteSQL writes the users and shards as INSERT statements for the user and
+// shard tables of a nel database.
+func (d *Dump) WriteSQL(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "-- Users and shards for the user and shard tables of a nel database.")
+	for _, shard := range d.Shards {
+		state := "ds_close"
+		switch shard.State {
+		case entityv1.ShardState_OPEN:
+			state = "ds_open"
+		case entityv1.ShardState_RESTRICTED:
+			state = "ds_restricted"
+		}
+		online := 0
+		if shard.IsOnline {
+			online = 1
+		}
+		fmt.Fprintf(bw, "INSERT INTO `shard` (`ShardId`, `Name`, `WsAddr`, `ClientApplication`, `State`, `Online`, `NbPlayers`) VALUES (%d, %s, %s, %s, '%s', %d, %d);\n",
+			shard.ShardId, sqlQuote(shard.Name), sqlQuote(shard.WsAddr), sqlQuote(shard.ClientApp), state, online, shard.PlayerCount)
+	}
+	for _, user := range d.Users {
+		state := "Offline"
+		if user.State == entityv1.UserState_ONLINE {
+			state = "Online"
+		}
+		shardID := user.ShardId
+		if shardID == 0 {
+			shardID = -1
+		}
+		privilege := ""
+		if len(user.Privileges) > 0 {
+			privilege = ":" + strings.Join(user.Privileges, ":") + ":"
+		}
+		fmt.Fprintf(bw, "INSERT INTO `user` (`UId`, `Login`, `Password`, `ShardId`, `State`, `Privilege`) VALUES (%d, %s, %s, %d, '%s', %s);\n",
+			user.UserId, sqlQuote(user.Username), sqlQuote(user.Password), shardID, state, sqlQuote(privilege))
+	}
+	return bw.Flush()
+}
+
+func sqlQuote(s string) string {
+	return "'" + sqlEscaper.Replace(s) + "'"
+}
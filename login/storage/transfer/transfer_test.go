@@ -0,0 +1,333 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/runeharvest/gserver/login/password"
+	"github.com/runeharvest/gserver/login/storage/memory"
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+// nelDump is trimmed from a mysqldump of a nel database, keeping the quirks
+// the reader must cope with.
+const nelDump = "-- MySQL dump 10.13  Distrib 5.7.44\n" +
+	"/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n" +
+	"DROP TABLE IF EXISTS `shard`;\n" +
+	"CREATE TABLE `shard` (\n" +
+	"  `ShardId` int(10) NOT NULL default '0',\n" +
+	"  `domain_id` int(11) unsigned NOT NULL default '0',\n" +
+	"  `WsAddr` varchar(64) default NULL,\n" +
+	"  `NbPlayers` int(10) unsigned default '0',\n" +
+	"  `Name` varchar(255) default 'unknown shard',\n" +
+	"  `Online` tinyint(1) unsigned default '0',\n" +
+	"  `ClientApplication` varchar(64) default 'ryzom',\n" +
+	"  `State` enum('ds_close','ds_dev','ds_restricted','ds_open') NOT NULL default 'ds_dev',\n" +
+	"  `MOTD` text NOT NULL,\n" +
+	"  `prim` int(10) unsigned NOT NULL auto_increment,\n" +
+	"  PRIMARY KEY  (`prim`)\n" +
+	") ENGINE=MyISAM DEFAULT CHARSET=utf8;\n" +
+	"LOCK TABLES `shard` WRITE;\n" +
+	"INSERT INTO `shard` VALUES (101,1,'atys.example.net:48851',12,'Atys',1,'ryzom','ds_open','Welcome; enjoy',1)," +
+	"(102,1,NULL,0,'Dev',0,'ryzom_dev','ds_dev','',2);\n" +
+	"UNLOCK TABLES;\n" +
+	"CREATE TABLE `user` (\n" +
+	"  `UId` int(10) NOT NULL auto_increment,\n" +
+	"  `Login` varchar(64) NOT NULL default '',\n" +
+	"  `Password` varchar(13) default NULL,\n" +
+	"  `ShardId` int(10) NOT NULL default '-1',\n" +
+	"  `State` enum('Offline','Online') NOT NULL default 'Offline',\n" +
+	"  `Privilege` varchar(255) NOT NULL default '',\n" +
+	"  PRIMARY KEY  (`UId`),\n" +
+	"  UNIQUE KEY `LoginIndex` (`Login`)\n" +
+	") ENGINE=MyISAM;\n" +
+	"INSERT INTO `user` VALUES (1,'alice','AbCdEfGhIjKlM',-1,'Offline',':DEV:GM:')," +
+	"(2,'o\\'brien','NoPqRsTuVwXyZ',101,'Online','');\n" +
+	"INSERT INTO `permission` VALUES (1,1,'ryzom');\n"
+
+func TestReadSQL(t *testing.T) {
+	dump := &Dump{}
+	err := dump.ReadSQL(strings.NewReader(nelDump))
+	if err != nil {
+		t.Fatal("read sql:", err)
+	}
+
+	if len(dump.Shards) != 2 || len(dump.Users) != 2 {
+		t.Fatal("read sql: expected 2 shards and 2 users, got", dump.Shards, dump.Users)
+	}
+	atys := dump.Shards[0]
+	if atys.ShardId != 101 || atys.Name != "Atys" || atys.WsAddr != "atys.example.net:48851" || atys.ClientApp != "ryzom" ||
+		atys.State != entityv1.ShardState_OPEN || !atys.IsOnline || atys.PlayerCount != 12 {
+		t.Fatal("shard 101:", atys)
+	}
+	if dev := dump.Shards[1]; dev.WsAddr != "" || dev.State != entityv1.ShardState_RESTRICTED || dev.IsOnline {
+		t.Fatal("shard 102:", dev)
+	}
+	alice := dump.Users[0]
+	if alice.Username != "alice" || alice.Password != "AbCdEfGhIjKlM" || alice.ShardId != 0 ||
+		alice.State != entityv1.UserState_OFFLINE || !slices.Equal(alice.Privileges, []string{"DEV", "GM"}) {
+		t.Fatal("user alice:", alice)
+	}
+	if obrien := dump.Users[1]; obrien.Username != "o'brien" || obrien.ShardId != 101 || obrien.State != entityv1.UserState_ONLINE || obrien.Privileges != nil {
+		t.Fatal("user o'brien:", obrien)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	bc, err := password.NewBcryptHasher(4)
+	if err != nil {
+		t.Fatal("new bcrypt hasher:", err)
+	}
+	passwords, err := password.NewPasswordService(bc)
+	if err != nil {
+		t.Fatal("new password service:", err)
+	}
+	hash, err := passwords.Hash("testpassword")
+	if err != nil {
+		t.Fatal("hash:", err)
+	}
+
+	dump := &Dump{}
+	err = dump.ReadSQL(strings.NewReader(nelDump))
+	if err != nil {
+		t.Fatal("read sql:", err)
+	}
+	dump.Users = append(dump.Users,
+		&entityv1.User{Username: "carol", Password: hash, CreatedAt: 1714564800000},
+		&entityv1.User{Username: "alice", Password: hash},
+	)
+
+	report, err := Import(ctx, memoryStorage, dump, Options{DryRun: true, Passwords: passwords})
+	if err != nil {
+		t.Fatal("import dry run:", err)
+	}
+	expected := Report{DryRun: true, UsersCreated: 3, UsersDuplicate: 1, PasswordsUnsupported: 2, ShardsCreated: 2}
+	if !reflect.DeepEqual(*report, expected) {
+		t.Fatal("import dry run report:", report)
+	}
+	users, err := memoryStorage.Users(ctx)
+	if err != nil || len(users) != 0 {
+		t.Fatal("users after dry run:", users, err)
+	}
+
+	// The legacy hashes of alice and o'brien cannot be verified.
+	_, err = Import(ctx, memoryStorage, dump, Options{Passwords: passwords})
+	if err == nil {
+		t.Fatal("import of unsupported password hashes succeeded")
+	}
+	users, err = memoryStorage.Users(ctx)
+	if err != nil || len(users) != 0 {
+		t.Fatal("users after failed import:", users, err)
+	}
+
+	report, err = Import(ctx, memoryStorage, dump, Options{Passwords: passwords, IsUnsupportedPasswordAllowed: true})
+	if err != nil {
+		t.Fatal("import:", err)
+	}
+	expected.DryRun = false
+	if !reflect.DeepEqual(*report, expected) {
+		t.Fatal("import report:", report)
+	}
+
+	// Running it again changes nothing.
+	report, err = Import(ctx, memoryStorage, dump, Options{Passwords: passwords})
+	if err != nil {
+		t.Fatal("import again:", err)
+	}
+	expected = Report{UsersExisting: 3, UsersDuplicate: 1, ShardsUnchanged: 2}
+	if !reflect.DeepEqual(*report, expected) {
+		t.Fatal("import again report:", report)
+	}
+	users, err = memoryStorage.Users(ctx)
+	if err != nil || len(users) != 3 {
+		t.Fatal("users after import:", users, err)
+	}
+	for _, user := range users {
+		if user.State != entityv1.UserState_OFFLINE {
+			t.Fatal("imported user not offline:", user)
+		}
+		if user.Username == "o'brien" && user.ShardId != 101 {
+			t.Fatal("imported user shard id:", user)
+		}
+		if user.Username == "carol" && user.CreatedAt != 1714564800000 {
+			t.Fatal("imported user created at:", user)
+		}
+	}
+	shard, err := memoryStorage.ShardByShardID(ctx, 101)
+	if err != nil || shard == nil || shard.IsOnline || shard.PlayerCount != 0 {
+		t.Fatal("imported shard not offline:", shard, err)
+	}
+
+	// Shards follow the dump, deleted users keep their name.
+	dump.Shards[0].Name = "Atys renamed"
+	alice, err := memoryStorage.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal("user by login:", err)
+	}
+	err = memoryStorage.UserDelete(ctx, alice.UserId)
+	if err != nil {
+		t.Fatal("user delete:", err)
+	}
+	report, err = Import(ctx, memoryStorage, dump, Options{})
+	if err != nil {
+		t.Fatal("import after changes:", err)
+	}
+	expected = Report{UsersExisting: 2, UsersDeleted: 1, UsersDuplicate: 1, ShardsUpdated: 1, ShardsUnchanged: 1}
+	if !reflect.DeepEqual(*report, expected) {
+		t.Fatal("import after changes report:", report)
+	}
+	shard, err = memoryStorage.ShardByShardID(ctx, 101)
+	if err != nil || shard.Name != "Atys renamed" || shard.Revision != 2 {
+		t.Fatal("updated shard:", shard, err)
+	}
+
+	_, err = Import(ctx, memoryStorage, &Dump{Users: []*entityv1.User{{Password: hash}}}, Options{})
+	if err == nil {
+		t.Fatal("import user without username: expected an error")
+	}
+}
+
+func TestImportUserIDs(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	// bob takes user id 1, the id of alice in the dump.
+	bob, err := memoryStorage.UserCreate(ctx, &entityv1.User{Username: "bob"})
+	if err != nil || bob.UserId != 1 {
+		t.Fatal("user create:", bob, err)
+	}
+
+	dump := &Dump{}
+	err = dump.ReadSQL(strings.NewReader(nelDump))
+	if err != nil {
+		t.Fatal("read sql:", err)
+	}
+	dump.Users = append(dump.Users, &entityv1.User{Username: "dave"})
+
+	report, err := Import(ctx, memoryStorage, dump, Options{DryRun: true})
+	if err != nil {
+		t.Fatal("import dry run:", err)
+	}
+	if !reflect.DeepEqual(report.UserIDsRemapped, map[int32]int32{1: 0}) {
+		t.Fatal("import dry run remapped:", report.UserIDsRemapped)
+	}
+
+	report, err = Import(ctx, memoryStorage, dump, Options{})
+	if err != nil {
+		t.Fatal("import:", err)
+	}
+	if !reflect.DeepEqual(report.UserIDsRemapped, map[int32]int32{1: 3}) {
+		t.Fatal("import remapped:", report.UserIDsRemapped)
+	}
+	if !strings.Contains(report.String(), "  1 -> 3\n") {
+		t.Fatal("import report:", report)
+	}
+	expected := map[string]int32{"bob": 1, "o'brien": 2, "alice": 3, "dave": 4}
+	for username, userID := range expected {
+		user, err := memoryStorage.UserByLogin(ctx, username)
+		if err != nil || user == nil || user.UserId != userID {
+			t.Fatal("user by login", username, ":", user, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	memoryStorage, err := memory.NewMemoryStorage()
+	if err != nil {
+		t.Fatal("new memory storage:", err)
+	}
+	_, err = memoryStorage.ShardCreate(ctx, &entityv1.Shard{
+		ShardId: 101, Name: "Atys, \"main\"", WsAddr: "atys:48851", ClientApp: "ryzom",
+		State: entityv1.ShardState_RESTRICTED, IsOnline: true, PlayerCount: 3, Capacity: 500, IsExternal: true,
+	})
+	if err != nil {
+		t.Fatal("shard create:", err)
+	}
+	_, err = memoryStorage.UserCreate(ctx, &entityv1.User{
+		Username: "it's\nme", Password: "$2a$04$hash\\", State: entityv1.UserState_ONLINE, ShardId: 101,
+		Privileges: []string{"DEV", "GM"}, CreatedAt: 1714564800123,
+	})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+	_, err = memoryStorage.UserCreate(ctx, &entityv1.User{Username: "plain"})
+	if err != nil {
+		t.Fatal("user create:", err)
+	}
+
+	exported, err := Export(ctx, memoryStorage)
+	if err != nil {
+		t.Fatal("export:", err)
+	}
+	if len(exported.Users) != 2 || len(exported.Shards) != 1 {
+		t.Fatal("export:", exported)
+	}
+
+	tests := []struct {
+		name  string
+		write func(d *Dump) ([]*bytes.Buffer, error)
+		read  func(d *Dump, r io.Reader) error
+		// isLegacy is set for the SQL dump, which has no column for some fields.
+		isLegacy bool
+	}{
+		{"json", func(d *Dump) ([]*bytes.Buffer, error) {
+			var b bytes.Buffer
+			return []*bytes.Buffer{&b}, d.WriteJSON(&b)
+		}, (*Dump).ReadJSON, false},
+		{"csv", func(d *Dump) ([]*bytes.Buffer, error) {
+			var users, shards bytes.Buffer
+			err := d.WriteUsersCSV(&users)
+			if err != nil {
+				return nil, err
+			}
+			return []*bytes.Buffer{&users, &shards}, d.WriteShardsCSV(&shards)
+		}, (*Dump).ReadCSV, false},
+		{"sql", func(d *Dump) ([]*bytes.Buffer, error) {
+			var b bytes.Buffer
+			return []*bytes.Buffer{&b}, d.WriteSQL(&b)
+		}, (*Dump).ReadSQL, true},
+	}
+	for _, tt := range tests {
+		buffers, err := tt.write(exported)
+		if err != nil {
+			t.Fatal(tt.name, "write:", err)
+		}
+		read := &Dump{}
+		for _, b := range buffers {
+			err = tt.read(read, b)
+			if err != nil {
+				t.Fatal(tt.name, "read:", err)
+			}
+		}
+		if len(read.Users) != len(exported.Users) || len(read.Shards) != len(exported.Shards) {
+			t.Fatal(tt.name, "read back:", read)
+		}
+		for i, user := range exported.Users {
+			got := read.Users[i]
+			if got.UserId != user.UserId || got.Username != user.Username || got.Password != user.Password ||
+				got.State != user.State || got.ShardId != user.ShardId || !slices.Equal(got.Privileges, user.Privileges) ||
+				(!tt.isLegacy && got.CreatedAt != user.CreatedAt) {
+				t.Fatal(tt.name, "user:", got, "expected", user)
+			}
+		}
+		got, shard := read.Shards[0], exported.Shards[0]
+		if got.ShardId != shard.ShardId || got.Name != shard.Name || got.WsAddr != shard.WsAddr || got.ClientApp != shard.ClientApp ||
+			got.State != shard.State || got.IsOnline != shard.IsOnline || got.PlayerCount != shard.PlayerCount ||
+			(!tt.isLegacy && (got.Capacity != shard.Capacity || got.IsExternal != shard.IsExternal)) {
+			t.Fatal(tt.name, "shard:", got, "expected", shard)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	entityv1 "github.com/runeharvest/gserver/proto/rh/entity/v1"
+)
+
+// ErrSlowConsumer ends a watch whose buffer filled up because its events were
+// not read fast enough.
+var ErrSlowConsumer = errors.New("watch fell behind")
+
+type EventType int32
+
+const (
+	EventCreate EventType = iota + 1
+	EventUpdate
+	EventDelete
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventCreate:
+		return "create"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// UserEvent is a committed change of a user. Previous is the user before the
+// change and nil for EventCreate; User is the user after it, or the deleted
+// user for EventDelete.
+type UserEvent struct {
+	Type     EventType
+	User     *entityv1.User
+	Previous *entityv1.User
+}
+
+// ShardEvent is a committed change of a shard, like UserEvent.
+type ShardEvent struct {
+	Type     EventType
+	Shard    *entityv1.Shard
+	Previous *entityv1.Shard
+}
+
+// UserFilter selects the users a watch is interested in. A nil UserFilter
+// selects every user.
+type UserFilter func(user *entityv1.User) bool
+
+// Watcher is implemented by the Storagers that can push their changes instead
+// of being polled.
+//
+// A watch receives the events committed after it started, in commit order,
+// and none of the writes of a rolled back WithTx. Each watch buffers a bounded
+// number of events. A watch that lets its buffer fill up is ended with
+// ErrSlowConsumer rather than slowing down writers or silently missing
+// events: the consumer should reload what it needs and watch again. A watch
+// also ends when its ctx is done.
+type Watcher interface {
+	// WatchUsers watches the users filter selects. An update is sent if filter
+	// selects the user before or after it, so watchers also see users
+	// leaving the selection.
+	WatchUsers(ctx context.Context, filter UserFilter) (*Watch[UserEvent], error)
+	WatchShards(ctx context.Context) (*Watch[ShardEvent], error)
+}
+
+// Watch is a running watch. Events is closed when it ends, after which Err
+// tells why.
+type Watch[E any] struct {
+	events chan E
+	done   chan struct{}
+	match  func(event E) bool
+
+	mux sync.Mutex
+	err error
+}
+
+// Events returns the events of the watch. Entities in them are owned by the
+// receiver.
+func (w *Watch[E]) Events() <-chan E {
+	return w.events
+}
+
+// Err returns why the watch ended, ErrSlowConsumer or the error of its ctx,
+// and nil while it is running.
+func (w *Watch[E]) Err() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.err
+}
+
+// Feed fans events out to watches, for Storagers implementing Watcher.
+// Publish never blocks.
+type Feed[E any] struct {
+	bufferSize int
+	clone      func(event E) E
+
+	mux     sync.Mutex
+	watches map[*Watch[E]]struct{}
+}
+
+// NewFeed returns a feed buffering bufferSize events per watch. clone copies
+// an event for each watch, so no two receivers share an entity.
+func NewFeed[E any](bufferSize int, clone func(event E) E) *Feed[E] {
+	return &Feed[E]{
+		bufferSize: bufferSize,
+		clone:      clone,
+		watches:    make(map[*Watch[E]]struct{}),
+	}
+}
+
+// Watch starts a watch receiving the published events match accepts, or all
+// of them if match is nil. It ends when ctx is done.
+func (f *Feed[E]) Watch(ctx context.Context, match func(event E) bool) *Watch[E] {
+	w := &Watch[E]{
+		events: make(chan E, f.bufferSize),
+		done:   make(chan struct{}),
+		match:  match,
+	}
+	f.mux.Lock()
+	f.watches[w] = struct{}{}
+	f.mux.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.mux.Lock()
+			f.end(w, ctx.Err())
+			f.mux.Unlock()
+		case <-w.done:
+		}
+	}()
+	return w
+}
+
+// Publish sends event to every watch accepting it, ending the watches with a
+// full buffer.
+func (f *Feed[E]) Publish(event E) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for w := range f.watches {
+		if w.match != nil && !w.match(event) {
+			continue
+		}
+		select {
+		case w.events <- f.clone(event):
+		default:
+			f.end(w, ErrSlowConsumer)
+		}
+	}
+}
+
+// Len returns the number of running watches.
+func (f *Feed[E]) Len() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return len(f.watches)
+}
+
+// end must be called with f.mux held.
+func (f *Feed[E]) end(w *Watch[E], err error) {
+	if _, ok := f.watches[w]; !ok {
+		return
+	}
+	delete(f.watches, w)
+	w.mux.Lock()
+	w.err = err
+	w.mux.Unlock()
+	close(w.done)
+	close(w.events)
+}
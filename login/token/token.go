@@ -0,0 +1,328 @@
+// Package token issues and verifies signed session tokens.
+//
+// Tokens are JWTs signed with Ed25519 ("EdDSA"). The header carries the key id
+// ("kid") of the signing key so keys can be rotated while tokens signed with
+// older keys remain valid until they expire. Services that only need to trust
+// a login can verify tokens with the public keys alone.
+//
+// The key id is derived from the public key, so login services sharing a key
+// file, or restarted with it, issue tokens that verify on each other.
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMalformed is returned when a token cannot be parsed.
+	ErrMalformed = errors.New("malformed token")
+	// ErrUnknownKey is returned when a token is signed with a key id that is not known.
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrSignature is returned when a token signature does not verify.
+	ErrSignature = errors.New("invalid token signature")
+	// ErrExpired is returned when a token is past its expiry.
+	ErrExpired = errors.New("token expired")
+	// ErrRevoked is returned when a token has been revoked.
+	ErrRevoked = errors.New("token revoked")
+)
+
+// Claims is the payload of a session token.
+type Claims struct {
+	ID          string   `json:"jti"`
+	Issuer      string   `json:"iss,omitempty"`
+	UserID      int32    `json:"uid"`
+	Username    string   `json:"sub"`
+	Privileges  []string `json:"priv,omitempty"`
+	Application string   `json:"app,omitempty"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// TokenService issues, verifies and revokes session tokens.
+type TokenService struct {
+	mux        sync.RWMutex
+	issuer     string
+	ttl        time.Duration
+	currentKID string
+	privateKey ed25519.PrivateKey
+	publicKeys map[string]ed25519.PublicKey
+	revoked    map[string]int64
+	now        func() time.Time
+}
+
+// NewTokenService returns a TokenService with a freshly generated signing key.
+func NewTokenService(issuer string, ttl time.Duration) (*TokenService, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	return NewTokenServiceWithKey(issuer, ttl, privateKey)
+}
+
+// NewTokenServiceWithKey returns a TokenService signing with privateKey,
+// see KeyFileLoad.
+func NewTokenServiceWithKey(issuer string, ttl time.Duration, privateKey ed25519.PrivateKey) (*TokenService, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl must be positive")
+	}
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("private key size %d", len(privateKey))
+	}
+	e := &TokenService{
+		issuer:     issuer,
+		ttl:        ttl,
+		publicKeys: make(map[string]ed25519.PublicKey),
+		revoked:    make(map[string]int64),
+		now:        time.Now,
+	}
+	e.keySet(privateKey)
+	return e, nil
+}
+
+// KeyFileLoad returns the Ed25519 private key stored in file as PKCS #8 PEM.
+// If file does not exist, a new key is generated and written to it, readable
+// by its owner only.
+func KeyFileLoad(file string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return keyFileCreate(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key is a %T, not an Ed25519 key", file, key)
+	}
+	return privateKey, nil
+}
+
+func keyFileCreate(file string) (ed25519.PrivateKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("marshal private key: %w", err)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		// Another login service created it first.
+		return KeyFileLoad(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	err = pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+	return privateKey, nil
+}
+
+// NewTokenVerifier returns a TokenService that can only verify tokens signed
+// by the given public keys. Issue and Rotate fail on it.
+func NewTokenVerifier(publicKeys map[string]ed25519.PublicKey) (*TokenService, error) {
+	e := &TokenService{
+		publicKeys: make(map[string]ed25519.PublicKey),
+		revoked:    make(map[string]int64),
+		now:        time.Now,
+	}
+	for kid, key := range publicKeys {
+		e.publicKeys[kid] = key
+	}
+	return e, nil
+}
+
+// Issue signs claims with the current key. ID, Issuer, IssuedAt and ExpiresAt
+// are filled in on claims by the service.
+func (e *TokenService) Issue(claims *Claims) (string, error) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	if e.privateKey == nil {
+		return "", fmt.Errorf("no signing key")
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return "", fmt.Errorf("token id: %w", err)
+	}
+	now := e.now()
+	claims.ID = id
+	claims.Issuer = e.issuer
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(e.ttl).Unix()
+
+	headerJSON, err := json.Marshal(header{Algorithm: "EdDSA", Type: "JWT", KeyID: e.currentKID})
+	if err != nil {
+		return "", fmt.Errorf("marshal header: %w", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("marshal claims: %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	signature := ed25519.Sign(e.privateKey, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature, expiry and revocation state of token and
+// returns its claims.
+func (e *TokenService) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("decode header: %w", ErrMalformed)
+	}
+	hdr := header{}
+	err = json.Unmarshal(headerJSON, &hdr)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal header: %w", ErrMalformed)
+	}
+	if hdr.Algorithm != "EdDSA" {
+		return nil, fmt.Errorf("algorithm '%s': %w", hdr.Algorithm, ErrMalformed)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("decode signature: %w", ErrMalformed)
+	}
+
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	publicKey, ok := e.publicKeys[hdr.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("kid '%s': %w", hdr.KeyID, ErrUnknownKey)
+	}
+	if !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrSignature
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("decode claims: %w", ErrMalformed)
+	}
+	claims := &Claims{}
+	err = json.Unmarshal(claimsJSON, claims)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal claims: %w", ErrMalformed)
+	}
+
+	if e.now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if _, ok := e.revoked[claims.ID]; ok {
+		return nil, ErrRevoked
+	}
+	return claims, nil
+}
+
+// Rotate generates a new signing key and makes it current. Tokens signed
+// with previous keys keep verifying until the old key is retired.
+func (e *TokenService) Rotate() (string, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("generate key: %w", err)
+	}
+	return e.keySet(privateKey), nil
+}
+
+// keySet makes privateKey the current signing key and returns its key id.
+func (e *TokenService) keySet(privateKey ed25519.PrivateKey) string {
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(publicKey)
+	kid := hex.EncodeToString(sum[:16])
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.currentKID = kid
+	e.privateKey = privateKey
+	e.publicKeys[kid] = publicKey
+	return kid
+}
+
+// Retire removes a previous signing key. Tokens signed with it no longer verify.
+func (e *TokenService) Retire(kid string) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if kid == e.currentKID {
+		return fmt.Errorf("cannot retire the current signing key")
+	}
+	delete(e.publicKeys, kid)
+	return nil
+}
+
+// PublicKeys returns the public keys that tokens are verified against, by key id.
+func (e *TokenService) PublicKeys() map[string]ed25519.PublicKey {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	keys := make(map[string]ed25519.PublicKey, len(e.publicKeys))
+	for kid, key := range e.publicKeys {
+		keys[kid] = key
+	}
+	return keys
+}
+
+// Revoke marks the token with the given claims as revoked. The revocation is
+// kept until the token would have expired anyway.
+func (e *TokenService) Revoke(claims *Claims) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	now := e.now().Unix()
+	for id, expiresAt := range e.revoked {
+		if now >= expiresAt {
+			delete(e.revoked, id)
+		}
+	}
+	e.revoked[claims.ID] = claims.ExpiresAt
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
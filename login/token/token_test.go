@@ -0,0 +1,168 @@
+package token
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenIssueVerify(t *testing.T) {
+	tokenService, err := NewTokenService("login", time.Hour)
+	if err != nil {
+		t.Fatal("new token service:", err)
+	}
+
+	tok, err := tokenService.Issue(&Claims{UserID: 7, Username: "testuser", Privileges: []string{"GM"}, Application: "ryzom"})
+	if err != nil {
+		t.Fatal("issue:", err)
+	}
+
+	claims, err := tokenService.Verify(tok)
+	if err != nil {
+		t.Fatal("verify:", err)
+	}
+	if claims.UserID != 7 || claims.Username != "testuser" || claims.Application != "ryzom" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	if len(claims.Privileges) != 1 || claims.Privileges[0] != "GM" {
+		t.Fatalf("unexpected privileges: %v", claims.Privileges)
+	}
+
+	verifier, err := NewTokenVerifier(tokenService.PublicKeys())
+	if err != nil {
+		t.Fatal("new token verifier:", err)
+	}
+	_, err = verifier.Verify(tok)
+	if err != nil {
+		t.Fatal("verify with public keys:", err)
+	}
+
+	parts := strings.Split(tok, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal("decode signature:", err)
+	}
+	signature[0] ^= 1
+	tampered := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)
+	_, err = tokenService.Verify(tampered)
+	if !errors.Is(err, ErrSignature) {
+		t.Fatal("verify tampered token: expected ErrSignature, got", err)
+	}
+}
+
+func TestTokenKeyFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token.pem")
+	privateKey, err := KeyFileLoad(file)
+	if err != nil {
+		t.Fatal("key file load:", err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal("stat:", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatal("key file mode:", info.Mode())
+	}
+	first, err := NewTokenServiceWithKey("login", time.Hour, privateKey)
+	if err != nil {
+		t.Fatal("new token service with key:", err)
+	}
+	tok, err := first.Issue(&Claims{UserID: 7, Username: "testuser"})
+	if err != nil {
+		t.Fatal("issue:", err)
+	}
+
+	// Another process, or the same one restarted, loads the same key.
+	privateKey, err = KeyFileLoad(file)
+	if err != nil {
+		t.Fatal("key file load:", err)
+	}
+	second, err := NewTokenServiceWithKey("login", time.Hour, privateKey)
+	if err != nil {
+		t.Fatal("new token service with key:", err)
+	}
+	_, err = second.Verify(tok)
+	if err != nil {
+		t.Fatal("verify with the loaded key:", err)
+	}
+
+	err = os.WriteFile(file, []byte("garbage"), 0o600)
+	if err != nil {
+		t.Fatal("write key file:", err)
+	}
+	_, err = KeyFileLoad(file)
+	if err == nil {
+		t.Fatal("key file load of garbage succeeded")
+	}
+}
+
+func TestTokenExpiredRevoked(t *testing.T) {
+	tokenService, err := NewTokenService("login", time.Minute)
+	if err != nil {
+		t.Fatal("new token service:", err)
+	}
+
+	tok, err := tokenService.Issue(&Claims{UserID: 1, Username: "testuser"})
+	if err != nil {
+		t.Fatal("issue:", err)
+	}
+	claims, err := tokenService.Verify(tok)
+	if err != nil {
+		t.Fatal("verify:", err)
+	}
+
+	tokenService.Revoke(claims)
+	_, err = tokenService.Verify(tok)
+	if !errors.Is(err, ErrRevoked) {
+		t.Fatal("verify revoked token: expected ErrRevoked, got", err)
+	}
+
+	tok, err = tokenService.Issue(&Claims{UserID: 1, Username: "testuser"})
+	if err != nil {
+		t.Fatal("issue:", err)
+	}
+	tokenService.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, err = tokenService.Verify(tok)
+	if !errors.Is(err, ErrExpired) {
+		t.Fatal("verify expired token: expected ErrExpired, got", err)
+	}
+}
+
+func TestTokenRotate(t *testing.T) {
+	tokenService, err := NewTokenService("login", time.Hour)
+	if err != nil {
+		t.Fatal("new token service:", err)
+	}
+	oldTok, err := tokenService.Issue(&Claims{UserID: 1, Username: "testuser"})
+	if err != nil {
+		t.Fatal("issue:", err)
+	}
+	oldKID := tokenService.currentKID
+
+	_, err = tokenService.Rotate()
+	if err != nil {
+		t.Fatal("rotate:", err)
+	}
+	_, err = tokenService.Verify(oldTok)
+	if err != nil {
+		t.Fatal("verify token signed with previous key:", err)
+	}
+
+	err = tokenService.Retire(oldKID)
+	if err != nil {
+		t.Fatal("retire:", err)
+	}
+	_, err = tokenService.Verify(oldTok)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatal("verify token signed with retired key: expected ErrUnknownKey, got", err)
+	}
+
+	err = tokenService.Retire(tokenService.currentKID)
+	if err == nil {
+		t.Fatal("retire current key: expected error")
+	}
+}
@@ -1,10 +1,18 @@
 package dial
 
 import (
+	"context"
+
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	welcomev1 "github.com/runeharvest/gserver/proto/rh/welcome/v1"
 )
 
 // Dialer defines the interface for network operations.
 type Dialer interface {
 	loginv1.LoginServiceClient
 }
+
+// WelcomeDialer connects to the welcome service of a shard by its address.
+type WelcomeDialer interface {
+	WelcomeDial(ctx context.Context, wsAddr string) (welcomev1.WelcomeServiceClient, error)
+}
@@ -25,6 +25,30 @@ func (e *GrpcNetwork) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRe
 	return e.loginClient.LoginVerify(ctx, in)
 }
 
+func (e *GrpcNetwork) Logout(ctx context.Context, in *loginv1.LogoutRequest, opts ...grpc.CallOption) (*loginv1.LogoutResponse, error) {
+	if e.loginClient == nil {
+		e.loginClient = loginv1.NewLoginServiceClient(e.conn)
+	}
+
+	return e.loginClient.Logout(ctx, in)
+}
+
+func (e *GrpcNetwork) Disconnect(ctx context.Context, in *loginv1.DisconnectRequest, opts ...grpc.CallOption) (*loginv1.DisconnectResponse, error) {
+	if e.loginClient == nil {
+		e.loginClient = loginv1.NewLoginServiceClient(e.conn)
+	}
+
+	return e.loginClient.Disconnect(ctx, in)
+}
+
+func (e *GrpcNetwork) ChooseShard(ctx context.Context, in *loginv1.ChooseShardRequest, opts ...grpc.CallOption) (*loginv1.ChooseShardResponse, error) {
+	if e.loginClient == nil {
+		e.loginClient = loginv1.NewLoginServiceClient(e.conn)
+	}
+
+	return e.loginClient.ChooseShard(ctx, in)
+}
+
 func (e *GrpcNetwork) LoginRegister(loginClient loginv1.LoginServiceClient) error {
 	e.loginClient = loginClient
 	return nil
@@ -0,0 +1,86 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/runeharvest/gserver/net/tlsconfig"
+	welcomev1 "github.com/runeharvest/gserver/proto/rh/welcome/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// GrpcWelcomeNetwork dials shard welcome services over gRPC, keeping one
+// connection per welcome service address.
+type GrpcWelcomeNetwork struct {
+	mutex sync.Mutex
+	opts  []grpc.DialOption
+	conns map[string]*grpc.ClientConn
+}
+
+func NewGrpcWelcomeNetwork(opts ...grpc.DialOption) (*GrpcWelcomeNetwork, error) {
+	e := &GrpcWelcomeNetwork{
+		opts:  opts,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+	return e, nil
+}
+
+// NewGrpcWelcomeNetworkFromConfig is NewGrpcWelcomeNetwork dialing with the
+// credentials of CredentialsFromConfig.
+func NewGrpcWelcomeNetworkFromConfig(opts ...grpc.DialOption) (*GrpcWelcomeNetwork, error) {
+	creds, err := CredentialsFromConfig()
+	if err != nil {
+		return nil, fmt.Errorf("credentials: %w", err)
+	}
+	opts = append(opts, grpc.WithTransportCredentials(creds))
+	return NewGrpcWelcomeNetwork(opts...)
+}
+
+// CredentialsFromConfig returns TLS credentials as set by the login.tls_*
+// keys, see tlsconfig.ClientConfigFromConfig, or insecure ones when
+// login.is_tls_used is false.
+func CredentialsFromConfig() (credentials.TransportCredentials, error) {
+	tlsConfig, err := tlsconfig.ClientConfigFromConfig()
+	if err != nil {
+		return nil, fmt.Errorf("tls config: %w", err)
+	}
+	if tlsConfig == nil {
+		return insecure.NewCredentials(), nil
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func (e *GrpcWelcomeNetwork) WelcomeDial(ctx context.Context, wsAddr string) (welcomev1.WelcomeServiceClient, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	conn, ok := e.conns[wsAddr]
+	if !ok {
+		var err error
+		conn, err = grpc.NewClient(wsAddr, e.opts...)
+		if err != nil {
+			return nil, fmt.Errorf("new client %s: %w", wsAddr, err)
+		}
+		e.conns[wsAddr] = conn
+	}
+	return welcomev1.NewWelcomeServiceClient(conn), nil
+}
+
+// Close closes every welcome service connection.
+func (e *GrpcWelcomeNetwork) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var firstErr error
+	for wsAddr, conn := range e.conns {
+		err := conn.Close()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("close %s: %w", wsAddr, err)
+		}
+		delete(e.conns, wsAddr)
+	}
+	return firstErr
+}
@@ -27,6 +27,30 @@ func (e *LoopbackNetwork) LoginVerify(ctx context.Context, in *loginv1.LoginVeri
 	return e.loginServer.LoginVerify(ctx, in)
 }
 
+func (e *LoopbackNetwork) Logout(ctx context.Context, in *loginv1.LogoutRequest, opts ...grpc.CallOption) (*loginv1.LogoutResponse, error) {
+	if e.loginServer == nil {
+		return nil, fmt.Errorf("login service not registered")
+	}
+
+	return e.loginServer.Logout(ctx, in)
+}
+
+func (e *LoopbackNetwork) Disconnect(ctx context.Context, in *loginv1.DisconnectRequest, opts ...grpc.CallOption) (*loginv1.DisconnectResponse, error) {
+	if e.loginServer == nil {
+		return nil, fmt.Errorf("login service not registered")
+	}
+
+	return e.loginServer.Disconnect(ctx, in)
+}
+
+func (e *LoopbackNetwork) ChooseShard(ctx context.Context, in *loginv1.ChooseShardRequest, opts ...grpc.CallOption) (*loginv1.ChooseShardResponse, error) {
+	if e.loginServer == nil {
+		return nil, fmt.Errorf("login service not registered")
+	}
+
+	return e.loginServer.ChooseShard(ctx, in)
+}
+
 func (e *LoopbackNetwork) LoginRegister(loginServer loginv1.LoginServiceServer) error {
 	e.loginServer = loginServer
 	return nil
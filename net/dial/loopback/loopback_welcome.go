@@ -0,0 +1,50 @@
+package loopback
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	welcomev1 "github.com/runeharvest/gserver/proto/rh/welcome/v1"
+	"google.golang.org/grpc"
+)
+
+// LoopbackWelcomeNetwork hands out in-process welcome services by address.
+type LoopbackWelcomeNetwork struct {
+	mutex          sync.RWMutex
+	welcomeServers map[string]welcomev1.WelcomeServiceServer
+}
+
+func NewLoopbackWelcomeNetwork() (*LoopbackWelcomeNetwork, error) {
+	e := &LoopbackWelcomeNetwork{welcomeServers: make(map[string]welcomev1.WelcomeServiceServer)}
+	return e, nil
+}
+
+func (e *LoopbackWelcomeNetwork) WelcomeDial(ctx context.Context, wsAddr string) (welcomev1.WelcomeServiceClient, error) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	welcomeServer, ok := e.welcomeServers[wsAddr]
+	if !ok {
+		return nil, fmt.Errorf("welcome service %s not registered", wsAddr)
+	}
+	return &loopbackWelcomeClient{welcomeServer: welcomeServer}, nil
+}
+
+func (e *LoopbackWelcomeNetwork) WelcomeRegister(wsAddr string, welcomeServer welcomev1.WelcomeServiceServer) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.welcomeServers[wsAddr] = welcomeServer
+	return nil
+}
+
+type loopbackWelcomeClient struct {
+	welcomeServer welcomev1.WelcomeServiceServer
+}
+
+func (e *loopbackWelcomeClient) UserDisconnect(ctx context.Context, in *welcomev1.UserDisconnectRequest, opts ...grpc.CallOption) (*welcomev1.UserDisconnectResponse, error) {
+	return e.welcomeServer.UserDisconnect(ctx, in)
+}
+
+func (e *loopbackWelcomeClient) UserAdmit(ctx context.Context, in *welcomev1.UserAdmitRequest, opts ...grpc.CallOption) (*welcomev1.UserAdmitResponse, error) {
+	return e.welcomeServer.UserAdmit(ctx, in)
+}
@@ -1,15 +1,246 @@
+// Package quic dials the login service over QUIC.
+//
+// A QuicNetwork keeps one connection and runs each RPC on a stream of its
+// own, framed by package quicrpc. It remembers the session tickets of the
+// server, so a connection dialed again after the previous one dropped sends
+// its first requests as 0-RTT data. The server only runs them once the
+// handshake completes, so this spares the client waiting before it sends,
+// not a round trip. Migrate moves the connection to another
+// local socket, as a mobile client does when it changes networks.
 package quic
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
 
+	"github.com/quic-go/quic-go"
+	"github.com/runeharvest/gserver/net/internal/quicrpc"
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
 )
 
 type QuicNetwork struct {
+	addr       string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+
+	mutex sync.Mutex
+	conn  *quic.Conn
+	// transports holds every transport the connection was dialed or migrated
+	// on; the last one is in use. Closing a transport kills the connections
+	// that ever used it, so they are only closed by Close.
+	transports []*quic.Transport
+}
+
+// NewQuicNetwork returns a QuicNetwork for the login service at addr. The
+// connection is dialed on first use. tlsConfig and quicConfig may be nil.
+func NewQuicNetwork(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (*QuicNetwork, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("split host port %s: %w", addr, err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{quicrpc.ALPN}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	e := &QuicNetwork{addr: addr, tlsConfig: tlsConfig, quicConfig: quicConfig}
+	return e, nil
+}
+
+func (e *QuicNetwork) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest, opts ...grpc.CallOption) (*loginv1.LoginVerifyResponse, error) {
+	out := &loginv1.LoginVerifyResponse{}
+	err := e.call(ctx, quicrpc.MethodLoginVerify, in, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (e *QuicNetwork) Logout(ctx context.Context, in *loginv1.LogoutRequest, opts ...grpc.CallOption) (*loginv1.LogoutResponse, error) {
+	out := &loginv1.LogoutResponse{}
+	err := e.call(ctx, quicrpc.MethodLogout, in, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (e *QuicNetwork) Disconnect(ctx context.Context, in *loginv1.DisconnectRequest, opts ...grpc.CallOption) (*loginv1.DisconnectResponse, error) {
+	out := &loginv1.DisconnectResponse{}
+	err := e.call(ctx, quicrpc.MethodDisconnect, in, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (e *QuicNetwork) ChooseShard(ctx context.Context, in *loginv1.ChooseShardRequest, opts ...grpc.CallOption) (*loginv1.ChooseShardResponse, error) {
+	out := &loginv1.ChooseShardResponse{}
+	err := e.call(ctx, quicrpc.MethodChooseShard, in, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Migrate moves the connection onto packetConn, once the server has answered
+// on it. The network keeps packetConn and closes it with Close.
+func (e *QuicNetwork) Migrate(ctx context.Context, packetConn net.PacketConn) error {
+	e.mutex.Lock()
+	conn := e.conn
+	e.mutex.Unlock()
+	if conn == nil || conn.Context().Err() != nil {
+		return fmt.Errorf("not connected")
+	}
+
+	transport := &quic.Transport{Conn: packetConn}
+	path, err := conn.AddPath(transport)
+	if err != nil {
+		return fmt.Errorf("add path: %w", err)
+	}
+	err = path.Probe(ctx)
+	if err != nil {
+		path.Close()
+		return fmt.Errorf("probe: %w", err)
+	}
+	err = path.Switch()
+	if err != nil {
+		path.Close()
+		return fmt.Errorf("switch: %w", err)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.transports = append(e.transports, transport)
+	return nil
+}
+
+// Close closes the connection and every socket it used.
+func (e *QuicNetwork) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.conn != nil {
+		e.conn.CloseWithError(0, "")
+		e.conn = nil
+	}
+	var firstErr error
+	for _, transport := range e.transports {
+		transport.Close()
+		err := transport.Conn.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	e.transports = nil
+	return firstErr
 }
 
-func (q *QuicNetwork) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error) {
-	// Implement the QUIC call to the login service here.
-	return &loginv1.LoginVerifyResponse{}, nil
+// call runs method on a new stream. Requests sent as 0-RTT data the server
+// rejected were never run, so they are sent again once the handshake is
+// done.
+func (e *QuicNetwork) call(ctx context.Context, method string, in proto.Message, out proto.Message) error {
+	conn, err := e.connGet(ctx)
+	if err != nil {
+		return err
+	}
+	err = callConn(ctx, conn, method, in, out)
+	if !errors.Is(err, quic.Err0RTTRejected) {
+		return err
+	}
+	conn, err = conn.NextConnection(ctx)
+	if err != nil {
+		return fmt.Errorf("next connection: %w", err)
+	}
+	e.mutex.Lock()
+	e.conn = conn
+	e.mutex.Unlock()
+	return callConn(ctx, conn, method, in, out)
+}
+
+func callConn(ctx context.Context, conn *quic.Conn, method string, in proto.Message, out proto.Message) error {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelWrite(quicrpc.StreamErrorCanceled)
+		stream.CancelRead(quicrpc.StreamErrorCanceled)
+	})
+	defer stop()
+
+	err = quicrpc.RequestWrite(stream, method, in)
+	if err != nil {
+		stream.CancelRead(quicrpc.StreamErrorCanceled)
+		return fmt.Errorf("write request: %w", contextErr(ctx, err))
+	}
+	stream.Close()
+
+	err = quicrpc.ResponseRead(stream, out)
+	var remoteErr *quicrpc.RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr
+	}
+	if err != nil {
+		return fmt.Errorf("read response: %w", contextErr(ctx, err))
+	}
+	return nil
+}
+
+// contextErr returns the error of ctx if it caused err, which is then only a
+// canceled stream.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// connGet returns the connection, dialing it if it is not open. Dialing
+// returns at once when 0-RTT is possible.
+func (e *QuicNetwork) connGet(ctx context.Context) (*quic.Conn, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.conn != nil && e.conn.Context().Err() == nil {
+		return e.conn, nil
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", e.addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", e.addr, err)
+	}
+	if len(e.transports) == 0 {
+		packetConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, fmt.Errorf("listen udp: %w", err)
+		}
+		e.transports = append(e.transports, &quic.Transport{Conn: packetConn})
+	}
+	transport := e.transports[len(e.transports)-1]
+
+	conn, err := transport.DialEarly(ctx, udpAddr, e.tlsConfig, e.quicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", e.addr, err)
+	}
+	e.conn = conn
+	return conn, nil
 }
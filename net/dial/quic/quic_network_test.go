@@ -0,0 +1,149 @@
+package quic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/net/internal/quicrpc"
+	netlistenquic "github.com/runeharvest/gserver/net/listen/quic"
+	"github.com/runeharvest/gserver/net/nettest"
+	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+)
+
+type testLoginService struct {
+	loginv1.UnimplementedLoginServiceServer
+	loginVerifyCount atomic.Int32
+}
+
+func (e *testLoginService) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error) {
+	e.loginVerifyCount.Add(1)
+	if in.Username == "" {
+		return nil, errors.New("empty username")
+	}
+	return &loginv1.LoginVerifyResponse{Token: "token-" + in.Username}, nil
+}
+
+func (e *testLoginService) Logout(ctx context.Context, in *loginv1.LogoutRequest) (*loginv1.LogoutResponse, error) {
+	return &loginv1.LogoutResponse{Error: "unknown token " + in.Token}, nil
+}
+
+func newTestQuicNetworks(t *testing.T) (*QuicNetwork, *testLoginService) {
+	t.Helper()
+	serverConfig, clientConfig := nettest.TLSConfigs(t)
+
+	listenNetwork, err := netlistenquic.NewQuicNetwork("127.0.0.1:0", serverConfig, nil)
+	if err != nil {
+		t.Fatal("new quic listen network:", err)
+	}
+	loginService := &testLoginService{}
+	err = listenNetwork.LoginRegister(loginService)
+	if err != nil {
+		t.Fatal("login register:", err)
+	}
+	go listenNetwork.Serve(context.Background())
+	t.Cleanup(func() { listenNetwork.Shutdown(context.Background()) })
+
+	dialNetwork, err := NewQuicNetwork(listenNetwork.Addr().String(), clientConfig, nil)
+	if err != nil {
+		t.Fatal("new quic dial network:", err)
+	}
+	t.Cleanup(func() { dialNetwork.Close() })
+	return dialNetwork, loginService
+}
+
+func TestQuicCalls(t *testing.T) {
+	ctx := context.Background()
+	dialNetwork, _ := newTestQuicNetworks(t)
+
+	resp, err := dialNetwork.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser"})
+	if err != nil || resp.Token != "token-testuser" {
+		t.Fatal("login verify:", resp, err)
+	}
+	logout, err := dialNetwork.Logout(ctx, &loginv1.LogoutRequest{Token: "abc"})
+	if err != nil || logout.Error != "unknown token abc" {
+		t.Fatal("logout:", logout, err)
+	}
+
+	_, err = dialNetwork.LoginVerify(ctx, &loginv1.LoginVerifyRequest{})
+	var remoteErr *quicrpc.RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Message != "empty username" {
+		t.Fatal("login verify without username: expected a remote error, got", err)
+	}
+	_, err = dialNetwork.ChooseShard(ctx, &loginv1.ChooseShardRequest{})
+	if !errors.As(err, &remoteErr) {
+		t.Fatal("unimplemented choose shard: expected a remote error, got", err)
+	}
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = dialNetwork.LoginVerify(canceledCtx, &loginv1.LoginVerifyRequest{Username: "testuser"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("login verify with canceled context: expected context.Canceled, got", err)
+	}
+}
+
+func TestQuicResumption(t *testing.T) {
+	ctx := context.Background()
+	dialNetwork, loginService := newTestQuicNetworks(t)
+
+	_, err := dialNetwork.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser"})
+	if err != nil {
+		t.Fatal("login verify:", err)
+	}
+	first := dialNetwork.conn
+	if first.ConnectionState().Used0RTT {
+		t.Fatal("first connection used 0-RTT")
+	}
+
+	// The connection drops; the next call dials again, resuming the session.
+	first.CloseWithError(0, "")
+	<-first.Context().Done()
+	resp, err := dialNetwork.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser"})
+	if err != nil || resp.Token != "token-testuser" {
+		t.Fatal("login verify after reconnection:", resp, err)
+	}
+	second := dialNetwork.conn
+	if second == first || !second.ConnectionState().Used0RTT {
+		t.Fatal("second connection did not use 0-RTT")
+	}
+	if n := loginService.loginVerifyCount.Load(); n != 2 {
+		t.Fatal("login verify count:", n)
+	}
+}
+
+func TestQuicMigrate(t *testing.T) {
+	ctx := context.Background()
+	dialNetwork, _ := newTestQuicNetworks(t)
+
+	_, err := dialNetwork.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser"})
+	if err != nil {
+		t.Fatal("login verify:", err)
+	}
+	conn := dialNetwork.conn
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen packet:", err)
+	}
+	migrateCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err = dialNetwork.Migrate(migrateCtx, packetConn)
+	if err != nil {
+		t.Fatal("migrate:", err)
+	}
+
+	resp, err := dialNetwork.LoginVerify(ctx, &loginv1.LoginVerifyRequest{Username: "testuser"})
+	if err != nil || resp.Token != "token-testuser" {
+		t.Fatal("login verify after migration:", resp, err)
+	}
+	if dialNetwork.conn != conn {
+		t.Fatal("migration dialed a new connection")
+	}
+	if conn.LocalAddr().String() != packetConn.LocalAddr().String() {
+		t.Fatal("connection not on the new socket:", conn.LocalAddr())
+	}
+}
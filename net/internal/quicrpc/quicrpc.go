@@ -0,0 +1,144 @@
+// Package quicrpc frames the RPCs exchanged by the quic dial and listen
+// networks.
+//
+// Every RPC runs on a bidirectional stream of its own. The client writes the
+// method name and the marshaled request, then closes its side of the stream.
+// The server writes a status byte followed by the marshaled response, or by
+// an error message when the status is not statusOK, then closes its side.
+// Method names, messages and error messages are each prefixed by their
+// length as a uvarint.
+package quicrpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/quic-go/quic-go"
+	"google.golang.org/protobuf/proto"
+)
+
+// ALPN is the TLS application protocol both ends negotiate.
+const ALPN = "rh-login/1"
+
+// MessageSizeMax bounds every frame, so a peer cannot make the other end
+// allocate without limit.
+const MessageSizeMax = 1 << 20
+
+const (
+	MethodLoginVerify = "LoginVerify"
+	MethodLogout      = "Logout"
+	MethodDisconnect  = "Disconnect"
+	MethodChooseShard = "ChooseShard"
+)
+
+// Stream error codes, sent when a stream is abandoned.
+const (
+	StreamErrorCanceled quic.StreamErrorCode = 1
+	StreamErrorInvalid  quic.StreamErrorCode = 2
+)
+
+const (
+	statusOK    byte = 0
+	statusError byte = 1
+)
+
+// ErrFrameTooLarge is returned for a frame over MessageSizeMax.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// RemoteError is an error returned by the service on the other end.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// RequestWrite writes the request of method.
+func RequestWrite(w io.Writer, method string, in proto.Message) error {
+	payload, err := proto.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	bw := bufio.NewWriter(w)
+	frameWrite(bw, []byte(method))
+	frameWrite(bw, payload)
+	return bw.Flush()
+}
+
+// RequestRead reads a request, returning its method and marshaled message.
+func RequestRead(r io.Reader) (string, []byte, error) {
+	br := bufio.NewReader(r)
+	method, err := frameRead(br)
+	if err != nil {
+		return "", nil, fmt.Errorf("read method: %w", err)
+	}
+	payload, err := frameRead(br)
+	if err != nil {
+		return "", nil, fmt.Errorf("read message: %w", err)
+	}
+	return string(method), payload, nil
+}
+
+// ResponseWrite writes out, or rpcErr if it is set.
+func ResponseWrite(w io.Writer, out proto.Message, rpcErr error) error {
+	bw := bufio.NewWriter(w)
+	if rpcErr != nil {
+		bw.WriteByte(statusError)
+		frameWrite(bw, []byte(rpcErr.Error()))
+		return bw.Flush()
+	}
+	payload, err := proto.Marshal(out)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	bw.WriteByte(statusOK)
+	frameWrite(bw, payload)
+	return bw.Flush()
+}
+
+// ResponseRead reads a response into out. It returns a *RemoteError if the
+// service failed.
+func ResponseRead(r io.Reader, out proto.Message) error {
+	br := bufio.NewReader(r)
+	status, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("read status: %w", err)
+	}
+	payload, err := frameRead(br)
+	if err != nil {
+		return fmt.Errorf("read message: %w", err)
+	}
+	if status != statusOK {
+		return &RemoteError{Message: string(payload)}
+	}
+	err = proto.Unmarshal(payload, out)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	return nil
+}
+
+func frameWrite(w *bufio.Writer, b []byte) {
+	w.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	w.Write(b)
+}
+
+func frameRead(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > MessageSizeMax {
+		return nil, fmt.Errorf("%d bytes: %w", size, ErrFrameTooLarge)
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
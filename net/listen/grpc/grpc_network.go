@@ -2,26 +2,115 @@ package grpc
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"sync"
 
+	"github.com/runeharvest/gserver/net/tlsconfig"
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type GrpcNetwork struct {
 	server *grpc.Server
+	lis    net.Listener
+
+	mutex        sync.RWMutex
+	loginService loginv1.LoginServiceServer
 }
 
-func NewGrpcNetwork(server *grpc.Server) (*GrpcNetwork, error) {
-	e := &GrpcNetwork{server: server}
+// NewGrpcNetwork binds the TCP address addr for a gRPC server created with
+// opts. Port 0 binds any free port, which Addr returns.
+func NewGrpcNetwork(addr string, opts ...grpc.ServerOption) (*GrpcNetwork, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", addr, err)
+	}
+	e := &GrpcNetwork{server: grpc.NewServer(opts...), lis: lis}
 	return e, nil
 }
 
+// NewGrpcNetworkFromConfig is NewGrpcNetwork serving TLS as set by the
+// login.tls_* keys, see tlsconfig.ServerConfigFromConfig.
+func NewGrpcNetworkFromConfig(addr string, isClientVerified bool, opts ...grpc.ServerOption) (*GrpcNetwork, error) {
+	tlsConfig, err := tlsconfig.ServerConfigFromConfig(isClientVerified)
+	if err != nil {
+		return nil, fmt.Errorf("tls config: %w", err)
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	return NewGrpcNetwork(addr, opts...)
+}
+
+// LoginVerify calls the registered login service in-process, as gRPC clients
+// reach it through the server.
 func (g *GrpcNetwork) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error) {
+	g.mutex.RLock()
+	loginService := g.loginService
+	g.mutex.RUnlock()
+	if loginService == nil {
+		return nil, fmt.Errorf("login service not registered")
+	}
 
-	return &loginv1.LoginVerifyResponse{}, nil
+	return loginService.LoginVerify(ctx, in)
 }
 
 func (g *GrpcNetwork) LoginRegister(loginService loginv1.LoginServiceServer) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.loginService != nil {
+		return fmt.Errorf("login service already registered")
+	}
 	loginv1.RegisterLoginServiceServer(g.server, loginService)
+	g.loginService = loginService
+	return nil
+}
+
+func (g *GrpcNetwork) ShardRegistryRegister(shardRegistryService loginv1.ShardRegistryServiceServer) error {
+	loginv1.RegisterShardRegistryServiceServer(g.server, shardRegistryService)
+	return nil
+}
+
+// HealthRegister serves healthServer, the standard gRPC health checking
+// service, to load balancers and orchestrators.
+func (g *GrpcNetwork) HealthRegister(healthServer healthgrpc.HealthServer) error {
+	healthgrpc.RegisterHealthServer(g.server, healthServer)
 	return nil
 }
+
+func (g *GrpcNetwork) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, g.server.Stop)
+	defer stop()
+
+	err := g.server.Serve(g.lis)
+	if err != nil {
+		return fmt.Errorf("grpc serve: %w", err)
+	}
+	return nil
+}
+
+func (g *GrpcNetwork) Addr() net.Addr {
+	return g.lis.Addr()
+}
+
+func (g *GrpcNetwork) Shutdown(ctx context.Context) error {
+	// Serve closes the listener, unless it never ran.
+	defer g.lis.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		g.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		g.server.Stop()
+		<-stopped
+		return ctx.Err()
+	}
+}
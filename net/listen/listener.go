@@ -2,6 +2,7 @@ package listen
 
 import (
 	"context"
+	"net"
 
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
 )
@@ -10,4 +11,14 @@ import (
 type Listener interface {
 	LoginRegister(loginService loginv1.LoginServiceServer) error
 	LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error)
+	ShardRegistryRegister(shardRegistryService loginv1.ShardRegistryServiceServer) error
+	// Serve serves the registered services until Shutdown is called, or
+	// until ctx is done, which stops it at once. It returns nil once stopped.
+	Serve(ctx context.Context) error
+	// Addr returns the address the listener is bound to.
+	Addr() net.Addr
+	// Shutdown stops accepting requests and waits for the in-flight ones to
+	// complete. If ctx is done first, it stops them at once and returns the
+	// error of ctx.
+	Shutdown(ctx context.Context) error
 }
@@ -3,6 +3,7 @@ package loopback
 import (
 	"context"
 	"fmt"
+	"net"
 	"sync"
 
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
@@ -14,29 +15,105 @@ const (
 	callbackLoginVerify callbackLookup = iota
 )
 
+// loopbackAddr is the address of every LoopbackNetwork, which binds nothing.
+type loopbackAddr struct{}
+
+func (loopbackAddr) Network() string { return "loopback" }
+func (loopbackAddr) String() string  { return "loopback" }
+
 type LoopbackNetwork struct {
-	mutex        sync.RWMutex
-	loginService loginv1.LoginServiceServer
+	mutex                sync.RWMutex
+	loginService         loginv1.LoginServiceServer
+	shardRegistryService loginv1.ShardRegistryServiceServer
+
+	// requests counts the in-flight calls; it only grows while isShutdown is
+	// false, so Shutdown may wait on it.
+	requests   sync.WaitGroup
+	isShutdown bool
+	stopped    chan struct{}
 }
 
 func NewLoopbackNetwork() (*LoopbackNetwork, error) {
-	e := &LoopbackNetwork{}
+	e := &LoopbackNetwork{stopped: make(chan struct{})}
 	return e, nil
 }
 
 func (g *LoopbackNetwork) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error) {
-	if g.loginService == nil {
+	g.mutex.RLock()
+	if g.isShutdown {
+		g.mutex.RUnlock()
+		return nil, fmt.Errorf("listener shut down")
+	}
+	loginService := g.loginService
+	g.requests.Add(1)
+	g.mutex.RUnlock()
+	defer g.requests.Done()
+
+	if loginService == nil {
 		return nil, fmt.Errorf("login service not registered")
 	}
 
-	return g.loginService.LoginVerify(ctx, in)
+	return loginService.LoginVerify(ctx, in)
 }
 
 func (g *LoopbackNetwork) LoginRegister(loginService loginv1.LoginServiceServer) error {
-
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
 	if g.loginService != nil {
 		return fmt.Errorf("login service already registered")
 	}
 	g.loginService = loginService
 	return nil
 }
+
+func (g *LoopbackNetwork) ShardRegistryRegister(shardRegistryService loginv1.ShardRegistryServiceServer) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.shardRegistryService != nil {
+		return fmt.Errorf("shard registry service already registered")
+	}
+	g.shardRegistryService = shardRegistryService
+	return nil
+}
+
+// Serve has nothing to accept; it blocks until the network stops.
+func (g *LoopbackNetwork) Serve(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		g.stop()
+	case <-g.stopped:
+	}
+	return nil
+}
+
+func (g *LoopbackNetwork) Addr() net.Addr {
+	return loopbackAddr{}
+}
+
+// Shutdown refuses new calls and waits for the in-flight ones. Calls run in
+// the caller's goroutine, so when ctx is done first they are left running.
+func (g *LoopbackNetwork) Shutdown(ctx context.Context) error {
+	g.stop()
+
+	drained := make(chan struct{})
+	go func() {
+		g.requests.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *LoopbackNetwork) stop() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.isShutdown {
+		return
+	}
+	g.isShutdown = true
+	close(g.stopped)
+}
@@ -1,15 +1,307 @@
+// Package quic serves the login service to game clients over QUIC, which
+// keeps their sessions alive across packet loss and network changes.
+//
+// Each RPC runs on a stream of its own, framed by package quicrpc. Clients
+// resuming a session may send their first requests as 0-RTT data, but as
+// such data can be replayed by an attacker and every login RPC changes
+// state, requests only run once the handshake has completed. 0-RTT thus
+// saves no round trip: the response arrives when it would have over a 1-RTT
+// handshake.
+//
+// Shutdown lets the RPCs in flight complete; streams opened meanwhile are
+// canceled with quicrpc.StreamErrorCanceled.
 package quic
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
 
+	"github.com/quic-go/quic-go"
+	"github.com/runeharvest/gserver/net/internal/quicrpc"
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
+	"google.golang.org/protobuf/proto"
 )
 
+// requestReadTimeout bounds how long a client may take to send a request
+// once the handshake has completed.
+const requestReadTimeout = 10 * time.Second
+
+// closeDelay is how long Shutdown keeps connections open once the in-flight
+// RPCs completed, as closing a connection drops the responses not yet sent.
+const closeDelay = time.Second
+
 type QuicNetwork struct {
+	packetConn net.PacketConn
+	transport  *quic.Transport
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+
+	mutex        sync.RWMutex
+	loginService loginv1.LoginServiceServer
+	listener     *quic.EarlyListener
+	conns        map[*quic.Conn]struct{}
+	// streams counts the in-flight RPCs; it only grows while isShutdown is
+	// false, so Shutdown may wait on it.
+	streams    sync.WaitGroup
+	isShutdown bool
+}
+
+// NewQuicNetwork binds the UDP address addr to serve with the certificate of
+// tlsConfig. Port 0 binds any free port, which Addr returns. quicConfig may
+// be nil; 0-RTT is always allowed, for clients that send early, but its
+// requests wait for the handshake.
+func NewQuicNetwork(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (*QuicNetwork, error) {
+	if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil) {
+		return nil, fmt.Errorf("tls config has no certificate")
+	}
+	tlsConfig = tlsConfig.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{quicrpc.ALPN}
+	}
+	if quicConfig == nil {
+		quicConfig = &quic.Config{}
+	}
+	quicConfig = quicConfig.Clone()
+	quicConfig.Allow0RTT = true
+
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen packet %s: %w", addr, err)
+	}
+	e := &QuicNetwork{
+		packetConn: packetConn,
+		transport:  &quic.Transport{Conn: packetConn},
+		tlsConfig:  tlsConfig,
+		quicConfig: quicConfig,
+		conns:      map[*quic.Conn]struct{}{},
+	}
+	return e, nil
+}
+
+func (e *QuicNetwork) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error) {
+	loginService := e.loginServiceGet()
+	if loginService == nil {
+		return nil, fmt.Errorf("login service not registered")
+	}
+	return loginService.LoginVerify(ctx, in)
+}
+
+func (e *QuicNetwork) LoginRegister(loginService loginv1.LoginServiceServer) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.loginService != nil {
+		return fmt.Errorf("login service already registered")
+	}
+	e.loginService = loginService
+	return nil
+}
+
+// ShardRegistryRegister always fails: QUIC carries the client-facing login
+// service only, shards register over gRPC.
+func (e *QuicNetwork) ShardRegistryRegister(shardRegistryService loginv1.ShardRegistryServiceServer) error {
+	return fmt.Errorf("shard registry service is not served over quic")
+}
+
+func (e *QuicNetwork) Serve(ctx context.Context) error {
+	e.mutex.Lock()
+	if e.isShutdown {
+		e.mutex.Unlock()
+		return nil
+	}
+	if e.listener != nil {
+		e.mutex.Unlock()
+		return fmt.Errorf("already serving")
+	}
+	listener, err := e.transport.ListenEarly(e.tlsConfig, e.quicConfig)
+	if err != nil {
+		e.mutex.Unlock()
+		return fmt.Errorf("listen: %w", err)
+	}
+	e.listener = listener
+	e.mutex.Unlock()
+
+	stop := context.AfterFunc(ctx, e.close)
+	defer stop()
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if errors.Is(err, quic.ErrServerClosed) || errors.Is(err, quic.ErrTransportClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("accept: %w", err)
+		}
+		if !e.connAdd(conn) {
+			conn.CloseWithError(0, "shutting down")
+			continue
+		}
+		go e.connServe(conn)
+	}
+}
+
+func (e *QuicNetwork) Addr() net.Addr {
+	return e.packetConn.LocalAddr()
+}
+
+// Shutdown stops accepting connections and streams, waits for the in-flight
+// RPCs, then closes every connection after closeDelay.
+func (e *QuicNetwork) Shutdown(ctx context.Context) error {
+	e.mutex.Lock()
+	e.isShutdown = true
+	if e.listener != nil {
+		e.listener.Close()
+	}
+	e.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		e.streams.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		e.close()
+		return ctx.Err()
+	}
+
+	e.mutex.RLock()
+	connCount := len(e.conns)
+	e.mutex.RUnlock()
+	if connCount > 0 {
+		timer := time.NewTimer(closeDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	e.close()
+	return nil
+}
+
+// close stops the network at once.
+func (e *QuicNetwork) close() {
+	e.mutex.Lock()
+	e.isShutdown = true
+	if e.listener != nil {
+		e.listener.Close()
+	}
+	conns := e.conns
+	e.conns = map[*quic.Conn]struct{}{}
+	e.mutex.Unlock()
+
+	for conn := range conns {
+		conn.CloseWithError(0, "shutting down")
+	}
+	e.transport.Close()
+	e.packetConn.Close()
+}
+
+// connAdd tracks conn until it is closed, unless the network is shutting
+// down.
+func (e *QuicNetwork) connAdd(conn *quic.Conn) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.isShutdown {
+		return false
+	}
+	e.conns[conn] = struct{}{}
+	context.AfterFunc(conn.Context(), func() {
+		e.mutex.Lock()
+		delete(e.conns, conn)
+		e.mutex.Unlock()
+	})
+	return true
+}
+
+// streamStart counts a new RPC as in flight, unless the network is shutting
+// down.
+func (e *QuicNetwork) streamStart() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.isShutdown {
+		return false
+	}
+	e.streams.Add(1)
+	return true
+}
+
+func (e *QuicNetwork) loginServiceGet() loginv1.LoginServiceServer {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.loginService
+}
+
+func (e *QuicNetwork) connServe(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
+		if !e.streamStart() {
+			stream.CancelRead(quicrpc.StreamErrorCanceled)
+			stream.CancelWrite(quicrpc.StreamErrorCanceled)
+			continue
+		}
+		go e.streamServe(conn, stream)
+	}
+}
+
+func (e *QuicNetwork) streamServe(conn *quic.Conn, stream *quic.Stream) {
+	defer e.streams.Done()
+	defer stream.Close()
+
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return
+	}
+
+	stream.SetReadDeadline(time.Now().Add(requestReadTimeout))
+	method, payload, err := quicrpc.RequestRead(stream)
+	if err != nil {
+		stream.CancelRead(quicrpc.StreamErrorInvalid)
+		stream.CancelWrite(quicrpc.StreamErrorInvalid)
+		return
+	}
+
+	out, err := e.dispatch(stream.Context(), method, payload)
+	quicrpc.ResponseWrite(stream, out, err)
+}
+
+func (e *QuicNetwork) dispatch(ctx context.Context, method string, payload []byte) (proto.Message, error) {
+	loginService := e.loginServiceGet()
+	if loginService == nil {
+		return nil, fmt.Errorf("login service not registered")
+	}
+	switch method {
+	case quicrpc.MethodLoginVerify:
+		return handle(ctx, payload, &loginv1.LoginVerifyRequest{}, loginService.LoginVerify)
+	case quicrpc.MethodLogout:
+		return handle(ctx, payload, &loginv1.LogoutRequest{}, loginService.Logout)
+	case quicrpc.MethodDisconnect:
+		return handle(ctx, payload, &loginv1.DisconnectRequest{}, loginService.Disconnect)
+	case quicrpc.MethodChooseShard:
+		return handle(ctx, payload, &loginv1.ChooseShardRequest{}, loginService.ChooseShard)
+	}
+	return nil, fmt.Errorf("unknown method '%s'", method)
 }
 
-func (q *QuicNetwork) LoginVerify(ctx context.Context, in *loginv1.LoginVerifyRequest) (*loginv1.LoginVerifyResponse, error) {
-	// Implement the QUIC call to the login service here.
-	return &loginv1.LoginVerifyResponse{}, nil
+// handle unmarshals payload into in and runs handler on it.
+func handle[In proto.Message, Out proto.Message](ctx context.Context, payload []byte, in In, handler func(context.Context, In) (Out, error)) (proto.Message, error) {
+	err := proto.Unmarshal(payload, in)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	out, err := handler(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
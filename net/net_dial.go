@@ -23,3 +23,24 @@ func (e *NetDialService) LoginVerify(ctx context.Context, in *loginv1.LoginVerif
 	}
 	return e.dialer.LoginVerify(ctx, in)
 }
+
+func (e *NetDialService) Logout(ctx context.Context, in *loginv1.LogoutRequest) (*loginv1.LogoutResponse, error) {
+	if e.dialer == nil {
+		return nil, fmt.Errorf("dialer is nil")
+	}
+	return e.dialer.Logout(ctx, in)
+}
+
+func (e *NetDialService) Disconnect(ctx context.Context, in *loginv1.DisconnectRequest) (*loginv1.DisconnectResponse, error) {
+	if e.dialer == nil {
+		return nil, fmt.Errorf("dialer is nil")
+	}
+	return e.dialer.Disconnect(ctx, in)
+}
+
+func (e *NetDialService) ChooseShard(ctx context.Context, in *loginv1.ChooseShardRequest) (*loginv1.ChooseShardResponse, error) {
+	if e.dialer == nil {
+		return nil, fmt.Errorf("dialer is nil")
+	}
+	return e.dialer.ChooseShard(ctx, in)
+}
@@ -1,7 +1,9 @@
 package network
 
 import (
+	"context"
 	"fmt"
+	"net"
 
 	loginv1 "github.com/runeharvest/gserver/proto/rh/login/v1"
 
@@ -23,3 +25,32 @@ func (e *NetListenService) LoginRegister(loginServer loginv1.LoginServiceServer)
 	}
 	return e.listener.LoginRegister(loginServer)
 }
+
+func (e *NetListenService) ShardRegistryRegister(shardRegistryService loginv1.ShardRegistryServiceServer) error {
+	if e.listener == nil {
+		return fmt.Errorf("listener is nil")
+	}
+	return e.listener.ShardRegistryRegister(shardRegistryService)
+}
+
+func (e *NetListenService) Serve(ctx context.Context) error {
+	if e.listener == nil {
+		return fmt.Errorf("listener is nil")
+	}
+	return e.listener.Serve(ctx)
+}
+
+// Addr returns the address of the listener, or nil without one.
+func (e *NetListenService) Addr() net.Addr {
+	if e.listener == nil {
+		return nil
+	}
+	return e.listener.Addr()
+}
+
+func (e *NetListenService) Shutdown(ctx context.Context) error {
+	if e.listener == nil {
+		return fmt.Errorf("listener is nil")
+	}
+	return e.listener.Shutdown(ctx)
+}
@@ -0,0 +1,122 @@
+// Package nettest generates the certificates the transport tests need.
+package nettest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var serialNumber atomic.Int64
+
+// CA is a self-signed certificate authority.
+type CA struct {
+	// Pool holds the CA certificate alone.
+	Pool        *x509.CertPool
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// NewCA returns a new CA, valid for an hour.
+func NewCA(t testing.TB) *CA {
+	t.Helper()
+	key := keyGenerate(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serialNumber.Add(1)),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("create ca certificate:", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("parse ca certificate:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &CA{Pool: pool, certificate: certificate, key: key}
+}
+
+// Issue returns a certificate signed by ca for commonName, valid for
+// localhost and 127.0.0.1 both as a server and as a client.
+func (ca *CA) Issue(t testing.TB, commonName string) tls.Certificate {
+	t.Helper()
+	key := keyGenerate(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serialNumber.Add(1)),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal("create certificate:", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TLSConfigs returns a server config with a certificate of a new CA, and a
+// client config trusting that CA.
+func TLSConfigs(t testing.TB) (*tls.Config, *tls.Config) {
+	t.Helper()
+	ca := NewCA(t)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{ca.Issue(t, "server")}}
+	clientConfig := &tls.Config{RootCAs: ca.Pool}
+	return serverConfig, clientConfig
+}
+
+// CertWrite writes the CA certificate to file as PEM.
+func (ca *CA) CertWrite(t testing.TB, file string) {
+	t.Helper()
+	pemWrite(t, file, "CERTIFICATE", ca.certificate.Raw)
+}
+
+// CertificateWrite writes certificate to certFile and its key to keyFile as
+// PEM.
+func CertificateWrite(t testing.TB, certificate tls.Certificate, certFile string, keyFile string) {
+	t.Helper()
+	pemWrite(t, certFile, "CERTIFICATE", certificate.Certificate[0])
+	der, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		t.Fatal("marshal key:", err)
+	}
+	pemWrite(t, keyFile, "PRIVATE KEY", der)
+}
+
+func pemWrite(t testing.TB, file string, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	err := os.WriteFile(file, data, 0o600)
+	if err != nil {
+		t.Fatal("write pem:", err)
+	}
+}
+
+func keyGenerate(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key:", err)
+	}
+	return key
+}
@@ -0,0 +1,204 @@
+// Package tlsconfig builds the TLS configurations of the network transports
+// from PEM files.
+//
+// Certificates are reloaded when their files change, so renewing them needs
+// no restart; the files are checked at most once per reload interval, on the
+// handshakes that need them. CA files are only read once.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/runeharvest/gserver/config"
+)
+
+// Certificate is a certificate and its key, loaded from PEM files.
+type Certificate struct {
+	certFile       string
+	keyFile        string
+	reloadInterval time.Duration
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	checkedAt   time.Time
+}
+
+// NewCertificate loads the certificate of certFile and keyFile, checking
+// them for changes every reloadInterval.
+func NewCertificate(certFile string, keyFile string, reloadInterval time.Duration) (*Certificate, error) {
+	if reloadInterval <= 0 {
+		return nil, fmt.Errorf("reload interval must be positive")
+	}
+	e := &Certificate{certFile: certFile, keyFile: keyFile, reloadInterval: reloadInterval}
+	err := e.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload loads the files again if they changed. On error, the certificate
+// loaded before stays in use.
+func (e *Certificate) Reload() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.reload()
+}
+
+func (e *Certificate) reload() error {
+	e.checkedAt = time.Now()
+	certInfo, err := os.Stat(e.certFile)
+	if err != nil {
+		return fmt.Errorf("stat certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(e.keyFile)
+	if err != nil {
+		return fmt.Errorf("stat key: %w", err)
+	}
+	if e.certificate != nil && certInfo.ModTime().Equal(e.certModTime) && keyInfo.ModTime().Equal(e.keyModTime) {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+	isReload := e.certificate != nil
+	e.certificate = &certificate
+	e.certModTime = certInfo.ModTime()
+	e.keyModTime = keyInfo.ModTime()
+	if isReload {
+		slog.Info("TLS certificate reloaded", "cert_file", e.certFile)
+	}
+	return nil
+}
+
+// current returns the certificate, reloading it first when the reload
+// interval elapsed.
+func (e *Certificate) current() *tls.Certificate {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if time.Since(e.checkedAt) >= e.reloadInterval {
+		err := e.reload()
+		if err != nil {
+			slog.Warn("TLS certificate reload failed", "cert_file", e.certFile, "error", err)
+		}
+	}
+	return e.certificate
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (e *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return e.current(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (e *Certificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return e.current(), nil
+}
+
+// CertPoolLoad returns a pool of the PEM certificates of file.
+func CertPoolLoad(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns a config serving certificate. With clientCAs, clients
+// must present a certificate they signed.
+func ServerConfig(certificate *Certificate, clientCAs *x509.CertPool) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificate.GetCertificate,
+	}
+	if clientCAs != nil {
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig
+}
+
+// ClientConfig returns a config trusting rootCAs, or the system pool when
+// nil. With certificate, it is presented to servers asking for one.
+func ClientConfig(certificate *Certificate, rootCAs *x509.CertPool) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    rootCAs,
+	}
+	if certificate != nil {
+		tlsConfig.GetClientCertificate = certificate.GetClientCertificate
+	}
+	return tlsConfig
+}
+
+// ServerConfigFromConfig returns the config of the login.tls_* keys, or nil
+// when login.is_tls_used is false. With isClientVerified and
+// login.tls_client_ca_file set, clients must present a certificate signed by
+// that CA.
+func ServerConfigFromConfig(isClientVerified bool) (*tls.Config, error) {
+	if !config.ValueBool("login", "is_tls_used") {
+		return nil, nil
+	}
+	certificate, err := certificateFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	var clientCAs *x509.CertPool
+	clientCAFile := config.ValueStr("login", "tls_client_ca_file")
+	if isClientVerified && clientCAFile != "" {
+		clientCAs, err = CertPoolLoad(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls_client_ca_file: %w", err)
+		}
+	}
+	return ServerConfig(certificate, clientCAs), nil
+}
+
+// ClientConfigFromConfig returns the config of the login.tls_* keys, or nil
+// when login.is_tls_used is false. Servers are verified with
+// login.tls_ca_file, or the system pool when empty, and are presented the
+// certificate of login.tls_cert_file for mutual TLS.
+func ClientConfigFromConfig() (*tls.Config, error) {
+	if !config.ValueBool("login", "is_tls_used") {
+		return nil, nil
+	}
+	certificate, err := certificateFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	var rootCAs *x509.CertPool
+	caFile := config.ValueStr("login", "tls_ca_file")
+	if caFile != "" {
+		rootCAs, err = CertPoolLoad(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls_ca_file: %w", err)
+		}
+	}
+	return ClientConfig(certificate, rootCAs), nil
+}
+
+func certificateFromConfig() (*Certificate, error) {
+	reloadInterval, err := time.ParseDuration(config.ValueStr("login", "tls_reload_interval"))
+	if err != nil {
+		return nil, fmt.Errorf("parse tls_reload_interval: %w", err)
+	}
+	certificate, err := NewCertificate(config.ValueStr("login", "tls_cert_file"), config.ValueStr("login", "tls_key_file"), reloadInterval)
+	if err != nil {
+		return nil, fmt.Errorf("new certificate: %w", err)
+	}
+	return certificate, nil
+}
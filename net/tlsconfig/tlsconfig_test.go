@@ -0,0 +1,161 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/runeharvest/gserver/net/nettest"
+)
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ca := nettest.NewCA(t)
+	first := ca.Issue(t, "first")
+	nettest.CertificateWrite(t, first, certFile, keyFile)
+
+	certificate, err := NewCertificate(certFile, keyFile, time.Nanosecond)
+	if err != nil {
+		t.Fatal("new certificate:", err)
+	}
+	current, _ := certificate.GetCertificate(nil)
+	if string(current.Certificate[0]) != string(first.Certificate[0]) {
+		t.Fatal("first certificate not loaded")
+	}
+
+	second := ca.Issue(t, "second")
+	nettest.CertificateWrite(t, second, certFile, keyFile)
+	modTime := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		err = os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatal("chtimes:", err)
+		}
+	}
+	current, _ = certificate.GetCertificate(nil)
+	if string(current.Certificate[0]) != string(second.Certificate[0]) {
+		t.Fatal("second certificate not reloaded")
+	}
+
+	// A broken file keeps the certificate loaded before.
+	err = os.WriteFile(certFile, []byte("garbage"), 0o600)
+	if err != nil {
+		t.Fatal("write certificate:", err)
+	}
+	err = os.Chtimes(certFile, modTime.Add(time.Minute), modTime.Add(time.Minute))
+	if err != nil {
+		t.Fatal("chtimes:", err)
+	}
+	if err = certificate.Reload(); err == nil {
+		t.Fatal("reload of a broken certificate succeeded")
+	}
+	current, _ = certificate.GetClientCertificate(nil)
+	if string(current.Certificate[0]) != string(second.Certificate[0]) {
+		t.Fatal("broken certificate replaced the second one")
+	}
+}
+
+// handshake runs a TLS handshake between serverConfig and clientConfig.
+func handshake(t *testing.T, serverConfig *tls.Config, clientConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net listen:", err)
+	}
+	defer lis.Close()
+	clientConn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal("net dial:", err)
+	}
+	defer clientConn.Close()
+	serverConn, err := lis.Accept()
+	if err != nil {
+		t.Fatal("accept:", err)
+	}
+	defer serverConn.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		server := tls.Server(serverConn, serverConfig)
+		err := server.Handshake()
+		if err != nil {
+			served <- err
+			return
+		}
+		// TLS 1.3 clients learn that their certificate was refused on
+		// their first read.
+		_, err = server.Write([]byte{0})
+		served <- err
+	}()
+	client := tls.Client(clientConn, clientConfig)
+	err = client.Handshake()
+	if err == nil {
+		_, err = client.Read(make([]byte, 1))
+	}
+	if err != nil {
+		clientConn.Close()
+		<-served
+		return err
+	}
+	return <-served
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := nettest.NewCA(t)
+	nettest.CertificateWrite(t, ca.Issue(t, "login"), filepath.Join(dir, "login.pem"), filepath.Join(dir, "login.key"))
+	nettest.CertificateWrite(t, ca.Issue(t, "shard"), filepath.Join(dir, "shard.pem"), filepath.Join(dir, "shard.key"))
+	other := nettest.NewCA(t)
+	nettest.CertificateWrite(t, other.Issue(t, "stranger"), filepath.Join(dir, "stranger.pem"), filepath.Join(dir, "stranger.key"))
+	ca.CertWrite(t, filepath.Join(dir, "ca.pem"))
+
+	certificateLoad := func(name string) *Certificate {
+		certificate, err := NewCertificate(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key"), time.Minute)
+		if err != nil {
+			t.Fatal("new certificate:", err)
+		}
+		return certificate
+	}
+	pool, err := CertPoolLoad(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal("cert pool load:", err)
+	}
+	serverConfig := ServerConfig(certificateLoad("login"), pool)
+
+	tests := []struct {
+		name        string
+		certificate *Certificate
+		isAccepted  bool
+	}{
+		{"no certificate", nil, false},
+		{"other ca", certificateLoad("stranger"), false},
+		{"same ca", certificateLoad("shard"), true},
+	}
+	for _, tt := range tests {
+		clientConfig := ClientConfig(tt.certificate, pool)
+		clientConfig.ServerName = "localhost"
+		err := handshake(t, serverConfig, clientConfig)
+		if (err == nil) != tt.isAccepted {
+			t.Fatal(tt.name, "handshake:", err)
+		}
+	}
+
+	// Without client CAs, clients need no certificate, but still verify
+	// the server.
+	clientConfig := ClientConfig(nil, pool)
+	clientConfig.ServerName = "localhost"
+	err = handshake(t, ServerConfig(certificateLoad("login"), nil), clientConfig)
+	if err != nil {
+		t.Fatal("tls handshake:", err)
+	}
+	clientConfig = ClientConfig(nil, other.Pool)
+	clientConfig.ServerName = "localhost"
+	err = handshake(t, ServerConfig(certificateLoad("login"), nil), clientConfig)
+	if err == nil {
+		t.Fatal("handshake with a server of another ca succeeded")
+	}
+}